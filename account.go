@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx"
+)
+
+// users can get everything we have about them with /account export and have
+// it erased with /account delete. deletion only happens after a cooling-off
+// period, during which it can be canceled with /account cancel, and only when
+// the balance is zero. the account row itself stays, stripped of everything
+// that identifies the person, so the other side of each transaction still
+// adds up.
+
+const (
+	ACCOUNTDELETIONDELAY    = 7 * 24 * time.Hour
+	ACCOUNTDELETIONINTERVAL = time.Hour
+)
+
+type AccountDeletion struct {
+	Id          int            `db:"id"`
+	Account     int            `db:"account"`
+	RequestedAt time.Time      `db:"requested_at"`
+	ExecuteAt   time.Time      `db:"execute_at"`
+	Status      string         `db:"status"` // scheduled, canceled, done or failed
+	Error       sql.NullString `db:"error"`
+	ResolvedAt  sql.NullTime   `db:"resolved_at"`
+}
+
+func handleAccount(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+
+	switch {
+	case opts["export"].(bool):
+		go u.track("account export", nil)
+
+		archive, err := exportAccount(u.Id)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to export account")
+			send(ctx, u, t.ERROR, t.T{"Err": "failed to export account data."})
+			return
+		}
+
+		send(ctx, u, t.ACCOUNTEXPORT, tempAssetURL(".json", archive))
+	case opts["delete"].(bool):
+		if err := checkAccountDeletable(u.Id); err != nil {
+			send(ctx, u, t.ACCOUNTDELETEBLOCKED, t.T{"Err": err.Error()})
+			return
+		}
+
+		if deletion, err := loadScheduledDeletion(u.Id); err == nil {
+			send(ctx, u, t.ACCOUNTDELETESCHEDULED, t.T{"ExecuteAt": deletion.ExecuteAt})
+			return
+		}
+
+		send(ctx, u, t.ACCOUNTDELETECONFIRM, t.T{
+			"Days": int(ACCOUNTDELETIONDELAY.Hours() / 24),
+		}, &tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
+				{
+					tgbotapi.NewInlineKeyboardButtonData(
+						translate(ctx, t.CANCEL),
+						fmt.Sprintf("cancel=%d", u.Id)),
+					tgbotapi.NewInlineKeyboardButtonData(
+						translate(ctx, t.ACCOUNTDELETEBUTTON),
+						fmt.Sprintf("acctdel=%d", u.Id)),
+				},
+			},
+		})
+	case opts["cancel"].(bool):
+		canceled, err := cancelAccountDeletion(u.Id)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ACCOUNTDELETECANCELED, t.T{"Canceled": canceled})
+		if canceled {
+			go u.track("account delete cancel", nil)
+		}
+	default:
+		deletion, err := loadScheduledDeletion(u.Id)
+		if err == nil {
+			send(ctx, u, t.ACCOUNTDELETESCHEDULED, t.T{"ExecuteAt": deletion.ExecuteAt})
+			return
+		}
+		handleHelp(ctx, "account")
+	}
+}
+
+// handleAccountDeleteConfirm is called when the user clicks the button on the
+// /account delete prompt.
+func handleAccountDeleteConfirm(ctx context.Context, data string) {
+	u := ctx.Value("initiator").(*User)
+	if strconv.Itoa(u.Id) != data {
+		send(ctx, t.CANTCANCEL, WITHALERT)
+		return
+	}
+	removeKeyboardButtons(ctx)
+
+	deletion, err := scheduleAccountDeletion(u.Id)
+	if err != nil {
+		send(ctx, u, t.ACCOUNTDELETEBLOCKED, t.T{"Err": err.Error()})
+		return
+	}
+
+	if err := turnSats4AdsOff(u); err != nil {
+		log.Warn().Err(err).Stringer("user", u).
+			Msg("failed to turn off sats4ads for account being deleted")
+	}
+
+	go u.track("account delete", nil)
+	send(ctx, u, t.ACCOUNTDELETESCHEDULED, t.T{"ExecuteAt": deletion.ExecuteAt})
+}
+
+// exportAccount puts together everything we keep about an account, except the
+// api password, in a single JSON document.
+func exportAccount(account int) ([]byte, error) {
+	var j []byte
+	err := pg.Get(&j, `
+SELECT jsonb_build_object(
+  'exported_at', now(),
+  'account', (
+    SELECT to_jsonb(a) - 'password' FROM account AS a WHERE a.id = $1
+  ),
+  'transactions', coalesce((
+    SELECT jsonb_agg(to_jsonb(tx) ORDER BY tx.time)
+    FROM lightning.account_txn AS tx WHERE tx.account_id = $1
+  ), '[]'::jsonb),
+  'balance_checks', coalesce((
+    SELECT jsonb_agg(to_jsonb(b) - 'account')
+    FROM balance_check AS b WHERE b.account = $1
+  ), '[]'::jsonb),
+  'hidden_messages', coalesce((
+    SELECT jsonb_agg(to_jsonb(h) - 'author' ORDER BY h.created_at)
+    FROM hidden_message AS h WHERE h.author = $1
+  ), '[]'::jsonb),
+  'group_memberships', coalesce((
+    SELECT jsonb_agg(to_jsonb(m) - 'telegram_id')
+    FROM group_membership AS m
+    WHERE m.telegram_id = (SELECT telegram_id FROM account WHERE id = $1)
+  ), '[]'::jsonb),
+  'group_deposits', coalesce((
+    SELECT jsonb_agg(to_jsonb(d) - 'account' ORDER BY d.created_at)
+    FROM group_deposit AS d
+    WHERE d.account = $1
+       OR d.telegram_id = (SELECT telegram_id FROM account WHERE id = $1)
+  ), '[]'::jsonb),
+  'group_charges', coalesce((
+    SELECT jsonb_agg(to_jsonb(c) - 'telegram_id' ORDER BY c.created_at)
+    FROM group_charge AS c
+    WHERE c.telegram_id = (SELECT telegram_id FROM account WHERE id = $1)
+  ), '[]'::jsonb),
+  'expensive_exemptions', coalesce((
+    SELECT jsonb_agg(to_jsonb(e) - 'telegram_id')
+    FROM expensive_exempt AS e
+    WHERE e.telegram_id = (SELECT telegram_id FROM account WHERE id = $1)
+  ), '[]'::jsonb)
+)
+    `, account)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, j, "", "  "); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// checkAccountDeletable is called when the deletion is requested and again
+// right before it happens.
+func checkAccountDeletable(account int) error {
+	if balance := getBalance(pg, account); balance > 0 {
+		return fmt.Errorf("there are still %.3f sat in this account, withdraw everything first.",
+			float64(balance)/1000)
+	} else if balance < 0 {
+		return errors.New("this account has a negative balance.")
+	}
+
+	// ads not viewed yet are just given back to the advertisers later
+	var pending int
+	if err := pg.Get(&pending, `
+SELECT count(*) FROM lightning.transaction
+WHERE (from_id = $1 OR to_id = $1) AND pending
+  AND NOT (to_id = $1 AND tag = 'sats4ads')
+    `, account); err != nil {
+		return ErrDatabase
+	} else if pending > 0 {
+		return errors.New("there are pending payments, wait until they are done.")
+	}
+
+	var deposits int
+	if err := pg.Get(&deposits, `
+SELECT count(*) FROM group_deposit WHERE account = $1 AND status = 'locked'
+    `, account); err != nil {
+		return ErrDatabase
+	} else if deposits > 0 {
+		return errors.New("there are group deposits still locked.")
+	}
+
+	return nil
+}
+
+func loadScheduledDeletion(account int) (deletion AccountDeletion, err error) {
+	err = pg.Get(&deletion, `
+SELECT * FROM account_deletion WHERE account = $1 AND status = 'scheduled'
+    `, account)
+	return
+}
+
+func scheduleAccountDeletion(account int) (deletion AccountDeletion, err error) {
+	if err = checkAccountDeletable(account); err != nil {
+		return
+	}
+
+	err = pg.Get(&deletion, `
+INSERT INTO account_deletion (account, execute_at)
+VALUES ($1, $2)
+ON CONFLICT (account) WHERE status = 'scheduled'
+  DO UPDATE SET account = excluded.account
+RETURNING *
+    `, account, time.Now().Add(ACCOUNTDELETIONDELAY))
+	return
+}
+
+func cancelAccountDeletion(account int) (canceled bool, err error) {
+	res, err := pg.Exec(`
+UPDATE account_deletion SET status = 'canceled', resolved_at = now()
+WHERE account = $1 AND status = 'scheduled'
+    `, account)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func accountDeletionRoutine() {
+	ctx := context.WithValue(context.Background(), "origin", "background")
+
+	for {
+		var deletions []AccountDeletion
+		err := pg.Select(&deletions, `
+SELECT * FROM account_deletion
+WHERE status = 'scheduled' AND execute_at < now()
+ORDER BY execute_at
+        `)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to load account deletions")
+		}
+
+		for _, deletion := range deletions {
+			logger := log.With().Int("account", deletion.Account).Logger()
+
+			user, err := loadUser(deletion.Account)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed to load account to delete")
+				continue
+			}
+
+			// the balance may have changed since it was requested
+			if err := checkAccountDeletable(deletion.Account); err != nil {
+				pg.Exec(`
+UPDATE account_deletion
+SET status = 'failed', error = $2, resolved_at = now()
+WHERE id = $1
+                `, deletion.Id, err.Error())
+				send(ctx, user, t.ACCOUNTDELETEBLOCKED, t.T{"Err": err.Error()})
+				continue
+			}
+
+			if err := deleteAccount(deletion); err != nil {
+				logger.Error().Err(err).Msg("failed to delete account")
+				continue
+			}
+
+			logger.Info().Msg("account deleted")
+
+			// the chat id is gone from the database, but we still have it here
+			send(ctx, user, t.ACCOUNTDELETED)
+		}
+
+		time.Sleep(ACCOUNTDELETIONINTERVAL)
+	}
+}
+
+func deleteAccount(deletion AccountDeletion) error {
+	txn, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	account := deletion.Account
+	if err := anonymizeAccount(txn, account); err != nil {
+		return err
+	}
+
+	if _, err := txn.Exec(`
+UPDATE account_deletion SET status = 'done', resolved_at = now()
+WHERE id = $1
+    `, deletion.Id); err != nil {
+		return err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+
+	rds.Del(redisKeyUnviewedAd(account))
+	return nil
+}
+
+// anonymizeAccount removes everything personal from an account and from the
+// transactions that only it could see. transactions with other users stay,
+// but those sent by this account become anonymous. the audit log can't be
+// changed and is kept, which the confirmation message says.
+func anonymizeAccount(txn *sqlx.Tx, account int) error {
+	// group tables only know the telegram id, which is gone after this
+	var telegramId sql.NullInt64
+	if err := txn.Get(&telegramId, `
+SELECT telegram_id FROM account WHERE id = $1
+    `, account); err != nil {
+		return err
+	}
+	if telegramId.Valid {
+		for _, query := range []string{`
+DELETE FROM group_membership WHERE telegram_id = $1
+        `, `
+DELETE FROM expensive_exempt WHERE telegram_id = $1
+        `, `
+DELETE FROM group_charge WHERE telegram_id = $1
+        `, `
+UPDATE group_deposit SET telegram_id = 0, username = NULL WHERE telegram_id = $1
+        `} {
+			if _, err := txn.Exec(query, telegramId.Int64); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, query := range []string{`
+UPDATE group_deposit SET telegram_id = 0, username = NULL WHERE account = $1
+    `, `
+UPDATE lightning.transaction
+SET anonymous = true, trigger_message = 0
+WHERE from_id = $1
+    `, `
+UPDATE lightning.transaction
+SET trigger_message = 0
+WHERE to_id = $1
+    `, `
+UPDATE lightning.transaction
+SET description = NULL, remote_node = NULL, label = NULL
+WHERE (from_id = $1 AND to_id IS NULL) OR (to_id = $1 AND from_id IS NULL)
+    `, `
+UPDATE hidden_message
+SET preview = '', content = '', copy_chat = NULL, copy_message = NULL,
+  media_type = '', media_file = '', withdrawn = true
+WHERE author = $1
+    `, `
+DELETE FROM hidden_web_access
+WHERE hidden_id IN (SELECT id FROM hidden_message WHERE author = $1)
+    `, `
+UPDATE pos_sale SET items = '[]' WHERE merchant = $1
+    `, `
+UPDATE account_merge
+SET removed_telegram_id = NULL, removed_username = NULL,
+  removed_password = md5(random()::text) || md5(random()::text),
+  removed_appdata = '{}'
+WHERE remaining = $1
+    `, `
+DELETE FROM balance_check WHERE account = $1
+    `, `
+DELETE FROM webhook_subscription WHERE account = $1
+    `, `
+DELETE FROM webhook_delivery WHERE account = $1
+    `, `
+DELETE FROM account_event WHERE account = $1
+    `, `
+DELETE FROM analytics_event WHERE account = $1
+    `, `
+DELETE FROM sats4ads_delivery WHERE receiver = $1 AND status = 'queued'
+    `, `
+UPDATE account
+SET telegram_id = NULL, telegram_username = NULL, telegram_chat_id = NULL,
+  password = DEFAULT, locale = 'en', manual_locale = false, appdata = '{}',
+  deleted_at = now()
+WHERE id = $1
+    `} {
+		if _, err := txn.Exec(query, account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isAccountDeleted(account int) bool {
+	var deleted bool
+	pg.Get(&deleted, `
+SELECT deleted_at IS NOT NULL FROM account WHERE id = $1
+    `, account)
+	return deleted
+}
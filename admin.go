@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/go-cliche"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/kballard/go-shellquote"
+)
+
+// the /admin commands are only available to the admin and co-admins and are
+// parsed separately, so they don't show up in /help or in the command list.
+
+const ADMINUSAGE = `admin
+
+Usage:
+  c admin lookup <user>
+  c admin credit <user> <satoshis> <note>...
+  c admin debit <user> <satoshis> <note>...
+  c admin ban <user> [--for=<duration>] [--scope=<scope>] [<reason>...]
+  c admin unban <user>
+  c admin bans
+  c admin settle <hash> <preimage>
+  c admin refund <hash>
+  c admin broadcast <message>...
+  c admin node
+  c admin audit export [<user>] [--days=<n>]
+  c admin audit [<user>] [--action=<action>] [--limit=<n>]
+`
+
+var hexHashPrefix = regexp.MustCompile("^[0-9a-f]{10,64}$")
+
+func isBotAdmin(u *User) bool {
+	if s.AdminAccount > 0 && u.Id == s.AdminAccount {
+		return true
+	}
+	for _, id := range s.CoAdmins {
+		if u.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+func parseAdmin(message string) (opts docopt.Opts, err error) {
+	message = strings.TrimPrefix(message, "/")
+
+	// "/admin_lookup 12" works like "/admin lookup 12"
+	parts := strings.SplitN(message, " ", 2)
+	parts[0] = strings.ToLower(strings.ReplaceAll(parts[0], "_", " "))
+	message = strings.Join(parts, " ")
+
+	argv, err := shellquote.Split(message)
+	if err != nil {
+		argv = strings.Split(message, " ")
+	}
+
+	return parser.ParseArgs(ADMINUSAGE, argv, "")
+}
+
+func handleAdmin(ctx context.Context, messageText string) {
+	u := ctx.Value("initiator").(*User)
+
+	opts, err := parseAdmin(messageText)
+	if err != nil {
+		send(ctx, u, t.ADMINHELP)
+		return
+	}
+
+	log.Info().Stringer("admin", u).Str("command", messageText).Msg("admin command")
+
+	switch {
+	case opts["lookup"].(bool):
+		query, _ := opts.String("<user>")
+		query = strings.ToLower(query)
+
+		if hexHashPrefix.MatchString(query) {
+			txns, err := loadAdminTransactions(query)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+			if len(txns) > 0 {
+				send(ctx, u, t.ADMINTRANSACTIONS, t.T{"Transactions": txns})
+				return
+			}
+		}
+
+		target, err := loadAdminTarget(query)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		info, err := target.getInfo()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		var pending int
+		pg.Get(&pending, `
+SELECT count(*) FROM lightning.transaction
+WHERE from_id = $1 AND to_id IS NULL AND pending
+        `, target.Id)
+
+		send(ctx, u, t.ADMINUSER, t.T{
+			"User":    target,
+			"Info":    info,
+			"Pending": pending,
+			"Bans":    activeBans(target.Id),
+		})
+	case opts["credit"].(bool), opts["debit"].(bool):
+		target, err := loadAdminTarget(opts["<user>"].(string))
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		sats, err := strconv.ParseInt(opts["<satoshis>"].(string), 10, 64)
+		if err != nil || sats <= 0 {
+			send(ctx, u, t.ERROR, t.T{"Err": "invalid amount"})
+			return
+		}
+
+		note := strings.Join(opts["<note>"].([]string), " ")
+		credit := opts["credit"].(bool)
+		hash, err := adjustBalance(ctx, target, sats*1000, credit, note)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ADMINADJUSTED, t.T{
+			"User":    target,
+			"Credit":  credit,
+			"Sats":    sats,
+			"Note":    note,
+			"Hash":    hash,
+			"Balance": float64(getBalance(pg, target.Id)) / 1000,
+		})
+	case opts["ban"].(bool):
+		target, err := loadAdminTarget(opts["<user>"].(string))
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		if isBotAdmin(target) {
+			send(ctx, u, t.ERROR, t.T{"Err": "can't ban an admin"})
+			return
+		}
+
+		var duration time.Duration
+		if text, err := opts.String("--for"); err == nil && text != "" {
+			duration, err = parseBanDuration(text)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+		}
+
+		scope := BANALL
+		if text, err := opts.String("--scope"); err == nil && text != "" {
+			scope = strings.ToLower(text)
+		}
+
+		reason := strings.Join(opts["<reason>"].([]string), " ")
+		ban, err := banAccount(target.Id, u.Id, scope, duration, reason)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ADMINBANNED, t.T{"User": target, "Ban": ban})
+	case opts["unban"].(bool):
+		target, err := loadAdminTarget(opts["<user>"].(string))
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		if lifted, err := unbanAccount(target.Id); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		} else if lifted == 0 {
+			send(ctx, u, t.ERROR, t.T{"Err": target.String() + " isn't banned"})
+		} else {
+			send(ctx, u, t.COMPLETED)
+		}
+	case opts["bans"].(bool):
+		bans, err := listActiveBans()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ADMINBANS, t.T{"Bans": bans})
+	case opts["settle"].(bool), opts["refund"].(bool):
+		pending, err := loadPendingPayment(opts["<hash>"].(string))
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		// whatever the admin says, the node must not contradict it
+		status, err := nodePaymentStatus(pending.Hash)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		// the user gets the usual notification, not as a reply to the admin
+		bgctx := context.WithValue(context.Background(), "origin", "telegram")
+		bgctx = context.WithValue(bgctx, "actor", u)
+		if opts["settle"].(bool) {
+			preimage := strings.ToLower(opts["<preimage>"].(string))
+			if !preimageMatches(preimage, pending.Hash) {
+				send(ctx, u, t.ERROR, t.T{"Err": "preimage doesn't match the payment hash"})
+				return
+			}
+			if status.Status == "failed" {
+				send(ctx, u, t.ERROR, t.T{"Err": "the node says this payment failed"})
+				return
+			}
+			paymentHasSucceeded(bgctx, pending.Msatoshi, status.FeeMsatoshi,
+				preimage, pending.Tag, pending.Hash)
+		} else {
+			if status.Status == "complete" {
+				send(ctx, u, t.ERROR, t.T{
+					"Err": "the node says this payment succeeded, settle it with the preimage " +
+						status.Preimage,
+				})
+				return
+			}
+			if status.Status != "failed" {
+				send(ctx, u, t.ERROR, t.T{
+					"Err": "the node says this payment is " + status.Status + ", can't refund it yet",
+				})
+				return
+			}
+			paymentHasFailed(bgctx, pending.Hash, []string{"- Refunded by the bot admin."})
+		}
+
+		send(ctx, u, t.COMPLETED)
+	case opts["broadcast"].(bool):
+		// the text is taken as it was written, with its line breaks
+		text := messageText[strings.Index(messageText, "broadcast")+len("broadcast"):]
+		text = strings.TrimSpace(text)
+
+		go func() {
+			sent, failed := broadcastToAllUsers(text)
+			send(ctx, u, t.ADMINBROADCAST, t.T{"Sent": sent, "Failed": failed})
+		}()
+	case opts["node"].(bool):
+		summary, err := loadNodeSummary()
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ADMINNODE, summary)
+	case opts["audit"].(bool):
+		q := AuditQuery{Limit: 15}
+		if query, err := opts.String("<user>"); err == nil && query != "" {
+			target, err := loadAdminTarget(query)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+			q.Account = target.Id
+		}
+
+		if opts["export"].(bool) {
+			days := AUDITEXPORTDAYS
+			if text, err := opts.String("--days"); err == nil && text != "" {
+				if days, err = strconv.Atoi(text); err != nil || days <= 0 {
+					send(ctx, u, t.ERROR, t.T{"Err": "invalid number of days"})
+					return
+				}
+			}
+			q.Since = time.Now().AddDate(0, 0, -days)
+			q.Limit = 1000000
+
+			entries, err := loadAuditEntries(q)
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+
+			send(ctx, u, t.ADMINAUDITEXPORT, t.T{"N": len(entries), "Days": days},
+				tempAssetURL(".csv", auditEntriesCSV(entries)))
+			return
+		}
+
+		q.Action, _ = opts.String("--action")
+		if text, err := opts.String("--limit"); err == nil && text != "" {
+			if q.Limit, err = strconv.Atoi(text); err != nil || q.Limit <= 0 {
+				send(ctx, u, t.ERROR, t.T{"Err": "invalid limit"})
+				return
+			}
+		}
+
+		entries, err := loadAuditEntries(q)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.ADMINAUDIT, t.T{"Entries": entries})
+	}
+}
+
+// loadAdminTarget takes an account id, a telegram username or a telegram id
+// prefixed with "tg:".
+func loadAdminTarget(query string) (*User, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	var (
+		target *User
+		err    error
+	)
+	if strings.HasPrefix(query, "tg:") {
+		var id int
+		if id, err = strconv.Atoi(query[3:]); err == nil {
+			target, err = loadTelegramUser(id)
+		}
+	} else if id, errx := strconv.Atoi(query); errx == nil {
+		target, err = loadUser(id)
+	} else {
+		target, err = loadTelegramUsername(strings.TrimPrefix(query, "@"))
+	}
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user '%s' not found", query)
+	}
+	return target, err
+}
+
+type AdminTransaction struct {
+	Time         time.Time      `db:"time"`
+	FromId       sql.NullInt64  `db:"from_id"`
+	FromUsername sql.NullString `db:"from_username"`
+	ToId         sql.NullInt64  `db:"to_id"`
+	ToUsername   sql.NullString `db:"to_username"`
+	Msatoshi     int64          `db:"amount"`
+	Fees         int64          `db:"fees"`
+	Pending      bool           `db:"pending"`
+	Tag          string         `db:"tag"`
+	Description  string         `db:"description"`
+	Hash         string         `db:"payment_hash"`
+}
+
+func loadAdminTransactions(hashPrefix string) (txns []AdminTransaction, err error) {
+	err = pg.Select(&txns, `
+SELECT
+  tx.time, tx.from_id, f.telegram_username AS from_username,
+  tx.to_id, r.telegram_username AS to_username,
+  tx.amount::bigint AS amount, tx.fees, tx.pending,
+  coalesce(tx.tag, '') AS tag,
+  coalesce(tx.description, '') AS description,
+  tx.payment_hash
+FROM lightning.transaction AS tx
+LEFT OUTER JOIN account AS f ON f.id = tx.from_id
+LEFT OUTER JOIN account AS r ON r.id = tx.to_id
+WHERE tx.payment_hash LIKE $1 || '%'
+ORDER BY tx.time DESC
+LIMIT 5
+    `, hashPrefix)
+
+	for i := range txns {
+		txns[i].Description = escapeHTML(txns[i].Description)
+	}
+	return
+}
+
+type PendingPayment struct {
+	Hash     string `db:"payment_hash"`
+	Msatoshi int64  `db:"amount"`
+	Tag      string `db:"tag"`
+}
+
+func loadPendingPayment(hashPrefix string) (pending PendingPayment, err error) {
+	var found []PendingPayment
+	err = pg.Select(&found, `
+SELECT payment_hash, amount::bigint AS amount, coalesce(tag, '') AS tag
+FROM lightning.transaction
+WHERE payment_hash LIKE $1 || '%' AND to_id IS NULL AND pending
+LIMIT 2
+    `, strings.ToLower(hashPrefix))
+	if err != nil {
+		return
+	}
+
+	switch len(found) {
+	case 0:
+		return pending, errors.New("no pending outgoing payment with this hash")
+	case 1:
+		return found[0], nil
+	default:
+		return pending, errors.New("more than one pending payment with this hash prefix")
+	}
+}
+
+// nodePaymentStatus asks the node about an outgoing payment, payments the
+// node doesn't know are reported as failed like checkOutgoingPayment does.
+func nodePaymentStatus(hash string) (info cliche.PaymentInfo, err error) {
+	if ln == nil {
+		return info, errors.New("not connected to the node")
+	}
+
+	res, err := ln.CheckPayment(hash)
+	if err != nil {
+		if strings.Contains(err.Error(),
+			fmt.Sprintf("couldn't get payment '%s' from database", hash),
+		) {
+			return cliche.PaymentInfo{Status: "failed"}, nil
+		}
+		return info, fmt.Errorf("failed to check the payment on the node: %w", err)
+	}
+	if res.IsIncoming {
+		return info, errors.New("the node has this as an incoming payment")
+	}
+	return res.PaymentInfo, nil
+}
+
+func preimageMatches(preimage string, hash string) bool {
+	b, err := hex.DecodeString(preimage)
+	if err != nil || len(b) != 32 {
+		return false
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+// adjustBalance adds or removes funds from an account without a counterpart,
+// the note is kept as the transaction description.
+func adjustBalance(
+	ctx context.Context,
+	target *User,
+	msats int64,
+	credit bool,
+	note string,
+) (hash string, err error) {
+	admin := ctx.Value("initiator").(*User)
+
+	txn, err := pg.BeginTxx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer txn.Rollback()
+
+	audit := startAudit(ctx, txn, "admin_adjustment", target.Id)
+
+	var from, to sql.NullInt64
+	if credit {
+		to = sql.NullInt64{Int64: int64(target.Id), Valid: true}
+	} else {
+		from = sql.NullInt64{Int64: int64(target.Id), Valid: true}
+	}
+
+	err = txn.Get(&hash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, description, tag)
+VALUES ($1, $2, $3, $4, 'adjustment')
+RETURNING payment_hash
+    `, from, to, msats, fmt.Sprintf("%s (by %d)", note, admin.Id))
+	if err != nil {
+		return "", err
+	}
+
+	if !credit && getBalance(txn, target.Id) < 0 {
+		return "", ErrInsufficientBalance
+	}
+
+	direction := "in"
+	if !credit {
+		direction = "out"
+	}
+	event := appPaymentEvent(direction, 0, msats, hash, "adjustment", note).
+		forAccount(target.Id)
+	if err := saveAccountEvents(txn, event); err != nil {
+		return "", err
+	}
+
+	if err := audit.save(txn, hash, map[string]interface{}{
+		"msatoshi": msats,
+		"credit":   credit,
+		"note":     note,
+	}); err != nil {
+		return "", err
+	}
+
+	if err := txn.Commit(); err != nil {
+		return "", err
+	}
+
+	go publishPaymentEvent(event)
+
+	return hash, nil
+}
+
+// broadcastToAllUsers sends the text to everybody with a private chat with the
+// bot, at the same rate sats4ads broadcasts go.
+func broadcastToAllUsers(text string) (sent int, failed int) {
+	var users []User
+	err := pg.Select(&users, `
+SELECT `+USERFIELDS+`
+FROM account
+WHERE telegram_chat_id IS NOT NULL
+ORDER BY id
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load users for broadcast")
+		return
+	}
+
+	rate := s.Sats4AdsBroadcastRate
+	if rate <= 0 {
+		rate = 1
+	}
+	interval := time.Second / time.Duration(rate)
+
+	ctx := context.WithValue(context.Background(), "origin", "background")
+	for i := range users {
+		if isBanned(users[i].Id, BANALL) {
+			continue
+		}
+
+		if id := send(ctx, &users[i], text); id == nil {
+			failed++
+		} else {
+			sent++
+		}
+		time.Sleep(interval)
+	}
+
+	return
+}
+
+func loadNodeSummary() (summary t.T, err error) {
+	if ln == nil {
+		return nil, errors.New("not connected to the node")
+	}
+
+	info, err := ln.GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	channels, onchain := sumNodeAssets(info)
+
+	statuses := make(map[string]int)
+	for _, channel := range info.Channels {
+		statuses[channel.Status]++
+	}
+
+	var totals struct {
+		Liabilities int64 `db:"liabilities"`
+		Accounts    int   `db:"accounts"`
+		Pending     int   `db:"pending"`
+		PendingMsat int64 `db:"pending_msat"`
+	}
+	err = pg.Get(&totals, `
+SELECT
+  (
+    SELECT coalesce(sum(balance), 0)::bigint FROM lightning.balance
+    WHERE account_id != $1
+  ) AS liabilities,
+  (SELECT count(*) FROM account) AS accounts,
+  count(*) AS pending,
+  coalesce(sum(amount), 0)::bigint AS pending_msat
+FROM lightning.transaction
+WHERE to_id IS NULL AND pending
+    `, s.ProxyAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.T{
+		"Pubkey":      info.MainPubkey,
+		"BlockHeight": info.BlockHeight,
+		"Channels":    len(info.Channels),
+		"Statuses":    statuses,
+		"ChannelSats": channels / 1000,
+		"OnchainSats": onchain / 1000,
+		"Liabilities": totals.Liabilities / 1000,
+		"Accounts":    totals.Accounts,
+		"Pending":     totals.Pending,
+		"PendingSats": totals.PendingMsat / 1000,
+	}, nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestPreimageMatches(t *testing.T) {
+	// sha256 of 32 zero bytes
+	zeros := "0000000000000000000000000000000000000000000000000000000000000000"
+	hash := "66687aadf862bd776c8fc18b8e9f8e20089714856ee233b3902a591d0d5f2925"
+
+	if !preimageMatches(zeros, hash) {
+		t.Error("valid preimage was refused")
+	}
+	if preimageMatches(zeros, zeros) {
+		t.Error("wrong hash was accepted")
+	}
+	if preimageMatches("", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855") {
+		t.Error("empty preimage was accepted")
+	}
+	if preimageMatches("zz", hash) {
+		t.Error("invalid hex was accepted")
+	}
+}
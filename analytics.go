@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/msingleton/amplitude-go"
+)
+
+// analytics events go to the sinks listed in ANALYTICS_SINK: amplitude,
+// postgres, stdout or none. the postgres one is what /analytics reads from.
+
+const DEFAULTANALYTICSDAYS = 14
+
+type AnalyticsSink interface {
+	Track(account int, event string, properties map[string]interface{})
+}
+
+var analytics AnalyticsSink = noopAnalytics{}
+
+type noopAnalytics struct{}
+
+func (_ noopAnalytics) Track(int, string, map[string]interface{}) {}
+
+type amplitudeAnalytics struct {
+	client *amplitude.Client
+}
+
+func (a amplitudeAnalytics) Track(account int, event string, properties map[string]interface{}) {
+	a.client.Event(amplitude.Event{
+		UserId:          strconv.Itoa(account),
+		EventType:       event,
+		EventProperties: properties,
+	})
+}
+
+type postgresAnalytics struct{}
+
+func (_ postgresAnalytics) Track(account int, event string, properties map[string]interface{}) {
+	j, _ := json.Marshal(properties)
+	if properties == nil {
+		j = []byte("{}")
+	}
+
+	_, err := pg.Exec(`
+INSERT INTO analytics_event (account, event, properties)
+VALUES ($1, $2, $3)
+    `, account, event, types.JSONText(j))
+	if err != nil {
+		log.Debug().Err(err).Int("account", account).Str("event", event).
+			Msg("failed to save analytics event")
+	}
+}
+
+// jsonLinesAnalytics writes one JSON object per event, to be collected by
+// whatever reads the process output.
+type jsonLinesAnalytics struct {
+	sync.Mutex
+	w io.Writer
+}
+
+func (a *jsonLinesAnalytics) Track(account int, event string, properties map[string]interface{}) {
+	line, err := json.Marshal(struct {
+		Time       time.Time              `json:"time"`
+		Account    int                    `json:"account"`
+		Event      string                 `json:"event"`
+		Properties map[string]interface{} `json:"properties,omitempty"`
+	}{time.Now().UTC(), account, event, properties})
+	if err != nil {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	a.w.Write(append(line, '\n'))
+}
+
+type multiAnalytics []AnalyticsSink
+
+func (m multiAnalytics) Track(account int, event string, properties map[string]interface{}) {
+	for _, sink := range m {
+		sink.Track(account, event, properties)
+	}
+}
+
+// setupAnalytics defaults to amplitude when there's a key for it, otherwise
+// events are just dropped.
+func setupAnalytics() error {
+	names := s.AnalyticsSink
+	if names == "" && s.AmplitudeKey != "" {
+		names = "amplitude"
+	}
+
+	var sinks multiAnalytics
+	for _, name := range strings.Split(names, ",") {
+		switch strings.TrimSpace(name) {
+		case "", "none":
+		case "amplitude":
+			if s.AmplitudeKey == "" {
+				return fmt.Errorf("AMPLITUDE_KEY is required for the amplitude analytics sink")
+			}
+			sinks = append(sinks, amplitudeAnalytics{amplitude.New(s.AmplitudeKey)})
+		case "postgres":
+			sinks = append(sinks, postgresAnalytics{})
+		case "stdout":
+			sinks = append(sinks, &jsonLinesAnalytics{w: os.Stdout})
+		default:
+			return fmt.Errorf("unknown analytics sink '%s'", name)
+		}
+	}
+
+	switch len(sinks) {
+	case 0:
+		analytics = noopAnalytics{}
+	case 1:
+		analytics = sinks[0]
+	default:
+		analytics = sinks
+	}
+	return nil
+}
+
+func analyticsStoredLocally() bool {
+	switch sink := analytics.(type) {
+	case postgresAnalytics:
+		return true
+	case multiAnalytics:
+		for _, each := range sink {
+			if _, ok := each.(postgresAnalytics); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type AnalyticsDay struct {
+	Day    time.Time `db:"day"`
+	Active int       `db:"active"`
+	Events int       `db:"events"`
+}
+
+type AnalyticsCommand struct {
+	Command string `db:"command"`
+	Count   int    `db:"count"`
+	Users   int    `db:"users"`
+}
+
+// handleAnalytics is only available to the admin, as "/analytics [days]".
+func handleAnalytics(ctx context.Context, messageText string) {
+	u := ctx.Value("initiator").(*User)
+
+	if !analyticsStoredLocally() {
+		send(ctx, u, t.ERROR, t.T{
+			"Err": "analytics aren't stored here, add 'postgres' to ANALYTICS_SINK.",
+		})
+		return
+	}
+
+	days := DEFAULTANALYTICSDAYS
+	if fields := strings.Fields(messageText); len(fields) > 1 {
+		if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+			days = n
+		}
+	}
+
+	var activity []AnalyticsDay
+	err := pg.Select(&activity, `
+SELECT date_trunc('day', time) AS day,
+  count(DISTINCT account) AS active,
+  count(*) AS events
+FROM analytics_event
+WHERE time > date_trunc('day', now()) - make_interval(days => $1 - 1)
+GROUP BY 1
+ORDER BY 1 DESC
+    `, days)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	var commands []AnalyticsCommand
+	err = pg.Select(&commands, `
+SELECT properties->>'command' AS command,
+  count(*) AS count,
+  count(DISTINCT account) AS users
+FROM analytics_event
+WHERE event = 'command' AND properties ? 'command'
+  AND time > date_trunc('day', now()) - make_interval(days => $1 - 1)
+GROUP BY 1
+ORDER BY 2 DESC
+LIMIT 25
+    `, days)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	var total int
+	pg.Get(&total, `
+SELECT count(DISTINCT account) FROM analytics_event
+WHERE time > date_trunc('day', now()) - make_interval(days => $1 - 1)
+    `, days)
+
+	send(ctx, u, t.ANALYTICS, t.T{
+		"Days":     days,
+		"Active":   total,
+		"Activity": activity,
+		"Commands": commands,
+	})
+}
@@ -15,7 +15,7 @@ import (
 	"github.com/docopt/docopt-go"
 	"github.com/fiatjaf/lntxbot/t"
 	"github.com/gorilla/mux"
-	"gopkg.in/antage/eventsource.v1"
+	"golang.org/x/net/websocket"
 )
 
 type Permission int
@@ -155,10 +155,15 @@ func registerAPIMethods() {
 		})
 		return
 	})
+}
 
+// serveAccountEvents exposes the event log of each account to its API tokens,
+// it's read-only so it stays up when the rest of the API is off.
+func serveAccountEvents() {
+	// payment events, sent again from the Last-Event-ID (or ?since=) if given
 	router.Path("/payments/stream").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		_, user, permission, err := loadUserFromAPICall(r)
-		if err != nil {
+		if err != nil || user == nil {
 			errorBadAuth(w)
 			return
 		}
@@ -167,41 +172,81 @@ func registerAPIMethods() {
 			return
 		}
 
-		var es eventsource.EventSource
-		if ies, ok := userPaymentStream.Get(strconv.Itoa(user.Id)); ok {
-			es = ies.(eventsource.EventSource)
-		} else {
-			es = eventsource.New(
-				&eventsource.Settings{
-					Timeout:        5 * time.Second,
-					CloseOnTimeout: true,
-					IdleTimeout:    1 * time.Minute,
-				},
-				func(r *http.Request) [][]byte {
-					return [][]byte{
-						[]byte("X-Accel-Buffering: no"),
-						[]byte("Cache-Control: no-cache"),
-						[]byte("Content-Type: text/event-stream"),
-						[]byte("Connection: keep-alive"),
-						[]byte("Access-Control-Allow-Origin: *"),
-					}
-				},
-			)
-			userPaymentStream.Set(strconv.Itoa(user.Id), es)
-			go func() {
-				for {
-					time.Sleep(25 * time.Second)
-					es.SendEventMessage("", "keepalive", "")
-				}
-			}()
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			errorInternal(w)
+			return
 		}
 
-		go func() {
-			time.Sleep(100 * time.Millisecond)
-			es.SendRetryMessage(3 * time.Second)
-		}()
+		lastSeen := r.Header.Get("Last-Event-ID")
+		if lastSeen == "" {
+			lastSeen = r.URL.Query().Get("since")
+		}
+		after := eventStreamStart(user.Id, lastSeen)
+
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		streamAccountEvents(r.Context(), user.Id, after,
+			func(event AccountEvent) error {
+				_, err := fmt.Fprintf(w, "id: %d\nevent: payment-%s\ndata: %s\n\n",
+					event.Id, event.Kind, event.Data)
+				flusher.Flush()
+				return err
+			},
+			func() error {
+				_, err := fmt.Fprint(w, "event: keepalive\ndata: \n\n")
+				flusher.Flush()
+				return err
+			},
+		)
+	})
 
-		es.ServeHTTP(w, r)
+	// the same events as JSON messages over a websocket
+	router.Path("/payments/ws").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, user, permission, err := loadUserFromAPICall(r)
+		if err != nil || user == nil {
+			errorBadAuth(w)
+			return
+		}
+		if permission < ReadOnlyPermissions {
+			errorInsufficientPermissions(w)
+			return
+		}
+
+		after := eventStreamStart(user.Id, r.URL.Query().Get("since"))
+
+		websocket.Server{
+			// clients that aren't browsers don't send an origin
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ctx, cancel := context.WithCancel(r.Context())
+				defer cancel()
+
+				// we don't expect anything from the client, reading is only
+				// how we know it has gone away
+				go func() {
+					var discard string
+					for websocket.Message.Receive(ws, &discard) == nil {
+					}
+					cancel()
+				}()
+
+				streamAccountEvents(ctx, user.Id, after,
+					func(event AccountEvent) error {
+						return websocket.JSON.Send(ws, event)
+					},
+					func() error {
+						return websocket.JSON.Send(ws, map[string]string{"kind": "keepalive"})
+					},
+				)
+			},
+		}.ServeHTTP(w, r)
 	})
 }
 
@@ -223,8 +268,8 @@ func loadUserFromAPICall(
 		return
 	}
 
-	// check user temporarily banned
-	if _, ok := s.Banned[userId]; ok {
+	// check user banned
+	if isBanned(userId, BANALL) {
 		log.Debug().Int("id", userId).Msg("got api request from banned user")
 		return
 	}
@@ -233,6 +278,14 @@ func loadUserFromAPICall(
 
 	// load user
 	user, err = loadUser(userId)
+	if err == sql.ErrNoRows {
+		// tokens of accounts that were merged into others keep working
+		var merge AccountMerge
+		if user, merge, err = loadMergedUser(userId); err != nil {
+			return
+		}
+		password = translateMergedPassword(password, merge.RemovedPassword, user.Password)
+	}
 	if err != nil {
 		return
 	}
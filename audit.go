@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// every change to balances is written to audit_log in the same database
+// transaction as the change itself, with who asked for it, from where
+// (telegram, api, lnurl, background...) and the balance of each affected
+// account before and after. the table can't be updated or deleted from.
+
+const AUDITEXPORTDAYS = 30
+
+type AuditEntry struct {
+	Id            int64          `db:"id" json:"id"`
+	Time          time.Time      `db:"time" json:"time"`
+	Actor         sql.NullInt64  `db:"actor" json:"-"`
+	Origin        string         `db:"origin" json:"origin"`
+	Action        string         `db:"action" json:"action"`
+	Account       int            `db:"account" json:"account"`
+	BalanceBefore int64          `db:"balance_before" json:"balance_before"`
+	BalanceAfter  int64          `db:"balance_after" json:"balance_after"`
+	PaymentHash   sql.NullString `db:"payment_hash" json:"-"`
+	Details       types.JSONText `db:"details" json:"details"`
+}
+
+func (e AuditEntry) Delta() int64 { return e.BalanceAfter - e.BalanceBefore }
+
+type AuditWriter interface {
+	BalanceGetter
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+type BalanceAudit struct {
+	actor    sql.NullInt64
+	origin   string
+	action   string
+	accounts []int
+	before   map[int]int64
+}
+
+// startAudit must be called inside the database transaction, before the
+// balances of the given accounts change. more accounts can be added later
+// with include(), then save() is called right before committing.
+func startAudit(ctx context.Context, txn BalanceGetter, action string, accounts ...int) *BalanceAudit {
+	audit := &BalanceAudit{
+		origin: "unknown",
+		action: action,
+		before: make(map[int]int64),
+	}
+	if origin, ok := ctx.Value("origin").(string); ok {
+		audit.origin = origin
+	}
+	// "actor" is set when someone acts on behalf of another user, like the
+	// admin settling a payment, otherwise it's whoever started the action
+	actor, ok := ctx.Value("actor").(*User)
+	if !ok {
+		actor, _ = ctx.Value("initiator").(*User)
+	}
+	if actor != nil {
+		audit.actor = sql.NullInt64{Int64: int64(actor.Id), Valid: true}
+	}
+
+	audit.include(txn, accounts...)
+	return audit
+}
+
+func (audit *BalanceAudit) include(txn BalanceGetter, accounts ...int) {
+	for _, account := range accounts {
+		if account == 0 || account == s.ProxyAccount {
+			continue
+		}
+		if _, ok := audit.before[account]; ok {
+			continue
+		}
+		audit.accounts = append(audit.accounts, account)
+		audit.before[account] = getBalance(txn, account)
+	}
+}
+
+func (audit *BalanceAudit) save(
+	txn AuditWriter,
+	hash string,
+	details map[string]interface{},
+) error {
+	j, _ := json.Marshal(details)
+	if details == nil {
+		j = []byte("{}")
+	}
+	hashn := sql.NullString{String: hash, Valid: hash != ""}
+
+	for _, account := range audit.accounts {
+		_, err := txn.Exec(`
+INSERT INTO audit_log
+  (actor, origin, action, account, balance_before, balance_after, payment_hash, details)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        `, audit.actor, audit.origin, audit.action, account,
+			audit.before[account], getBalance(txn, account), hashn, types.JSONText(j))
+		if err != nil {
+			log.Error().Err(err).Str("action", audit.action).Int("account", account).
+				Msg("failed to write audit log")
+			return ErrDatabase
+		}
+	}
+
+	return nil
+}
+
+type AuditQuery struct {
+	Account int    // 0 for all
+	Action  string // "" for all
+	Since   time.Time
+	Limit   int
+}
+
+func loadAuditEntries(q AuditQuery) (entries []AuditEntry, err error) {
+	err = pg.Select(&entries, `
+SELECT * FROM audit_log
+WHERE ($1 = 0 OR account = $1)
+  AND ($2 = '' OR action = $2)
+  AND time >= $3
+ORDER BY id DESC
+LIMIT $4
+    `, q.Account, q.Action, q.Since, q.Limit)
+	return
+}
+
+func auditEntriesCSV(entries []AuditEntry) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"id", "time", "actor", "origin", "action", "account",
+		"balance_before", "balance_after", "payment_hash", "details"})
+	for _, e := range entries {
+		actor := ""
+		if e.Actor.Valid {
+			actor = strconv.FormatInt(e.Actor.Int64, 10)
+		}
+		w.Write([]string{
+			strconv.FormatInt(e.Id, 10),
+			e.Time.UTC().Format(time.RFC3339),
+			actor,
+			e.Origin,
+			e.Action,
+			strconv.Itoa(e.Account),
+			strconv.FormatInt(e.BalanceBefore, 10),
+			strconv.FormatInt(e.BalanceAfter, 10),
+			e.PaymentHash.String,
+			string(e.Details),
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
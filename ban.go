@@ -0,0 +1,294 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bans are issued by admins with /admin ban and last until they expire or
+// are lifted with /admin unban. a ban can cover everything or only some of
+// what the account can do:
+//
+//   all: the bot ignores the account and nobody can pay it
+//   send: no money can leave the account
+//   apps: no paying for or joining apps (coinflips, giveaways, sats4ads...)
+//   sats4ads: no sats4ads, neither as advertiser nor as receiver
+//
+// fees charged by groups (tickets, subscriptions, expensive chat...) aren't
+// apps, an "apps" ban doesn't keep anyone out of groups or silence them there.
+//
+// active bans are kept in memory, replicas drop their copy when any of them
+// changes a ban.
+
+const (
+	BANALL      = "all"
+	BANSEND     = "send"
+	BANAPPS     = "apps"
+	BANSATS4ADS = "sats4ads"
+
+	BANCACHETTL = 5 * time.Minute
+)
+
+var BANSCOPES = []string{BANALL, BANSEND, BANAPPS, BANSATS4ADS}
+
+var GROUPFEETAGS = []string{"ticket", "deposit", "subscription", "fine", "expensive", "expensive chat"}
+
+type Ban struct {
+	Id        int            `db:"id"`
+	Account   int            `db:"account"`
+	Scope     string         `db:"scope"`
+	Reason    string         `db:"reason"`
+	Until     sql.NullTime   `db:"until"` // null means forever
+	BannedBy  sql.NullInt64  `db:"banned_by"`
+	CreatedAt time.Time      `db:"created_at"`
+	Username  sql.NullString `db:"username"`
+}
+
+func (ban Ban) active() bool {
+	return !ban.Until.Valid || ban.Until.Time.After(time.Now())
+}
+
+// covers says if this ban forbids what is in the given scope, "apps" bans
+// include sats4ads and "all" includes everything.
+func (ban Ban) covers(scope string) bool {
+	switch ban.Scope {
+	case BANALL:
+		return true
+	case BANAPPS:
+		return scope == BANAPPS || scope == BANSATS4ADS
+	default:
+		return ban.Scope == scope
+	}
+}
+
+var bansCache = struct {
+	sync.RWMutex
+	byAccount map[int][]Ban
+	loadedAt  time.Time
+}{}
+
+func reloadBans() error {
+	var bans []Ban
+	err := pg.Select(&bans, `
+SELECT b.id, b.account, b.scope, b.reason, b.until, b.banned_by, b.created_at,
+  a.telegram_username AS username
+FROM ban AS b
+INNER JOIN account AS a ON a.id = b.account
+WHERE b.lifted_at IS NULL AND (b.until IS NULL OR b.until > now())
+ORDER BY b.created_at DESC
+    `)
+	if err != nil {
+		return err
+	}
+
+	byAccount := make(map[int][]Ban)
+	for _, ban := range bans {
+		byAccount[ban.Account] = append(byAccount[ban.Account], ban)
+	}
+
+	bansCache.Lock()
+	bansCache.byAccount = byAccount
+	bansCache.loadedAt = time.Now()
+	bansCache.Unlock()
+	return nil
+}
+
+func invalidateBans() {
+	bansCache.Lock()
+	bansCache.loadedAt = time.Time{}
+	bansCache.Unlock()
+}
+
+// bansChanged is called after any change so all replicas reload.
+func bansChanged() {
+	invalidateBans()
+	rds.Publish("bans", "changed")
+}
+
+func activeBans(account int) (bans []Ban) {
+	bansCache.RLock()
+	fresh := time.Since(bansCache.loadedAt) < BANCACHETTL
+	cached := bansCache.byAccount[account]
+	bansCache.RUnlock()
+
+	if !fresh {
+		if err := reloadBans(); err != nil {
+			// better to use what we had than to let everybody in or out
+			log.Warn().Err(err).Msg("failed to reload bans")
+		} else {
+			bansCache.RLock()
+			cached = bansCache.byAccount[account]
+			bansCache.RUnlock()
+		}
+	}
+
+	for _, ban := range cached {
+		if ban.active() {
+			bans = append(bans, ban)
+		}
+	}
+	return
+}
+
+func isBanned(account int, scope string) bool {
+	for _, ban := range activeBans(account) {
+		if ban.covers(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSpendingBan is called before any money leaves an account. payments
+// with a tag are made by apps, except group fees.
+func checkSpendingBan(account int, tag string) error {
+	if isBanned(account, BANSEND) {
+		return ErrBanned
+	}
+
+	if tag != "" && !stringIsIn(tag, GROUPFEETAGS) {
+		scope := BANAPPS
+		if tag == "sats4ads" {
+			scope = BANSATS4ADS
+		}
+		if isBanned(account, scope) {
+			return ErrBanned
+		}
+	}
+
+	return nil
+}
+
+// banInvalidationRoutine listens for ban changes made by other replicas.
+func banInvalidationRoutine() {
+	for {
+		pubsub, err := rds.Subscribe("bans")
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to subscribe to ban changes")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for {
+			if _, err := pubsub.ReceiveMessage(); err != nil {
+				log.Warn().Err(err).Msg("ban changes subscription failed")
+				break
+			}
+			invalidateBans()
+		}
+
+		pubsub.Close()
+		invalidateBans()
+		time.Sleep(time.Second)
+	}
+}
+
+func banAccount(
+	account int,
+	by int,
+	scope string,
+	duration time.Duration,
+	reason string,
+) (ban Ban, err error) {
+	if !stringIsIn(scope, BANSCOPES) {
+		return ban, fmt.Errorf("invalid scope '%s', must be one of %s",
+			scope, strings.Join(BANSCOPES, ", "))
+	}
+
+	until := sql.NullTime{Time: time.Now().Add(duration), Valid: duration > 0}
+	err = pg.Get(&ban, `
+INSERT INTO ban (account, scope, reason, until, banned_by)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, account, scope, reason, until, banned_by, created_at
+    `, account, scope, reason, until, by)
+	if err == nil {
+		bansChanged()
+	}
+	return
+}
+
+func unbanAccount(account int) (lifted int64, err error) {
+	res, err := pg.Exec(`
+UPDATE ban SET lifted_at = now()
+WHERE account = $1 AND lifted_at IS NULL
+    `, account)
+	if err != nil {
+		return 0, err
+	}
+	bansChanged()
+	return res.RowsAffected()
+}
+
+func listActiveBans() (bans []Ban, err error) {
+	if err = reloadBans(); err != nil {
+		return
+	}
+
+	bansCache.RLock()
+	defer bansCache.RUnlock()
+	for _, accountBans := range bansCache.byAccount {
+		bans = append(bans, accountBans...)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].CreatedAt.After(bans[j].CreatedAt)
+	})
+	return
+}
+
+// seedBansFromEnv moves the accounts in the old BANNED variable to the ban
+// table. an account that was ever banned is left alone, so lifting these bans
+// with /admin unban works.
+func seedBansFromEnv() {
+	if len(s.Banned) == 0 {
+		return
+	}
+	log.Warn().Msg("BANNED is deprecated, bans are now managed with /admin ban")
+
+	seeded := 0
+	for account, banned := range s.Banned {
+		if !banned {
+			continue
+		}
+
+		res, err := pg.Exec(`
+INSERT INTO ban (account, scope, reason)
+SELECT $1, $2, 'from the BANNED environment variable'
+WHERE EXISTS (SELECT 1 FROM account WHERE id = $1)
+  AND NOT EXISTS (SELECT 1 FROM ban WHERE account = $1)
+        `, account, BANALL)
+		if err != nil {
+			log.Warn().Err(err).Int("account", account).Msg("failed to seed ban")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			seeded++
+		}
+	}
+
+	if seeded > 0 {
+		log.Info().Int("n", seeded).Msg("seeded bans from BANNED")
+		bansChanged()
+	}
+}
+
+// parseBanDuration accepts what time.ParseDuration does plus days, like "3d".
+func parseBanDuration(text string) (time.Duration, error) {
+	if strings.HasSuffix(text, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(text, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid duration '%s'", text)
+		}
+		return time.Hour * 24 * time.Duration(days), nil
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", text)
+	}
+	return duration, nil
+}
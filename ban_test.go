@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanCovers(t *testing.T) {
+	for _, c := range []struct {
+		ban    string
+		scope  string
+		covers bool
+	}{
+		{BANALL, BANSEND, true},
+		{BANALL, BANSATS4ADS, true},
+		{BANAPPS, BANSATS4ADS, true},
+		{BANAPPS, BANAPPS, true},
+		{BANAPPS, BANSEND, false},
+		{BANSEND, BANAPPS, false},
+		{BANSATS4ADS, BANAPPS, false},
+	} {
+		if got := (Ban{Scope: c.ban}).covers(c.scope); got != c.covers {
+			t.Errorf("%s ban covering %s: expected %v", c.ban, c.scope, c.covers)
+		}
+	}
+}
+
+func TestParseBanDuration(t *testing.T) {
+	for text, expected := range map[string]time.Duration{
+		"3d":  72 * time.Hour,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	} {
+		got, err := parseBanDuration(text)
+		if err != nil || got != expected {
+			t.Errorf("%s: expected %s, got %s %v", text, expected, got, err)
+		}
+	}
+
+	if _, err := parseBanDuration("forever"); err == nil {
+		t.Error("invalid duration was accepted")
+	}
+}
@@ -152,7 +152,13 @@ func clicheCheckingRoutine() {
 func clichePing() chan error {
 	ch := make(chan error)
 	go func() {
+		start := time.Now()
 		_, err := ln.Call("ping", map[string]interface{}{})
+		if err != nil {
+			metricNodePing.ObserveSince(start, "error")
+		} else {
+			metricNodePing.ObserveSince(start, "ok")
+		}
 		ch <- err
 	}()
 	return ch
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lucsky/cuid"
+)
+
+// coinflips are provably fair: when one is created we generate a secret seed
+// and publish its sha256 (the commitment). every participant that joins adds
+// an entry to an ordered list. the winner is taken from
+// sha256(seed:entry1:entry2:...) and the seed is revealed at the end, so
+// anyone can check the result with /verify.
+
+type CoinflipRecord struct {
+	Id         string         `db:"id"`
+	Time       time.Time      `db:"time"`
+	Commitment string         `db:"commitment"`
+	Seed       string         `db:"seed"`
+	Entries    types.JSONText `db:"entries"`
+	Winner     int            `db:"winner"`
+	Sats       int            `db:"sats"`
+}
+
+func coinflipCommitment(seed string) string {
+	return hashString("%s", seed)
+}
+
+// the commitment as it goes in the callback data (which is limited to 64 bytes)
+func shortCommitment(commitment string) string {
+	if len(commitment) > 16 {
+		return commitment[:16]
+	}
+	return commitment
+}
+
+func createCoinflip(initiatorId int) (coinflipid string, commitment string, err error) {
+	seed, err := randomHex()
+	if err != nil {
+		return
+	}
+
+	coinflipid = cuid.Slug()
+	commitment = coinflipCommitment(seed)
+
+	if err = rds.Set("coinflip:"+coinflipid+":seed", seed, s.GiveAwayTimeout).Err(); err != nil {
+		return
+	}
+
+	// the initiator doesn't have a callback id, so its entry is the published
+	// commitment, which is fixed by the seed and can't be picked afterwards
+	_, err = joinCoinflip(coinflipid, initiatorId, commitment)
+	return
+}
+
+func getCoinflipCommitment(coinflipid string) (commitment string, ok bool) {
+	seed, err := rds.Get("coinflip:" + coinflipid + ":seed").Result()
+	if err != nil || seed == "" {
+		return "", false
+	}
+	return coinflipCommitment(seed), true
+}
+
+// joinCoinflip adds the user to the coinflip participants set and appends its
+// entry to the ordered list of entries that will be mixed with the seed.
+func joinCoinflip(coinflipid string, userId int, joinData string) (joined bool, err error) {
+	rkey := "coinflip:" + coinflipid
+
+	added, err := rds.SAdd(rkey, userId).Result()
+	if err != nil || added == 0 {
+		return false, err
+	}
+
+	err = rds.RPush(rkey+":entries", fmt.Sprintf("%d:%s", userId, joinData)).Err()
+	if err != nil {
+		return false, err
+	}
+
+	rds.Expire(rkey, s.GiveAwayTimeout)
+	rds.Expire(rkey+":entries", s.GiveAwayTimeout)
+	rds.Expire(rkey+":seed", s.GiveAwayTimeout)
+
+	return true, nil
+}
+
+// coinflipWinner returns the index of the winning entry.
+func coinflipWinner(seed string, entries []string) int {
+	hash := sha256.Sum256([]byte(seed + ":" + strings.Join(entries, ":")))
+	return int(binary.BigEndian.Uint64(hash[:8]) % uint64(len(entries)))
+}
+
+func coinflipEntryUser(entry string) (userId int, err error) {
+	return strconv.Atoi(strings.SplitN(entry, ":", 2)[0])
+}
+
+func saveCoinflipRecord(record CoinflipRecord) error {
+	_, err := pg.Exec(`
+INSERT INTO coinflip (id, commitment, seed, entries, winner, sats)
+VALUES ($1, $2, $3, $4, $5, $6)
+    `, record.Id, record.Commitment, record.Seed, record.Entries, record.Winner, record.Sats)
+	return err
+}
+
+func handleVerifyCoinflip(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	coinflipid := opts["<coinflip_id>"].(string)
+
+	var record CoinflipRecord
+	err := pg.Get(&record, `
+SELECT id, time, commitment, seed, entries, winner, sats
+FROM coinflip
+WHERE id = $1
+    `, coinflipid)
+	if err == sql.ErrNoRows {
+		send(ctx, u, t.ERROR, t.T{"Err": "coinflip not found."}, ctx.Value("message"))
+		return
+	} else if err != nil {
+		log.Warn().Err(err).Str("coinflip", coinflipid).Msg("failed to load coinflip record")
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()}, ctx.Value("message"))
+		return
+	}
+
+	var entries []string
+	if err := json.Unmarshal(record.Entries, &entries); err != nil || len(entries) == 0 {
+		send(ctx, u, t.ERROR, t.T{"Err": "invalid coinflip entries."}, ctx.Value("message"))
+		return
+	}
+
+	computedId, _ := coinflipEntryUser(entries[coinflipWinner(record.Seed, entries)])
+	winnerName := "?"
+	if winner, err := loadUser(computedId); err == nil {
+		winnerName = winner.AtName(ctx)
+	}
+
+	go u.track("coinflip verify", nil)
+
+	send(ctx, u, t.COINFLIPVERIFY, t.T{
+		"Id":              record.Id,
+		"Sats":            record.Sats,
+		"Commitment":      record.Commitment,
+		"Seed":            record.Seed,
+		"Entries":         entries,
+		"Winner":          winnerName,
+		"CommitmentMatch": coinflipCommitment(record.Seed) == record.Commitment,
+		"WinnerMatch":     computedId == record.Winner,
+	}, ctx.Value("message"))
+}
+
+// house rules for coinflips and giveflips, configured per group with /toggle coinflips
+type CoinflipRules struct {
+	MinSats       int           `db:"coinflip_min"`
+	MaxSats       int           `db:"coinflip_max"`
+	MaxPlayers    int           `db:"coinflip_players"`
+	Tax           sql.NullInt64 `db:"coinflip_tax"` // percent, null means no tax
+	TaxTo         string        `db:"coinflip_tax_to"`
+	Quota         sql.NullInt64 `db:"coinflip_quota"`
+	GiveflipQuota sql.NullInt64 `db:"giveflip_quota"`
+	HoursStart    int           `db:"coinflip_hours_start"`
+	HoursEnd      int           `db:"coinflip_hours_end"`
+}
+
+const COINFLIPRULESFIELDS = `
+  coinflip_min, coinflip_max, coinflip_players,
+  coinflip_tax, coinflip_tax_to,
+  coinflip_quota, giveflip_quota,
+  coinflip_hours_start, coinflip_hours_end
+`
+
+var defaultCoinflipRules = CoinflipRules{MaxPlayers: 100, TaxTo: "owner"}
+
+func (g GroupChat) getCoinflipRules() (rules CoinflipRules) {
+	if g.TelegramId >= 0 {
+		// not a group
+		return defaultCoinflipRules
+	}
+
+	err := pg.Get(&rules, `
+SELECT `+COINFLIPRULESFIELDS+`
+FROM groupchat
+WHERE telegram_id = $1
+    `, g.TelegramId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Stringer("group", &g).Msg("failed to load coinflip rules")
+		}
+		return defaultCoinflipRules
+	}
+
+	return rules
+}
+
+func coinflipRulesFromContext(ctx context.Context) CoinflipRules {
+	if g, ok := ctx.Value("group").(GroupChat); ok {
+		return g.getCoinflipRules()
+	}
+	return defaultCoinflipRules
+}
+
+func (g GroupChat) setCoinflipRule(setting string, value string) (err error) {
+	var field string
+	var arg interface{}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch setting {
+	case "min", "max", "players":
+		field = map[string]string{
+			"min":     "coinflip_min",
+			"max":     "coinflip_max",
+			"players": "coinflip_players",
+		}[setting]
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid number '%s'.", value)
+		}
+		if setting == "players" && (n < 2 || n > 100) {
+			return errors.New("number of participants must be between 2 and 100.")
+		}
+		// zero means no limit
+		current := g.getCoinflipRules()
+		if setting == "min" && current.MaxSats != 0 && n > current.MaxSats {
+			return fmt.Errorf("minimum can't be above the maximum of %d sat.", current.MaxSats)
+		}
+		if setting == "max" && n != 0 && n < current.MinSats {
+			return fmt.Errorf("maximum can't be below the minimum of %d sat.", current.MinSats)
+		}
+		arg = n
+	case "tax":
+		field = "coinflip_tax"
+		if value == "default" {
+			arg = nil
+			break
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || n < 0 || n > 50 {
+			return errors.New("tax must be a percentage between 0 and 50, or 'default'.")
+		}
+		arg = n
+	case "taxto":
+		field = "coinflip_tax_to"
+		if value != "owner" && value != "treasury" {
+			return errors.New("tax destination must be 'owner' or 'treasury'.")
+		}
+		arg = value
+	case "quota", "giveflipquota":
+		field = "coinflip_quota"
+		if setting == "giveflipquota" {
+			field = "giveflip_quota"
+		}
+		if value == "default" {
+			arg = nil
+			break
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid quota '%s'.", value)
+		}
+		arg = n
+	case "hours":
+		start, end := 0, 0
+		if value != "any" {
+			if _, err := fmt.Sscanf(value, "%d-%d", &start, &end); err != nil ||
+				start < 0 || start > 23 || end < 0 || end > 23 {
+				return errors.New("hours must be like '18-23' (UTC) or 'any'.")
+			}
+		}
+		_, err = pg.Exec(`
+UPDATE groupchat SET coinflip_hours_start = $2, coinflip_hours_end = $3
+WHERE telegram_id = $1
+        `, g.TelegramId, start, end)
+		return err
+	default:
+		return fmt.Errorf("unknown setting '%s'.", setting)
+	}
+
+	_, err = pg.Exec(`
+UPDATE groupchat SET `+field+` = $2
+WHERE telegram_id = $1
+    `, g.TelegramId, arg)
+	return err
+}
+
+func (rules CoinflipRules) isOpen(now time.Time) bool {
+	if rules.HoursStart == rules.HoursEnd {
+		return true
+	}
+
+	hour := now.UTC().Hour()
+	if rules.HoursStart < rules.HoursEnd {
+		return hour >= rules.HoursStart && hour < rules.HoursEnd
+	}
+
+	// window goes through midnight
+	return hour >= rules.HoursStart || hour < rules.HoursEnd
+}
+
+// check is called both when a coinflip/giveflip is created and when someone joins it.
+// the hours are only checked at creation, see checkHours.
+func (rules CoinflipRules) check(sats int, nparticipants int) error {
+	if rules.MinSats != 0 && sats < rules.MinSats {
+		return fmt.Errorf("amount must be at least %d sat in this group.", rules.MinSats)
+	}
+	if rules.MaxSats != 0 && sats > rules.MaxSats {
+		return fmt.Errorf("amount must be at most %d sat in this group.", rules.MaxSats)
+	}
+	if nparticipants > rules.MaxPlayers {
+		return fmt.Errorf("at most %d participants are allowed in this group.", rules.MaxPlayers)
+	}
+	return nil
+}
+
+// checkHours is only called when a coinflip/giveflip is created, the ones
+// already open can still be filled after the window closes.
+func (rules CoinflipRules) checkHours() error {
+	if !rules.isOpen(time.Now()) {
+		return fmt.Errorf("lotteries are only allowed between %02d:00 and %02d:00 UTC in this group.",
+			rules.HoursStart, rules.HoursEnd)
+	}
+	return nil
+}
+
+func (rules CoinflipRules) quota(kind string) int {
+	switch kind {
+	case "giveflip":
+		if rules.GiveflipQuota.Valid {
+			return int(rules.GiveflipQuota.Int64)
+		}
+		return s.GiveflipDailyQuota
+	default:
+		if rules.Quota.Valid {
+			return int(rules.Quota.Int64)
+		}
+		return s.CoinflipDailyQuota
+	}
+}
+
+func quotaKey(kind string, groupId int64, userId int) string {
+	return fmt.Sprintf("quota:%s:%d:%d:%s", kind, groupId, userId,
+		time.Now().UTC().Format("2006-01-02"))
+}
+
+// checkQuota returns an error if the user has already joined as many lotteries
+// of this kind today as the group allows. a quota of zero means no limit and
+// private or inline lotteries (groupId 0) have no quota.
+func (rules CoinflipRules) checkQuota(kind string, groupId int64, userId int) error {
+	quota := rules.quota(kind)
+	if quota == 0 || groupId == 0 {
+		return nil
+	}
+
+	used, _ := rds.Get(quotaKey(kind, groupId, userId)).Int64()
+	if used >= int64(quota) {
+		return fmt.Errorf("you can only join %d %ss per day here.", quota, kind)
+	}
+	return nil
+}
+
+func useQuota(kind string, groupId int64, userId int) {
+	if groupId == 0 {
+		return
+	}
+	key := quotaKey(kind, groupId, userId)
+	rds.Incr(key)
+	rds.Expire(key, time.Hour*24)
+}
+
+// tax is the part of each losing entry that goes to the group instead of the winner.
+func (rules CoinflipRules) tax(msats int64) int64 {
+	if !rules.Tax.Valid {
+		return 0
+	}
+	return msats * rules.Tax.Int64 / 100
+}
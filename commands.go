@@ -74,6 +74,9 @@ var methods = []def{
 	{
 		aliases: []string{"apps"},
 	},
+	{
+		aliases: []string{"proof"},
+	},
 	{
 		aliases: []string{"tx"},
 		argstr:  "<hash>",
@@ -94,6 +97,30 @@ var methods = []def{
 		inline:         true,
 		inline_example: "coinflip <satoshis> <num_participants>",
 	},
+	{
+		aliases: []string{"treasury"},
+		argstr:  "[transfer <satoshis> <receiver>]",
+	},
+	{
+		aliases: []string{"members"},
+		argstr:  "",
+	},
+	{
+		aliases: []string{"leaderboard"},
+		argstr:  "",
+	},
+	{
+		aliases: []string{"stats"},
+		argstr:  "[week | month | all]",
+	},
+	{
+		aliases: []string{"upvote"},
+		argstr:  "[<satoshis>]",
+	},
+	{
+		aliases: []string{"verify"},
+		argstr:  "<coinflip_id>",
+	},
 	{
 		aliases:        []string{"giveflip"},
 		argstr:         "<satoshis> [<num_participants>]",
@@ -106,7 +133,15 @@ var methods = []def{
 	},
 	{
 		aliases: []string{"hide"},
-		argstr:  "<satoshis> [<message>...] [--revealers=<num_revealers>] [--crowdfund=<num_participants>] [--private]",
+		argstr:  "<satoshis> [<message>...] [--revealers=<num_revealers>] [--crowdfund=<num_participants>] [--private] [--days=<days>] [--web [--downloads=<num_downloads>]]",
+	},
+	{
+		aliases: []string{"hidden"},
+		argstr:  "[list | cancel <hidden_message_id>]",
+	},
+	{
+		aliases: []string{"pos"},
+		argstr:  "[(add <price> <currency> <name>...) | (del <item_number>) | list | sales | web [reset]]",
 	},
 	{
 		aliases:        []string{"reveal"},
@@ -116,12 +151,16 @@ var methods = []def{
 	},
 	{
 		aliases: []string{"sats4ads"},
-		argstr:  "(on [<msat_per_character>] | off | rate | rates | broadcast <satoshis> [<text>...] [--max-rate=<maxrate>] [--skip=<offset>] | preview)",
+		argstr:  "(on [<msat_per_character>] | off | rate | rates [--locale=<locale>] [--tags=<tags>] [--active=<days>] | tags [clear | <interest>...] | broadcast <satoshis> [<text>...] [--max-rate=<maxrate>] [--skip=<offset>] [--locale=<locale>] [--tags=<tags>] [--active=<days>] [--start=<when>] | campaigns | report <campaign_id> | cancel <campaign_id> | preview)",
 	},
 	{
 		aliases: []string{"api"},
 		argstr:  "[full | invoice | readonly | url | refresh]",
 	},
+	{
+		aliases: []string{"webhooks"},
+		argstr:  "[(add <url> [<events>...]) | (del <webhook_id>) | deliveries | secret [reset]]",
+	},
 	{
 		aliases: []string{"lightningatm"},
 	},
@@ -143,7 +182,7 @@ var methods = []def{
 	},
 	{
 		aliases: []string{"toggle"},
-		argstr:  "(ticket [<satoshis>] | renamable [<satoshis>] | spammy | expensive [<satoshis> <pattern>] | language [<lang>] | coinflips)",
+		argstr:  "(ticket [<satoshis>] | subscription [<satoshis> [<period> [<grace>]]] | deposits [<satoshis> [<period> [<messages>]]] [--to=<destination>] | reactions [<emoji>...] | renamable [<satoshis>] | spammy | expensive [(add <satoshis> [<pattern>] [--media=<types>] [--to=<destination>] [--exempt=<roles>]) | list | (del <rule_id>) | (exempt [<receiver>])] | language [<lang>] | coinflips [<setting> [<value>]])",
 	},
 	{
 		aliases: []string{"satoshis", "calc"},
@@ -159,6 +198,10 @@ var methods = []def{
 	{
 		aliases: []string{"stop"},
 	},
+	{
+		aliases: []string{"account"},
+		argstr:  "[export | delete | cancel]",
+	},
 }
 
 var (
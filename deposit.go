@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// groups can make new members lock a deposit instead of paying a ticket. the
+// money goes through the proxy to the group destination as a pending payment,
+// so it only becomes theirs if the member is fined or banned. otherwise it is
+// given back after some days or some messages.
+type DepositPolicy struct {
+	GroupId   int64  `db:"group_id"`
+	Sats      int    `db:"sats"`
+	Days      int    `db:"days"`
+	Messages  int    `db:"messages"`   // 0 means only days are considered
+	ForfeitTo string `db:"forfeit_to"` // "owner" or "treasury"
+}
+
+type Deposit struct {
+	Id         int            `db:"id"`
+	GroupId    int64          `db:"group_id"`
+	TelegramId int64          `db:"telegram_id"`
+	Account    int            `db:"account"` // who paid and will get the money back
+	SourceHash string         `db:"source_hash"`
+	TargetHash string         `db:"target_hash"`
+	Sats       int            `db:"sats"`
+	Messages   int            `db:"messages"`
+	Status     string         `db:"status"` // locked, refunded or forfeited
+	CreatedAt  time.Time      `db:"created_at"`
+	ResolvedAt sql.NullTime   `db:"resolved_at"`
+	Username   sql.NullString `db:"username"`
+}
+
+// locked_deposits has the group:member pairs with a deposit locked, so
+// countDepositMessage only touches the database for them.
+var locked_deposits = cmap.New()
+
+func lockedDepositKey(groupId int64, telegramId int64) string {
+	return fmt.Sprintf("%d:%d", groupId, telegramId)
+}
+
+func loadLockedDeposits() {
+	var deposits []Deposit
+	err := pg.Select(&deposits, `
+SELECT * FROM group_deposit WHERE status = 'locked'
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to load locked deposits")
+		return
+	}
+
+	for _, deposit := range deposits {
+		locked_deposits.Set(lockedDepositKey(deposit.GroupId, deposit.TelegramId), true)
+	}
+}
+
+func (g GroupChat) getDepositPolicy() (policy DepositPolicy, err error) {
+	err = pg.Get(&policy, `
+SELECT * FROM deposit_policy WHERE group_id = $1
+    `, g.TelegramId)
+	return
+}
+
+func (g GroupChat) setDepositPolicy(policy DepositPolicy) (err error) {
+	_, err = pg.Exec(`
+INSERT INTO deposit_policy (group_id, sats, days, messages, forfeit_to)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (group_id) DO UPDATE SET
+  sats = $2, days = $3, messages = $4, forfeit_to = $5
+    `, g.TelegramId, policy.Sats, policy.Days, policy.Messages, policy.ForfeitTo)
+	return
+}
+
+func (g GroupChat) hasLockedDeposit(telegramId int) (locked bool) {
+	pg.Get(&locked, `
+SELECT EXISTS (
+  SELECT 1 FROM group_deposit
+  WHERE group_id = $1 AND telegram_id = $2 AND status = 'locked'
+)
+    `, g.TelegramId, telegramId)
+	return
+}
+
+// lockDeposit takes the deposit from the payer balance when the join charge
+// created by handleTelegramNewMember is paid.
+func lockDeposit(ctx context.Context, payer *User, kickdata KickData) error {
+	g, err := loadTelegramGroup(kickdata.ChatMemberConfig.ChatID)
+	if err != nil {
+		return err
+	}
+	policy, err := g.getDepositPolicy()
+	if err != nil {
+		return err
+	}
+	destination, err := g.getGroupDestination(policy.ForfeitTo)
+	if err != nil {
+		return err
+	}
+
+	random, err := randomHex()
+	if err != nil {
+		return err
+	}
+	sourcehash := hashString(random)
+	targethash := hashString("deposit:%s", sourcehash)
+
+	var notifyMessageId int
+	if kickdata.NotifyMessage != nil {
+		notifyMessageId = kickdata.NotifyMessage.MessageID
+	}
+
+	errMsg, err := payer.sendThroughProxy(
+		ctx,
+		sourcehash,
+		targethash,
+		notifyMessageId,
+		0,
+		destination,
+		kickdata.Sats*1000,
+		fmt.Sprintf("Deposit for joining group %d.", g.TelegramId),
+		fmt.Sprintf("Deposit from %s, yours if they're fined or banned.", kickdata.TargetUsername),
+		true, // pending until refunded or forfeited
+		"deposit",
+	)
+	if err != nil {
+		return errors.New(errMsg)
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO group_deposit
+  (group_id, telegram_id, account, source_hash, target_hash, sats, username)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+    `, g.TelegramId, kickdata.ChatMemberConfig.UserID, payer.Id,
+		sourcehash, targethash, kickdata.Sats, kickdata.TargetUsername)
+	if err != nil {
+		log.Error().Err(err).Str("hash", sourcehash).Stringer("payer", payer).
+			Msg("deposit taken but not recorded")
+		return err
+	}
+	locked_deposits.Set(lockedDepositKey(g.TelegramId,
+		int64(kickdata.ChatMemberConfig.UserID)), true)
+
+	go payer.track("deposit locked", map[string]interface{}{
+		"sats":  kickdata.Sats,
+		"group": g.TelegramId,
+	})
+
+	return nil
+}
+
+// depositPaidByInvoice is called when the member has paid an invoice to their
+// own account so the deposit can be locked from there.
+func depositPaidByInvoice(ctx context.Context, joinKey string, kickdata KickData) {
+	member, err := loadUser(kickdata.TargetId)
+	if err != nil {
+		log.Warn().Err(err).Str("join-key", joinKey).Msg("failed to load depositor")
+		return
+	}
+
+	if err := lockDeposit(ctx, member, kickdata); err != nil {
+		// the money may have been spent already, so the member stays muted
+		// and can still pay with the button before the deadline, otherwise
+		// they're kicked as if they hadn't paid
+		log.Warn().Err(err).Str("join-key", joinKey).Stringer("member", member).
+			Msg("failed to lock deposit after invoice paid")
+		reopenCharge(joinKey, kickdata)
+		send(ctx, member, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	ticketPaid(ctx, joinKey, kickdata)
+}
+
+// countDepositMessage is called for every message in a group and refunds the
+// deposit once the member has sent enough of them.
+func countDepositMessage(groupId int64, telegramId int) {
+	if !locked_deposits.Has(lockedDepositKey(groupId, int64(telegramId))) {
+		return
+	}
+
+	var deposit Deposit
+	err := pg.Get(&deposit, `
+UPDATE group_deposit AS d SET messages = d.messages + 1
+FROM deposit_policy AS p
+WHERE d.group_id = $1 AND d.telegram_id = $2 AND d.status = 'locked'
+  AND p.group_id = d.group_id
+RETURNING d.*
+    `, groupId, telegramId)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Int64("group", groupId).Int("user", telegramId).
+				Msg("failed to count deposit message")
+		}
+		return
+	}
+
+	g := GroupChat{TelegramId: groupId}
+	policy, err := g.getDepositPolicy()
+	if err != nil || policy.Messages == 0 || deposit.Messages < policy.Messages {
+		return
+	}
+
+	refundDeposit(deposit)
+}
+
+func refundDeposit(deposit Deposit) {
+	logger := log.With().Int("deposit", deposit.Id).Logger()
+	ctx := context.WithValue(context.Background(), "origin", "background")
+
+	txn, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	audit := startAudit(ctx, txn, "deposit_refund", deposit.Account)
+
+	res, err := txn.Exec(`
+UPDATE group_deposit SET status = 'refunded', resolved_at = now()
+WHERE id = $1 AND status = 'locked'
+    `, deposit.Id)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to mark deposit as refunded")
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return
+	}
+
+	// undo both sides of the proxied payment
+	_, err = txn.Exec(`
+DELETE FROM lightning.transaction
+WHERE (payment_hash = $1 AND pending) OR payment_hash = $2
+    `, deposit.TargetHash, deposit.SourceHash)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to delete deposit transactions")
+		return
+	}
+
+	if err := checkProxyBalance(txn); err != nil {
+		logger.Error().Err(err).Msg("proxy balance check on refundDeposit")
+		return
+	}
+
+	if err := audit.save(txn, deposit.SourceHash, map[string]interface{}{
+		"deposit": deposit.Id,
+		"group":   deposit.GroupId,
+	}); err != nil {
+		return
+	}
+
+	if err := txn.Commit(); err != nil {
+		logger.Warn().Err(err).Msg("failed to commit deposit refund")
+		return
+	}
+	locked_deposits.Remove(lockedDepositKey(deposit.GroupId, deposit.TelegramId))
+
+	logger.Info().Int64("group", deposit.GroupId).Msg("deposit refunded")
+
+	if depositor, err := loadUser(deposit.Account); err == nil {
+		send(ctx, depositor, t.DEPOSITREFUNDED, t.T{"Sats": deposit.Sats})
+		go depositor.track("deposit refunded", map[string]interface{}{
+			"sats":  deposit.Sats,
+			"group": deposit.GroupId,
+		})
+	}
+}
+
+// forfeitDeposit gives the locked deposit of a member to the group, called when
+// they're fined or banned by an admin.
+func forfeitDeposit(ctx context.Context, groupId int64, telegramId int64) {
+	var deposit Deposit
+	err := pg.Get(&deposit, `
+SELECT * FROM group_deposit
+WHERE group_id = $1 AND telegram_id = $2 AND status = 'locked'
+    `, groupId, telegramId)
+	if err != nil {
+		return
+	}
+
+	logger := log.With().Int("deposit", deposit.Id).Logger()
+
+	g := GroupChat{TelegramId: groupId}
+	policy, err := g.getDepositPolicy()
+	if err != nil {
+		policy.ForfeitTo = "owner"
+	}
+	destination, err := g.getGroupDestination(policy.ForfeitTo)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get deposit forfeit destination")
+		return
+	}
+
+	txn, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	audit := startAudit(ctx, txn, "deposit_forfeit", destination.Id)
+
+	res, err := txn.Exec(`
+UPDATE group_deposit SET status = 'forfeited', resolved_at = now()
+WHERE id = $1 AND status = 'locked'
+    `, deposit.Id)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to mark deposit as forfeited")
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return
+	}
+
+	_, err = txn.Exec(`
+UPDATE lightning.transaction SET pending = false, to_id = $2
+WHERE payment_hash = $1 AND pending
+    `, deposit.TargetHash, destination.Id)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to release forfeited deposit")
+		return
+	}
+
+	if err := audit.save(txn, deposit.TargetHash, map[string]interface{}{
+		"deposit":   deposit.Id,
+		"group":     groupId,
+		"depositor": deposit.Account,
+	}); err != nil {
+		return
+	}
+
+	if err := txn.Commit(); err != nil {
+		logger.Warn().Err(err).Msg("failed to commit deposit forfeit")
+		return
+	}
+	locked_deposits.Remove(lockedDepositKey(groupId, telegramId))
+
+	logger.Info().Int64("group", groupId).Msg("deposit forfeited")
+
+	send(ctx, g, t.DEPOSITFORFEITED, t.T{
+		"User": deposit.Username.String,
+		"Sats": deposit.Sats,
+	}, FORCESPAMMY)
+
+	go destination.track("deposit forfeited", map[string]interface{}{
+		"sats":  deposit.Sats,
+		"group": groupId,
+	})
+}
+
+func depositRefundRoutine() {
+	loadLockedDeposits()
+
+	for {
+		refundMaturedDeposits()
+		time.Sleep(time.Hour)
+	}
+}
+
+func refundMaturedDeposits() {
+	var deposits []Deposit
+	err := pg.Select(&deposits, `
+SELECT d.* FROM group_deposit AS d
+INNER JOIN deposit_policy AS p ON p.group_id = d.group_id
+WHERE d.status = 'locked'
+  AND p.days > 0
+  AND d.created_at + make_interval(days => p.days) <= now()
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch matured deposits")
+		return
+	}
+
+	for _, deposit := range deposits {
+		refundDeposit(deposit)
+	}
+}
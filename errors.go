@@ -6,4 +6,6 @@ var (
 	ErrInsufficientBalance = errors.New("Insufficient balance.")
 	ErrDatabase            = errors.New("Database error.")
 	ErrInvalidAmount       = errors.New("Invalid amount.")
+	ErrBanned              = errors.New("This account is banned.")
+	ErrReceiverBanned      = errors.New("The receiver account is banned.")
 )
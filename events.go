@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// every payment that touches an account is written to the event log, which
+// API clients can follow through /payments/stream (SSE) or /payments/ws
+// (WebSocket) and resume from the last id they saw. events are written in the
+// same transaction that moves the money and their ids are a per-account
+// sequence, so a stream never misses one that committed late. redis is only
+// used to wake up the streams, so any replica can serve any account.
+
+const (
+	EVENTLOGDAYS         = 30
+	EVENTSTREAMBATCH     = 100
+	EVENTSTREAMKEEPALIVE = 25 * time.Second
+)
+
+type PaymentEvent struct {
+	Event        string    `json:"event"` // received, sent, failed, internal or app
+	Account      int       `json:"account"`
+	Direction    string    `json:"direction,omitempty"` // for internal and app payments, "in" or "out"
+	PaymentHash  string    `json:"payment_hash"`
+	Msatoshi     int64     `json:"msatoshi"`
+	FeeMsatoshi  int64     `json:"fee_msatoshi,omitempty"`
+	Preimage     string    `json:"preimage,omitempty"`
+	Description  string    `json:"description,omitempty"`
+	Comment      string    `json:"comment,omitempty"`
+	Tag          string    `json:"tag,omitempty"`
+	Counterparty int       `json:"counterparty,omitempty"`
+	Failures     []string  `json:"failures,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+type AccountEvent struct {
+	Id        int64          `db:"seq" json:"id"`
+	Account   int            `db:"account" json:"-"`
+	Kind      string         `db:"kind" json:"kind"`
+	Data      types.JSONText `db:"data" json:"data"`
+	CreatedAt time.Time      `db:"created_at" json:"time"`
+}
+
+// forAccount is the event as it goes to the log of the given account.
+func (event PaymentEvent) forAccount(account int) PaymentEvent {
+	event.Account = account
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	return event
+}
+
+func hasAccountEvents(account int) bool {
+	return account != 0 && account != s.ProxyAccount
+}
+
+// saveAccountEvents writes the events to the log, must be called in the same
+// transaction that moves the money. the sequence is bumped on the account row,
+// which stays locked until the commit, so events of the same account become
+// visible in order.
+func saveAccountEvents(txn *sqlx.Tx, events ...PaymentEvent) error {
+	sorted := make([]PaymentEvent, 0, len(events))
+	for _, event := range events {
+		if hasAccountEvents(event.Account) {
+			sorted = append(sorted, event)
+		}
+	}
+
+	// always lock accounts in the same order so transfers can't deadlock
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Account < sorted[j].Account
+	})
+
+	for _, event := range sorted {
+		data, _ := json.Marshal(event)
+		_, err := txn.Exec(`
+WITH bumped AS (
+  UPDATE account SET event_seq = event_seq + 1
+  WHERE id = $1
+  RETURNING event_seq
+)
+INSERT INTO account_event (account, seq, kind, data)
+SELECT $1, event_seq, $2, $3 FROM bumped
+        `, event.Account, event.Event, types.JSONText(data))
+		if err != nil {
+			log.Warn().Err(err).Int("account", event.Account).Str("event", event.Event).
+				Str("hash", event.PaymentHash).Msg("failed to save account event")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// publishPaymentEvent is called after the events are committed, it wakes up
+// whoever is streaming the account and calls its webhooks.
+func publishPaymentEvent(event PaymentEvent) {
+	if !hasAccountEvents(event.Account) {
+		return
+	}
+
+	observePaymentEvent(event)
+	rds.Publish("events:"+strconv.Itoa(event.Account), event.Event)
+
+	for _, kind := range WEBHOOKEVENTS {
+		if kind == event.Event {
+			enqueueWebhooks(event.Account, event)
+			break
+		}
+	}
+}
+
+// appPaymentEvent describes a payment made through one of the bot apps, the
+// counterparty is 0 when there are many or when it is the bot itself.
+func appPaymentEvent(
+	direction string,
+	counterparty int,
+	msats int64,
+	hash string,
+	tag string,
+	desc string,
+) PaymentEvent {
+	if counterparty == s.ProxyAccount {
+		counterparty = 0
+	}
+	return PaymentEvent{
+		Event:        "app",
+		Direction:    direction,
+		Counterparty: counterparty,
+		PaymentHash:  hash,
+		Msatoshi:     msats,
+		Description:  desc,
+		Tag:          tag,
+	}
+}
+
+func loadAccountEvents(account int, after int64, limit int) (events []AccountEvent, err error) {
+	err = pg.Select(&events, `
+SELECT seq, account, kind, data, created_at FROM account_event
+WHERE account = $1 AND seq > $2
+ORDER BY seq
+LIMIT $3
+    `, account, after, limit)
+	return
+}
+
+func lastAccountEventId(account int) (id int64) {
+	pg.Get(&id, `
+SELECT event_seq FROM account WHERE id = $1
+    `, account)
+	return
+}
+
+// streams register here to be woken up when their account has new events
+var (
+	eventListeners      = make(map[int]map[chan struct{}]bool)
+	eventListenersMutex sync.Mutex
+)
+
+func listenAccountEvents(account int) (wake chan struct{}, stop func()) {
+	wake = make(chan struct{}, 1)
+
+	eventListenersMutex.Lock()
+	if eventListeners[account] == nil {
+		eventListeners[account] = make(map[chan struct{}]bool)
+	}
+	eventListeners[account][wake] = true
+	eventListenersMutex.Unlock()
+
+	return wake, func() {
+		eventListenersMutex.Lock()
+		delete(eventListeners[account], wake)
+		if len(eventListeners[account]) == 0 {
+			delete(eventListeners, account)
+		}
+		eventListenersMutex.Unlock()
+	}
+}
+
+func wakeAccountListeners(account int) {
+	eventListenersMutex.Lock()
+	defer eventListenersMutex.Unlock()
+
+	for wake := range eventListeners[account] {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// accountEventsRoutine receives the notifications published by all replicas.
+func accountEventsRoutine() {
+	for {
+		pubsub, err := rds.PSubscribe("events:*")
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to subscribe to account events")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		for {
+			msg, err := pubsub.ReceiveMessage()
+			if err != nil {
+				log.Warn().Err(err).Msg("account events subscription failed")
+				break
+			}
+
+			account, err := strconv.Atoi(strings.TrimPrefix(msg.Channel, "events:"))
+			if err != nil {
+				continue
+			}
+			wakeAccountListeners(account)
+		}
+
+		pubsub.Close()
+		time.Sleep(time.Second)
+	}
+}
+
+func eventLogCleanupRoutine() {
+	for {
+		_, err := pg.Exec(`
+DELETE FROM account_event
+WHERE created_at < now() - make_interval(days => $1)
+        `, EVENTLOGDAYS)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to cleanup old account events")
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// streamAccountEvents calls emit for every event after the given id, then for
+// the new ones as they come, until ctx is done or emit fails. keepalive is
+// called when nothing happens for a while.
+func streamAccountEvents(
+	ctx context.Context,
+	account int,
+	after int64,
+	emit func(AccountEvent) error,
+	keepalive func() error,
+) {
+	wake, stop := listenAccountEvents(account)
+	defer stop()
+
+	for {
+		events, err := loadAccountEvents(account, after, EVENTSTREAMBATCH)
+		if err != nil {
+			log.Warn().Err(err).Int("account", account).Msg("failed to load account events")
+			return
+		}
+
+		for _, event := range events {
+			if err := emit(event); err != nil {
+				return
+			}
+			after = event.Id
+		}
+
+		if len(events) == EVENTSTREAMBATCH {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-time.After(EVENTSTREAMKEEPALIVE):
+			if err := keepalive(); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// eventStreamStart is where a stream begins: right after the id the client
+// has seen, or at the end of the log if it hasn't seen anything.
+func eventStreamStart(account int, lastSeen string) int64 {
+	if id, err := strconv.ParseInt(lastSeen, 10, 64); err == nil && id >= 0 {
+		return id
+	}
+	return lastAccountEventId(account)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// expensive rules make messages in a group cost money. each group can have
+// many of them, the most expensive one that matches a message is charged.
+type ExpensiveRule struct {
+	Id                int    `db:"id"`
+	GroupId           int64  `db:"group_id"`
+	Price             int    `db:"price"`
+	Pattern           string `db:"pattern"`     // empty matches any text
+	Media             string `db:"media"`       // comma-separated, empty matches any message
+	Destination       string `db:"destination"` // "owner" or "treasury"
+	ExemptAdmins      bool   `db:"exempt_admins"`
+	ExemptWhitelisted bool   `db:"exempt_whitelisted"`
+
+	patternRegex *regexp.Regexp
+}
+
+var EXPENSIVEMEDIA = []string{"photo", "video", "link", "forward"}
+
+var expensive_cache = cmap.New()
+
+func (g GroupChat) getExpensiveRules() (rules []ExpensiveRule, err error) {
+	key := strconv.FormatInt(g.TelegramId, 10)
+	if irules, ok := expensive_cache.Get(key); ok {
+		return irules.([]ExpensiveRule), nil
+	}
+
+	err = pg.Select(&rules, `
+SELECT * FROM expensive_rule
+WHERE group_id = $1
+ORDER BY price DESC, id
+    `, g.TelegramId)
+	if err != nil {
+		return
+	}
+
+	for i := range rules {
+		rules[i].patternRegex, _ = regexp.Compile(rules[i].Pattern)
+	}
+
+	expensive_cache.Set(key, rules)
+	return
+}
+
+func (g GroupChat) addExpensiveRule(rule ExpensiveRule) (id int, err error) {
+	defer expensive_cache.Remove(strconv.FormatInt(g.TelegramId, 10))
+
+	err = pg.Get(&id, `
+INSERT INTO expensive_rule
+  (group_id, price, pattern, media, destination, exempt_admins, exempt_whitelisted)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id
+    `, g.TelegramId, rule.Price, rule.Pattern, rule.Media, rule.Destination,
+		rule.ExemptAdmins, rule.ExemptWhitelisted)
+	return
+}
+
+// removeExpensiveRule deletes one rule, or all of them if id is 0.
+func (g GroupChat) removeExpensiveRule(id int) (removed bool, err error) {
+	defer expensive_cache.Remove(strconv.FormatInt(g.TelegramId, 10))
+
+	res, err := pg.Exec(`
+DELETE FROM expensive_rule
+WHERE group_id = $1 AND ($2 = 0 OR id = $2)
+    `, g.TelegramId, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+type ExpensiveExempt struct {
+	TelegramId int64  `db:"telegram_id"`
+	Username   string `db:"username"`
+}
+
+// toggleExpensiveExempt puts the user in the whitelist or takes them out of it.
+func (g GroupChat) toggleExpensiveExempt(telegramId int64, username string) (exempt bool, err error) {
+	defer expensive_exempt_cache.Remove(strconv.FormatInt(g.TelegramId, 10))
+
+	res, err := pg.Exec(`
+DELETE FROM expensive_exempt WHERE group_id = $1 AND telegram_id = $2
+    `, g.TelegramId, telegramId)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return false, nil
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO expensive_exempt (group_id, telegram_id, username)
+VALUES ($1, $2, $3)
+    `, g.TelegramId, telegramId, username)
+	return err == nil, err
+}
+
+func (g GroupChat) listExpensiveExempt() (exempt []ExpensiveExempt, err error) {
+	err = pg.Select(&exempt, `
+SELECT telegram_id, username FROM expensive_exempt
+WHERE group_id = $1
+ORDER BY username
+    `, g.TelegramId)
+	return
+}
+
+// expensive_exempt_cache has the whitelist of each group as a map of telegram ids.
+var expensive_exempt_cache = cmap.New()
+
+func (g GroupChat) isExpensiveExempt(telegramId int) bool {
+	key := strconv.FormatInt(g.TelegramId, 10)
+	if iexempt, ok := expensive_exempt_cache.Get(key); ok {
+		return iexempt.(map[int64]bool)[int64(telegramId)]
+	}
+
+	var ids []int64
+	err := pg.Select(&ids, `
+SELECT telegram_id FROM expensive_exempt WHERE group_id = $1
+    `, g.TelegramId)
+	if err != nil {
+		log.Warn().Err(err).Stringer("group", &g).Msg("failed to load expensive whitelist")
+		return false
+	}
+
+	exempt := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		exempt[id] = true
+	}
+	expensive_exempt_cache.Set(key, exempt)
+	return exempt[int64(telegramId)]
+}
+
+// admins are asked to telegram, which is slow, so the answer is kept for a while.
+const EXPENSIVEADMINCACHE = 10 * time.Minute
+
+var expensive_admin_cache = cmap.New()
+
+type cachedAdmin struct {
+	admin bool
+	until time.Time
+}
+
+func isExpensiveAdmin(chat *tgbotapi.Chat, user *tgbotapi.User) bool {
+	key := fmt.Sprintf("%d:%d", chat.ID, user.ID)
+	if icached, ok := expensive_admin_cache.Get(key); ok {
+		if cached := icached.(cachedAdmin); cached.until.After(time.Now()) {
+			return cached.admin
+		}
+	}
+
+	admin := isAdmin(chat, user)
+	expensive_admin_cache.Set(key, cachedAdmin{admin, time.Now().Add(EXPENSIVEADMINCACHE)})
+	return admin
+}
+
+// parseExpensiveMedia validates and normalizes a comma-separated list of media types.
+func parseExpensiveMedia(media string) (string, bool) {
+	var types []string
+	for _, kind := range strings.Split(strings.ToLower(media), ",") {
+		kind = strings.TrimSpace(kind)
+		if kind == "" {
+			continue
+		}
+
+		valid := false
+		for _, allowed := range EXPENSIVEMEDIA {
+			if kind == allowed {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return "", false
+		}
+		types = append(types, kind)
+	}
+
+	sort.Strings(types)
+	return strings.Join(types, ","), true
+}
+
+func messageMediaTypes(message *tgbotapi.Message) (types []string) {
+	if message.Photo != nil {
+		types = append(types, "photo")
+	}
+	if message.Video != nil || message.VideoNote != nil || message.Animation != nil {
+		types = append(types, "video")
+	}
+	if message.ForwardDate != 0 {
+		types = append(types, "forward")
+	}
+
+	// captions have no entities here, so we also look for links in the text
+	hasLink := linkRegex.MatchString(message.Text) || linkRegex.MatchString(message.Caption)
+	if message.Entities != nil {
+		for _, entity := range *message.Entities {
+			if entity.Type == "url" || entity.Type == "text_link" {
+				hasLink = true
+				break
+			}
+		}
+	}
+	if hasLink {
+		types = append(types, "link")
+	}
+
+	return types
+}
+
+func (rule ExpensiveRule) matches(text string, media []string) bool {
+	if rule.Media != "" {
+		found := false
+		for _, kind := range media {
+			if strings.Contains(","+rule.Media+",", ","+kind+",") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if rule.Pattern != "" {
+		if rule.patternRegex == nil || !rule.patternRegex.MatchString(text) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// matchExpensiveRule returns the rule that should be charged for this message,
+// if any, skipping the ones the sender is exempt from.
+func matchExpensiveRule(message *tgbotapi.Message) *ExpensiveRule {
+	g := GroupChat{TelegramId: message.Chat.ID}
+	rules, err := g.getExpensiveRules()
+	if err != nil || len(rules) == 0 {
+		return nil
+	}
+
+	text := message.Text
+	if text == "" {
+		text = message.Caption
+	}
+	text = strings.ToLower(text)
+	media := messageMediaTypes(message)
+
+	// these are only checked if needed since they're costly
+	var admin, whitelisted *bool
+	isSenderAdmin := func() bool {
+		if admin == nil {
+			v := isExpensiveAdmin(message.Chat, message.From)
+			admin = &v
+		}
+		return *admin
+	}
+	isSenderWhitelisted := func() bool {
+		if whitelisted == nil {
+			v := g.isExpensiveExempt(message.From.ID)
+			whitelisted = &v
+		}
+		return *whitelisted
+	}
+
+	// rules are sorted by price, so the first that applies is the most expensive
+	for _, rule := range rules {
+		if !rule.matches(text, media) {
+			continue
+		}
+		if rule.ExemptWhitelisted && isSenderWhitelisted() {
+			continue
+		}
+		if rule.ExemptAdmins && isSenderAdmin() {
+			continue
+		}
+
+		return &rule
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"time"
 
@@ -40,6 +39,9 @@ func handleFine(ctx context.Context, opts docopt.Opts) {
 			return
 		}
 
+		// fined members lose their join deposit
+		go forfeitDeposit(ctx, message.Chat.ID, int64(message.ReplyToMessage.From.ID))
+
 		target, cas, err := ensureTelegramUser(message.ReplyToMessage)
 		if err != nil {
 			send(ctx, chatOwner, t.ERROR, t.T{"Err": err.Error()})
@@ -146,12 +148,11 @@ func handleFine(ctx context.Context, opts docopt.Opts) {
 			target.AtName(ctx),
 			hash,
 			int(msats / 1000),
+			time.Time{},
 		}
-		kickdatajson, _ := json.Marshal(kickdata)
-		err = rds.HSet("ticket-pending", fineKey, string(kickdatajson)).Err()
+		err = savePendingCharge(fineKey, &kickdata)
 		if err != nil {
-			log.Warn().Err(err).Str("kickdata", string(kickdatajson)).
-				Msg("error saving kickdata")
+			log.Warn().Err(err).Str("fine-key", fineKey).Msg("error saving kickdata")
 		}
 		go waitToKick(ctx, fineKey, kickdata)
 	}
@@ -162,19 +163,17 @@ func handleFineClickPay(ctx context.Context, fineKey string) {
 
 	log := log.With().Str("fine-key", fineKey).Logger()
 
-	kickdatastr, err := rds.HGet("ticket-pending", fineKey).Result()
+	kickdata, err := loadPendingCharge(fineKey)
 	if err != nil {
 		log.Warn().Err(err).Msg("error getting fine pending on callback")
 		return
 	}
 
-	var kickdata KickData
-	if err := json.Unmarshal([]byte(kickdatastr), &kickdata); err != nil {
-		log.Warn().Err(err).Msg("failed to unmarshal kickdata from redis")
+	if payer.Id != kickdata.TargetId {
 		return
 	}
 
-	if payer.Id != kickdata.TargetId {
+	if !resolveCharge(fineKey, "paid") {
 		return
 	}
 
@@ -189,6 +188,7 @@ func handleFineClickPay(ctx context.Context, fineKey string) {
 		"fine",
 	)
 	if err != nil {
+		reopenCharge(fineKey, kickdata)
 		send(ctx, payer, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
@@ -201,8 +201,6 @@ func fineNotPaid(ctx context.Context, fineKey string, kickdata KickData) {
 	log.Info().Str("fine-key", fineKey).Interface("chat-member", kickdata.ChatMemberConfig).
 		Msg("fine expired, kicking user")
 
-	rds.HDel("ticket-pending", fineKey)
-
 	// delete invoice message if it exists
 	if kickdata.InvoiceMessage != nil {
 		deleteMessage(kickdata.InvoiceMessage)
@@ -221,7 +219,6 @@ func fineNotPaid(ctx context.Context, fineKey string, kickdata KickData) {
 
 func finePaid(ctx context.Context, fineKey string, kickdata KickData) {
 	log.Debug().Str("fine-key", fineKey).Msg("fine paid")
-	rds.HDel("ticket-pending", fineKey)
 
 	// delete the invoice message
 	if kickdata.InvoiceMessage != nil {
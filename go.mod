@@ -10,7 +10,7 @@ require (
 	github.com/fiatjaf/go-cliche v0.3.1
 	github.com/fiatjaf/go-lnurl v1.10.2
 	github.com/fiatjaf/ln-decodepay v1.1.0
-	github.com/fogleman/gg v1.3.0 // indirect
+	github.com/fogleman/gg v1.3.0
 	github.com/fogleman/primitive v0.0.0-20200504002142-0373c216458b
 	github.com/go-telegram-bot-api/telegram-bot-api v4.6.4+incompatible
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
@@ -37,7 +37,7 @@ require (
 	github.com/tuotoo/qrcode v0.0.0-20190222102259-ac9c44189bf2
 	github.com/willf/bitset v1.1.10 // indirect
 	golang.org/x/image v0.1.0 // indirect
-	gopkg.in/antage/eventsource.v1 v1.0.0-20150318155416-803f4c5af225
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
 	gopkg.in/jmcvetta/napping.v3 v3.2.0
 	gopkg.in/redis.v5 v5.2.9
 	gopkg.in/yaml.v2 v2.2.8 // indirect
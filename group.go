@@ -5,13 +5,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/jmoiron/sqlx/types"
 	cmap "github.com/orcaman/concurrent-map"
 )
 
@@ -33,6 +32,7 @@ type KickData struct {
 	TargetUsername   string                    `json:"new_member_username"`
 	Hash             string                    `json:"hash"`
 	Sats             int                       `json:"sats"`
+	Deadline         time.Time                 `json:"deadline,omitempty"` // defaults to 15 minutes
 }
 
 func isChannelOrGroupUser(user *tgbotapi.User) bool {
@@ -51,15 +51,28 @@ func isChannelOrGroupUser(user *tgbotapi.User) bool {
 func interceptMessage(message *tgbotapi.Message) (proceed bool) {
 	ctx := context.Background()
 
+	if message.From == nil || message.Chat.Type == "private" {
+		return true
+	}
+
 	// check if ticket payments is pending
-	joinKey := fmt.Sprintf("%d:%d", message.From.ID, message.Chat.ID)
-	if _, isPending := pendingApproval.Get(joinKey); isPending {
+	if isPendingJoin(message.Chat.ID, message.From.ID) {
 		log.Debug().Str("user", message.From.String()).Msg("user pending, can't speak")
 		return false
 	}
 
+	// members with a deposit get it back after some messages
+	go countDepositMessage(message.Chat.ID, message.From.ID)
+
+	// members from before the subscription was turned on
+	if !isChannelOrGroupUser(message.From) {
+		go seeSubscriptionMember(message.Chat.ID, message.From)
+	}
+
 	// check expensiveness
-	if sats := isExpensive(message.Chat.ID, message.Text); sats != 0 {
+	if rule := matchExpensiveRule(message); rule != nil {
+		sats := rule.Price
+
 		// take money out of the poor guy who sent the message
 		u, err := loadTelegramUser(message.From.ID)
 		if err != nil {
@@ -69,19 +82,20 @@ func interceptMessage(message *tgbotapi.Message) (proceed bool) {
 			return false
 		}
 
-		owner, err := getChatOwner(message.Chat.ID)
+		g := GroupChat{TelegramId: message.Chat.ID}
+		receiver, err := g.getGroupDestination(rule.Destination)
 		if err != nil {
 			return true
 		}
 
-		if owner.Id == u.Id {
+		if receiver.Id == u.Id {
 			return true
 		}
 
 		link := fmt.Sprintf("https://t.me/c/%s/%d",
 			strconv.FormatInt(message.Chat.ID, 10)[4:], message.MessageID)
 
-		err = u.sendInternally(ctx, owner, false, int64(sats)*1000, 0,
+		err = u.sendInternally(ctx, receiver, false, int64(sats)*1000, 0,
 			fmt.Sprintf("Expensive %s.", link), "", "expensive")
 		if err == nil {
 			send(ctx, u, t.EXPENSIVENOTIFICATION, t.T{
@@ -90,11 +104,13 @@ func interceptMessage(message *tgbotapi.Message) (proceed bool) {
 				"Sender": true,
 			})
 
-			send(ctx, owner, t.EXPENSIVENOTIFICATION, t.T{
-				"Link":   link,
-				"Price":  sats,
-				"Sender": false,
-			})
+			if rule.Destination != "treasury" {
+				send(ctx, receiver, t.EXPENSIVENOTIFICATION, t.T{
+					"Link":   link,
+					"Price":  sats,
+					"Sender": false,
+				})
+			}
 
 			return true
 		}
@@ -114,9 +130,16 @@ type GroupChat struct {
 	Locale     string `db:"locale"`
 	Spammy     bool   `db:"spammy"`
 	Ticket     int    `db:"ticket"`
+
+	SubscriptionPrice  int `db:"subscription_price"`  // sat per period, 0 means no subscription
+	SubscriptionPeriod int `db:"subscription_period"` // days
+	SubscriptionGrace  int `db:"subscription_grace"`  // days
+
+	Reactions     bool   `db:"reactions"`      // tipping by replying with emoji or +N
+	ReactionEmoji string `db:"reaction_emoji"` // space-separated
 }
 
-const GROUPCHATFIELDS = "coalesce(telegram_id, 0) AS telegram_id, locale, spammy, ticket"
+const GROUPCHATFIELDS = "coalesce(telegram_id, 0) AS telegram_id, locale, spammy, ticket, subscription_price, subscription_period, subscription_grace, reactions, reaction_emoji"
 
 func (g *GroupChat) String() string {
 	if g == nil {
@@ -188,57 +211,6 @@ WHERE telegram_id = $1
 	return
 }
 
-type expensiveness struct {
-	Price        int    `db:"expensive_price"`
-	Pattern      string `db:"expensive_pattern"`
-	patternRegex *regexp.Regexp
-}
-
-var expensive_cache = cmap.New()
-
-func (g GroupChat) setExpensive(sat int, pattern string) (err error) {
-	_, err = pg.Exec(`
-UPDATE groupchat SET expensive_price = $2, expensive_pattern = $3
-WHERE telegram_id = $1
-    `, g.TelegramId, sat, pattern)
-	if err != nil {
-		return err
-	}
-
-	regex, _ := regexp.Compile(pattern)
-	expensive_cache.Set(strconv.FormatInt(g.TelegramId, 10), expensiveness{
-		sat, pattern, regex,
-	})
-	return
-}
-
-func isExpensive(groupTelegramId int64, text string) (price int) {
-	var expensive expensiveness
-	if iexpensive, ok := expensive_cache.Get(strconv.FormatInt(groupTelegramId, 10)); ok {
-		expensive = iexpensive.(expensiveness)
-	} else {
-		pg.Get(&expensive, `
-SELECT expensive_price, expensive_pattern
-FROM groupchat
-WHERE telegram_id = $1
-        `, groupTelegramId)
-
-		regex, _ := regexp.Compile(expensive.Pattern)
-		expensive.patternRegex = regex
-		expensive_cache.Set(strconv.FormatInt(groupTelegramId, 10), expensive)
-	}
-
-	if expensive.Price == 0 {
-		return 0
-	}
-
-	if expensive.patternRegex.MatchString(strings.ToLower(text)) {
-		return expensive.Price
-	}
-
-	return 0
-}
-
 func (g GroupChat) setRenamePrice(sat int) (err error) {
 	_, err = pg.Exec(`
 UPDATE groupchat SET renamable = $2
@@ -289,7 +261,15 @@ func setLanguage(chatId int64, lang string) (err error) {
 }
 
 func startKicking() {
-	data, err := rds.HGetAll("ticket-pending").Result()
+	migrateRedisCharges()
+
+	var charges []struct {
+		Key  string         `db:"key"`
+		Data types.JSONText `db:"data"`
+	}
+	err := pg.Select(&charges, `
+SELECT key, data FROM group_charge WHERE status = 'pending'
+    `)
 	if err != nil {
 		log.Warn().Err(err).Msg("error getting tickets pending")
 		return
@@ -297,36 +277,84 @@ func startKicking() {
 
 	ctx := context.WithValue(context.Background(), "origin", "background")
 
-	for joinKey, kickdatastr := range data {
+	for _, charge := range charges {
 		var kickdata KickData
-		err := json.Unmarshal([]byte(kickdatastr), &kickdata)
+		err := charge.Data.Unmarshal(&kickdata)
 		if err != nil {
-			log.Warn().Err(err).Msg("failed to unmarshal kickdata from redis")
+			log.Warn().Err(err).Str("key", charge.Key).Msg("failed to unmarshal kickdata")
 			continue
 		}
 
-		log.Debug().Msg("restarted kick invoice wait")
-		pendingApproval.Set(joinKey, kickdata)
-		go waitToKick(ctx, joinKey, kickdata)
+		if isJoinCharge(kickdata.Kind) {
+			pending_joins.Set(pendingJoinKey(kickdata.ChatMemberConfig.ChatID,
+				kickdata.ChatMemberConfig.UserID), charge.Key)
+		}
+
+		log.Debug().Str("key", charge.Key).Msg("restarted kick invoice wait")
+		go waitToKick(ctx, charge.Key, kickdata)
+	}
+}
+
+// migrateRedisCharges moves the charges that were pending on redis, from
+// before they were kept on the database, to group_charge.
+func migrateRedisCharges() {
+	data, err := rds.HGetAll("ticket-pending").Result()
+	if err != nil {
+		log.Warn().Err(err).Msg("error getting tickets pending from redis")
+		return
+	}
+
+	for key, kickdatastr := range data {
+		var kickdata KickData
+		if err := json.Unmarshal([]byte(kickdatastr), &kickdata); err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("failed to unmarshal kickdata from redis")
+			rds.HDel("ticket-pending", key)
+			continue
+		}
+
+		// these didn't have a deadline, they get the default from now
+		if err := savePendingCharge(key, &kickdata); err != nil {
+			log.Warn().Err(err).Str("key", key).Msg("failed to migrate pending charge")
+			continue
+		}
+		rds.HDel("ticket-pending", key)
 	}
 }
 
 func waitToKick(ctx context.Context, key string, kickdata KickData) {
 	log.Debug().Str("key", key).Msg("waiting to kick")
+
+	timeout := 15 * time.Minute
+	if !kickdata.Deadline.IsZero() {
+		timeout = time.Until(kickdata.Deadline)
+	}
+
 	select {
 	case <-waitInvoice(kickdata.Hash):
+		if !resolveCharge(key, "paid") {
+			return
+		}
 		switch kickdata.Kind {
 		case "ticket":
 			ticketPaid(ctx, key, kickdata)
+		case "deposit":
+			depositPaidByInvoice(ctx, key, kickdata)
 		case "fine":
 			finePaid(ctx, key, kickdata)
+		case "renewal":
+			renewalPaid(ctx, key, kickdata)
+		}
+	case <-time.After(timeout):
+		if !resolveCharge(key, "expired") {
+			return
 		}
-	case <-time.After(15 * time.Minute):
 		switch kickdata.Kind {
-		case "ticket":
+		case "ticket", "deposit":
 			ticketNotPaid(ctx, key, kickdata)
 		case "fine":
 			fineNotPaid(ctx, key, kickdata)
+		case "renewal":
+			renewalNotPaid(ctx, key, kickdata)
 		}
 	case <-waitGeneric(key):
 		// just to stop this waiter
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"strconv"
@@ -27,6 +29,12 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 	log.Debug().Str("d", cb.Data).Stringer("user", u).Msg("got callback")
 	ctx = context.WithValue(ctx, "initiator", u)
 
+	if isBanned(u.Id, BANALL) {
+		log.Debug().Stringer("user", u).Msg("got callback from banned user")
+		send(ctx, "")
+		return
+	}
+
 	if cb.Message != nil {
 		// we have access to the full message, means it was done through a /command
 		ctx = context.WithValue(ctx, "message", cb.Message)
@@ -157,7 +165,67 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 		// join a new participant in a coinflip lottery
 		// if the total of participants is reached run the coinflip
 		params := strings.Split(cb.Data[5:], "-")
-		if len(params) != 3 {
+		if len(params) == 3 {
+			// coinflip created before commitments were introduced
+			removeKeyboardButtons(ctx)
+			send(ctx, t.CALLBACKEXPIRED, t.T{"BotOp": "Coinflip"}, APPEND)
+			goto answerEmpty
+		}
+		if len(params) != 4 {
+			goto answerEmpty
+		}
+
+		if params[2] == "new" {
+			// posted from an inline query, create it now and publish the
+			// commitment before anyone can join
+			initiatorId, err1 := strconv.Atoi(params[3])
+			nparticipants, err2 := strconv.Atoi(params[0])
+			sats, err3 := strconv.Atoi(params[1])
+			if err1 != nil || err2 != nil || err3 != nil || cb.InlineMessageID == "" {
+				log.Error().Str("data", cb.Data).Msg("invalid inline coinflip callback")
+				removeKeyboardButtons(ctx)
+				send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
+				goto answerEmpty
+			}
+
+			// only the first press creates it
+			if !rds.SetNX("coinflip:inline:"+cb.InlineMessageID, "t", s.GiveAwayTimeout).Val() {
+				goto answerEmpty
+			}
+
+			coinflipid, commitment, err := createCoinflip(initiatorId)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to create inline coinflip")
+				removeKeyboardButtons(ctx)
+				send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
+				goto answerEmpty
+			}
+
+			send(ctx, translateTemplate(ctx, t.COINFLIPAD, t.T{
+				"Sats":       sats,
+				"Prize":      sats * nparticipants,
+				"SpotsLeft":  nparticipants - 1,
+				"MaxPlayers": nparticipants,
+			})+translateTemplate(ctx, t.COINFLIPCOMMITMENT, t.T{
+				"Id":         coinflipid,
+				"Commitment": commitment,
+			}), EDIT, coinflipKeyboard(ctx, coinflipid, commitment, nparticipants, sats))
+
+			if initiator, err := loadUser(initiatorId); err == nil {
+				go initiator.track("coinflip created", map[string]interface{}{
+					"sats":   sats,
+					"n":      nparticipants,
+					"inline": true,
+				})
+			}
+
+			// save this to limit coinflip creation per user
+			rds.Set(fmt.Sprintf("recentcoinflip:%d", initiatorId), "t", time.Minute*30)
+
+			if initiatorId != u.Id {
+				send(ctx, t.COINFLIPOPENED, WITHALERT)
+				return
+			}
 			goto answerEmpty
 		}
 
@@ -165,11 +233,19 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 		rkey := "coinflip:" + coinflipid
 
 		nregistered := int(rds.SCard(rkey).Val())
-		if nregistered == 0 {
+		commitment, ok := getCoinflipCommitment(coinflipid)
+		if nregistered == 0 || !ok {
 			removeKeyboardButtons(ctx)
 			send(ctx, t.CALLBACKEXPIRED, t.T{"BotOp": "Coinflip"}, APPEND)
 			goto answerEmpty
 		}
+		if shortCommitment(commitment) != params[3] {
+			log.Warn().Str("data", cb.Data).Str("commitment", commitment).
+				Msg("coinflip commitment mismatch")
+			removeKeyboardButtons(ctx)
+			send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
+			goto answerEmpty
+		}
 
 		nparticipants, err := strconv.Atoi(params[0])
 		if err != nil {
@@ -200,36 +276,55 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 		})
 
 		joiner := u
+		rules := coinflipRulesFromContext(ctx)
 		if !joiner.checkBalanceFor(ctx, msats+COINFLIP_TAX, "coinflip") {
 			goto answerEmpty
 		}
 
-		isMember, err := rds.SIsMember(rkey, joiner.Id).Result()
-		if err != nil || isMember {
-			// can't join twice
-			send(ctx, t.CANTJOINTWICE, WITHALERT)
+		var groupId int64
+		if g, ok := ctx.Value("group").(GroupChat); ok {
+			groupId = g.TelegramId
+		}
+		if err := rules.check(sats, nparticipants); err != nil {
+			send(ctx, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
+			return
+		}
+		if err := rules.checkQuota("coinflip", groupId, joiner.Id); err != nil {
+			send(ctx, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
 			return
 		}
 
-		if err := rds.SAdd("coinflip:"+coinflipid, joiner.Id).Err(); err != nil {
+		// the callback query id is generated by telegram and can't be predicted
+		// by us when we publish the commitment, so it goes in the entry
+		joined, err := joinCoinflip(coinflipid, joiner.Id, cb.ID)
+		if err != nil {
 			log.Warn().Err(err).Str("coinflip", coinflipid).
 				Msg("error adding participant to coinflip.")
 			send(ctx, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
 			goto answerEmpty
 		}
+		if !joined {
+			// can't join twice
+			send(ctx, t.CANTJOINTWICE, WITHALERT)
+			return
+		}
+		useQuota("coinflip", groupId, joiner.Id)
 
 		// append @user to the coinflip message (without removing the keyboard)
-		keyboard := coinflipKeyboard(ctx, coinflipid, 0, nparticipants, sats)
+		keyboard := coinflipKeyboard(ctx, coinflipid, commitment, nparticipants, sats)
 
 		if message := ctx.Value("message"); message != nil {
 			send(ctx, message, joiner.AtName(ctx), APPEND, keyboard)
 		} else {
-			send(ctx, t.COINFLIPAD, t.T{
+			send(ctx, translateTemplate(ctx, t.COINFLIPAD, t.T{
 				"Sats":       sats,
 				"Prize":      sats * nparticipants,
 				"SpotsLeft":  nparticipants - nregistered,
 				"MaxPlayers": nparticipants,
-			}, EDIT, keyboard)
+			})+translateTemplate(ctx, t.COINFLIPCOMMITMENT, t.T{
+				"Id":         coinflipid,
+				"Commitment": commitment,
+			}), EDIT, keyboard)
 		}
 
 		if nregistered+1 >= nparticipants {
@@ -237,37 +332,26 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 			time.Sleep(3 * time.Second)
 			// even if for some bug we registered more participants than we should
 			// we run the lottery with them all
-			sparticipants, err := rds.SMembers(rkey).Result()
-			go rds.Del(rkey)
-			if err != nil {
-				log.Warn().Err(err).Msg("failed to get coinflip participants")
+			seed, err1 := rds.Get(rkey + ":seed").Result()
+			entries, err2 := rds.LRange(rkey+":entries", 0, -1).Result()
+			go rds.Del(rkey, rkey+":seed", rkey+":entries")
+			if err1 != nil || err2 != nil {
+				log.Warn().Err(err1).Err(err2).Msg("failed to get coinflip entries")
 				removeKeyboardButtons(ctx)
 				send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
 				goto answerEmpty
 			}
-			log.Debug().Int("nparticipants", len(sparticipants)).Msg("resolving coinflip")
-			if len(sparticipants) <= 0 {
+			log.Debug().Int("nparticipants", len(entries)).Msg("resolving coinflip")
+			if len(entries) <= 0 {
 				goto answerEmpty
 			}
 
-			swinnerId := sparticipants[rand.Intn(len(sparticipants))]
-
-			// winner id
-			winnerId, err := strconv.Atoi(swinnerId)
-			if err != nil {
-				log.Warn().Err(err).Str("winnerId", swinnerId).
-					Msg("winner id is not an int")
-				removeKeyboardButtons(ctx)
-				send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
-				goto answerEmpty
-			}
-
-			// all participants
-			participants := make([]int, len(sparticipants))
-			for i, spart := range sparticipants {
-				part, err := strconv.Atoi(spart)
+			// all participants, in the order they joined
+			participants := make([]int, len(entries))
+			for i, entry := range entries {
+				part, err := coinflipEntryUser(entry)
 				if err != nil {
-					log.Warn().Err(err).Str("part", spart).
+					log.Warn().Err(err).Str("entry", entry).
 						Msg("participant id is not an int")
 					removeKeyboardButtons(ctx)
 					send(ctx, t.CALLBACKERROR, t.T{"BotOp": "Coinflip"}, APPEND)
@@ -276,6 +360,9 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 				participants[i] = part
 			}
 
+			// winner id
+			winnerId := participants[coinflipWinner(seed, entries)]
+
 			winner, err := settleCoinflip(ctx, sats, winnerId, participants)
 			if err != nil {
 				log.Warn().Err(err).Msg("error processing coinflip transactions")
@@ -284,6 +371,24 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 				goto answerEmpty
 			}
 
+			jentries, _ := json.Marshal(entries)
+			if err := saveCoinflipRecord(CoinflipRecord{
+				Id:         coinflipid,
+				Commitment: commitment,
+				Seed:       seed,
+				Entries:    jentries,
+				Winner:     winnerId,
+				Sats:       sats,
+			}); err != nil {
+				log.Warn().Err(err).Str("coinflip", coinflipid).
+					Msg("failed to save coinflip record")
+			}
+
+			reveal := translateTemplate(ctx, t.COINFLIPREVEAL, t.T{
+				"Id":   coinflipid,
+				"Seed": seed,
+			})
+
 			removeKeyboardButtons(ctx)
 			if imessage := ctx.Value("message"); imessage != nil {
 				message := imessage.(*tgbotapi.Message)
@@ -291,11 +396,14 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 					translateTemplate(ctx, t.CALLBACKWINNER, t.T{
 						"Winner": winner.AtName(ctx),
 					}))
-				send(ctx, message.Chat.ID, FORCESPAMMY, t.CALLBACKCOINFLIPWINNER,
-					t.T{"Winner": winner.AtName(ctx)}, message.MessageID)
+				send(ctx, message.Chat.ID, FORCESPAMMY,
+					translateTemplate(ctx, t.CALLBACKCOINFLIPWINNER, t.T{
+						"Winner": winner.AtName(ctx),
+					})+reveal, message.MessageID)
 			} else {
-				send(ctx, t.CALLBACKCOINFLIPWINNER, t.T{"Winner": winner.AtName(ctx)},
-					EDIT)
+				send(ctx, translateTemplate(ctx, t.CALLBACKCOINFLIPWINNER, t.T{
+					"Winner": winner.AtName(ctx),
+				})+reveal, EDIT)
 			}
 		}
 	case strings.HasPrefix(cb.Data, "gifl="):
@@ -340,11 +448,26 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 			return
 		}
 
+		rules := coinflipRulesFromContext(ctx)
+		var groupId int64
+		if g, ok := ctx.Value("group").(GroupChat); ok {
+			groupId = g.TelegramId
+		}
+		if err := rules.check(sats, nparticipants); err != nil {
+			send(ctx, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
+			return
+		}
+		if err := rules.checkQuota("giveflip", groupId, joiner.Id); err != nil {
+			send(ctx, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
+			return
+		}
+
 		if err := rds.SAdd("giveflip:"+giveflipid, joiner.Id).Err(); err != nil {
 			log.Warn().Err(err).Str("giveflip", giveflipid).
 				Msg("error adding participant to giveflip.")
 			goto answerEmpty
 		}
+		useQuota("giveflip", groupId, joiner.Id)
 		rds.Expire("giveflip:"+giveflipid, s.GiveAwayTimeout)
 
 		// append @user to the giveflip message (without removing the keyboard)
@@ -619,11 +742,49 @@ func handleTelegramCallback(ctx context.Context, cb *tgbotapi.CallbackQuery) {
 		// remove unclaimed transaction
 		// when you tip an invalid account or an account that has never talked with the bot
 		hash := cb.Data[7:]
-		_, err := pg.Exec(`
+		err := func() error {
+			txn, err := pg.Beginx()
+			if err != nil {
+				return err
+			}
+			defer txn.Rollback()
+
+			audit := startAudit(ctx, txn, "unclaimed_removed", u.Id)
+
+			var removed []struct {
+				Hash   string `db:"payment_hash"`
+				Amount int64  `db:"amount"`
+			}
+			err = txn.Select(&removed, `
 DELETE FROM lightning.transaction AS tx
 WHERE substring(payment_hash from 0 for $2) = $1
+  AND from_id = $3
   AND is_unclaimed(tx)
-        `, hash, len(hash)+1)
+RETURNING payment_hash, amount::bigint AS amount
+            `, hash, len(hash)+1, u.Id)
+			if err != nil {
+				return err
+			}
+			if len(removed) == 0 {
+				return sql.ErrNoRows
+			}
+
+			var (
+				msats  int64
+				hashes []string
+			)
+			for _, tx := range removed {
+				msats += tx.Amount
+				hashes = append(hashes, tx.Hash)
+			}
+			if err := audit.save(txn, hashes[0], map[string]interface{}{
+				"msatoshi": msats,
+				"hashes":   hashes,
+			}); err != nil {
+				return err
+			}
+			return txn.Commit()
+		}()
 		if err != nil {
 			log.Error().Err(err).Str("hash", hash).
 				Msg("failed to remove pending payment")
@@ -638,12 +799,12 @@ WHERE substring(payment_hash from 0 for $2) = $1
 		// perform payment between users,
 		// reveal message.
 		parts := strings.Split(cb.Data[7:], "-")
-		hiddenkey := parts[0]
+		hiddenId := parts[0]
 		revealer := u
 
-		sourceUserId, hiddenId, hiddenMessage, err := getHiddenMessage(ctx, hiddenkey)
+		hiddenMessage, err := getHiddenMessage(ctx, hiddenId)
 		if err != nil {
-			log.Error().Err(err).Str("key", hiddenkey).
+			log.Error().Err(err).Str("id", hiddenId).
 				Msg("error locating hidden message")
 			removeKeyboardButtons(ctx)
 			send(ctx, t.HIDDENMSGNOTFOUND, APPEND)
@@ -656,7 +817,7 @@ WHERE substring(payment_hash from 0 for $2) = $1
 		}
 
 		// can't reveal your own thing
-		if sourceUserId == revealer.Id {
+		if hiddenMessage.Author == revealer.Id {
 			send(ctx, WITHALERT, t.CANTREVEALOWN)
 			return
 		}
@@ -668,55 +829,24 @@ WHERE substring(payment_hash from 0 for $2) = $1
 			"public":    hiddenMessage.Public,
 		})
 
-		// cache reveal so we know who has paid to reveal this for now
-		var revealerIds []int
-		var totalRevealers int
-
-		revealedSetKey := fmt.Sprintf("revealed:%s", hiddenId)
-
+		// register this payer and fetch everybody who has paid so far,
 		// also don't let users pay twice
-		if alreadyPaid, err := rds.SIsMember(revealedSetKey, u.Id).Result(); err != nil {
+		revealerIds, ok, err := addHiddenRevealer(hiddenId, u.Id)
+		if err != nil {
 			send(ctx, WITHALERT, t.ERROR, t.T{"Err": err.Error()})
 			return
-		} else if alreadyPaid {
+		} else if !ok {
 			send(ctx, WITHALERT, t.ERROR, t.T{"Err": "can't reveal twice"})
 			return
 		}
-
-		// add current payer to redis then fetch that same set of current revealers
-		result := rds.Eval(`
-            local key = KEYS[1]
-            local user = ARGV[1]
-            local expiry = ARGV[2]
-            redis.call("sadd", key, user)
-            redis.call("expire", key, expiry)
-            return redis.call("smembers", key)
-        `,
-			[]string{revealedSetKey}, u.Id, int(s.HiddenMessageTimeout/time.Second))
-
-		if err := result.Err(); err != nil {
-			send(ctx, WITHALERT, t.ERROR, t.T{"Err": err.Error()})
-			return
-		}
-
-		revealerIdsI := result.Val().([]interface{})
-		totalRevealers = len(revealerIdsI)
-		revealerIds = make([]int, totalRevealers)
-		for i, revealerId := range revealerIdsI {
-			revealerId, err := strconv.Atoi(revealerId.(string))
-			if err != nil {
-				send(ctx, WITHALERT, t.ERROR, t.T{"Err": err.Error()})
-				return
-			}
-			revealerIds[i] = revealerId
-		}
+		totalRevealers := len(revealerIds)
 
 		if hiddenMessage.Crowdfund > 1 && totalRevealers < hiddenMessage.Crowdfund {
 			// if this is a crowdfund we must only reveal after the threshold of
 			// participants has been reached. before that we will just update the
 			// message in-place.
 			send(ctx, hiddenMessage.Preview, EDIT,
-				revealKeyboard(ctx, hiddenkey, hiddenMessage, totalRevealers))
+				revealKeyboard(ctx, hiddenMessage, totalRevealers))
 			return
 		}
 
@@ -728,8 +858,9 @@ WHERE substring(payment_hash from 0 for $2) = $1
 		}
 
 		_, err = settleReveal(ctx, hiddenMessage.Satoshis, hiddenId,
-			sourceUserId, revealerIds)
+			hiddenMessage.Author, revealerIds)
 		if err != nil {
+			removeHiddenRevealer(hiddenId, u.Id)
 			log.Warn().Err(err).Str("id", hiddenId).
 				Int("satoshis", hiddenMessage.Satoshis).
 				Stringer("revealer", revealer).Msg("failed to pay to reveal")
@@ -743,18 +874,19 @@ WHERE substring(payment_hash from 0 for $2) = $1
 
 		if hiddenMessage.Public {
 			// reveal message in-place
-			if hiddenMessage.CopyMessage != nil && cb.Message != nil {
+			if hiddenMessage.HasAttachment() && cb.Message != nil {
 				send(ctx, EDIT,
 					hiddenMessage.Preview+"\n\n~ <code>"+hiddenId+"</code> 👁")
 				send(ctx, cb.Message, cb.Message.Chat.ID, FORCESPAMMY,
-					hiddenMessage.CopyMessage)
+					hiddenMessage.CopyMessage, hiddenMessage.File, hiddenMessage.Content)
 			} else {
 				send(ctx, EDIT, revealedText)
 			}
 		} else {
 			// reveal message privately
-			if hiddenMessage.CopyMessage != nil {
-				send(ctx, revealer, hiddenMessage.CopyMessage)
+			if hiddenMessage.HasAttachment() {
+				send(ctx, revealer, hiddenMessage.CopyMessage, hiddenMessage.File,
+					hiddenMessage.Content)
 			} else {
 				send(ctx, revealer, revealedText)
 			}
@@ -764,7 +896,7 @@ WHERE substring(payment_hash from 0 for $2) = $1
 				// more people can still pay for this
 				// buttons are kept so others still can pay, but updated
 				send(ctx, EDIT, hiddenMessage.Preview,
-					revealKeyboard(ctx, hiddenkey, hiddenMessage, totalRevealers))
+					revealKeyboard(ctx, hiddenMessage, totalRevealers))
 			} else {
 				// end of quota. no more people can reveal.
 				send(ctx, EDIT, "A hidden message prompt once lived here.")
@@ -785,6 +917,16 @@ WHERE substring(payment_hash from 0 for $2) = $1
 		joinKey := strings.Split(cb.Data, "=")[1]
 		handleTicketClickPay(ctx, joinKey)
 		break
+	case strings.HasPrefix(cb.Data, "renew="):
+		renewKey := cb.Data[len("renew="):]
+		handleRenewalClickPay(ctx, renewKey)
+		break
+	case strings.HasPrefix(cb.Data, "pos="):
+		handlePOSCallback(ctx, cb.Data[4:])
+		break
+	case strings.HasPrefix(cb.Data, "acctdel="):
+		handleAccountDeleteConfirm(ctx, cb.Data[len("acctdel="):])
+		break
 	case strings.HasPrefix(cb.Data, "fine="):
 		fineKey := strings.Split(cb.Data, "=")[1]
 		handleFineClickPay(ctx, fineKey)
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -13,6 +12,11 @@ import (
 	"github.com/lucsky/cuid"
 )
 
+const (
+	INLINEINVOICESATS = 1000
+	INLINEPAGESIZE    = 10
+)
+
 func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 	var (
 		u       *User
@@ -33,18 +37,32 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 		goto answerEmpty
 	}
 
+	if isBanned(u.Id, BANALL) {
+		goto answerEmpty
+	}
+
 	text = strings.TrimSpace(q.Query)
 	argv, err = shellquote.Split(text)
-	if err != nil || len(argv) < 1 {
+	if err != nil {
 		goto answerEmpty
 	}
 
+	// just the bot name, or the bot name and an amount
+	if len(argv) == 0 {
+		resp, err = answerInlineDefault(ctx, u, q, INLINEINVOICESATS*1000)
+		goto responded
+	}
+	if msats, errA := parseAmountString(argv[0]); errA == nil && len(argv) == 1 {
+		resp, err = answerInlineDefault(ctx, u, q, msats)
+		goto responded
+	}
+
 	command = argv[0]
 	if strings.HasPrefix(command, "/") {
 		command = command[1:]
 	}
 
-	if len(argv) < 2 {
+	if len(argv) < 2 && command != "reveal" {
 		goto answerEmpty
 	}
 
@@ -154,12 +172,8 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 			}
 		}
 
-		go u.track("coinflip created", map[string]interface{}{
-			"sats":   sats,
-			"n":      nparticipants,
-			"inline": true,
-		})
-
+		// the coinflip is only created when its message is posted and the
+		// first button is pressed, not on every keystroke
 		result := tgbotapi.NewInlineQueryResultArticleHTML(
 			fmt.Sprintf("flip-%d-%d-%d", u.Id, sats, nparticipants),
 			translateTemplate(ctx, t.INLINECOINFLIPRESULT, t.T{
@@ -174,19 +188,13 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 			}),
 		)
 
-		result.ReplyMarkup = coinflipKeyboard(ctx, "", u.Id, nparticipants, sats)
+		result.ReplyMarkup = inlineCoinflipKeyboard(ctx, u.Id, nparticipants, sats)
 
 		resp, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
 			InlineQueryID: q.ID,
 			Results:       []interface{}{result},
 			IsPersonal:    true,
 		})
-
-		go func() {
-			// after a while save this to limit coinflip creation per user
-			time.Sleep(time.Second * 120)
-			rds.Set(fmt.Sprintf("recentcoinflip:%d", u.Id), "t", time.Minute*30)
-		}()
 	case "giveflip":
 		if len(argv) < 3 {
 			goto answerEmpty
@@ -234,36 +242,39 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 			IsPersonal:    true,
 		})
 	case "reveal":
-		hiddenid := "*"
+		var nextOffset string
+		prefix := ""
 		if len(argv) == 2 {
-			hiddenid = argv[1]
+			prefix = argv[1]
 		}
 
-		hiddenkeys := rds.Keys(fmt.Sprintf("hidden:%d:%s", u.Id, hiddenid)).Val()
-
-		results := make([]interface{}, len(hiddenkeys))
-		for i, hiddenkey := range hiddenkeys {
-			_, hiddenid, hiddenmessage, err := getHiddenMessage(ctx, hiddenkey)
-			if err != nil {
-				continue
-			}
+		offset, _ := strconv.Atoi(q.Offset)
+		hiddenmessages, err := listHiddenMessages(ctx, u.Id, prefix, true, INLINEPAGESIZE, offset)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to list hidden messages")
+		}
+		if len(hiddenmessages) == INLINEPAGESIZE {
+			nextOffset = strconv.Itoa(offset + INLINEPAGESIZE)
+		}
 
-			if hiddenmessage.CopyMessage != nil && hiddenmessage.Public {
-				// copyMessages can't be sent in public groups through the inline thing
+		results := make([]interface{}, 0, len(hiddenmessages))
+		for _, hiddenmessage := range hiddenmessages {
+			if hiddenmessage.HasAttachment() && hiddenmessage.Public {
+				// copyMessages and files can't be sent in public groups through the inline thing
 				continue
 			}
 
 			result := tgbotapi.NewInlineQueryResultArticleHTML(
-				fmt.Sprintf("reveal-%s", hiddenkey),
+				fmt.Sprintf("reveal-%s", hiddenmessage.Id),
 				translateTemplate(ctx, t.INLINEHIDDENRESULT, t.T{
-					"HiddenId": hiddenid,
+					"HiddenId": hiddenmessage.Id,
 					"Message":  hiddenmessage,
 				}),
 				hiddenmessage.Preview,
 			)
 
-			result.ReplyMarkup = revealKeyboard(ctx, hiddenkey, hiddenmessage, 0)
-			results[i] = result
+			result.ReplyMarkup = revealKeyboard(ctx, hiddenmessage, 0)
+			results = append(results, result)
 		}
 
 		if len(results) > 0 {
@@ -276,6 +287,7 @@ func handleInlineQuery(ctx context.Context, q *tgbotapi.InlineQuery) {
 			InlineQueryID: q.ID,
 			Results:       results,
 			IsPersonal:    true,
+			NextOffset:    nextOffset,
 		})
 	case "show":
 		if argv[1] == "id" {
@@ -312,3 +324,115 @@ answerEmpty:
 		Results:       []interface{}{},
 	})
 }
+
+// inlineDefaultInvoice reuses the invoice made for the same amount on a
+// previous query, since telegram sends a new query for every keystroke.
+func inlineDefaultInvoice(ctx context.Context, u *User, msats int64) (bolt11, hash string, err error) {
+	key := fmt.Sprintf("inline-invoice:%d:%d", u.Id, msats)
+	if cached, err := rds.Get(key).Result(); err == nil {
+		if parts := strings.SplitN(cached, " ", 2); len(parts) == 2 {
+			var paid bool
+			pg.Get(&paid, `
+SELECT EXISTS (SELECT 1 FROM lightning.transaction WHERE payment_hash = $1)
+            `, parts[0])
+			if !paid {
+				return parts[1], parts[0], nil
+			}
+		}
+	}
+
+	bolt11, hash, err = u.makeInvoice(ctx, &MakeInvoiceArgs{
+		Msatoshi: msats,
+		Description: fmt.Sprintf("%s:  inline invoice for %d satoshis",
+			u.Username, msats/1000),
+	})
+	if err != nil {
+		return
+	}
+
+	// half the invoice lifetime, so what we show is never about to expire
+	rds.Set(key, hash+" "+bolt11, s.InvoiceTimeout/2)
+	return
+}
+
+// answerInlineDefault shows an invoice QR code, the balance and a list of
+// recent contacts to give money to. only the contacts are paginated.
+func answerInlineDefault(
+	ctx context.Context,
+	u *User,
+	q *tgbotapi.InlineQuery,
+	msats int64,
+) (tgbotapi.APIResponse, error) {
+	sats := int(msats / 1000)
+	offset, _ := strconv.Atoi(q.Offset)
+	results := make([]interface{}, 0, INLINEPAGESIZE+2)
+
+	if offset == 0 {
+		bolt11, hash, err := inlineDefaultInvoice(ctx, u, msats)
+		if err != nil {
+			log.Warn().Err(err).Msg("error making invoice on inline query.")
+		} else {
+			qr := qrJPEGURL(bolt11).String()
+			result := tgbotapi.NewInlineQueryResultPhotoWithThumb("invqr-"+hash[:10], qr, qr)
+			result.Title = translateTemplate(ctx, t.INLINEINVOICERESULT, t.T{"Sats": sats})
+			result.Caption = bolt11
+			results = append(results, result)
+		}
+
+		// this is only seen by the user, what gets sent is how to pay them
+		receive := createLNURLPayCode(u, "")
+		if u.Username != "" {
+			receive = u.Username + "@" + getHost()
+		}
+		result := tgbotapi.NewInlineQueryResultArticleHTML(
+			"balance",
+			translateTemplate(ctx, t.INLINEBALANCERESULT, t.T{
+				"Sats": float64(getBalance(pg, u.Id)) / 1000,
+			}),
+			translateTemplate(ctx, t.INLINEBALANCESHARE, t.T{"Receive": receive}),
+		)
+		result.Description = translate(ctx, t.INLINEBALANCEDESC)
+		results = append(results, result)
+
+		go u.track("inline default", map[string]interface{}{"sats": sats})
+	}
+
+	contacts, err := u.recentContacts(INLINEPAGESIZE, offset)
+	if err != nil {
+		log.Warn().Err(err).Stringer("user", u).Msg("failed to list recent contacts")
+	}
+	canGive := getBalance(pg, u.Id) >= msats
+	for _, contact := range contacts {
+		if !canGive {
+			break
+		}
+
+		result := tgbotapi.NewInlineQueryResultArticleHTML(
+			fmt.Sprintf("gv-%d-%d-%s", u.Id, sats, contact),
+			translateTemplate(ctx, t.INLINEGIVEAWAYRESULT, t.T{
+				"Sats":     sats,
+				"Receiver": contact,
+			}),
+			translateTemplate(ctx, t.GIVEAWAYMSG, t.T{
+				"User":     u.AtName(ctx),
+				"Sats":     sats,
+				"Receiver": contact,
+			}),
+		)
+		result.ReplyMarkup = giveawayKeyboard(ctx, u.Id, sats, contact)
+		results = append(results, result)
+	}
+
+	var nextOffset string
+	if canGive && len(contacts) == INLINEPAGESIZE {
+		nextOffset = strconv.Itoa(offset + INLINEPAGESIZE)
+	}
+
+	return bot.AnswerInlineQuery(tgbotapi.InlineConfig{
+		InlineQueryID: q.ID,
+		Results:       results,
+		IsPersonal:    true,
+		CacheTime:     30,
+		NextOffset:    nextOffset,
+	})
+}
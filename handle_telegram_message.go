@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/url"
@@ -31,8 +30,8 @@ func handleTelegramMessage(ctx context.Context, message *tgbotapi.Message) {
 		return
 	}
 
-	// stop if temporarily banned
-	if _, ok := s.Banned[u.Id]; ok {
+	// stop if banned
+	if isBanned(u.Id, BANALL) {
 		log.Debug().Stringer("id", u).Msg("got request from banned user")
 		return
 	}
@@ -45,7 +44,7 @@ func handleTelegramMessage(ctx context.Context, message *tgbotapi.Message) {
 	// we at least want the correct language used there.
 	g := GroupChat{TelegramId: message.Chat.ID, Locale: u.Locale}
 
-	// this is just to send to amplitude
+	// this is just to send to analytics
 	var groupId *int64 = nil
 
 	if message.Chat.Type == "private" {
@@ -79,6 +78,10 @@ func handleTelegramMessage(ctx context.Context, message *tgbotapi.Message) {
 			// bot commands will work
 			(*message.Entities)[0].Type != "bot_command" ||
 			(*message.Entities)[0].Offset != 0 {
+			// but replies may be reaction tips
+			if message.ReplyToMessage != nil {
+				handleReactionTip(ctx, g, message)
+			}
 			return
 		}
 	}
@@ -134,6 +137,34 @@ func handleTelegramMessage(ctx context.Context, message *tgbotapi.Message) {
 		return
 	}
 
+	// admin console
+	if message.Chat.Type == "private" &&
+		isBotAdmin(u) &&
+		(messageText == "/admin" || strings.HasPrefix(messageText, "/admin ") ||
+			strings.HasPrefix(messageText, "/admin_")) {
+
+		go handleAdmin(ctx, messageText)
+		return
+	}
+
+	// usage numbers, also only for admins
+	if message.Chat.Type == "private" &&
+		isBotAdmin(u) &&
+		(messageText == "/analytics" || strings.HasPrefix(messageText, "/analytics ")) {
+
+		go handleAnalytics(ctx, messageText)
+		return
+	}
+
+	// a fresh solvency report
+	if message.Chat.Type == "private" &&
+		isBotAdmin(u) &&
+		messageText == "/solvency" {
+
+		go handleSolvency(ctx)
+		return
+	}
+
 	// otherwise parse the slash command
 	opts, isCommand, err = parse(messageText)
 	log.Debug().Str("t", messageText).Stringer("user", u).Err(err).
@@ -184,12 +215,17 @@ parsed:
 			go u.track("stop", nil)
 		}
 		break
+	case opts["account"].(bool):
+		// before "delete", which is also a command by itself
+		go handleAccount(ctx, opts)
 	case opts["bluewallet"].(bool), opts["zeus"].(bool), opts["lndhub"].(bool):
 		send(ctx, u, "This command is not available.")
 		// go handleBlueWallet(ctx, opts)
 	case opts["api"].(bool):
 		send(ctx, u, "This command is not available.")
 		// go handleAPI(ctx, opts)
+	case opts["webhooks"].(bool):
+		go handleWebhooks(ctx, opts)
 	case opts["lightningatm"].(bool):
 		send(ctx, u, "This command is not available.")
 		// go handleLightningATM(ctx)
@@ -197,6 +233,18 @@ parsed:
 		go handleTriangles(ctx, opts, message)
 	case opts["tx"].(bool):
 		go handleSingleTransaction(ctx, opts)
+	case opts["verify"].(bool):
+		go handleVerifyCoinflip(ctx, opts)
+	case opts["treasury"].(bool):
+		go handleTreasury(ctx, opts)
+	case opts["members"].(bool):
+		go handleMembers(ctx)
+	case opts["leaderboard"].(bool):
+		go handleLeaderboard(ctx)
+	case opts["stats"].(bool):
+		go handleStats(ctx, opts)
+	case opts["upvote"].(bool):
+		go handleUpvote(ctx, opts)
 	case opts["send"].(bool), opts["tip"].(bool):
 		go u.track("send", map[string]interface{}{
 			"group":     groupId,
@@ -235,10 +283,11 @@ parsed:
 			break
 		}
 
+		rules := g.getCoinflipRules()
 		sats := int(msats / 1000)
 		var nparticipants int
 		if n, err := opts.Int("<num_participants>"); err == nil {
-			if n < 2 || n > 100 {
+			if n < 2 || n > rules.MaxPlayers {
 				send(ctx, u, t.INVALIDPARTNUMBER, t.T{"Number": strconv.Itoa(n)})
 				break
 			} else {
@@ -248,6 +297,15 @@ parsed:
 			nparticipants = 2
 		}
 
+		if err := rules.check(sats, nparticipants); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+		if err := rules.checkHours(); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+
 		giveflipid := cuid.Slug()
 		send(ctx, g, FORCESPAMMY,
 			t.GIVEFLIPMSG, t.T{
@@ -277,6 +335,8 @@ parsed:
 			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 			break
 		}
+
+		rules := g.getCoinflipRules()
 		if !u.checkBalanceFor(ctx, msats+COINFLIP_TAX, "coinflip") {
 			break
 		}
@@ -284,7 +344,7 @@ parsed:
 		sats := int(msats / 1000)
 		nparticipants := 2
 		if n, err := opts.Int("<num_participants>"); err == nil {
-			if n < 2 || n > 100 {
+			if n < 2 || n > rules.MaxPlayers {
 				send(ctx, u, t.INVALIDPARTNUMBER, t.T{"Number": strconv.Itoa(n)})
 				break
 			} else {
@@ -292,12 +352,38 @@ parsed:
 			}
 		}
 
-		send(ctx, g, t.LOTTERYMSG, FORCESPAMMY, t.T{
-			"EntrySats":    sats,
-			"Participants": nparticipants,
-			"Prize":        sats * nparticipants,
-			"Registered":   u.AtName(ctx),
-		}, coinflipKeyboard(ctx, "", u.Id, nparticipants, sats))
+		if err := rules.check(sats, nparticipants); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+		if err := rules.checkHours(); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+		if err := rules.checkQuota("coinflip", g.TelegramId, u.Id); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+
+		coinflipid, commitment, err := createCoinflip(u.Id)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create coinflip")
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			break
+		}
+		useQuota("coinflip", g.TelegramId, u.Id)
+
+		send(ctx, g, FORCESPAMMY,
+			translateTemplate(ctx, t.LOTTERYMSG, t.T{
+				"EntrySats":    sats,
+				"Participants": nparticipants,
+				"Prize":        sats * nparticipants,
+				"Registered":   u.AtName(ctx),
+			})+translateTemplate(ctx, t.COINFLIPCOMMITMENT, t.T{
+				"Id":         coinflipid,
+				"Commitment": commitment,
+			}),
+			coinflipKeyboard(ctx, coinflipid, commitment, nparticipants, sats))
 
 		// save this to limit coinflip creation per user
 		go u.track("coinflip created", map[string]interface{}{
@@ -345,17 +431,26 @@ parsed:
 			"n":     nparticipants,
 		})
 	case opts["hide"].(bool):
-		hiddenid := getHiddenId(message) // deterministic
+		hiddenid := getHiddenId(u.Id, message) // deterministic
 
 		hiddenmessage := HiddenMessage{
+			Id:     hiddenid,
+			Author: u.Id,
 			Public: true,
 		}
 
-		// if there's a replyto, use that as a forward/copy
+		// if there's a replyto, use its photo, document or voice note,
+		// or the entire message as a forward/copy
 		if message.ReplyToMessage != nil {
-			hiddenmessage.CopyMessage = &TelegramCopyMessage{
-				MessageID: message.ReplyToMessage.MessageID,
-				ChatID:    message.Chat.ID,
+			if file := hiddenMediaFromMessage(message.ReplyToMessage); file != nil {
+				hiddenmessage.File = file
+				hiddenmessage.MediaType = file.Type
+				hiddenmessage.Content = message.ReplyToMessage.Caption
+			} else {
+				hiddenmessage.CopyMessage = &TelegramCopyMessage{
+					MessageID: message.ReplyToMessage.MessageID,
+					ChatID:    message.Chat.ID,
+				}
 			}
 		}
 
@@ -363,7 +458,7 @@ parsed:
 		// -- or if there's a replyo and inline, the inline part is the preview
 		if icontent, ok := opts["<message>"]; ok {
 			message := strings.Join(icontent.([]string), " ")
-			if hiddenmessage.CopyMessage != nil {
+			if hiddenmessage.HasAttachment() {
 				// if we are using the replyto forward,
 				// this is the preview
 				hiddenmessage.Preview = message
@@ -379,7 +474,7 @@ parsed:
 			}
 		}
 
-		if hiddenmessage.Content == "" && hiddenmessage.CopyMessage == nil {
+		if hiddenmessage.Content == "" && !hiddenmessage.HasAttachment() {
 			// no content found
 			send(ctx, u, t.ERROR, t.T{"Err": "No content to hide."})
 			return
@@ -411,13 +506,39 @@ parsed:
 			hiddenmessage.Times = 0
 		}
 
-		hiddenmessagejson, err := json.Marshal(hiddenmessage)
-		if err != nil {
-			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
-			return
+		expiry := s.HiddenMessageTimeout
+		if days, err := opts.Int("--days"); err == nil {
+			if days < 1 || days > MAXHIDDENDAYS {
+				send(ctx, u, t.ERROR, t.T{
+					"Err": fmt.Sprintf("hidden messages can last from 1 to %d days.", MAXHIDDENDAYS),
+				})
+				return
+			}
+			expiry = time.Hour * 24 * time.Duration(days)
+		}
+		hiddenmessage.ExpiresAt = time.Now().Add(expiry)
+
+		if opts["--web"].(bool) {
+			// sold on a public page, so it can't depend on a telegram chat
+			if hiddenmessage.CopyMessage != nil {
+				send(ctx, u, t.ERROR, t.T{
+					"Err": "only text, photos, documents and voice notes can be sold on the web.",
+				})
+				return
+			}
+
+			hiddenmessage.Web = true
+			hiddenmessage.Downloads = DEFAULTHIDDENDOWNLOADS
+			if downloads, err := opts.Int("--downloads"); err == nil {
+				if downloads < 1 {
+					send(ctx, u, t.ERROR, t.T{"Err": "downloads must be at least 1."})
+					return
+				}
+				hiddenmessage.Downloads = downloads
+			}
 		}
 
-		err = rds.Set(fmt.Sprintf("hidden:%d:%s", u.Id, hiddenid), string(hiddenmessagejson), s.HiddenMessageTimeout).Err()
+		err = saveHiddenMessage(hiddenmessage)
 		if err != nil {
 			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 			return
@@ -427,10 +548,13 @@ parsed:
 			"HiddenId": hiddenid,
 			"Message":  hiddenmessage,
 		}
+		if hiddenmessage.Web {
+			templateParams["WebURL"] = hiddenmessage.WebURL()
+		}
 
 		var shareKeyboard interface{}
-		if hiddenmessage.CopyMessage != nil && hiddenmessage.Public {
-			// copyMessages can't be sent in public groups through the inline thing
+		if hiddenmessage.HasAttachment() && hiddenmessage.Public {
+			// copyMessages and files can't be sent in public groups through the inline thing
 			// so don't show the keyboard in this case
 			templateParams["WithInstructions"] = true
 		} else {
@@ -455,6 +579,9 @@ parsed:
 			"times":     hiddenmessage.Times,
 			"crowdfund": hiddenmessage.Crowdfund,
 			"public":    hiddenmessage.Public,
+			"media":     hiddenmessage.MediaType,
+			"days":      int(expiry.Hours() / 24),
+			"web":       hiddenmessage.Web,
 		})
 
 		break
@@ -462,25 +589,28 @@ parsed:
 		go func() {
 			hiddenid := opts["<hidden_message_id>"].(string)
 
-			redisKey, ok := findHiddenKey(hiddenid)
-			if !ok {
+			hidden, err := getHiddenMessage(ctx, hiddenid)
+			if err == sql.ErrNoRows {
 				send(ctx, u, t.HIDDENMSGNOTFOUND, nil, message.MessageID)
 				return
-			}
-
-			_, _, hidden, err := getHiddenMessage(ctx, redisKey)
-			if err != nil {
+			} else if err != nil {
 				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 				return
 			}
 
 			send(ctx, u, g, FORCESPAMMY,
-				hidden.Preview, revealKeyboard(ctx, redisKey, hidden, 0))
+				hidden.Preview, revealKeyboard(ctx, hidden, 0))
 		}()
+	case opts["hidden"].(bool):
+		go handleHiddenList(ctx, opts)
+	case opts["pos"].(bool):
+		go handlePOS(ctx, opts)
 	case opts["transactions"].(bool):
 		go handleTransactionList(ctx, opts)
 	case opts["balance"].(bool):
 		go handleBalance(ctx, opts)
+	case opts["proof"].(bool):
+		go handleProof(ctx)
 	case opts["withdraw"].(bool):
 		if address, err := opts.String("<address>"); err != nil {
 			send(ctx, u, "Call it with <code>/withdraw your@lightning.address</code>")
@@ -523,9 +653,29 @@ parsed:
 				return
 			}
 			balance := info.BalanceMsat * 995 / 1000 / 1000 * 1000
-			_, err = pg.Exec(`insert into lightning.transaction (from_id, amount, pending) values ($1, $2, false)`,
-				u.Id, balance)
+			err = func() error {
+				txn, err := pg.Beginx()
+				if err != nil {
+					return err
+				}
+				defer txn.Rollback()
+
+				audit := startAudit(ctx, txn, "manual_withdraw", u.Id)
+				_, err = txn.Exec(`insert into lightning.transaction (from_id, amount, pending) values ($1, $2, false)`,
+					u.Id, balance)
+				if err != nil {
+					return err
+				}
+				if getBalance(txn, u.Id) < 0 {
+					return ErrInsufficientBalance
+				}
+				if err := audit.save(txn, "", map[string]interface{}{"address": address}); err != nil {
+					return err
+				}
+				return txn.Commit()
+			}()
 			if err != nil {
+				log.Warn().Err(err).Stringer("user", u).Msg("failed to save manual withdraw")
 				send(ctx, u, "Something went wrong.")
 				return
 			}
@@ -662,41 +812,259 @@ parsed:
 				if sats > 0 {
 					send(ctx, g, t.TICKETSET, t.T{"Sat": sats})
 				}
-			case opts["expensive"].(bool):
-				log.Info().Stringer("group", &g).Msg("toggling expensive")
-				msats, _ := parseSatoshis(opts)
-				pattern, _ := opts.String("<pattern>")
-				pattern = strings.ToLower(pattern)
+			case opts["subscription"].(bool):
+				msats, err := parseSatoshis(opts)
+				if err != nil {
+					// just show the current settings
+					send(ctx, g, t.SUBSCRIPTIONMSG, t.T{"Group": g})
+					break
+				}
 				sats := int(msats / 1000)
 
-				if sats != 0 && (sats > 50 || sats < 5) {
+				period, err := opts.Int("<period>")
+				if err != nil {
+					period = g.SubscriptionPeriod
+				}
+				grace, err := opts.Int("<grace>")
+				if err != nil {
+					grace = g.SubscriptionGrace
+				}
+				if period < 1 || grace < 0 || grace >= period {
 					send(ctx, g, t.ERROR, t.T{
-						"Err": "price per message must be between 5 and 50 sat.",
+						"Err": "period must be at least 1 day and grace must be shorter than the period.",
 					})
-					return
+					break
 				}
 
-				if sats == 0 {
-					g.setExpensive(0, "")
-					send(ctx, g, t.FREETALK)
-				} else if _, err := regexp.Compile(pattern); err != nil {
+				log.Info().Stringer("group", &g).Int("sats", sats).Int("period", period).
+					Int("grace", grace).Msg("toggling subscription")
+				if err := g.setSubscription(sats, period, grace); err != nil {
 					send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
-					return
+					break
 				}
+				g.SubscriptionPrice = sats
+				g.SubscriptionPeriod = period
+				g.SubscriptionGrace = grace
 
-				go u.track("toggle expensive", map[string]interface{}{
-					"group":   groupId,
-					"sats":    sats,
-					"pattern": pattern,
+				go u.track("toggle subscription", map[string]interface{}{
+					"group":  groupId,
+					"sats":   sats,
+					"period": period,
 				})
 
-				g.setExpensive(sats, pattern)
-				if sats > 0 {
+				send(ctx, g, t.SUBSCRIPTIONMSG, t.T{"Group": g})
+			case opts["deposits"].(bool):
+				policy, err := g.getDepositPolicy()
+				if err != nil {
+					policy = DepositPolicy{Days: 7, ForfeitTo: "owner"}
+				}
+
+				msats, err := parseSatoshis(opts)
+				if err != nil {
+					// just show the current settings
+					send(ctx, g, t.DEPOSITMSG, t.T{"Policy": policy})
+					break
+				}
+				policy.Sats = int(msats / 1000)
+				if days, err := opts.Int("<period>"); err == nil {
+					policy.Days = days
+				}
+				if messages, err := opts.Int("<messages>"); err == nil {
+					policy.Messages = messages
+				}
+				if to, err := opts.String("--to"); err == nil {
+					policy.ForfeitTo = to
+				}
+				if policy.ForfeitTo != "owner" && policy.ForfeitTo != "treasury" {
+					send(ctx, g, t.ERROR, t.T{"Err": "deposits can only go to the owner or the treasury."})
+					break
+				}
+				if policy.Days < 0 || policy.Messages < 0 || (policy.Days == 0 && policy.Messages == 0) {
+					send(ctx, g, t.ERROR, t.T{
+						"Err": "deposits must be given back after some days or some messages.",
+					})
+					break
+				}
+
+				log.Info().Stringer("group", &g).Int("sats", policy.Sats).
+					Int("days", policy.Days).Int("messages", policy.Messages).
+					Msg("toggling deposits")
+				if err := g.setDepositPolicy(policy); err != nil {
+					send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+					break
+				}
+
+				go u.track("toggle deposits", map[string]interface{}{
+					"group":    groupId,
+					"sats":     policy.Sats,
+					"days":     policy.Days,
+					"messages": policy.Messages,
+				})
+
+				send(ctx, g, t.DEPOSITMSG, t.T{"Policy": policy})
+			case opts["expensive"].(bool):
+				switch {
+				case opts["add"].(bool):
+					msats, err := parseSatoshis(opts)
+					sats := int(msats / 1000)
+					if err != nil || sats > 50 || sats < 5 {
+						send(ctx, g, t.ERROR, t.T{
+							"Err": "price per message must be between 5 and 50 sat.",
+						})
+						return
+					}
+
+					pattern, _ := opts.String("<pattern>")
+					pattern = strings.ToLower(pattern)
+					if _, err := regexp.Compile(pattern); err != nil {
+						send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+						return
+					}
+
+					rule := ExpensiveRule{
+						Price:             sats,
+						Pattern:           pattern,
+						Destination:       "owner",
+						ExemptAdmins:      true,
+						ExemptWhitelisted: true,
+					}
+					if media, err := opts.String("--media"); err == nil {
+						var ok bool
+						if rule.Media, ok = parseExpensiveMedia(media); !ok || rule.Media == "" {
+							send(ctx, g, t.ERROR, t.T{
+								"Err": "media must be one or more of " + strings.Join(EXPENSIVEMEDIA, ", ") + ".",
+							})
+							return
+						}
+					}
+					if to, err := opts.String("--to"); err == nil {
+						if to != "owner" && to != "treasury" {
+							send(ctx, g, t.ERROR, t.T{"Err": "money can only go to the owner or the treasury."})
+							return
+						}
+						rule.Destination = to
+					}
+					if exempt, err := opts.String("--exempt"); err == nil {
+						rule.ExemptAdmins = strings.Contains(exempt, "admins")
+						rule.ExemptWhitelisted = strings.Contains(exempt, "whitelist")
+					}
+
+					log.Info().Stringer("group", &g).Int("sats", sats).Str("pattern", pattern).
+						Str("media", rule.Media).Msg("adding expensive rule")
+					id, err := g.addExpensiveRule(rule)
+					if err != nil {
+						send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+						return
+					}
+
+					go u.track("toggle expensive", map[string]interface{}{
+						"group":   groupId,
+						"sats":    sats,
+						"pattern": pattern,
+						"media":   rule.Media,
+					})
+
 					send(ctx, g, t.EXPENSIVEMSG, t.T{
-						"Price":   sats,
-						"Pattern": pattern,
+						"Id":       id,
+						"Price":    sats,
+						"Pattern":  pattern,
+						"Media":    rule.Media,
+						"Treasury": rule.Destination == "treasury",
+					})
+				case opts["del"].(bool):
+					// "all" removes every rule
+					id, err := strconv.Atoi(opts["<rule_id>"].(string))
+					if err != nil && opts["<rule_id>"].(string) != "all" {
+						send(ctx, g, t.ERROR, t.T{"Err": "invalid rule id."})
+						return
+					}
+
+					removed, err := g.removeExpensiveRule(id)
+					if err != nil {
+						send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+						return
+					} else if !removed {
+						send(ctx, g, t.ERROR, t.T{"Err": "rule not found."})
+						return
+					}
+
+					log.Info().Stringer("group", &g).Int("rule", id).Msg("removed expensive rule")
+
+					rules, _ := g.getExpensiveRules()
+					if len(rules) == 0 {
+						send(ctx, g, t.FREETALK)
+						return
+					}
+					exempt, _ := g.listExpensiveExempt()
+
+					send(ctx, g, t.EXPENSIVERULES, t.T{"Rules": rules, "Exempt": exempt})
+				case opts["exempt"].(bool):
+					var (
+						telegramId int64
+						username   string
+					)
+					if receiver, ok := opts["<receiver>"].(string); ok {
+						target, err := loadTelegramUsername(
+							strings.ToLower(strings.TrimPrefix(receiver, "@")))
+						if err != nil || target.TelegramId == 0 {
+							send(ctx, g, t.ERROR, t.T{"Err": "user not found."})
+							return
+						}
+						telegramId = target.TelegramId
+						username = "@" + target.Username
+					} else if message.ReplyToMessage != nil && message.ReplyToMessage.From != nil {
+						telegramId = int64(message.ReplyToMessage.From.ID)
+						username = message.ReplyToMessage.From.String()
+					} else {
+						send(ctx, u, t.MISSINGRECEIVER)
+						return
+					}
+
+					exempt, err := g.toggleExpensiveExempt(telegramId, username)
+					if err != nil {
+						send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+						return
+					}
+
+					go u.track("toggle expensive exempt", map[string]interface{}{
+						"group":  groupId,
+						"exempt": exempt,
 					})
+
+					send(ctx, g, t.EXPENSIVEEXEMPT, t.T{"User": username, "Exempt": exempt})
+				default:
+					// list rules
+					rules, err := g.getExpensiveRules()
+					if err != nil {
+						send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+						return
+					}
+					exempt, _ := g.listExpensiveExempt()
+
+					send(ctx, g, t.EXPENSIVERULES, t.T{"Rules": rules, "Exempt": exempt})
+				}
+			case opts["reactions"].(bool):
+				emoji := strings.Join(g.reactionEmoji(), " ")
+				enabled := !g.Reactions
+				if list := opts["<emoji>"].([]string); len(list) > 0 {
+					// setting the emoji always enables reactions
+					emoji = strings.Join(list, " ")
+					enabled = true
+				}
+
+				log.Info().Stringer("group", &g).Bool("enabled", enabled).Str("emoji", emoji).
+					Msg("toggling reactions")
+				if err := g.setReactions(enabled, emoji); err != nil {
+					send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+					break
 				}
+
+				go u.track("toggle reactions", map[string]interface{}{
+					"group":   groupId,
+					"enabled": enabled,
+				})
+
+				send(ctx, g, t.REACTIONSMSG, t.T{"Enabled": enabled, "Emoji": emoji})
 			case opts["renamable"].(bool):
 				log.Info().Stringer("group", &g).Msg("toggling renamable")
 				msats, err := parseSatoshis(opts)
@@ -731,6 +1099,30 @@ parsed:
 
 				send(ctx, g, t.SPAMMYMSG, t.T{"Spammy": spammy})
 			case opts["coinflips"].(bool):
+				if setting, err := opts.String("<setting>"); err == nil {
+					if setting != "rules" {
+						value, _ := opts.String("<value>")
+						log.Info().Stringer("group", &g).Str("setting", setting).
+							Str("value", value).Msg("setting coinflip rule")
+						if err := g.setCoinflipRule(setting, value); err != nil {
+							send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+							break
+						}
+
+						go u.track("coinflip rule", map[string]interface{}{
+							"group":   groupId,
+							"setting": setting,
+							"value":   value,
+						})
+					}
+
+					send(ctx, g, t.COINFLIPRULESMSG, t.T{
+						"Enabled": g.areCoinflipsEnabled(),
+						"Rules":   g.getCoinflipRules(),
+					})
+					break
+				}
+
 				log.Debug().Stringer("group", &g).Msg("toggling coinflips")
 				enabled, err := g.toggleCoinflips()
 				if err != nil {
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/gorilla/mux"
+	"github.com/juju/ratelimit"
+)
+
+// hidden messages created with --web can also be bought on a public page. each
+// payment gives a secret link that can be opened a limited number of times.
+
+const HIDDENWEBINVOICEEXPIRY = time.Hour
+
+type HiddenWebAccess struct {
+	PaymentHash string       `db:"payment_hash"`
+	HiddenId    string       `db:"hidden_id"`
+	Bolt11      string       `db:"bolt11"`
+	Token       string       `db:"token"`
+	Downloads   int          `db:"downloads"`
+	CreatedAt   time.Time    `db:"created_at"`
+	PaidAt      sql.NullTime `db:"paid_at"`
+}
+
+func (hidden HiddenMessage) WebURL() string {
+	return s.ServiceURL + "/hidden/" + hidden.Id
+}
+
+func (hidden HiddenMessage) contentURL(token string) string {
+	return hidden.WebURL() + "/content/" + token
+}
+
+// grantHiddenWebAccess marks the payment as done, only the first call for each
+// payment returns true.
+func grantHiddenWebAccess(hidden HiddenMessage, hash string) (granted bool, err error) {
+	txn, err := pg.Beginx()
+	if err != nil {
+		return
+	}
+	defer txn.Rollback()
+
+	res, err := txn.Exec(`
+UPDATE hidden_web_access SET paid_at = now()
+WHERE payment_hash = $1 AND hidden_id = $2 AND paid_at IS NULL
+    `, hash, hidden.Id)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	_, err = txn.Exec(`
+UPDATE hidden_message SET reveals = reveals + 1, revenue = revenue + $2
+WHERE id = $1
+    `, hidden.Id, hidden.Satoshis*1000)
+	if err != nil {
+		return
+	}
+
+	return true, txn.Commit()
+}
+
+// each hidden message page can only create so many invoices, independently
+// from the author's own limit.
+var hiddenWebRateLimitBuckets = &sync.Map{}
+
+func getHiddenWebRateLimitBucket(id string) *ratelimit.Bucket {
+	bucket, _ := hiddenWebRateLimitBuckets.LoadOrStore(id,
+		ratelimit.NewBucket(time.Minute, 30))
+	return bucket.(*ratelimit.Bucket)
+}
+
+// getHiddenWebInvoice returns the unpaid invoice this visitor already has, if
+// any, or makes a new one.
+func getHiddenWebInvoice(
+	ctx context.Context,
+	hidden HiddenMessage,
+	r *http.Request,
+) (access HiddenWebAccess, err error) {
+	if cookie, errc := r.Cookie("hidden-" + hidden.Id); errc == nil {
+		err = pg.Get(&access, `
+SELECT * FROM hidden_web_access
+WHERE payment_hash = $1 AND hidden_id = $2 AND paid_at IS NULL
+  AND created_at > now() - make_interval(secs => $3)
+        `, cookie.Value, hidden.Id, HIDDENWEBINVOICEEXPIRY.Seconds())
+		if err == nil {
+			return
+		}
+	}
+
+	if getHiddenWebRateLimitBucket(hidden.Id).TakeAvailable(1) == 0 {
+		return access, errors.New("too many invoices, try again in a minute.")
+	}
+
+	author, err := loadUser(hidden.Author)
+	if err != nil {
+		return
+	}
+
+	expiry := HIDDENWEBINVOICEEXPIRY
+	bolt11, hash, err := author.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true, // limited above
+		Msatoshi:        int64(hidden.Satoshis) * 1000,
+		Description:     fmt.Sprintf("reveal of %s", hidden.Id),
+		Tag:             "webreveal",
+		Expiry:          &expiry,
+	})
+	if err != nil {
+		return
+	}
+
+	token, err := randomHex()
+	if err != nil {
+		return
+	}
+
+	err = pg.Get(&access, `
+INSERT INTO hidden_web_access (payment_hash, hidden_id, bolt11, token)
+VALUES ($1, $2, $3, $4)
+RETURNING *
+    `, hash, hidden.Id, bolt11, token)
+	return
+}
+
+// hiddenWebPaid checks if the payment for this access was received while
+// nobody was waiting for it.
+func hiddenWebPaid(hidden HiddenMessage, hash string) (paid bool) {
+	pg.Get(&paid, `
+SELECT EXISTS (
+  SELECT 1 FROM lightning.transaction
+  WHERE payment_hash = $1 AND to_id = $2 AND tag = 'webreveal'
+)
+    `, hash, hidden.Author)
+	return
+}
+
+// getWebHiddenMessage ignores expiration, so people who have paid can still
+// get the content.
+func getWebHiddenMessage(ctx context.Context, id string) (hidden HiddenMessage, err error) {
+	err = pg.Get(&hidden, `
+SELECT * FROM hidden_message WHERE id = $1 AND web
+    `, id)
+	if err != nil {
+		return
+	}
+
+	hidden.hydrate(ctx)
+	return
+}
+
+func serveHiddenPages() {
+	ctx := context.WithValue(context.Background(), "origin", "external")
+
+	router.Path("/hidden/{id}").Methods("GET").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hidden, err := getHiddenMessage(ctx, mux.Vars(r)["id"])
+		if err != nil || !hidden.Web {
+			http.Error(w, "hidden message not found or expired", 404)
+			return
+		}
+
+		// the invoice is only made when the visitor asks for it, so link
+		// previews and crawlers don't create any
+		if err = tmpl.ExecuteTemplate(w, "hidden", struct {
+			Preview    string
+			Sats       int
+			Downloads  int
+			InvoiceURL string
+		}{
+			hidden.Preview,
+			hidden.Satoshis,
+			hidden.Downloads,
+			hidden.WebURL() + "/invoice",
+		}); err != nil {
+			log.Error().Err(err).Str("id", hidden.Id).Msg("failed to render template")
+		}
+	})
+
+	router.Path("/hidden/{id}/invoice").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hidden, err := getHiddenMessage(ctx, mux.Vars(r)["id"])
+		if err != nil || !hidden.Web {
+			http.Error(w, "hidden message not found or expired", 404)
+			return
+		}
+
+		access, err := getHiddenWebInvoice(ctx, hidden, r)
+		if err != nil {
+			log.Warn().Err(err).Str("id", hidden.Id).Msg("failed to make web reveal invoice")
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		// the same visitor gets the same invoice until it expires
+		http.SetCookie(w, &http.Cookie{
+			Name:     "hidden-" + hidden.Id,
+			Value:    access.PaymentHash,
+			Path:     "/hidden/" + hidden.Id,
+			MaxAge:   int(HIDDENWEBINVOICEEXPIRY.Seconds()),
+			HttpOnly: true,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"invoice": access.Bolt11,
+			"qr":      qrURL(access.Bolt11).String(),
+			"wait":    hidden.WebURL() + "/wait/" + access.PaymentHash,
+		})
+	})
+
+	router.Path("/hidden/{id}/wait/{hash}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hidden, err := getWebHiddenMessage(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "hidden message not found", 404)
+			return
+		}
+
+		var access HiddenWebAccess
+		err = pg.Get(&access, `
+SELECT * FROM hidden_web_access WHERE payment_hash = $1 AND hidden_id = $2
+        `, mux.Vars(r)["hash"], hidden.Id)
+		if err != nil {
+			http.Error(w, "invoice not found", 404)
+			return
+		}
+
+		if !access.PaidAt.Valid && !hiddenWebPaid(hidden, access.PaymentHash) {
+			wait := waitInvoice(access.PaymentHash)
+			select {
+			case <-wait:
+			case <-r.Context().Done():
+				stopWaitingInvoice(access.PaymentHash, wait)
+				return
+			case <-time.After(60 * time.Second):
+				stopWaitingInvoice(access.PaymentHash, wait)
+				http.Error(w, "payment not received yet", 408)
+				return
+			}
+		}
+
+		granted, err := grantHiddenWebAccess(hidden, access.PaymentHash)
+		if err != nil {
+			log.Warn().Err(err).Str("id", hidden.Id).Str("hash", access.PaymentHash).
+				Msg("failed to grant web reveal access")
+			http.Error(w, "failed to register payment", 500)
+			return
+		}
+		if granted {
+			if author, err := loadUser(hidden.Author); err == nil {
+				send(ctx, author, t.HIDDENWEBSOLD, t.T{
+					"Id":   hidden.Id,
+					"Sats": hidden.Satoshis,
+				})
+				go author.track("web reveal", map[string]interface{}{
+					"sats":  hidden.Satoshis,
+					"media": hidden.MediaType,
+				})
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"url": hidden.contentURL(access.Token),
+		})
+	})
+
+	router.Path("/hidden/{id}/content/{token}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hidden, err := getWebHiddenMessage(ctx, mux.Vars(r)["id"])
+		if err != nil {
+			http.Error(w, "hidden message not found", 404)
+			return
+		}
+
+		var downloads int
+		err = pg.Get(&downloads, `
+UPDATE hidden_web_access SET downloads = downloads + 1
+WHERE token = $1 AND hidden_id = $2 AND paid_at IS NOT NULL AND downloads < $3
+RETURNING downloads
+        `, mux.Vars(r)["token"], hidden.Id, hidden.Downloads)
+		if err == sql.ErrNoRows {
+			http.Error(w, "this link has expired or was used too many times", 410)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		if hidden.File == nil {
+			if err = tmpl.ExecuteTemplate(w, "hiddencontent", struct {
+				Preview   string
+				Content   string
+				Remaining int
+			}{
+				hidden.Preview,
+				hidden.Content,
+				hidden.Downloads - downloads,
+			}); err != nil {
+				log.Error().Err(err).Str("id", hidden.Id).Msg("failed to render template")
+			}
+			return
+		}
+
+		// stream the file from telegram, the direct url has our token in it
+		fileurl, err := bot.GetFileDirectURL(hidden.File.FileID)
+		if err != nil {
+			http.Error(w, "failed to get file", 502)
+			return
+		}
+		resp, err := http.Get(fileurl)
+		if err != nil {
+			http.Error(w, "failed to download file", 502)
+			return
+		}
+		defer resp.Body.Close()
+
+		ext := path.Ext(fileurl)
+		mimeType := mime.TypeByExtension(ext)
+		if mimeType == "" {
+			mimeType = resp.Header.Get("Content-Type")
+		}
+		w.Header().Set("Content-Type", mimeType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(
+			"attachment; filename=\"%s%s\"", hidden.Id, ext))
+		io.Copy(w, resp.Body)
+	})
+}
@@ -8,75 +8,244 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"time"
 
+	"github.com/docopt/docopt-go"
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/lucsky/cuid"
 )
 
 const (
-	COINFLIP_TAX = 9999
+	COINFLIP_TAX           = 9999
+	MAXHIDDENDAYS          = 365
+	DEFAULTHIDDENDOWNLOADS = 3
 )
 
 // hide and reveal
 type HiddenMessage struct {
-	Preview     string               `json:"preview"`
-	Content     string               `json:"content"`
-	CopyMessage *TelegramCopyMessage `json:"copyMessage"`
-	Times       int                  `json:"times"`
-	Crowdfund   int                  `json:"crowdfund"`
-	Public      bool                 `json:"public"`
-	Satoshis    int                  `json:"satoshis"`
+	Id        string    `db:"id"`
+	Author    int       `db:"author"`
+	Preview   string    `db:"preview"`
+	Content   string    `db:"content"`
+	Times     int       `db:"times"`
+	Crowdfund int       `db:"crowdfund"`
+	Public    bool      `db:"public"`
+	Satoshis  int       `db:"satoshis"`
+	Reveals   int       `db:"reveals"`
+	Revenue   int64     `db:"revenue"` // msats
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+	Withdrawn bool      `db:"withdrawn"`
+	Web       bool      `db:"web"`
+	Downloads int       `db:"downloads"` // per web payment
+
+	// the hidden thing can also be a message we copy or a file we send again
+	CopyChat      sql.NullInt64 `db:"copy_chat"`
+	CopyMessageId sql.NullInt64 `db:"copy_message"`
+	MediaType     string        `db:"media_type"`
+	MediaFile     string        `db:"media_file"`
+
+	CopyMessage *TelegramCopyMessage `db:"-"`
+	File        *TelegramFile        `db:"-"`
 }
 
-func getHiddenId(message *tgbotapi.Message) string {
-	return hashString("%d%d", message.MessageID, message.Chat.ID)[:7]
+func (hidden HiddenMessage) Expired() bool { return hidden.ExpiresAt.Before(time.Now()) }
+
+// HasAttachment tells if this is revealed by something other than its text.
+func (hidden HiddenMessage) HasAttachment() bool {
+	return hidden.CopyMessage != nil || hidden.File != nil
+}
+
+func (hidden *HiddenMessage) hydrate(ctx context.Context) {
+	if hidden.CopyChat.Valid && hidden.CopyMessageId.Valid {
+		hidden.CopyMessage = &TelegramCopyMessage{
+			ChatID:    hidden.CopyChat.Int64,
+			MessageID: int(hidden.CopyMessageId.Int64),
+		}
+	}
+	if hidden.MediaFile != "" {
+		hidden.File = &TelegramFile{Type: hidden.MediaType, FileID: hidden.MediaFile}
+	}
+	if hidden.Preview == "" {
+		hidden.Preview = translateTemplate(ctx, t.HIDDENDEFAULTPREVIEW,
+			t.T{"Sats": hidden.Satoshis})
+	}
+}
+
+// getHiddenId is deterministic so hiding again from the same message replaces
+// it. the author is part of it so nobody can end up with someone else's id.
+func getHiddenId(author int, message *tgbotapi.Message) string {
+	return hashString("%d:%d:%d", author, message.Chat.ID, message.MessageID)[:16]
+}
+
+// hiddenMediaFromMessage gets the photo, document or voice note of a message,
+// these can be sent again anywhere, unlike copied messages.
+func hiddenMediaFromMessage(message *tgbotapi.Message) *TelegramFile {
+	switch {
+	case message.Photo != nil && len(*message.Photo) > 0:
+		photos := *message.Photo
+		return &TelegramFile{Type: "photo", FileID: photos[len(photos)-1].FileID}
+	case message.Document != nil:
+		return &TelegramFile{Type: "document", FileID: message.Document.FileID}
+	case message.Voice != nil:
+		return &TelegramFile{Type: "voice", FileID: message.Voice.FileID}
+	}
+	return nil
+}
+
+func saveHiddenMessage(hidden HiddenMessage) (err error) {
+	var copyChat, copyMessageId sql.NullInt64
+	if hidden.CopyMessage != nil {
+		copyChat = sql.NullInt64{Int64: hidden.CopyMessage.ChatID, Valid: true}
+		copyMessageId = sql.NullInt64{Int64: int64(hidden.CopyMessage.MessageID), Valid: true}
+	}
+	var mediaType, mediaFile string
+	if hidden.File != nil {
+		mediaType = hidden.File.Type
+		mediaFile = hidden.File.FileID
+	}
+
+	// the id is deterministic, so hiding again the same thing replaces it
+	res, err := pg.Exec(`
+INSERT INTO hidden_message
+  (id, author, preview, content, copy_chat, copy_message, media_type, media_file,
+   times, crowdfund, public, satoshis, expires_at, web, downloads)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+ON CONFLICT (id) DO UPDATE SET
+  preview = $3, content = $4, copy_chat = $5, copy_message = $6,
+  media_type = $7, media_file = $8, times = $9, crowdfund = $10,
+  public = $11, satoshis = $12, expires_at = $13, withdrawn = false,
+  web = $14, downloads = $15
+WHERE hidden_message.author = $2
+    `, hidden.Id, hidden.Author, hidden.Preview, hidden.Content,
+		copyChat, copyMessageId, mediaType, mediaFile,
+		hidden.Times, hidden.Crowdfund, hidden.Public, hidden.Satoshis,
+		hidden.ExpiresAt, hidden.Web, hidden.Downloads)
+	if err != nil {
+		return err
+	}
+
+	// the id belongs to someone else (only possible with the old short ids)
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("hidden message id already taken.")
+	}
+	return nil
 }
 
-func findHiddenKey(hiddenId string) (key string, ok bool) {
-	found := rds.Keys("hidden:*:" + hiddenId).Val()
-	if len(found) == 0 {
-		return "", false
+// getHiddenMessage only returns messages that can still be revealed.
+func getHiddenMessage(ctx context.Context, id string) (hidden HiddenMessage, err error) {
+	err = pg.Get(&hidden, `
+SELECT * FROM hidden_message
+WHERE id = $1 AND NOT withdrawn AND expires_at > now()
+    `, id)
+	if err != nil {
+		return
 	}
 
-	return found[0], true
+	hidden.hydrate(ctx)
+	return
 }
 
-func getHiddenMessage(
+// listHiddenMessages returns the messages of the author whose ids start with
+// prefix, which can be empty.
+func listHiddenMessages(
 	ctx context.Context,
-	redisKey string,
-) (sourceuser int, id string, hiddenmessage HiddenMessage, err error) {
-	data, err := rds.Get(redisKey).Bytes()
+	author int,
+	prefix string,
+	onlyActive bool,
+	limit, offset int,
+) (hiddens []HiddenMessage, err error) {
+	err = pg.Select(&hiddens, `
+SELECT * FROM hidden_message
+WHERE author = $1 AND (NOT $2 OR (NOT withdrawn AND expires_at > now()))
+  AND left(id, length($5)) = $5
+ORDER BY created_at DESC
+LIMIT $3 OFFSET $4
+    `, author, onlyActive, limit, offset, prefix)
 	if err != nil {
 		return
 	}
 
-	err = json.Unmarshal(data, &hiddenmessage)
+	for i := range hiddens {
+		hiddens[i].hydrate(ctx)
+	}
+	return
+}
+
+func withdrawHiddenMessage(author int, id string) (withdrawn bool, err error) {
+	res, err := pg.Exec(`
+UPDATE hidden_message SET withdrawn = true
+WHERE id = $1 AND author = $2 AND NOT withdrawn
+    `, id, author)
 	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func handleHiddenList(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+
+	if opts["cancel"].(bool) {
+		hiddenId := opts["<hidden_message_id>"].(string)
+		withdrawn, err := withdrawHiddenMessage(u.Id, hiddenId)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		if !withdrawn {
+			send(ctx, u, t.HIDDENMSGNOTFOUND)
+			return
+		}
+
+		send(ctx, u, t.HIDDENCANCELED, t.T{"Id": hiddenId})
+		go u.track("hidden withdrawn", nil)
 		return
 	}
 
-	keyparts := strings.Split(redisKey, ":")
-	id = keyparts[2]
-	sourceuser, err = strconv.Atoi(keyparts[1])
+	hiddens, err := listHiddenMessages(ctx, u.Id, "", false, 30, 0)
 	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
 
-	if hiddenmessage.Preview == "" {
-		hiddenmessage.Preview = translateTemplate(ctx, t.HIDDENDEFAULTPREVIEW,
-			t.T{"Sats": hiddenmessage.Satoshis})
+	send(ctx, u, t.HIDDENLIST, t.T{"Messages": hiddens})
+	go u.track("hidden list", nil)
+}
+
+// addHiddenRevealer registers a payer and returns everybody who has paid for
+// this message so far. ok is false if they had already paid.
+func addHiddenRevealer(hiddenId string, account int) (revealers []int, ok bool, err error) {
+	res, err := pg.Exec(`
+INSERT INTO hidden_revealer (hidden_id, account) VALUES ($1, $2)
+ON CONFLICT DO NOTHING
+    `, hiddenId, account)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, false, nil
 	}
 
-	return
+	err = pg.Select(&revealers, `
+SELECT account FROM hidden_revealer
+WHERE hidden_id = $1
+ORDER BY time
+    `, hiddenId)
+	return revealers, true, err
+}
+
+func removeHiddenRevealer(hiddenId string, account int) {
+	pg.Exec(`
+DELETE FROM hidden_revealer WHERE hidden_id = $1 AND account = $2
+    `, hiddenId, account)
 }
 
 func revealKeyboard(
 	ctx context.Context,
-	fullRedisKey string,
 	hiddenmessage HiddenMessage,
 	havepaid int,
 ) *tgbotapi.InlineKeyboardMarkup {
@@ -91,7 +260,7 @@ func revealKeyboard(
 						"Times":     hiddenmessage.Times,
 						"HavePaid":  havepaid,
 					})),
-					fmt.Sprintf("reveal=%s", fullRedisKey),
+					fmt.Sprintf("reveal=%s", hiddenmessage.Id),
 				),
 			},
 		},
@@ -111,6 +280,8 @@ func settleReveal(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "reveal", append([]int{toId}, fromIds...)...)
+
 	receiver, _ = loadUser(toId)
 	giverNames := make([]string, 0, len(fromIds))
 
@@ -123,6 +294,7 @@ func settleReveal(
 	receiverHash := hashString(random) // for the proxied transaction
 
 	desc := fmt.Sprintf("reveal of %s", hiddenId)
+	events := make([]PaymentEvent, 0, len(fromIds)+1)
 
 	for _, fromId := range fromIds {
 		if fromId == toId {
@@ -130,13 +302,17 @@ func settleReveal(
 		}
 
 		// A->proxy->B (for many A, one B)
-		_, err = txn.Exec(`
+		var giverHash string
+		err = txn.Get(&giverHash, `
 INSERT INTO lightning.transaction (from_id, to_id, amount, tag, description)
 VALUES ($1, $2, $3, 'reveal', $4)
+RETURNING payment_hash
     `, fromId, s.ProxyAccount, msats, desc)
 		if err != nil {
 			return
 		}
+		events = append(events,
+			appPaymentEvent("out", toId, int64(msats), giverHash, "reveal", desc).forAccount(fromId))
 		_, err = txn.Exec(`
 INSERT INTO lightning.transaction AS t
     (payment_hash, from_id, to_id, amount, tag, description)
@@ -169,11 +345,39 @@ ON CONFLICT (payment_hash) DO UPDATE SET amount = t.amount + $4
 		})
 	}
 
+	// keep track of what each hidden message has earned for /hidden
+	_, err = txn.Exec(`
+UPDATE hidden_message SET reveals = reveals + $2, revenue = revenue + $3
+WHERE id = $1
+    `, hiddenId, len(giverNames), msats*len(giverNames))
+	if err != nil {
+		return
+	}
+
+	events = append(events, appPaymentEvent("in", 0,
+		int64(msats*len(events)), receiverHash, "reveal", desc).forAccount(toId))
+	err = saveAccountEvents(txn, events...)
+	if err != nil {
+		return
+	}
+
+	err = audit.save(txn, receiverHash, map[string]interface{}{
+		"hidden":   hiddenId,
+		"msatoshi": msats,
+	})
+	if err != nil {
+		return
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return
 	}
 
+	for _, event := range events {
+		go publishPaymentEvent(event)
+	}
+
 	send(ctx, receiver, t.HIDDENSOURCEMSG, t.T{
 		"Sats":      sats * len(fromIds),
 		"Revealers": strings.Join(giverNames, " "),
@@ -286,26 +490,37 @@ func giveflipKeyboard(
 func coinflipKeyboard(
 	ctx context.Context,
 	coinflipid string,
-	initiatorId int,
+	commitment string,
 	nparticipants,
 	sats int,
 ) *tgbotapi.InlineKeyboardMarkup {
-	if coinflipid == "" {
-		coinflipid = cuid.Slug()
-	}
-
-	if initiatorId != 0 {
-		rds.SAdd("coinflip:"+coinflipid, initiatorId)
+	return &tgbotapi.InlineKeyboardMarkup{
+		[][]tgbotapi.InlineKeyboardButton{
+			{
+				tgbotapi.NewInlineKeyboardButtonData(
+					translate(ctx, t.COINFLIPJOIN),
+					fmt.Sprintf("flip=%d-%d-%s-%s",
+						nparticipants, sats, coinflipid, shortCommitment(commitment)),
+				),
+			},
+		},
 	}
+}
 
-	rds.Expire("coinflip:"+coinflipid, s.GiveAwayTimeout)
-
+// inlineCoinflipKeyboard is the button of a coinflip posted from an inline
+// query, which doesn't exist yet. the first press creates it.
+func inlineCoinflipKeyboard(
+	ctx context.Context,
+	initiatorId int,
+	nparticipants,
+	sats int,
+) *tgbotapi.InlineKeyboardMarkup {
 	return &tgbotapi.InlineKeyboardMarkup{
-		[][]tgbotapi.InlineKeyboardButton{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
 			{
 				tgbotapi.NewInlineKeyboardButtonData(
 					translate(ctx, t.COINFLIPJOIN),
-					fmt.Sprintf("flip=%d-%d-%s", nparticipants, sats, coinflipid),
+					fmt.Sprintf("flip=%d-%d-new-%d", nparticipants, sats, initiatorId),
 				),
 			},
 		},
@@ -324,10 +539,29 @@ func settleCoinflip(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "coinflip", append([]int{toId}, fromIds...)...)
+
 	receiver, _ = loadUser(toId)
 	giverNames := make([]string, 0, len(fromIds))
 
 	msats := int64(sats) * 1000
+	chatId := transactionChatId(ctx)
+
+	// group house rules
+	rules := coinflipRulesFromContext(ctx)
+	tax := rules.tax(msats)
+	var taxDestination *User
+	if tax > 0 {
+		g := ctx.Value("group").(GroupChat)
+		taxDestination, err = g.getGroupDestination(rules.TaxTo)
+		if err != nil {
+			log.Warn().Err(err).Stringer("group", &g).Str("to", rules.TaxTo).
+				Msg("failed to get coinflip tax destination, not taxing")
+			tax = 0
+		} else {
+			audit.include(txn, taxDestination.Id)
+		}
+	}
 
 	// receiver must also have the necessary sats in his balance at the time
 	receiverBalance := getBalance(txn, toId)
@@ -341,21 +575,27 @@ func settleCoinflip(
 		return
 	}
 	receiverHash := hashString(random) // for the proxied transaction
+	taxHash := hashString("tax:" + random)
 
 	// then we create a transfer from each of the other participants
+	events := make([]PaymentEvent, 0, len(fromIds)+1)
 	for _, fromId := range fromIds {
 		if fromId == toId {
 			continue
 		}
 
 		// A->proxy->B (for many A, one B)
-		_, err = txn.Exec(`
-INSERT INTO lightning.transaction (from_id, to_id, amount, fees, tag)
-VALUES ($1, $2, $3, $4, 'coinflip')
-    `, fromId, s.ProxyAccount, msats, COINFLIP_TAX)
+		var giverHash string
+		err = txn.Get(&giverHash, `
+INSERT INTO lightning.transaction (from_id, to_id, amount, fees, tag, chat_id)
+VALUES ($1, $2, $3, $4, 'coinflip', $5)
+RETURNING payment_hash
+    `, fromId, s.ProxyAccount, msats, COINFLIP_TAX, chatId)
 		if err != nil {
 			return
 		}
+		events = append(events,
+			appPaymentEvent("out", toId, msats, giverHash, "coinflip", "").forAccount(fromId))
 
 		// check sender balance
 		if balance := getBalance(txn, fromId); balance < 0 {
@@ -364,14 +604,25 @@ VALUES ($1, $2, $3, $4, 'coinflip')
 		}
 
 		_, err = txn.Exec(`
-INSERT INTO lightning.transaction AS t (payment_hash, from_id, to_id, amount, tag)
-VALUES ($1, $2, $3, $4, 'coinflip')
+INSERT INTO lightning.transaction AS t (payment_hash, from_id, to_id, amount, tag, chat_id)
+VALUES ($1, $2, $3, $4, 'coinflip', $5)
 ON CONFLICT (payment_hash) DO UPDATE SET amount = t.amount + $4
-    `, receiverHash, s.ProxyAccount, toId, msats)
+    `, receiverHash, s.ProxyAccount, toId, msats-tax, chatId)
 		if err != nil {
 			return
 		}
 
+		if tax > 0 {
+			_, err = txn.Exec(`
+INSERT INTO lightning.transaction AS t (payment_hash, from_id, to_id, amount, description, tag, chat_id)
+VALUES ($1, $2, $3, $4, 'Coinflip tax.', 'coinflip', $5)
+ON CONFLICT (payment_hash) DO UPDATE SET amount = t.amount + $4
+        `, taxHash, s.ProxyAccount, taxDestination.Id, tax, chatId)
+			if err != nil {
+				return
+			}
+		}
+
 		// check proxy balance (should be always zero)
 		if errW := checkProxyBalance(txn); err != nil {
 			err = errW
@@ -388,13 +639,33 @@ ON CONFLICT (payment_hash) DO UPDATE SET amount = t.amount + $4
 		})
 	}
 
+	events = append(events, appPaymentEvent("in", 0,
+		(msats-tax)*int64(len(events)), receiverHash, "coinflip", "").forAccount(toId))
+	err = saveAccountEvents(txn, events...)
+	if err != nil {
+		return
+	}
+
+	err = audit.save(txn, receiverHash, map[string]interface{}{
+		"msatoshi": msats,
+		"fee":      COINFLIP_TAX,
+		"tax":      tax,
+	})
+	if err != nil {
+		return
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return
 	}
 
+	for _, event := range events {
+		go publishPaymentEvent(event)
+	}
+
 	send(ctx, receiver, t.COINFLIPWINNERMSG, t.T{
-		"TotalSats": sats * len(fromIds),
+		"TotalSats": float64(msats*int64(len(fromIds))-tax*int64(len(fromIds)-1)) / 1000,
 		"Senders":   strings.Join(giverNames, " "),
 	})
 
@@ -444,6 +715,8 @@ func settleFundraise(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "fundraise", append([]int{toId}, fromIds...)...)
+
 	receiver, _ = loadUser(toId)
 	giverNames := make([]string, 0, len(fromIds))
 
@@ -454,6 +727,7 @@ func settleFundraise(
 		return
 	}
 	receiverHash := hashString(random) // for the proxied transaction
+	events := make([]PaymentEvent, 0, len(fromIds)+1)
 
 	for _, fromId := range fromIds {
 		if fromId == toId {
@@ -461,13 +735,17 @@ func settleFundraise(
 		}
 
 		// A->proxy->B (for many A, one B)
-		_, err = txn.Exec(`
+		var giverHash string
+		err = txn.Get(&giverHash, `
 INSERT INTO lightning.transaction (from_id, to_id, amount, tag)
 VALUES ($1, $2, $3, 'fundraise')
+RETURNING payment_hash
     `, fromId, s.ProxyAccount, msats)
 		if err != nil {
 			return
 		}
+		events = append(events,
+			appPaymentEvent("out", toId, int64(msats), giverHash, "fundraise", "").forAccount(fromId))
 
 		_, err = txn.Exec(`
 INSERT INTO lightning.transaction AS t (payment_hash, from_id, to_id, amount, tag)
@@ -500,11 +778,29 @@ ON CONFLICT (payment_hash) DO UPDATE SET amount = t.amount + $4
 		})
 	}
 
+	events = append(events, appPaymentEvent("in", 0,
+		int64(msats*len(events)), receiverHash, "fundraise", "").forAccount(toId))
+	err = saveAccountEvents(txn, events...)
+	if err != nil {
+		return
+	}
+
+	err = audit.save(txn, receiverHash, map[string]interface{}{
+		"msatoshi": msats,
+	})
+	if err != nil {
+		return
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return
 	}
 
+	for _, event := range events {
+		go publishPaymentEvent(event)
+	}
+
 	send(ctx, receiver, t.FUNDRAISERECEIVERMSG, t.T{
 		"TotalSats": sats * len(fromIds),
 		"Senders":   strings.Join(giverNames, " "),
@@ -6,7 +6,6 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
-	"strconv"
 	"time"
 
 	"github.com/docopt/docopt-go"
@@ -14,7 +13,6 @@ import (
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	cmap "github.com/orcaman/concurrent-map"
-	"gopkg.in/antage/eventsource.v1"
 )
 
 type InvoiceData struct {
@@ -77,6 +75,27 @@ func waitInvoice(hash string) (inv <-chan InvoiceData) {
 	return wait
 }
 
+// stopWaitingInvoice must be called by whoever gives up on a channel from
+// waitInvoice before the invoice is paid, otherwise it stays here forever.
+func stopWaitingInvoice(hash string, wait <-chan InvoiceData) {
+	waitingInvoices.Upsert(hash, nil,
+		func(exists bool, arr interface{}, _ interface{}) interface{} {
+			var remaining []interface{}
+			if exists {
+				for _, ch := range arr.([]interface{}) {
+					if (<-chan InvoiceData)(ch.(chan InvoiceData)) != wait {
+						remaining = append(remaining, ch)
+					}
+				}
+			}
+			return remaining
+		},
+	)
+	waitingInvoices.RemoveCb(hash, func(_ string, arr interface{}, exists bool) bool {
+		return exists && len(arr.([]interface{})) == 0
+	})
+}
+
 func resolveWaitingInvoice(hash string, inv InvoiceData) {
 	if chans, ok := waitingInvoices.Get(hash); ok {
 		for _, ch := range chans.([]interface{}) {
@@ -131,8 +150,6 @@ func handleInvoice(ctx context.Context, opts docopt.Opts, desc string) {
 }
 
 // what happens when a payment is received
-var userPaymentStream = cmap.New() // make(map[int]eventsource.EventSource)
-
 func paymentReceived(
 	ctx context.Context,
 	hash string,
@@ -152,13 +169,44 @@ func paymentReceived(
 		return
 	}
 
-	_, err = pg.Exec(`
+	txn, err := pg.Beginx()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to start transaction on paymentReceived")
+		send(ctx, user, t.FAILEDTOSAVERECEIVED, t.T{"Hash": hash}, data.MessageId)
+		return
+	}
+	defer txn.Rollback()
+
+	audit := startAudit(ctx, txn, "payment_received", user.Id)
+	event := PaymentEvent{
+		Event:       "received",
+		PaymentHash: hash,
+		Msatoshi:    amount,
+		Preimage:    data.Preimage,
+		Description: data.Description,
+		Comment:     data.Extra.Comment,
+		Tag:         data.Tag,
+	}.forAccount(user.Id)
+
+	_, err = txn.Exec(`
 INSERT INTO lightning.transaction
   (to_id, amount, description, payment_hash, preimage, tag)
 VALUES ($1, $2, $3, $4, $5, $6)
 ON CONFLICT (payment_hash) DO UPDATE SET to_id = $1
     `, user.Id, amount, data.Description, hash,
 		data.Preimage, sql.NullString{String: data.Tag, Valid: data.Tag != ""})
+	if err == nil {
+		err = saveAccountEvents(txn, event)
+	}
+	if err == nil {
+		err = audit.save(txn, hash, map[string]interface{}{
+			"msatoshi": amount,
+			"tag":      data.Tag,
+		})
+	}
+	if err == nil {
+		err = txn.Commit()
+	}
 	if err != nil {
 		log.Error().Err(err).
 			Stringer("user", user).Str("hash", hash).
@@ -168,19 +216,12 @@ ON CONFLICT (payment_hash) DO UPDATE SET to_id = $1
 	}
 
 	go resolveWaitingInvoice(hash, data)
+	go publishPaymentEvent(event)
 
 	user.track("got payment", map[string]interface{}{
 		"sats": amount / 1000,
 	})
 
-	// send to user stream if the user is listening
-	if ies, ok := userPaymentStream.Get(strconv.Itoa(user.Id)); ok {
-		go ies.(eventsource.EventSource).SendEventMessage(
-			`{"payment_hash": "`+hash+`", "msatoshi": `+
-				strconv.FormatInt(data.Msatoshi, 10)+`}`,
-			"payment-received", "")
-	}
-
 	tmplParams := t.T{
 		"Sats": data.Msatoshi / 1000,
 		"Hash": hash[:5],
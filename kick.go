@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// tickets, fines and membership renewals are charges that must be paid until a
+// deadline. they're stored in the group_charge table and go from 'pending' to
+// 'paid', 'expired' or 'cancelled' exactly once, so whoever manages to make
+// that transition is the one that gets to act on it.
+
+// pending_joins mirrors the pending tickets and deposits so we don't have to
+// query the database on every group message. it's filled by startKicking and
+// kept up to date by the functions below, which are the only ones that change
+// the status of a charge.
+var pending_joins = cmap.New()
+
+func pendingJoinKey(groupId int64, telegramId int) string {
+	return fmt.Sprintf("%d:%d", groupId, telegramId)
+}
+
+func isJoinCharge(kind string) bool {
+	return kind == "ticket" || kind == "deposit"
+}
+
+func savePendingCharge(key string, kickdata *KickData) error {
+	if kickdata.Deadline.IsZero() {
+		kickdata.Deadline = time.Now().Add(15 * time.Minute)
+	}
+
+	data, err := json.Marshal(kickdata)
+	if err != nil {
+		return err
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO group_charge (key, kind, group_id, telegram_id, deadline, data)
+VALUES ($1, $2, $3, $4, $5, $6)
+ON CONFLICT (key) DO UPDATE SET
+  status = 'pending',
+  deadline = $5,
+  data = $6,
+  created_at = now(),
+  resolved_at = NULL
+    `, key, kickdata.Kind, kickdata.ChatMemberConfig.ChatID,
+		kickdata.ChatMemberConfig.UserID, kickdata.Deadline, types.JSONText(data))
+	if err == nil && isJoinCharge(kickdata.Kind) {
+		pending_joins.Set(pendingJoinKey(kickdata.ChatMemberConfig.ChatID,
+			kickdata.ChatMemberConfig.UserID), key)
+	}
+	return err
+}
+
+func loadPendingCharge(key string) (kickdata KickData, err error) {
+	var data types.JSONText
+	err = pg.Get(&data, `
+SELECT data FROM group_charge WHERE key = $1 AND status = 'pending'
+    `, key)
+	if err != nil {
+		return
+	}
+	err = data.Unmarshal(&kickdata)
+	return
+}
+
+// resolveCharge moves a pending charge to its final status. it returns false if
+// the charge wasn't pending anymore.
+func resolveCharge(key string, status string) bool {
+	var charge struct {
+		Kind       string `db:"kind"`
+		GroupId    int64  `db:"group_id"`
+		TelegramId int    `db:"telegram_id"`
+	}
+	err := pg.Get(&charge, `
+UPDATE group_charge SET status = $2, resolved_at = now()
+WHERE key = $1 AND status = 'pending'
+RETURNING kind, group_id, telegram_id
+    `, key, status)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Warn().Err(err).Str("key", key).Str("status", status).
+			Msg("failed to resolve charge")
+		return false
+	}
+
+	if isJoinCharge(charge.Kind) {
+		pending_joins.Remove(pendingJoinKey(charge.GroupId, charge.TelegramId))
+	}
+	return true
+}
+
+// reopenCharge puts back a charge that was marked as paid but the payment
+// failed. the waiter may have given up in the meantime, so a new one is
+// started, which expires the charge right away if the deadline has passed.
+func reopenCharge(key string, kickdata KickData) {
+	res, err := pg.Exec(`
+UPDATE group_charge SET status = 'pending', resolved_at = NULL
+WHERE key = $1 AND status = 'paid'
+    `, key)
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("failed to reopen charge")
+		return
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return
+	}
+
+	if isJoinCharge(kickdata.Kind) {
+		pending_joins.Set(pendingJoinKey(kickdata.ChatMemberConfig.ChatID,
+			kickdata.ChatMemberConfig.UserID), key)
+	}
+
+	// the charge can only be resolved once, so it doesn't matter if the
+	// previous waiter is still there
+	ctx := context.WithValue(context.Background(), "origin", "background")
+	go waitToKick(ctx, key, kickdata)
+}
+
+// isPendingJoin tells if the user has joined the group and hasn't paid the
+// ticket or the deposit yet, in which case they can't speak.
+func isPendingJoin(groupId int64, telegramId int) bool {
+	return pending_joins.Has(pendingJoinKey(groupId, telegramId))
+}
+
+// cancelPendingJoin is called when someone leaves the group before paying.
+func cancelPendingJoin(groupId int64, telegramId int) {
+	var charges []struct {
+		Key  string         `db:"key"`
+		Data types.JSONText `db:"data"`
+	}
+	err := pg.Select(&charges, `
+UPDATE group_charge SET status = 'cancelled', resolved_at = now()
+WHERE group_id = $1 AND telegram_id = $2 AND kind IN ('ticket', 'deposit') AND status = 'pending'
+RETURNING key, data
+    `, groupId, telegramId)
+	if err != nil {
+		log.Warn().Err(err).Int64("group", groupId).Int("user", telegramId).
+			Msg("failed to cancel pending join")
+		return
+	}
+
+	pending_joins.Remove(pendingJoinKey(groupId, telegramId))
+
+	for _, charge := range charges {
+		log.Debug().Str("join-key", charge.Key).Msg("ticket cancelled")
+
+		// stop the waiter
+		dispatchGeneric(charge.Key, nil)
+
+		var kickdata KickData
+		if err := charge.Data.Unmarshal(&kickdata); err == nil {
+			if kickdata.InvoiceMessage != nil {
+				deleteMessage(kickdata.InvoiceMessage)
+			}
+			if kickdata.NotifyMessage != nil {
+				deleteMessage(kickdata.NotifyMessage)
+			}
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -55,7 +56,7 @@ func handleCreateLNURLWithdraw(ctx context.Context, opts docopt.Opts) (enc strin
 }
 
 func serveLNURL() {
-	ctx := context.WithValue(context.Background(), "origin", "external")
+	ctx := context.WithValue(context.Background(), "origin", "lnurl")
 
 	router.Path("/lnurl/withdraw").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Debug().Str("url", r.URL.String()).Msg("lnurl-withdraw first request")
@@ -91,6 +92,11 @@ func serveLNURL() {
 			return
 		}
 
+		if isBanned(u.Id, BANSEND) {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(ErrBanned.Error()))
+			return
+		}
+
 		json.NewEncoder(w).Encode(lnurl.LNURLWithdrawResponse{
 			Callback:        fmt.Sprintf("%s/lnurl/withdraw/invoice", s.ServiceURL),
 			K1:              challenge,
@@ -104,7 +110,7 @@ func serveLNURL() {
 	})
 
 	router.Path("/lnurl/withdraw/invoice").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.WithValue(context.Background(), "origin", "external")
+		ctx := context.WithValue(context.Background(), "origin", "lnurl")
 
 		qs := r.URL.Query()
 		challenge := qs.Get("k1")
@@ -135,6 +141,11 @@ func serveLNURL() {
 			return
 		}
 
+		if isBanned(payer.Id, BANSEND) {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(ErrBanned.Error()))
+			return
+		}
+
 		log.Debug().
 			Str("url", r.URL.String()).
 			Stringer("user", payer).
@@ -204,7 +215,7 @@ func serveLNURL() {
 	})
 
 	router.Path("/.well-known/lnurlp/{username}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.WithValue(context.Background(), "origin", "external")
+		ctx := context.WithValue(context.Background(), "origin", "lnurl")
 		username := mux.Vars(r)["username"]
 		qs := r.URL.Query()
 
@@ -280,15 +291,11 @@ func lnurlPayUserParams(
 
 	if id, errx := strconv.Atoi(username); errx == nil {
 		// case in which `username` is actually a number
-
-		// check for user banned beforehand, we save one database call
-		if _, ok := s.Banned[id]; ok {
-			// banned, stop here
-			err = fmt.Errorf("%d is banned, cannot fetch lnurl-pay params", id)
-			return
-		}
-
 		receiver, err = loadUser(id)
+		if err == sql.ErrNoRows {
+			// codes of accounts merged into others still work
+			receiver, _, err = loadMergedUser(id)
+		}
 	} else {
 		// case in which username is a real username
 		receiver, err = loadTelegramUsername(username)
@@ -298,7 +305,12 @@ func lnurlPayUserParams(
 		return
 	}
 
-	if _, ok := s.Banned[receiver.Id]; ok {
+	if isAccountDeleted(receiver.Id) {
+		err = fmt.Errorf("%d was deleted, cannot fetch lnurl-pay params", receiver.Id)
+		return
+	}
+
+	if isBanned(receiver.Id, BANALL) {
 		// banned, stop here
 		err = fmt.Errorf("%d is banned, cannot fetch lnurl-pay params", receiver.Id)
 		return
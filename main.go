@@ -22,7 +22,6 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/kelseyhightower/envconfig"
 	_ "github.com/lib/pq"
-	"github.com/msingleton/amplitude-go"
 	cmap "github.com/orcaman/concurrent-map"
 	"github.com/rs/cors"
 	"github.com/rs/zerolog"
@@ -43,10 +42,16 @@ type Settings struct {
 	ClicheDataDir    string   `envconfig:"CLICHE_DATADIR" required:"true"`
 
 	// account in the database named '@'
-	ProxyAccount int `envconfig:"PROXY_ACCOUNT" required:"true"`
-	AdminAccount int `envconfig:"ADMIN_ACCOUNT"`
+	ProxyAccount int   `envconfig:"PROXY_ACCOUNT" required:"true"`
+	AdminAccount int   `envconfig:"ADMIN_ACCOUNT"`
+	CoAdmins     []int `envconfig:"CO_ADMINS"` // can use /admin, but not /cliche
 
-	AmplitudeKey string `envconfig:"AMPLITUDE_KEY"`
+	AmplitudeKey  string `envconfig:"AMPLITUDE_KEY"`
+	AnalyticsSink string `envconfig:"ANALYTICS_SINK"` // comma-separated: amplitude, postgres, stdout or none
+	MetricsToken  string `envconfig:"METRICS_TOKEN"`  // /metrics is only served when this is set, as a bearer token
+
+	// the admin is alerted when node funds cover less than this share of user balances
+	SolvencyAlertRatio float64 `envconfig:"SOLVENCY_ALERT_RATIO" default:"1"`
 
 	InvoiceTimeout       time.Duration `envconfig:"INVOICE_TIMEOUT" default:"480h"`
 	PayConfirmTimeout    time.Duration `envconfig:"PAY_CONFIRM_TIMEOUT" default:"10m"`
@@ -60,6 +65,10 @@ type Settings struct {
 	GiveawayDailyQuota int `envconfig:"GIVEAWAY_DAILY_QUOTA" default:"5"`
 	GiveawayAvgDays    int `envconfig:"GIVEAWAY_AVG_DAYS" default:"7"`
 
+	Sats4AdsBroadcastRate int `envconfig:"SATS4ADS_BROADCAST_RATE" default:"10"` // ads sent per second
+
+	// deprecated, use /admin ban. these accounts get a ban on startup if they
+	// never had one
 	Banned map[int]bool `envconfig:"BANNED"`
 
 	Usage string
@@ -71,7 +80,6 @@ var (
 	ln                      *cliche.Control
 	rds                     *redis.Client
 	bot                     *tgbotapi.BotAPI
-	amp                     *amplitude.Client
 	log                     = zerolog.New(os.Stderr).Output(zerolog.ConsoleWriter{Out: PluginLogger{}})
 	router                  = mux.NewRouter()
 	waitingPaymentSuccesses = cmap.New() //  make(map[string][]chan string)
@@ -141,9 +149,9 @@ func main() {
 			Msg("failed to connect to redis")
 	}
 
-	// amplitude client
-	if s.AmplitudeKey != "" {
-		amp = amplitude.New(s.AmplitudeKey)
+	// analytics
+	if err := setupAnalytics(); err != nil {
+		log.Fatal().Err(err).Msg("failed to setup analytics")
 	}
 
 	// setup commands
@@ -175,8 +183,19 @@ func main() {
 
 	// routines
 	// routineCtx := context.WithValue(context.Background(), "origin", "routine")
-	// go startKicking()
-	// go sats4adsCleanupRoutine()
+	go startKicking()
+	go sats4adsCleanupRoutine()
+	go sats4adsBroadcastRoutine()
+	go subscriptionRoutine()
+	go depositRefundRoutine()
+	go posSummaryRoutine()
+	go webhookDeliveryRoutine()
+	go accountEventsRoutine()
+	go eventLogCleanupRoutine()
+	go solvencyRoutine()
+	seedBansFromEnv()
+	go banInvalidationRoutine()
+	go accountDeletionRoutine()
 	// go lnurlBalanceCheckRoutine()
 	// go checkAllOutgoingPayments(routineCtx)
 	// go checkAllIncomingPayments(routineCtx)
@@ -195,11 +214,17 @@ func main() {
 	// registerAPIMethods()
 
 	// register webserver routes
-	// serveQRCodes()
-	// serveTempAssets()
+	serveMetrics()
+	serveQRCodes()
+	serveTempAssets()
+	serveHiddenPages()
+	servePOSPages()
+	serveAccountEvents()
+	serveSolvency()
 	// serveLNURL()
 	// serveLNURLBalanceNotify()
 	// servePages()
+	serveSats4AdsClicks()
 	// router.Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 	// 	http.Redirect(w, r, "https://t.me/lntxbot", http.StatusTemporaryRedirect)
 	// })
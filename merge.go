@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// when someone gets money sent to their @username before they start the bot,
+// or changes their username to one that already had an account, we end up
+// with two accounts for the same person. the one with the telegram id stays,
+// everything that belonged to the other is moved to it and a record of the
+// merge is kept in account_merge. if the two accounts have settings or data
+// that can't be combined the merge is refused and the admin is told about it.
+
+const MERGECONFLICTNOTIFYINTERVAL = 24 * time.Hour
+
+var ErrMergeConflict = errors.New("accounts can't be merged")
+
+type AccountMerge struct {
+	Id                int            `db:"id"`
+	Time              time.Time      `db:"time"`
+	Remaining         int            `db:"remaining"`
+	Removed           int            `db:"removed"`
+	RemovedTelegramId sql.NullInt64  `db:"removed_telegram_id"`
+	RemovedUsername   sql.NullString `db:"removed_username"`
+	RemovedPassword   string         `db:"removed_password"`
+	RemovedAppData    types.JSONText `db:"removed_appdata"`
+	Moved             types.JSONText `db:"moved"`
+}
+
+// every column that points to an account, rows that would be duplicated by
+// the move are taken care of in mergeDuplicates and the event log in
+// mergeAccountEvents before these run.
+var accountReferences = []struct {
+	table  string
+	column string
+}{
+	{"lightning.transaction", "from_id"},
+	{"lightning.transaction", "to_id"},
+	{"balance_check", "account"},
+	{"groupchat", "treasury"},
+	{"coinflip", "winner"},
+	{"group_deposit", "account"},
+	{"hidden_message", "author"},
+	{"hidden_revealer", "account"},
+	{"pos_sale", "merchant"},
+	{"analytics_event", "account"},
+	{"webhook_subscription", "account"},
+	{"webhook_delivery", "account"},
+	{"ban", "account"},
+	{"ban", "banned_by"},
+	{"solvency_leaf", "account"},
+	{"sats4ads_campaign", "advertiser"},
+	{"sats4ads_delivery", "receiver"},
+	{"account_deletion", "account"},
+	{"account_merge", "remaining"}, // accounts merged into the one being removed
+}
+
+// appDataMergers combine the data each app keeps in account.appdata, apps
+// not here can only be merged when just one of the accounts has them or both
+// have the same thing.
+var appDataMergers = map[string]func(keep, remove json.RawMessage) (interface{}, error){
+	"sats4ads": func(keep, remove json.RawMessage) (interface{}, error) {
+		var a, b Sats4AdsData
+		json.Unmarshal(keep, &a)
+		json.Unmarshal(remove, &b)
+
+		if a.Rate == 0 || (!a.On && b.On) {
+			a.Rate = b.Rate
+		}
+		a.On = a.On || b.On
+		a.Banned = a.Banned || b.Banned
+		for _, tag := range b.Tags {
+			if !stringIsIn(tag, a.Tags) {
+				a.Tags = append(a.Tags, tag)
+			}
+		}
+		return a, nil
+	},
+	"upvote": func(keep, remove json.RawMessage) (interface{}, error) {
+		var a, b UpvoteSettings
+		json.Unmarshal(keep, &a)
+		json.Unmarshal(remove, &b)
+
+		if a.Sats == 0 {
+			return b, nil
+		}
+		return a, nil
+	},
+	"pos": func(keep, remove json.RawMessage) (interface{}, error) {
+		var a, b POSData
+		json.Unmarshal(keep, &a)
+		json.Unmarshal(remove, &b)
+
+		// the web page of each catalogue is linked somewhere, we can't pick one
+		if len(a.Items) > 0 && len(b.Items) > 0 {
+			return nil, errors.New("both accounts have a point-of-sale catalogue")
+		}
+		if len(a.Items) == 0 && (len(b.Items) > 0 || a.Token == "") {
+			return b, nil
+		}
+		return a, nil
+	},
+	"webhooks": func(keep, remove json.RawMessage) (interface{}, error) {
+		var a, b WebhookSettings
+		json.Unmarshal(keep, &a)
+		json.Unmarshal(remove, &b)
+
+		// receivers verify signatures with the secret they already have
+		if a.Secret != "" && b.Secret != "" && a.Secret != b.Secret {
+			return nil, errors.New("both accounts have different webhook secrets")
+		}
+		if a.Secret == "" {
+			return b, nil
+		}
+		return a, nil
+	},
+}
+
+func mergeAppData(keep, remove types.JSONText) (merged map[string]interface{}, conflicts []string) {
+	var a, b map[string]json.RawMessage
+	json.Unmarshal(keep, &a)
+	json.Unmarshal(remove, &b)
+
+	merged = make(map[string]interface{}, len(a)+len(b))
+	for app, data := range a {
+		merged[app] = data
+	}
+
+	for app, data := range b {
+		existing, ok := a[app]
+		if !ok || isEmptyAppData(existing) {
+			merged[app] = data
+			continue
+		}
+		if isEmptyAppData(data) {
+			continue
+		}
+
+		if merger, ok := appDataMergers[app]; ok {
+			result, err := merger(existing, data)
+			if err != nil {
+				conflicts = append(conflicts, fmt.Sprintf("%s: %s", app, err.Error()))
+				continue
+			}
+			merged[app] = result
+			continue
+		}
+
+		var x, y interface{}
+		json.Unmarshal(existing, &x)
+		json.Unmarshal(data, &y)
+		if !reflect.DeepEqual(x, y) {
+			conflicts = append(conflicts,
+				fmt.Sprintf("%s: both accounts have different data", app))
+		}
+	}
+
+	sort.Strings(conflicts)
+	return
+}
+
+func isEmptyAppData(data json.RawMessage) bool {
+	s := strings.TrimSpace(string(data))
+	return s == "" || s == "null" || s == "{}"
+}
+
+// mergeDuplicates removes the rows of the account being removed that would
+// break unique constraints once moved, or returns the reasons why they can't
+// just be removed.
+func mergeDuplicates(txn *sqlx.Tx, keep, remove int) (dropped int64, conflicts []string, err error) {
+	var services []string
+	err = txn.Select(&services, `
+SELECT r.service FROM balance_check AS r
+INNER JOIN balance_check AS k ON k.service = r.service AND k.account = $1
+WHERE r.account = $2 AND r.url != k.url
+    `, keep, remove)
+	if err != nil {
+		return
+	}
+	for _, service := range services {
+		conflicts = append(conflicts,
+			fmt.Sprintf("balance_check: different urls for %s", service))
+	}
+
+	var campaigns []int
+	err = txn.Select(&campaigns, `
+SELECT r.campaign FROM sats4ads_delivery AS r
+INNER JOIN sats4ads_delivery AS k ON k.campaign = r.campaign AND k.receiver = $1
+WHERE r.receiver = $2 AND r.status = 'sent'
+    `, keep, remove)
+	if err != nil {
+		return
+	}
+	for _, campaign := range campaigns {
+		conflicts = append(conflicts,
+			fmt.Sprintf("sats4ads: both accounts got an ad from campaign %d", campaign))
+	}
+
+	if len(conflicts) > 0 {
+		return
+	}
+
+	for _, query := range []string{`
+DELETE FROM balance_check AS r
+USING balance_check AS k
+WHERE r.account = $2 AND k.account = $1 AND k.service = r.service
+    `, `
+DELETE FROM hidden_revealer AS r
+USING hidden_revealer AS k
+WHERE r.account = $2 AND k.account = $1 AND k.hidden_id = r.hidden_id
+    `, `
+DELETE FROM webhook_subscription AS r
+USING webhook_subscription AS k
+WHERE r.account = $2 AND k.account = $1 AND k.url = r.url
+    `, `
+DELETE FROM sats4ads_delivery AS r
+USING sats4ads_delivery AS k
+WHERE r.receiver = $2 AND k.receiver = $1 AND k.campaign = r.campaign
+    `} {
+		res, errx := txn.Exec(query, keep, remove)
+		if errx != nil {
+			return dropped, nil, errx
+		}
+		n, _ := res.RowsAffected()
+		dropped += n
+	}
+
+	return
+}
+
+// mergeAccountEvents moves the event log of the removed account after the
+// events of the remaining one, so their sequence numbers don't collide and
+// streams of the remaining account see them as new.
+func mergeAccountEvents(txn *sqlx.Tx, keep, remove int) (moved int64, err error) {
+	res, err := txn.Exec(`
+UPDATE account_event
+SET account = $1, seq = seq + (SELECT event_seq FROM account WHERE id = $1)
+WHERE account = $2
+    `, keep, remove)
+	if err != nil {
+		return
+	}
+	moved, _ = res.RowsAffected()
+
+	_, err = txn.Exec(`
+UPDATE account
+SET event_seq = event_seq + (SELECT event_seq FROM account WHERE id = $2)
+WHERE id = $1
+    `, keep, remove)
+	return
+}
+
+// mergeAccounts moves everything from one account into the other and deletes
+// it, inside the given transaction. when it returns ErrMergeConflict the
+// conflicts say why and nothing was changed.
+func mergeAccounts(
+	ctx context.Context,
+	txn *sqlx.Tx,
+	keep *User,
+	remove *User,
+) (merge AccountMerge, conflicts []string, err error) {
+	var accounts []struct {
+		Id         int            `db:"id"`
+		TelegramId sql.NullInt64  `db:"telegram_id"`
+		Username   sql.NullString `db:"telegram_username"`
+		Password   string         `db:"password"`
+		AppData    types.JSONText `db:"appdata"`
+	}
+	err = txn.Select(&accounts, `
+SELECT id, telegram_id, telegram_username, password, appdata
+FROM account WHERE id = $1 OR id = $2
+ORDER BY id = $1 DESC
+FOR UPDATE
+    `, keep.Id, remove.Id)
+	if err != nil {
+		return
+	}
+	if len(accounts) != 2 {
+		err = fmt.Errorf("expected 2 accounts to merge, found %d", len(accounts))
+		return
+	}
+	kept, removed := accounts[0], accounts[1]
+
+	if removed.TelegramId.Valid && removed.TelegramId.Int64 != 0 &&
+		removed.TelegramId.Int64 != kept.TelegramId.Int64 {
+		conflicts = append(conflicts,
+			"the other account belongs to a different telegram user")
+	}
+
+	appdata, appConflicts := mergeAppData(kept.AppData, removed.AppData)
+	conflicts = append(conflicts, appConflicts...)
+	if len(conflicts) > 0 {
+		return merge, conflicts, ErrMergeConflict
+	}
+
+	audit := startAudit(ctx, txn, "account_merge", keep.Id, remove.Id)
+
+	dropped, dupConflicts, err := mergeDuplicates(txn, keep.Id, remove.Id)
+	if err != nil {
+		return
+	}
+	if len(dupConflicts) > 0 {
+		return merge, dupConflicts, ErrMergeConflict
+	}
+
+	moved := map[string]int64{"duplicates_dropped": dropped}
+
+	events, err := mergeAccountEvents(txn, keep.Id, remove.Id)
+	if err != nil {
+		return merge, nil, fmt.Errorf("moving account_event: %w", err)
+	}
+	if events > 0 {
+		moved["account_event.account"] = events
+	}
+	for _, ref := range accountReferences {
+		res, errx := txn.Exec(fmt.Sprintf(
+			"UPDATE %s SET %s = $1 WHERE %s = $2", ref.table, ref.column, ref.column,
+		), keep.Id, remove.Id)
+		if errx != nil {
+			return merge, nil, fmt.Errorf("moving %s.%s: %w", ref.table, ref.column, errx)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			moved[ref.table+"."+ref.column] += n
+		}
+	}
+
+	// the appdata goes to the remaining account, the username is moved by
+	// the caller after the other account is gone
+	j, _ := json.Marshal(appdata)
+	if _, err = txn.Exec(`
+UPDATE account SET appdata = $2 WHERE id = $1
+    `, keep.Id, types.JSONText(j)); err != nil {
+		return
+	}
+
+	movedj, _ := json.Marshal(moved)
+	err = txn.Get(&merge, `
+INSERT INTO account_merge
+  (remaining, removed, removed_telegram_id, removed_username,
+   removed_password, removed_appdata, moved)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING *
+    `, keep.Id, remove.Id, removed.TelegramId, removed.Username,
+		removed.Password, removed.AppData, types.JSONText(movedj))
+	if err != nil {
+		return
+	}
+
+	if _, err = txn.Exec("DELETE FROM account WHERE id = $1", remove.Id); err != nil {
+		return
+	}
+
+	err = audit.save(txn, "", map[string]interface{}{
+		"merge":     merge.Id,
+		"remaining": keep.Id,
+		"removed":   remove.Id,
+	})
+	return
+}
+
+// notifyMergeConflict tells the admin once a day for each pair of accounts,
+// as the merge is attempted again on every message.
+func notifyMergeConflict(keep *User, remove *User, conflicts []string) {
+	log.Warn().Stringer("keep", keep).Stringer("remove", remove).
+		Strs("conflicts", conflicts).Msg("refused to merge accounts")
+
+	key := fmt.Sprintf("mergeconflict:%d:%d", keep.Id, remove.Id)
+	if ok, err := rds.SetNX(key, "1", MERGECONFLICTNOTIFYINTERVAL).Result(); err != nil || !ok {
+		return
+	}
+
+	admin, err := loadUser(s.AdminAccount)
+	if err != nil {
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), "origin", "background")
+	send(ctx, admin, t.MERGECONFLICT, t.T{
+		"Keep":      keep,
+		"Remove":    remove,
+		"Conflicts": conflicts,
+	})
+}
+
+// loadMergedUser finds where an account that doesn't exist anymore went, so
+// api tokens and lnurl codes made for it keep working.
+func loadMergedUser(removed int) (*User, AccountMerge, error) {
+	var merge AccountMerge
+	err := pg.Get(&merge, `
+SELECT * FROM account_merge WHERE removed = $1
+    `, removed)
+	if err != nil {
+		return nil, merge, err
+	}
+
+	// an account can be merged into one that was later merged too
+	user, err := loadUser(merge.Remaining)
+	if err == sql.ErrNoRows {
+		user, _, err = loadMergedUser(merge.Remaining)
+	}
+	return user, merge, err
+}
+
+// translateMergedPassword turns a password (or one of its hashes, see
+// loadUserFromAPICall) of a removed account into the equivalent for the
+// account it was merged into.
+func translateMergedPassword(password, removed, remaining string) string {
+	for i := 0; i < 3; i++ {
+		if password == removed {
+			return remaining
+		}
+		removed, remaining = hashString(removed), hashString(remaining)
+	}
+	return password
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+func TestMergeAppData(t *testing.T) {
+	merged, conflicts := mergeAppData(
+		types.JSONText(`{"tip": {"x": 1}, "same": {"y": 2}, "empty": {}, "webhooks": {"secret": "a"}}`),
+		types.JSONText(`{"only": [1], "same": {"y": 2}, "empty": {"z": 3}, "webhooks": {}}`),
+	)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+
+	j, _ := json.Marshal(merged)
+	var got map[string]interface{}
+	json.Unmarshal(j, &got)
+
+	var expected map[string]interface{}
+	json.Unmarshal([]byte(`{
+		"tip": {"x": 1},
+		"same": {"y": 2},
+		"empty": {"z": 3},
+		"only": [1],
+		"webhooks": {"secret": "a"}
+	}`), &expected)
+
+	if string(mustMarshal(got)) != string(mustMarshal(expected)) {
+		t.Errorf("expected %s, got %s", mustMarshal(expected), mustMarshal(got))
+	}
+}
+
+func TestMergeAppDataConflicts(t *testing.T) {
+	_, conflicts := mergeAppData(
+		types.JSONText(`{"other": {"a": 1}, "webhooks": {"secret": "a"}, "pos": {"items": [{"name": "x"}]}}`),
+		types.JSONText(`{"other": {"a": 2}, "webhooks": {"secret": "b"}, "pos": {"items": [{"name": "y"}]}}`),
+	)
+	if len(conflicts) != 3 {
+		t.Fatalf("expected 3 conflicts, got %v", conflicts)
+	}
+	// sorted by app name
+	if conflicts[0][:6] != "other:" || conflicts[1][:4] != "pos:" || conflicts[2][:9] != "webhooks:" {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+}
+
+func TestMergeAppDataMergers(t *testing.T) {
+	merged, conflicts := mergeAppData(
+		types.JSONText(`{"pos": {"token": "t1"}, "webhooks": {"secret": ""}}`),
+		types.JSONText(`{"pos": {"items": [{"name": "x", "price": 1, "currency": "sat"}], "token": "t2"}, "webhooks": {"secret": "s"}}`),
+	)
+	if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts %v", conflicts)
+	}
+
+	pos := merged["pos"].(POSData)
+	if pos.Token != "t2" || len(pos.Items) != 1 {
+		t.Errorf("expected the catalogue of the removed account, got %v", pos)
+	}
+	webhooks := merged["webhooks"].(WebhookSettings)
+	if webhooks.Secret != "s" {
+		t.Errorf("expected the secret of the removed account, got %v", webhooks)
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	j, _ := json.Marshal(v)
+	return j
+}
+
+func TestTranslateMergedPasswordChain(t *testing.T) {
+	a, b, c := "passa", "passb", "passc"
+
+	// a token made for A, after A went into B and B into C
+	for _, given := range []string{a, hashString(a), hashString(hashString(a))} {
+		got := translateMergedPassword(given, a, c)
+		expected := map[string]string{
+			a:                         c,
+			hashString(a):             hashString(c),
+			hashString(hashString(a)): hashString(hashString(c)),
+		}[given]
+		if got != expected {
+			t.Errorf("%s: expected %s, got %s", given, expected, got)
+		}
+	}
+
+	if translateMergedPassword(b, a, c) != b {
+		t.Error("password of another account was translated")
+	}
+}
+
+// TestMergeChain needs TEST_DATABASE_URL pointing to a database created from
+// postgres.sql, everything is rolled back at the end.
+func TestMergeChain(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	txn, err := db.Beginx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer txn.Rollback()
+
+	newAccount := func(username string) *User {
+		var id int
+		if err := txn.Get(&id, `
+INSERT INTO account (telegram_username) VALUES ($1) RETURNING id
+        `, username); err != nil {
+			t.Fatal(err)
+		}
+		return &User{Id: id}
+	}
+	a := newAccount("merge_test_a")
+	b := newAccount("merge_test_b")
+	c := newAccount("merge_test_c")
+
+	event := PaymentEvent{Event: "internal", Msatoshi: 1000}
+	if err := saveAccountEvents(txn,
+		event.forAccount(a.Id), event.forAccount(b.Id), event.forAccount(b.Id),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), "origin", "background")
+
+	if _, conflicts, err := mergeAccounts(ctx, txn, b, a); err != nil {
+		t.Fatalf("merging A into B: %v %v", err, conflicts)
+	}
+	if _, conflicts, err := mergeAccounts(ctx, txn, c, b); err != nil {
+		t.Fatalf("merging B into C: %v %v", err, conflicts)
+	}
+
+	var merges []AccountMerge
+	if err := txn.Select(&merges, `
+SELECT * FROM account_merge WHERE removed = $1 OR removed = $2 ORDER BY id
+    `, a.Id, b.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(merges) != 2 {
+		t.Fatalf("expected 2 merges, got %d", len(merges))
+	}
+	for _, merge := range merges {
+		if merge.Remaining != c.Id {
+			t.Errorf("merge of %d points to %d, not to %d", merge.Removed, merge.Remaining, c.Id)
+		}
+	}
+
+	var seqs []int64
+	if err := txn.Select(&seqs, `
+SELECT seq FROM account_event WHERE account = $1 ORDER BY seq
+    `, c.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[2] != 3 {
+		t.Errorf("expected events 1 to 3 on the last account, got %v", seqs)
+	}
+}
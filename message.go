@@ -26,6 +26,12 @@ type TelegramCopyMessage struct {
 	MessageID int
 }
 
+// TelegramFile is something already uploaded to telegram, sent again by its id.
+type TelegramFile struct {
+	Type   string // "photo", "document" or "voice"
+	FileID string
+}
+
 func send(ctx context.Context, things ...interface{}) (id interface{}) {
 	var (
 		edit         bool
@@ -69,6 +75,7 @@ func send(ctx context.Context, things ...interface{}) (id interface{}) {
 		replyToId               int // will be sent in reply to this -- or if editing will edit this
 		forceReply              *tgbotapi.ForceReply
 		copyMessage             *TelegramCopyMessage
+		file                    *TelegramFile
 		callbackQuery           *tgbotapi.CallbackQuery
 		telegramMessage         *tgbotapi.Message // unless this is provided, this has precedence in edition priotiry
 		mustSendAnActualMessage bool
@@ -131,6 +138,8 @@ func send(ctx context.Context, things ...interface{}) (id interface{}) {
 			copyMessage = thing
 		case TelegramCopyMessage:
 			copyMessage = &thing
+		case *TelegramFile:
+			file = thing
 		case MessageModifier:
 			switch thing {
 			case WITHALERT:
@@ -307,6 +316,17 @@ func send(ctx context.Context, things ...interface{}) (id interface{}) {
 				values.Set("from_chat_id", strconv.FormatInt(
 					copyMessage.ChatID, 10))
 				values.Set("message_id", strconv.Itoa(copyMessage.MessageID))
+			} else if file != nil {
+				switch file.Type {
+				case "photo":
+					method = "sendPhoto"
+				case "voice":
+					method = "sendVoice"
+				default:
+					method = "sendDocument"
+				}
+				values.Set(file.Type, file.FileID)
+				values.Set("caption", text)
 			} else if pictureURL == "" && documentURL == "" {
 				method = "sendMessage"
 				values.Set("text", text)
@@ -337,6 +357,7 @@ func send(ctx context.Context, things ...interface{}) (id interface{}) {
 			}
 			if err != nil {
 				log.Warn().Err(err).Msg("error sending message to telegram")
+				metricTelegramSendErrors.Inc(method, telegramErrorKind(err))
 				return
 			}
 		}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// metrics are exposed on /metrics in the prometheus text format, only when
+// METRICS_TOKEN is set. counters and histograms are kept in memory and reset
+// on restart, gauges are read from the database when they're scraped, at most
+// once every METRICSGAUGECACHE.
+
+const METRICSGAUGECACHE = 30 * time.Second
+
+var (
+	metricInvoicesCreated = newCounter("lntxbot_invoices_created_total",
+		"Invoices created, by app tag.", "tag")
+	metricInvoicesPaid = newCounter("lntxbot_invoices_paid_total",
+		"Invoices paid to the bot, by app tag.", "tag")
+	metricInvoicesPaidMsats = newCounter("lntxbot_invoices_paid_msats_total",
+		"Amount received through invoices.", "tag")
+	metricPaymentDuration = newHistogram("lntxbot_payment_duration_seconds",
+		"Time between starting an outgoing payment and knowing its result.",
+		[]float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 900}, "result")
+	metricPaymentFailures = newCounter("lntxbot_payment_failures_total",
+		"Outgoing payments that failed, by the first failure reported.", "reason")
+	metricInternalTransfers = newCounter("lntxbot_internal_transfers_total",
+		"Payments between bot accounts, by app tag.", "tag")
+	metricInternalTransfersMsats = newCounter("lntxbot_internal_transfers_msats_total",
+		"Amount moved between bot accounts, by app tag.", "tag")
+	metricTelegramSendErrors = newCounter("lntxbot_telegram_send_errors_total",
+		"Errors returned by telegram when sending messages.", "method", "error")
+	metricNodePing = newHistogram("lntxbot_node_ping_seconds",
+		"Time the node takes to answer a ping.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "result")
+
+	_ = newGaugeFunc("lntxbot_pending_transactions",
+		"Outgoing payments still in flight.", func() (v float64, err error) {
+			err = pg.Get(&v, `
+SELECT count(*) FROM lightning.transaction WHERE pending AND to_id IS NULL
+            `)
+			return
+		})
+	_ = newGaugeFunc("lntxbot_liabilities_msats",
+		"Sum of all account balances.", func() (v float64, err error) {
+			err = pg.Get(&v, `
+SELECT coalesce(sum(balance), 0) FROM lightning.balance WHERE account_id != $1
+            `, s.ProxyAccount)
+			return
+		})
+)
+
+type metricFamily interface {
+	write(w io.Writer) error
+}
+
+var (
+	metricsRegistry      []metricFamily
+	metricsRegistryMutex sync.Mutex
+)
+
+func registerMetric(m metricFamily) {
+	metricsRegistryMutex.Lock()
+	metricsRegistry = append(metricsRegistry, m)
+	metricsRegistryMutex.Unlock()
+}
+
+type metricSeries struct {
+	labels []string
+	value  float64
+
+	// only for histograms
+	buckets []uint64
+	count   uint64
+}
+
+type Counter struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	series map[string]*metricSeries
+}
+
+func newCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels,
+		series: make(map[string]*metricSeries)}
+	registerMetric(c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.Lock()
+	defer c.Unlock()
+	getMetricSeries(c.series, labelValues, 0).value += v
+}
+
+func (c *Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c *Counter) write(w io.Writer) error {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedMetricKeys(c.series) {
+		series := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatMetricLabels(c.labels, series.labels, "", ""), formatMetricValue(series.value))
+	}
+	return nil
+}
+
+type Histogram struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets,
+		series: make(map[string]*metricSeries)}
+	registerMetric(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+
+	series := getMetricSeries(h.series, labelValues, len(h.buckets))
+	for i, upper := range h.buckets {
+		if v <= upper {
+			series.buckets[i]++
+		}
+	}
+	series.count++
+	series.value += v
+}
+
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedMetricKeys(h.series) {
+		series := h.series[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatMetricLabels(h.labels, series.labels, "le", formatMetricValue(upper)),
+				series.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatMetricLabels(h.labels, series.labels, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			formatMetricLabels(h.labels, series.labels, "", ""), formatMetricValue(series.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name,
+			formatMetricLabels(h.labels, series.labels, "", ""), series.count)
+	}
+	return nil
+}
+
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() (float64, error)
+
+	mutex     sync.Mutex
+	value     float64
+	fetchedAt time.Time
+}
+
+func newGaugeFunc(name string, help string, fn func() (float64, error)) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	registerMetric(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) error {
+	// concurrent scrapes wait here instead of all hitting the database
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if time.Since(g.fetchedAt) > METRICSGAUGECACHE {
+		v, err := g.fn()
+		if err != nil {
+			return fmt.Errorf("%s: %w", g.name, err)
+		}
+		g.value, g.fetchedAt = v, time.Now()
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+		g.name, g.help, g.name, g.name, formatMetricValue(g.value))
+	return nil
+}
+
+func getMetricSeries(all map[string]*metricSeries, labelValues []string, nbuckets int) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	series, ok := all[key]
+	if !ok {
+		series = &metricSeries{labels: labelValues}
+		if nbuckets > 0 {
+			series.buckets = make([]uint64, nbuckets)
+		}
+		all[key] = series
+	}
+	return series
+}
+
+func sortedMetricKeys(all map[string]*metricSeries) []string {
+	keys := make([]string, 0, len(all))
+	for key := range all {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricLabels(names []string, values []string, extraName string, extraValue string) string {
+	var pairs []string
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+`="`+metricLabelEscaper.Replace(value)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricTag is the label used for payments, which have no tag when they're
+// plain sends or tips.
+func metricTag(tag string) string {
+	if tag == "" {
+		return "none"
+	}
+	return tag
+}
+
+// paymentFailureReason turns "- Local failure: no-routes-found." into
+// "no-routes-found" so it can be used as a label.
+func paymentFailureReason(failures []string) string {
+	if len(failures) == 0 {
+		return "unknown"
+	}
+
+	reason := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(failures[0]), "-"))
+	reason = strings.Split(reason, ".")[0]
+	if i := strings.LastIndex(reason, ": "); i != -1 {
+		reason = reason[i+2:]
+	}
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	if reason == "" || len(reason) > 48 {
+		return "other"
+	}
+	return reason
+}
+
+// telegramErrorKind keeps only the category of errors like
+// "Forbidden: bot was blocked by the user".
+func telegramErrorKind(err error) string {
+	kind := strings.SplitN(err.Error(), ":", 2)[0]
+	if len(kind) > 32 {
+		return "other"
+	}
+	return kind
+}
+
+// outgoing payments are timed from when they're sent to the node until it
+// tells us how they ended.
+var outgoingPaymentStarts = cmap.New() // make(map[string]time.Time)
+
+func startPaymentTimer(hash string) {
+	outgoingPaymentStarts.Set(hash, time.Now())
+}
+
+func stopPaymentTimer(hash string, result string) {
+	if start, ok := outgoingPaymentStarts.Pop(hash); ok {
+		metricPaymentDuration.ObserveSince(start.(time.Time), result)
+	}
+}
+
+// observePaymentEvent feeds the payment counters from the event log.
+func observePaymentEvent(event PaymentEvent) {
+	switch event.Event {
+	case "received":
+		metricInvoicesPaid.Inc(metricTag(event.Tag))
+		metricInvoicesPaidMsats.Add(float64(event.Msatoshi), metricTag(event.Tag))
+	case "internal", "app":
+		if event.Direction == "out" {
+			metricInternalTransfers.Inc(metricTag(event.Tag))
+			metricInternalTransfersMsats.Add(float64(event.Msatoshi), metricTag(event.Tag))
+		}
+	}
+}
+
+func serveMetrics() {
+	if s.MetricsToken == "" {
+		log.Info().Msg("METRICS_TOKEN not set, /metrics is disabled")
+		return
+	}
+	expected := []byte("Bearer " + s.MetricsToken)
+
+	router.Path("/metrics").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		metricsRegistryMutex.Lock()
+		families := metricsRegistry
+		metricsRegistryMutex.Unlock()
+
+		var buf bytes.Buffer
+		for _, family := range families {
+			if err := family.write(&buf); err != nil {
+				log.Warn().Err(err).Msg("failed to collect metric")
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
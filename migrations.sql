@@ -0,0 +1,12 @@
+-- postgres.sql always has the current schema. these are the data changes
+-- needed on databases created from an older version of it, to be run after
+-- the new tables and columns are created.
+
+-- expensive chat settings moved from groupchat to expensive_rule. the old
+-- setting charged everybody and paid the group owner.
+INSERT INTO expensive_rule (group_id, price, pattern, destination, exempt_admins, exempt_whitelisted)
+SELECT telegram_id, expensive_price, expensive_pattern, 'owner', false, false
+FROM groupchat
+WHERE expensive_price > 0;
+
+ALTER TABLE groupchat DROP COLUMN expensive_price, DROP COLUMN expensive_pattern;
@@ -201,12 +201,53 @@ func paymentHasSucceeded(
 		UserId         int `db:"from_id"`
 		TriggerMessage int `db:"trigger_message"`
 	}
-	err := pg.Get(&res, `
+	var event PaymentEvent
+	err := func() error {
+		txn, err := pg.Beginx()
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+
+		var payer int
+		if err := txn.Get(&payer, `
+SELECT from_id FROM lightning.transaction
+WHERE payment_hash = $1 AND pending
+FOR UPDATE
+        `, hash); err != nil {
+			return err
+		}
+		audit := startAudit(ctx, txn, "payment_sent", payer)
+
+		if err := txn.Get(&res, `
 UPDATE lightning.transaction
 SET fees = $1, preimage = $2, pending = false, tag = $4
 WHERE payment_hash = $3 AND pending
 RETURNING from_id, trigger_message
-    `, feesPaid, preimage, hash, tagn)
+        `, feesPaid, preimage, hash, tagn); err != nil {
+			return err
+		}
+
+		event = PaymentEvent{
+			Event:       "sent",
+			PaymentHash: hash,
+			Msatoshi:    msatoshi,
+			FeeMsatoshi: feesPaid,
+			Preimage:    preimage,
+			Tag:         tag,
+		}.forAccount(res.UserId)
+		if err := saveAccountEvents(txn, event); err != nil {
+			return err
+		}
+
+		if err := audit.save(txn, hash, map[string]interface{}{
+			"msatoshi": msatoshi,
+			"fees":     feesPaid,
+		}); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}()
 	if err != nil {
 		log.Error().Err(err).Str("hash", hash).
 			Int64("fees", feesPaid).Msg("failed to update transaction paid status")
@@ -214,6 +255,8 @@ RETURNING from_id, trigger_message
 	}
 
 	go resolveWaitingPaymentSuccess(hash, preimage)
+	stopPaymentTimer(hash, "succeeded")
+	go publishPaymentEvent(event)
 
 	user, err := loadUser(res.UserId)
 	if err != nil {
@@ -236,15 +279,55 @@ RETURNING from_id, trigger_message
 
 func paymentHasFailed(ctx context.Context, hash string, failures []string) {
 	var res struct {
-		UserId         int `db:"from_id"`
-		TriggerMessage int `db:"trigger_message"`
+		UserId         int   `db:"from_id"`
+		TriggerMessage int   `db:"trigger_message"`
+		Msatoshi       int64 `db:"amount"`
 	}
-	err := pg.Get(&res, `
+	var event PaymentEvent
+	err := func() error {
+		txn, err := pg.Beginx()
+		if err != nil {
+			return err
+		}
+		defer txn.Rollback()
+
+		var payer int
+		if err := txn.Get(&payer, `
+SELECT from_id FROM lightning.transaction
+WHERE payment_hash = $1 AND to_id IS NULL AND pending
+FOR UPDATE
+        `, hash); err != nil {
+			return err
+		}
+		audit := startAudit(ctx, txn, "payment_failed", payer)
+
+		if err := txn.Get(&res, `
 DELETE FROM lightning.transaction
 WHERE payment_hash = $1 AND to_id IS NULL
   AND pending
-RETURNING from_id, trigger_message
-    `, hash)
+RETURNING from_id, trigger_message, amount
+        `, hash); err != nil {
+			return err
+		}
+
+		event = PaymentEvent{
+			Event:       "failed",
+			PaymentHash: hash,
+			Msatoshi:    res.Msatoshi,
+			Failures:    failures,
+		}.forAccount(res.UserId)
+		if err := saveAccountEvents(txn, event); err != nil {
+			return err
+		}
+
+		if err := audit.save(txn, hash, map[string]interface{}{
+			"msatoshi": res.Msatoshi,
+			"failures": failures,
+		}); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}()
 	if err != nil {
 		log.Error().Err(err).Str("hash", hash).
 			Msg("failed to cancel transaction after routing failure")
@@ -253,6 +336,11 @@ RETURNING from_id, trigger_message
 
 	rds.Set("hash:"+strconv.Itoa(res.UserId)+":"+hash[0:5], hash, time.Hour*24*2)
 
+	stopPaymentTimer(hash, "failed")
+	metricPaymentFailures.Inc(paymentFailureReason(failures))
+
+	go publishPaymentEvent(event)
+
 	user, err := loadUser(res.UserId)
 	if err != nil {
 		log.Error().Err(err).Str("hash", hash).Int("id", res.UserId).
@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/juju/ratelimit"
+)
+
+// merchants keep a catalogue of items in their appdata and charge customers by
+// tapping them on a keyboard or on a web page at the counter. each charge is an
+// invoice recorded in pos_sale, and a sale is paid once its transaction exists.
+
+const (
+	POSSALETIMEOUT = 30 * time.Minute
+	POSMAXQUANTITY = 100 // of each item in a single sale
+)
+
+type POSItem struct {
+	Name     string  `json:"name"`
+	Price    float64 `json:"price"`
+	Currency string  `json:"currency"` // "sat" or a fiat currency code
+}
+
+type POSData struct {
+	Items []POSItem `json:"items"`
+	Token string    `json:"token,omitempty"` // secret part of the web page url
+}
+
+type POSOrderLine struct {
+	POSItem
+	Quantity int `json:"quantity"`
+}
+
+type POSTotal struct {
+	Amount   float64
+	Currency string
+}
+
+type POSSale struct {
+	Id          int            `db:"id"`
+	Merchant    int            `db:"merchant"`
+	PaymentHash string         `db:"payment_hash"`
+	Items       types.JSONText `db:"items"`
+	Msats       int64          `db:"msats"`
+	CreatedAt   time.Time      `db:"created_at"`
+}
+
+func (u User) getPOSData() (data POSData) {
+	u.getAppData("pos", &data)
+	return
+}
+
+func redisKeyPOSOrder(u *User) string {
+	return fmt.Sprintf("pos:order:%d", u.Id)
+}
+
+// the order being built on telegram maps item indexes to quantities.
+func (u *User) getPOSOrder() (order map[int]int) {
+	order = make(map[int]int)
+	if j, err := rds.Get(redisKeyPOSOrder(u)).Bytes(); err == nil {
+		json.Unmarshal(j, &order)
+	}
+	return
+}
+
+func (u *User) setPOSOrder(order map[int]int) {
+	j, _ := json.Marshal(order)
+	rds.Set(redisKeyPOSOrder(u), string(j), time.Hour)
+}
+
+func posOrderLines(items []POSItem, order map[int]int) (lines []POSOrderLine) {
+	indexes := make([]int, 0, len(order))
+	for idx, quantity := range order {
+		if idx >= 0 && idx < len(items) && quantity > 0 {
+			indexes = append(indexes, idx)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		lines = append(lines, POSOrderLine{items[idx], order[idx]})
+	}
+	return
+}
+
+// posTotals sums the order for display, one total per currency.
+func posTotals(lines []POSOrderLine) (totals []POSTotal) {
+	byCurrency := make(map[string]float64)
+	for _, line := range lines {
+		if _, ok := byCurrency[line.Currency]; !ok {
+			totals = append(totals, POSTotal{Currency: line.Currency})
+		}
+		byCurrency[line.Currency] += line.Price * float64(line.Quantity)
+	}
+	for i := range totals {
+		totals[i].Amount = byCurrency[totals[i].Currency]
+	}
+	return
+}
+
+func posOrderMsats(lines []POSOrderLine) (msats int64, err error) {
+	rates := make(map[string]int64)
+	for _, line := range lines {
+		amount := line.Price * float64(line.Quantity)
+		if line.Currency == "sat" {
+			msats += int64(amount * 1000)
+			continue
+		}
+
+		rate, ok := rates[line.Currency]
+		if !ok {
+			rate, err = getMsatsPerFiatUnit(line.Currency)
+			if err != nil {
+				return
+			}
+			rates[line.Currency] = rate
+		}
+		msats += int64(amount * float64(rate))
+	}
+	return
+}
+
+func parsePOSCurrency(currency string) (string, bool) {
+	switch lower := strings.ToLower(currency); lower {
+	case "sat", "sats", "satoshis":
+		return "sat", true
+	default:
+		upper := strings.ToUpper(currency)
+		for _, code := range CURRENCIES {
+			if code == upper {
+				return upper, true
+			}
+		}
+	}
+	return "", false
+}
+
+func createPOSSale(ctx context.Context, u *User, lines []POSOrderLine) (
+	sale POSSale, bolt11 string, err error,
+) {
+	if len(lines) == 0 {
+		err = errors.New("the order is empty.")
+		return
+	}
+
+	msats, err := posOrderMsats(lines)
+	if err != nil {
+		return
+	}
+	if msats < 1000 {
+		err = errors.New("the order total is less than 1 sat.")
+		return
+	}
+
+	names := make([]string, len(lines))
+	for i, line := range lines {
+		names[i] = fmt.Sprintf("%d× %s", line.Quantity, line.Name)
+	}
+
+	expiry := POSSALETIMEOUT
+	bolt11, hash, err := u.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        msats,
+		Description:     u.Username + ": " + strings.Join(names, ", "),
+		Expiry:          &expiry,
+		Tag:             "pos",
+	})
+	if err != nil {
+		return
+	}
+
+	items, _ := json.Marshal(lines)
+	err = pg.Get(&sale, `
+INSERT INTO pos_sale (merchant, payment_hash, items, msats)
+VALUES ($1, $2, $3, $4)
+RETURNING *
+    `, u.Id, hash, types.JSONText(items), msats)
+	return
+}
+
+func waitPOSSale(ctx context.Context, u *User, sale POSSale, replyTo interface{}) {
+	wait := waitInvoice(sale.PaymentHash)
+	select {
+	case <-wait:
+		send(ctx, u, t.POSPAID, t.T{
+			"Id":   sale.Id,
+			"Sats": sale.Msats / 1000,
+		}, replyTo)
+
+		go u.track("pos sale", map[string]interface{}{"sats": sale.Msats / 1000})
+	case <-time.After(POSSALETIMEOUT):
+		stopWaitingInvoice(sale.PaymentHash, wait)
+	}
+}
+
+func posSaleIsPaid(sale POSSale) (paid bool) {
+	pg.Get(&paid, `
+SELECT EXISTS (
+  SELECT 1 FROM lightning.transaction
+  WHERE payment_hash = $1 AND to_id = $2
+)
+    `, sale.PaymentHash, sale.Merchant)
+	return
+}
+
+type POSSummary struct {
+	Day   string
+	Count int
+	Msats int64
+	Items []POSOrderLine
+}
+
+func (summary POSSummary) Sats() int64 { return summary.Msats / 1000 }
+
+func (u User) posSalesSummary(from, to time.Time) (summary POSSummary, err error) {
+	var sales []POSSale
+	err = pg.Select(&sales, `
+SELECT s.* FROM pos_sale AS s
+INNER JOIN lightning.transaction AS t
+  ON t.payment_hash = s.payment_hash AND t.to_id = s.merchant
+WHERE s.merchant = $1 AND t.time >= $2 AND t.time < $3
+    `, u.Id, from, to)
+	if err != nil {
+		return
+	}
+
+	summary.Day = from.Format("2 Jan 2006")
+	byItem := make(map[string]int)
+	for _, sale := range sales {
+		summary.Count++
+		summary.Msats += sale.Msats
+
+		var lines []POSOrderLine
+		sale.Items.Unmarshal(&lines)
+		for _, line := range lines {
+			key := line.Name + "\x00" + line.Currency
+			if idx, ok := byItem[key]; ok {
+				summary.Items[idx].Quantity += line.Quantity
+			} else {
+				byItem[key] = len(summary.Items)
+				summary.Items = append(summary.Items, line)
+			}
+		}
+	}
+
+	sort.SliceStable(summary.Items, func(i, j int) bool {
+		return summary.Items[i].Quantity > summary.Items[j].Quantity
+	})
+	return
+}
+
+func posKeyboard(ctx context.Context, items []POSItem) *tgbotapi.InlineKeyboardMarkup {
+	rows := make([][]tgbotapi.InlineKeyboardButton, 0, len(items)/2+2)
+	for i, item := range items {
+		button := tgbotapi.NewInlineKeyboardButtonData(
+			fmt.Sprintf("%s · %g %s", item.Name, item.Price, item.Currency),
+			fmt.Sprintf("pos=a%d", i),
+		)
+		if i%2 == 0 {
+			rows = append(rows, []tgbotapi.InlineKeyboardButton{button})
+		} else {
+			rows[len(rows)-1] = append(rows[len(rows)-1], button)
+		}
+	}
+
+	rows = append(rows, []tgbotapi.InlineKeyboardButton{
+		tgbotapi.NewInlineKeyboardButtonData(translate(ctx, t.POSCHARGEBTN), "pos=c"),
+		tgbotapi.NewInlineKeyboardButtonData(translate(ctx, t.POSCLEARBTN), "pos=x"),
+	})
+
+	return &tgbotapi.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+func posOrderParams(items []POSItem, order map[int]int) t.T {
+	lines := posOrderLines(items, order)
+	return t.T{
+		"Lines":  lines,
+		"Totals": posTotals(lines),
+	}
+}
+
+func handlePOS(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	data := u.getPOSData()
+
+	switch {
+	case opts["add"].(bool):
+		price, err := strconv.ParseFloat(opts["<price>"].(string), 64)
+		if err != nil || price <= 0 {
+			send(ctx, u, t.ERROR, t.T{"Err": "invalid price."})
+			return
+		}
+		currency, ok := parsePOSCurrency(opts["<currency>"].(string))
+		if !ok {
+			send(ctx, u, t.ERROR, t.T{"Err": "unknown currency, use sat or a fiat code like USD."})
+			return
+		}
+
+		data.Items = append(data.Items, POSItem{
+			Name:     strings.Join(opts["<name>"].([]string), " "),
+			Price:    price,
+			Currency: currency,
+		})
+		if err := u.setAppData("pos", data); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.POSCATALOG, t.T{"Items": data.Items})
+		go u.track("pos item added", map[string]interface{}{"currency": currency})
+	case opts["del"].(bool):
+		idx, err := opts.Int("<item_number>")
+		if err != nil || idx < 1 || idx > len(data.Items) {
+			send(ctx, u, t.ERROR, t.T{"Err": "there's no such item."})
+			return
+		}
+
+		data.Items = append(data.Items[:idx-1], data.Items[idx:]...)
+		if err := u.setAppData("pos", data); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		// indexes have changed
+		rds.Del(redisKeyPOSOrder(u))
+
+		send(ctx, u, t.POSCATALOG, t.T{"Items": data.Items})
+	case opts["list"].(bool):
+		send(ctx, u, t.POSCATALOG, t.T{"Items": data.Items})
+	case opts["sales"].(bool):
+		now := time.Now().UTC()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		summary, err := u.posSalesSummary(today, today.AddDate(0, 0, 1))
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, u, t.POSSALES, t.T{"Summary": summary})
+		go u.track("pos sales", nil)
+	case opts["web"].(bool):
+		if data.Token == "" || opts["reset"].(bool) {
+			token, err := randomHex()
+			if err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+			data.Token = token[:24]
+			if err := u.setAppData("pos", data); err != nil {
+				send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+				return
+			}
+		}
+
+		send(ctx, u, t.POSWEB, t.T{"URL": s.ServiceURL + "/pos/" + data.Token})
+		go u.track("pos web", nil)
+	default:
+		if len(data.Items) == 0 {
+			send(ctx, u, t.POSCATALOG, t.T{"Items": data.Items})
+			return
+		}
+
+		order := make(map[int]int)
+		u.setPOSOrder(order)
+		send(ctx, u, t.POSORDER, posOrderParams(data.Items, order),
+			posKeyboard(ctx, data.Items))
+		go u.track("pos start", nil)
+	}
+}
+
+func handlePOSCallback(ctx context.Context, action string) {
+	u := ctx.Value("initiator").(*User)
+	data := u.getPOSData()
+	order := u.getPOSOrder()
+
+	switch {
+	case strings.HasPrefix(action, "a"):
+		idx, err := strconv.Atoi(action[1:])
+		if err != nil || idx < 0 || idx >= len(data.Items) {
+			return
+		}
+		if order[idx] >= POSMAXQUANTITY {
+			return
+		}
+		order[idx]++
+		u.setPOSOrder(order)
+
+		send(ctx, EDIT, t.POSORDER, posOrderParams(data.Items, order),
+			posKeyboard(ctx, data.Items))
+	case action == "x":
+		order = make(map[int]int)
+		u.setPOSOrder(order)
+
+		send(ctx, EDIT, t.POSORDER, posOrderParams(data.Items, order),
+			posKeyboard(ctx, data.Items))
+	case action == "c":
+		lines := posOrderLines(data.Items, order)
+		sale, bolt11, err := createPOSSale(ctx, u, lines)
+		if err != nil {
+			send(ctx, WITHALERT, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		rds.Del(redisKeyPOSOrder(u))
+
+		// the order is done, the next customer starts a new one
+		params := posOrderParams(data.Items, order)
+		params["Id"] = sale.Id
+		send(ctx, EDIT, t.POSORDER, params)
+
+		invoiceMessageId := send(ctx, u, qrURL(bolt11), "<pre>"+bolt11+"</pre>")
+		go waitPOSSale(ctx, u, sale, invoiceMessageId)
+	}
+}
+
+func posSummaryRoutine() {
+	for {
+		now := time.Now().UTC()
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		time.Sleep(time.Until(midnight))
+		sendPOSSummaries(midnight.AddDate(0, 0, -1), midnight)
+	}
+}
+
+// sendPOSSummaries tells every merchant that sold something how the day went.
+func sendPOSSummaries(from, to time.Time) {
+	var merchants []int
+	err := pg.Select(&merchants, `
+SELECT DISTINCT s.merchant FROM pos_sale AS s
+INNER JOIN lightning.transaction AS t
+  ON t.payment_hash = s.payment_hash AND t.to_id = s.merchant
+WHERE t.time >= $1 AND t.time < $2
+    `, from, to)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch merchants for daily summary")
+		return
+	}
+
+	ctx := context.WithValue(context.Background(), "origin", "background")
+	for _, id := range merchants {
+		merchant, err := loadUser(id)
+		if err != nil {
+			continue
+		}
+		summary, err := merchant.posSalesSummary(from, to)
+		if err != nil || summary.Count == 0 {
+			continue
+		}
+		send(ctx, merchant, t.POSSALES, t.T{"Summary": summary})
+	}
+}
+
+func loadPOSMerchant(token string) (*User, error) {
+	if len(token) < 24 {
+		return nil, errors.New("invalid token")
+	}
+
+	var id int
+	err := pg.Get(&id, `
+SELECT id FROM account WHERE appdata -> 'pos' ->> 'token' = $1
+    `, token)
+	if err != nil {
+		return nil, err
+	}
+	return loadUser(id)
+}
+
+// the web page of each merchant can only create so many invoices, since
+// anyone with the link can use it.
+var posRateLimitBuckets = &sync.Map{}
+
+func getPOSRateLimitBucket(merchantId int) *ratelimit.Bucket {
+	bucket, _ := posRateLimitBuckets.LoadOrStore(merchantId,
+		ratelimit.NewBucket(time.Minute, 30))
+	return bucket.(*ratelimit.Bucket)
+}
+
+func servePOSPages() {
+	ctx := context.WithValue(context.Background(), "origin", "external")
+
+	router.Path("/pos/{token}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchant, err := loadPOSMerchant(mux.Vars(r)["token"])
+		if err != nil {
+			http.Error(w, "point of sale not found", 404)
+			return
+		}
+
+		if err = tmpl.ExecuteTemplate(w, "pos", struct {
+			Merchant string
+			Items    []POSItem
+		}{merchant.Username, merchant.getPOSData().Items}); err != nil {
+			log.Error().Err(err).Stringer("merchant", merchant).Msg("failed to render template")
+		}
+	})
+
+	router.Path("/pos/{token}/charge").Methods("POST").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchant, err := loadPOSMerchant(mux.Vars(r)["token"])
+		if err != nil {
+			http.Error(w, "point of sale not found", 404)
+			return
+		}
+
+		var params struct {
+			Order map[int]int `json:"order"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			http.Error(w, "invalid order", 400)
+			return
+		}
+		for _, quantity := range params.Order {
+			if quantity > POSMAXQUANTITY {
+				http.Error(w, fmt.Sprintf("at most %d of each item.", POSMAXQUANTITY), 400)
+				return
+			}
+		}
+
+		if getPOSRateLimitBucket(merchant.Id).TakeAvailable(1) == 0 {
+			http.Error(w, "too many invoices, try again in a minute.", 429)
+			return
+		}
+
+		lines := posOrderLines(merchant.getPOSData().Items, params.Order)
+		sale, bolt11, err := createPOSSale(ctx, merchant, lines)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		go waitPOSSale(ctx, merchant, sale, nil)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":      sale.Id,
+			"sats":    sale.Msats / 1000,
+			"invoice": bolt11,
+			"qr":      qrURL(bolt11).String(),
+			"hash":    sale.PaymentHash,
+		})
+	})
+
+	router.Path("/pos/{token}/wait/{hash}").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchant, err := loadPOSMerchant(mux.Vars(r)["token"])
+		if err != nil {
+			http.Error(w, "point of sale not found", 404)
+			return
+		}
+
+		var sale POSSale
+		err = pg.Get(&sale, `
+SELECT * FROM pos_sale WHERE payment_hash = $1 AND merchant = $2
+        `, mux.Vars(r)["hash"], merchant.Id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "sale not found", 404)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+
+		paid := posSaleIsPaid(sale)
+		if !paid {
+			wait := waitInvoice(sale.PaymentHash)
+			select {
+			case <-wait:
+				paid = true
+			case <-r.Context().Done():
+				stopWaitingInvoice(sale.PaymentHash, wait)
+				return
+			case <-time.After(60 * time.Second):
+				stopWaitingInvoice(sale.PaymentHash, wait)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"paid": paid})
+	})
+}
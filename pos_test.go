@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestPOSOrderMsatsInSats(t *testing.T) {
+	msats, err := posOrderMsats([]POSOrderLine{
+		{POSItem{"coffee", 2500, "sat"}, 2},
+		{POSItem{"cookie", 0.5, "sat"}, 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msats != 5001500 {
+		t.Errorf("expected 5001500 msats, got %d", msats)
+	}
+
+	msats, err = posOrderMsats(nil)
+	if err != nil || msats != 0 {
+		t.Errorf("empty order: got %d, %v", msats, err)
+	}
+}
+
+func TestPOSOrderLines(t *testing.T) {
+	items := []POSItem{{"a", 1, "sat"}, {"b", 2, "sat"}, {"c", 3, "sat"}}
+	lines := posOrderLines(items, map[int]int{2: 1, 0: 4, 1: 0, 7: 1, -1: 2})
+	if len(lines) != 2 ||
+		lines[0].Name != "a" || lines[0].Quantity != 4 ||
+		lines[1].Name != "c" || lines[1].Quantity != 1 {
+		t.Errorf("unexpected lines %v", lines)
+	}
+}
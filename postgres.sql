@@ -10,7 +10,9 @@ CREATE TABLE account (
   password text NOT NULL DEFAULT md5(random()::text) || md5(random()::text), -- used in lndhub interface
   locale text NOT NULL DEFAULT 'en', -- default language for messages
   manual_locale boolean NOT NULL DEFAULT false,
-  appdata jsonb NOT NULL DEFAULT '{}' -- data for all apps this user have, as a map of {"appname": {anything}}
+  appdata jsonb NOT NULL DEFAULT '{}', -- data for all apps this user have, as a map of {"appname": {anything}}
+  event_seq bigint NOT NULL DEFAULT 0, -- last account_event.seq, bumped under the row lock
+  deleted_at timestamptz -- set when the user deleted the account, see account_deletion
 );
 
 CREATE TABLE balance_check (
@@ -28,10 +30,341 @@ CREATE TABLE groupchat (
   ticket int NOT NULL DEFAULT 0,
   renamable int NOT NULL DEFAULT 0,
   coinflips bool NOT NULL DEFAULT true,
-  expensive_price int NOT NULL DEFAULT 0,
-  expensive_pattern text NOT NULL DEFAULT ''
+  treasury int REFERENCES account (id), -- account that collects money for the group
+
+  -- paid memberships, charged every period instead of a one-time ticket
+  subscription_price int NOT NULL DEFAULT 0, -- in sat, 0 means no subscription
+  subscription_period int NOT NULL DEFAULT 30, -- in days
+  subscription_grace int NOT NULL DEFAULT 3, -- days members have to pay after the period ends
+
+  -- tipping by replying to messages with an emoji or +N
+  reactions boolean NOT NULL DEFAULT false,
+  reaction_emoji text NOT NULL DEFAULT '👍 ⚡', -- space-separated
+
+  -- coinflip and giveflip house rules
+  coinflip_min int NOT NULL DEFAULT 0, -- entry bounds in sat, 0 means no limit
+  coinflip_max int NOT NULL DEFAULT 0,
+  coinflip_players int NOT NULL DEFAULT 100,
+  coinflip_tax int, -- percent of each entry for the group, null means no tax (the bot fee is charged anyway)
+  coinflip_tax_to text NOT NULL DEFAULT 'owner', -- 'owner' or 'treasury'
+  coinflip_quota int, -- per user per day, null means the global default
+  giveflip_quota int,
+  coinflip_hours_start int NOT NULL DEFAULT 0, -- allowed hours window in UTC,
+  coinflip_hours_end int NOT NULL DEFAULT 0 -- start = end means any time
+);
+
+CREATE TABLE coinflip (
+  id text PRIMARY KEY,
+  time timestamptz NOT NULL DEFAULT now(),
+  commitment text NOT NULL, -- sha256 of the seed, published when the coinflip is created
+  seed text NOT NULL, -- revealed when the coinflip is settled
+  entries jsonb NOT NULL, -- ordered list of "<account_id>:<join_data>"
+  winner int REFERENCES account (id),
+  sats int NOT NULL
+);
+
+CREATE TABLE group_charge (
+  key text PRIMARY KEY,
+  kind text NOT NULL, -- ticket, deposit, fine or renewal
+  group_id bigint NOT NULL,
+  telegram_id bigint NOT NULL, -- the user who must pay
+  status text NOT NULL DEFAULT 'pending', -- pending, paid, expired or cancelled
+  deadline timestamptz NOT NULL,
+  data jsonb NOT NULL, -- the KickData
+  created_at timestamptz NOT NULL DEFAULT now(),
+  resolved_at timestamptz
+);
+
+CREATE INDEX ON group_charge (group_id, telegram_id) WHERE status = 'pending';
+CREATE INDEX ON group_charge (status);
+
+CREATE TABLE group_membership (
+  group_id bigint NOT NULL REFERENCES groupchat (telegram_id),
+  telegram_id bigint NOT NULL, -- the member
+  username text NOT NULL DEFAULT '',
+  paid_until timestamptz NOT NULL,
+  status text NOT NULL DEFAULT 'active', -- active, pending (renewal invoice sent), lapsed or left
+
+  PRIMARY KEY (group_id, telegram_id)
+);
+
+CREATE INDEX ON group_membership (status, paid_until);
+
+CREATE TABLE expensive_rule (
+  id serial PRIMARY KEY,
+  group_id bigint NOT NULL REFERENCES groupchat (telegram_id),
+  price int NOT NULL, -- sat per message
+  pattern text NOT NULL DEFAULT '', -- regex, empty matches any text
+  media text NOT NULL DEFAULT '', -- comma-separated photo, video, link, forward. empty matches any message
+  destination text NOT NULL DEFAULT 'owner', -- owner or treasury
+  exempt_admins boolean NOT NULL DEFAULT true,
+  exempt_whitelisted boolean NOT NULL DEFAULT true
+);
+
+CREATE INDEX ON expensive_rule (group_id);
+
+CREATE TABLE expensive_exempt (
+  group_id bigint NOT NULL REFERENCES groupchat (telegram_id),
+  telegram_id bigint NOT NULL,
+  username text NOT NULL DEFAULT '',
+
+  PRIMARY KEY (group_id, telegram_id)
+);
+
+CREATE TABLE deposit_policy (
+  group_id bigint PRIMARY KEY REFERENCES groupchat (telegram_id),
+  sats int NOT NULL DEFAULT 0, -- 0 means no deposits
+  days int NOT NULL DEFAULT 7, -- given back after this many days
+  messages int NOT NULL DEFAULT 0, -- or after this many messages, 0 to ignore
+  forfeit_to text NOT NULL DEFAULT 'owner' -- owner or treasury
+);
+
+CREATE TABLE group_deposit (
+  id serial PRIMARY KEY,
+  group_id bigint NOT NULL REFERENCES groupchat (telegram_id),
+  telegram_id bigint NOT NULL, -- the member
+  username text,
+  account int NOT NULL REFERENCES account (id), -- who paid and gets it back
+  source_hash text NOT NULL,
+  target_hash text NOT NULL,
+  sats int NOT NULL,
+  messages int NOT NULL DEFAULT 0,
+  status text NOT NULL DEFAULT 'locked', -- locked, refunded or forfeited
+  created_at timestamptz NOT NULL DEFAULT now(),
+  resolved_at timestamptz
+);
+
+CREATE UNIQUE INDEX ON group_deposit (group_id, telegram_id) WHERE status = 'locked';
+
+CREATE TABLE hidden_message (
+  id text PRIMARY KEY, -- see getHiddenId
+  author int NOT NULL REFERENCES account (id),
+  preview text NOT NULL DEFAULT '',
+  content text NOT NULL DEFAULT '',
+  copy_chat bigint, -- message copied on reveal
+  copy_message int,
+  media_type text NOT NULL DEFAULT '', -- photo, document or voice
+  media_file text NOT NULL DEFAULT '', -- telegram file_id
+  times int NOT NULL DEFAULT 0, -- max revealers, 0 means unlimited
+  crowdfund int NOT NULL DEFAULT 1,
+  public boolean NOT NULL DEFAULT true,
+  satoshis int NOT NULL,
+  reveals int NOT NULL DEFAULT 0,
+  revenue bigint NOT NULL DEFAULT 0, -- in msatoshis
+  created_at timestamptz NOT NULL DEFAULT now(),
+  expires_at timestamptz NOT NULL,
+  withdrawn boolean NOT NULL DEFAULT false,
+  web boolean NOT NULL DEFAULT false, -- also sold on a public page
+  downloads int NOT NULL DEFAULT 0 -- allowed per web payment
+);
+
+CREATE INDEX ON hidden_message (author, created_at);
+
+CREATE TABLE hidden_revealer (
+  hidden_id text NOT NULL REFERENCES hidden_message (id) ON DELETE CASCADE,
+  account int NOT NULL REFERENCES account (id),
+  time timestamptz NOT NULL DEFAULT now(),
+
+  PRIMARY KEY (hidden_id, account)
+);
+
+CREATE TABLE hidden_web_access (
+  payment_hash text PRIMARY KEY,
+  hidden_id text NOT NULL REFERENCES hidden_message (id) ON DELETE CASCADE,
+  bolt11 text NOT NULL DEFAULT '', -- shown again to the same visitor until paid or expired
+  token text UNIQUE NOT NULL, -- secret part of the content link, only given after payment
+  downloads int NOT NULL DEFAULT 0,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  paid_at timestamptz
+);
+
+CREATE TABLE pos_sale (
+  id serial PRIMARY KEY,
+  merchant int NOT NULL REFERENCES account (id),
+  payment_hash text UNIQUE NOT NULL, -- paid once there's a transaction with it
+  items jsonb NOT NULL, -- list of {name, price, currency, quantity}
+  msats bigint NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX ON pos_sale (merchant, created_at);
+CREATE INDEX ON account ((appdata -> 'pos' ->> 'token')); -- see loadPOSMerchant
+
+CREATE TABLE analytics_event (
+  time timestamptz NOT NULL DEFAULT now(),
+  account int NOT NULL,
+  event text NOT NULL,
+  properties jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX ON analytics_event (time);
+CREATE INDEX ON analytics_event (event, time);
+
+CREATE TABLE account_event (
+  id bigserial PRIMARY KEY,
+  account int NOT NULL REFERENCES account (id),
+  seq bigint NOT NULL, -- per account, clients resume streams from here
+  kind text NOT NULL, -- received, sent, failed, internal or app
+  data jsonb NOT NULL,
+  created_at timestamptz NOT NULL DEFAULT now(),
+
+  UNIQUE (account, seq)
+);
+
+CREATE INDEX ON account_event (created_at);
+
+CREATE TABLE webhook_subscription (
+  id serial PRIMARY KEY,
+  account int NOT NULL REFERENCES account (id),
+  url text NOT NULL,
+  events text NOT NULL DEFAULT '', -- comma-separated, empty means all
+  created_at timestamptz NOT NULL DEFAULT now(),
+
+  UNIQUE (account, url)
+);
+
+CREATE TABLE webhook_delivery (
+  id bigserial PRIMARY KEY,
+  account int NOT NULL REFERENCES account (id),
+  url text NOT NULL,
+  event text NOT NULL,
+  payload jsonb NOT NULL, -- signed again on each attempt
+  status text NOT NULL DEFAULT 'pending', -- pending, delivered or failed
+  attempts int NOT NULL DEFAULT 0,
+  next_attempt timestamptz NOT NULL DEFAULT now(),
+  last_response int, -- http status code, null if the request didn't complete
+  last_error text,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  delivered_at timestamptz
 );
 
+CREATE INDEX ON webhook_delivery (status, next_attempt);
+CREATE INDEX ON webhook_delivery (account, id);
+
+CREATE TABLE ban (
+  id serial PRIMARY KEY,
+  account int NOT NULL REFERENCES account (id),
+  scope text NOT NULL DEFAULT 'all' CHECK (scope IN ('all', 'send', 'apps', 'sats4ads')),
+  reason text NOT NULL DEFAULT '',
+  until timestamptz, -- null means forever
+  banned_by int REFERENCES account (id),
+  created_at timestamptz NOT NULL DEFAULT now(),
+  lifted_at timestamptz
+);
+
+CREATE INDEX ON ban (account) WHERE lifted_at IS NULL;
+
+CREATE TABLE solvency_report (
+  id serial PRIMARY KEY,
+  created_at timestamptz NOT NULL DEFAULT now(),
+  liabilities bigint NOT NULL, -- msats, the sum of the merkle-sum tree
+  channels bigint NOT NULL, -- msats
+  onchain bigint NOT NULL, -- msats
+  accounts int NOT NULL,
+  root text NOT NULL
+);
+
+CREATE TABLE solvency_leaf (
+  report int NOT NULL REFERENCES solvency_report (id),
+  position int NOT NULL,
+  account int NOT NULL REFERENCES account (id),
+  nonce text NOT NULL,
+  balance bigint NOT NULL,
+  PRIMARY KEY (report, position)
+);
+
+CREATE INDEX ON solvency_leaf (report, account);
+
+CREATE TABLE account_merge (
+  id serial PRIMARY KEY,
+  time timestamptz NOT NULL DEFAULT now(),
+  remaining int NOT NULL REFERENCES account (id),
+  removed int UNIQUE NOT NULL, -- the deleted account, its api tokens still work
+  removed_telegram_id bigint,
+  removed_username text,
+  removed_password text NOT NULL,
+  removed_appdata jsonb NOT NULL,
+  moved jsonb NOT NULL DEFAULT '{}' -- number of rows moved from each table
+);
+
+CREATE TABLE account_deletion (
+  id serial PRIMARY KEY,
+  account int NOT NULL REFERENCES account (id),
+  requested_at timestamptz NOT NULL DEFAULT now(),
+  execute_at timestamptz NOT NULL, -- after the cooling-off period
+  status text NOT NULL DEFAULT 'scheduled', -- scheduled, canceled, done or failed
+  error text,
+  resolved_at timestamptz
+);
+
+CREATE UNIQUE INDEX ON account_deletion (account) WHERE status = 'scheduled';
+
+CREATE TABLE audit_log (
+  id bigserial PRIMARY KEY,
+  time timestamptz NOT NULL DEFAULT now(),
+  actor int, -- the user who started the action, null for background jobs
+  origin text NOT NULL, -- telegram, api, lnurl, background...
+  action text NOT NULL,
+  account int NOT NULL, -- no foreign key so entries survive merges and deletions
+  balance_before bigint NOT NULL, -- msats
+  balance_after bigint NOT NULL, -- msats
+  payment_hash text,
+  details jsonb NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX ON audit_log (account, time);
+CREATE INDEX ON audit_log (action, time);
+
+-- append-only, changes fail loudly instead of being silently dropped
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only, % is not allowed', TG_OP;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only
+  BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE PROCEDURE audit_log_append_only();
+
+CREATE TABLE sats4ads_campaign (
+  id serial PRIMARY KEY,
+  time timestamptz NOT NULL DEFAULT now(),
+  advertiser int NOT NULL REFERENCES account (id),
+  source_hash text UNIQUE NOT NULL, -- proxied_with of all payments to the ad receivers
+  status text NOT NULL DEFAULT 'scheduled', -- scheduled, running, done or canceled
+  starts_at timestamptz NOT NULL DEFAULT now(),
+  content jsonb NOT NULL, -- the telegram message used as the ad
+  trigger_message int NOT NULL DEFAULT 0,
+  max_rate int NOT NULL,
+  skip int NOT NULL DEFAULT 0,
+  budget int NOT NULL, -- in sat
+  targeting jsonb NOT NULL DEFAULT '{}',
+  links jsonb NOT NULL DEFAULT '[]', -- links in the ad, served through a click-counting redirect
+  sent int NOT NULL DEFAULT 0,
+  cost numeric(13) NOT NULL DEFAULT 0, -- in msatoshis
+  views int NOT NULL DEFAULT 0,
+  viewed_cost numeric(13) NOT NULL DEFAULT 0,
+  refunds int NOT NULL DEFAULT 0, -- ads that weren't viewed and were refunded
+  refunded numeric(13) NOT NULL DEFAULT 0,
+  clicks int NOT NULL DEFAULT 0, -- unique viewers that clicked on any link
+  error text
+);
+
+CREATE INDEX ON sats4ads_campaign (advertiser);
+CREATE INDEX ON sats4ads_campaign (status);
+
+CREATE TABLE sats4ads_delivery (
+  id bigserial PRIMARY KEY, -- deliveries are sent in this order
+  campaign int NOT NULL REFERENCES sats4ads_campaign (id),
+  receiver int NOT NULL REFERENCES account (id),
+  rate int NOT NULL,
+  status text NOT NULL DEFAULT 'queued', -- queued, sent or skipped
+
+  UNIQUE (campaign, receiver)
+);
+
+CREATE INDEX ON sats4ads_delivery (status);
+
 CREATE TABLE lightning.transaction (
   time timestamptz NOT NULL DEFAULT now(),
   from_id int REFERENCES account (id),
@@ -47,7 +380,8 @@ CREATE TABLE lightning.transaction (
   remote_node text,
   anonymous boolean NOT NULL DEFAULT false,
   tag text,
-  proxied_with text -- the transaction related to this if used the proxy account
+  proxied_with text, -- the transaction related to this if used the proxy account
+  chat_id bigint -- the group where this was triggered, if any
 );
 
 CREATE INDEX ON lightning.transaction (from_id);
@@ -56,6 +390,7 @@ CREATE INDEX ON lightning.transaction (label);
 CREATE INDEX ON lightning.transaction (payment_hash);
 CREATE INDEX ON lightning.transaction (pending);
 CREATE INDEX ON lightning.transaction (proxied_with);
+CREATE INDEX ON lightning.transaction (chat_id, time) WHERE chat_id IS NOT NULL;
 
 CREATE VIEW lightning.account_txn AS
   SELECT
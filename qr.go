@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/base64"
 	"errors"
+	"image/jpeg"
 	"io"
 	"net/http"
 	"net/url"
@@ -42,8 +43,13 @@ func serveQRCodes() {
 				return
 			}
 
-			w.Header().Set("Content-Type", "image/png")
-			err = qr.Write(256, w)
+			if r.URL.Query().Get("format") == "jpeg" {
+				w.Header().Set("Content-Type", "image/jpeg")
+				err = jpeg.Encode(w, qr.Image(256), nil)
+			} else {
+				w.Header().Set("Content-Type", "image/png")
+				err = qr.Write(256, w)
+			}
 			if err != nil {
 				log.Warn().Err(err).Str("value", value).Msg("failed to write qr")
 				http.Error(w, "failed to write "+value+" as a QR code.", 400)
@@ -61,6 +67,13 @@ func qrURL(value string) *url.URL {
 	return u
 }
 
+// qrJPEGURL is for places that only take jpeg, like inline query photos.
+func qrJPEGURL(value string) *url.URL {
+	u := qrURL(value)
+	u.RawQuery = "format=jpeg"
+	return u
+}
+
 func decodeQR(fileurl string) (data string, err error) {
 	chineselibrary := make(chan string)
 	qrserver := make(chan string)
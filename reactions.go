@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"gopkg.in/redis.v5"
+)
+
+// groups that enable reactions let people tip a message by replying to it with
+// one of the configured emoji (which sends their default upvote amount) or with
+// something like +21.
+
+const (
+	DEFAULTUPVOTESATS    = 10
+	DEFAULTREACTIONEMOJI = "👍 ⚡"
+	MAXREACTIONSATS      = 10000
+)
+
+var plusAmountRegex = regexp.MustCompile(`^\+(\d+)$`)
+
+type UpvoteSettings struct {
+	Sats int `json:"sats"`
+}
+
+func (u User) getUpvoteSats() int {
+	var settings UpvoteSettings
+	if err := u.getAppData("upvote", &settings); err != nil || settings.Sats == 0 {
+		return DEFAULTUPVOTESATS
+	}
+	return settings.Sats
+}
+
+func (g GroupChat) setReactions(enabled bool, emoji string) (err error) {
+	_, err = pg.Exec(`
+UPDATE groupchat SET reactions = $2, reaction_emoji = $3
+WHERE telegram_id = $1
+    `, g.TelegramId, enabled, emoji)
+	return
+}
+
+func (g GroupChat) reactionEmoji() []string {
+	if g.ReactionEmoji == "" {
+		return strings.Fields(DEFAULTREACTIONEMOJI)
+	}
+	return strings.Fields(g.ReactionEmoji)
+}
+
+// parseReaction returns the amount in sat this reply is tipping, or 0 if it
+// isn't a reaction.
+func (g GroupChat) parseReaction(u *User, text string) int {
+	text = strings.TrimSpace(text)
+
+	if m := plusAmountRegex.FindStringSubmatch(text); m != nil {
+		sats, _ := strconv.Atoi(m[1])
+		return sats
+	}
+
+	for _, emoji := range g.reactionEmoji() {
+		if text == emoji {
+			return u.getUpvoteSats()
+		}
+	}
+
+	return 0
+}
+
+func handleReactionTip(ctx context.Context, g GroupChat, message *tgbotapi.Message) {
+	u := ctx.Value("initiator").(*User)
+
+	if !g.Reactions || message.ReplyToMessage == nil ||
+		message.ReplyToMessage.From == nil || message.ReplyToMessage.From.IsBot ||
+		message.ReplyToMessage.From.ID == message.From.ID {
+		return
+	}
+
+	sats := g.parseReaction(u, message.Text)
+	if sats == 0 {
+		return
+	}
+	if sats > MAXREACTIONSATS {
+		send(ctx, u, t.ERROR, t.T{
+			"Err": fmt.Sprintf("reactions can't send more than %d sat.", MAXREACTIONSATS),
+		})
+		return
+	}
+
+	// each message can only be upvoted once by each user
+	key := fmt.Sprintf("reaction:%d:%d:%d",
+		message.Chat.ID, message.ReplyToMessage.MessageID, u.Id)
+	if ok, _ := rds.SetNX(key, sats, time.Hour*24*7).Result(); !ok {
+		return
+	}
+
+	receiver, cas, err := ensureTelegramUser(message.ReplyToMessage)
+	if err != nil {
+		rds.Del(key)
+		log.Warn().Err(err).Int("case", cas).
+			Int("id", message.ReplyToMessage.From.ID).
+			Msg("failed to ensure user on reaction tip")
+		return
+	}
+
+	err = u.sendInternally(
+		ctx,
+		receiver,
+		false,
+		int64(sats)*1000,
+		0,
+		"Reaction to "+telegramMessageLink(message.ReplyToMessage),
+		"",
+		"reaction",
+	)
+	if err != nil {
+		rds.Del(key)
+		log.Debug().Err(err).Stringer("from", u).Stringer("to", receiver).
+			Msg("failed to send reaction tip")
+		send(ctx, u, t.FAILEDSEND, t.T{"Err": err.Error()})
+		return
+	}
+
+	registerLeaderboardEarnings(message.Chat.ID, receiver, sats)
+
+	go u.track("reaction tip", map[string]interface{}{
+		"group": message.Chat.ID,
+		"sats":  sats,
+	})
+
+	// notify privately if possible, publicly otherwise
+	send(ctx, u, t.USERSENTTOUSER, t.T{
+		"User":              receiver.AtName(ctx),
+		"Sats":              sats,
+		"ReceiverHasNoChat": receiver.TelegramChatId == 0,
+	})
+	if receiver.hasPrivateChat() && !g.Spammy {
+		send(ctx, receiver, t.USERSENTYOUSATS, t.T{
+			"User": u.AtName(ctx),
+			"Sats": sats,
+		})
+	} else {
+		send(ctx, g, t.SATSGIVENPUBLIC, t.T{
+			"From":             u.AtName(ctx),
+			"To":               receiver.AtName(ctx),
+			"Sats":             sats,
+			"ClaimerHasNoChat": receiver.TelegramChatId == 0,
+		}, message, FORCESPAMMY)
+	}
+}
+
+func redisKeyLeaderboard(groupId int64, when time.Time) string {
+	year, week := when.ISOWeek()
+	return fmt.Sprintf("leaderboard:%d:%d-%d", groupId, year, week)
+}
+
+func registerLeaderboardEarnings(groupId int64, receiver *User, sats int) {
+	key := redisKeyLeaderboard(groupId, time.Now())
+	rds.ZIncrBy(key, float64(sats), strconv.Itoa(receiver.Id))
+	rds.Expire(key, time.Hour*24*15)
+}
+
+type LeaderboardEntry struct {
+	User string
+	Sats int
+}
+
+func handleLeaderboard(ctx context.Context) {
+	u := ctx.Value("initiator").(*User)
+	message := ctx.Value("message").(*tgbotapi.Message)
+
+	if message.Chat.Type == "private" {
+		send(ctx, u, t.MUSTBEGROUP)
+		return
+	}
+
+	g := ctx.Value("group").(GroupChat)
+
+	scores, err := rds.ZRevRangeWithScores(
+		redisKeyLeaderboard(message.Chat.ID, time.Now()), 0, 9).Result()
+	if err != nil && err != redis.Nil {
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	entries := make([]LeaderboardEntry, 0, len(scores))
+	for _, score := range scores {
+		id, _ := strconv.Atoi(score.Member.(string))
+		user, err := loadUser(id)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, LeaderboardEntry{
+			User: user.AtName(ctx),
+			Sats: int(score.Score),
+		})
+	}
+
+	go u.track("leaderboard", map[string]interface{}{"group": message.Chat.ID})
+
+	send(ctx, g, t.LEADERBOARD, t.T{"Entries": entries})
+}
+
+func handleUpvote(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+
+	msats, err := parseSatoshis(opts)
+	if err == nil {
+		sats := int(msats / 1000)
+		if sats > MAXREACTIONSATS {
+			send(ctx, u, t.ERROR, t.T{
+				"Err": fmt.Sprintf("reactions can't send more than %d sat.", MAXREACTIONSATS),
+			})
+			return
+		}
+
+		if err := u.setAppData("upvote", UpvoteSettings{Sats: sats}); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		go u.track("upvote set", map[string]interface{}{"sats": sats})
+	}
+
+	send(ctx, u, t.UPVOTEMSG, t.T{"Sats": u.getUpvoteSats()})
+}
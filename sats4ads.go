@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -18,9 +19,85 @@ import (
 const SATS4ADSUNACTIVITYDATEFORMAT = "20060102"
 
 type Sats4AdsData struct {
-	On     bool `json:"on"`
-	Rate   int  `json:"rate"` // in msatoshi per character
-	Banned bool `json:"banned,omitempty"`
+	On     bool     `json:"on"`
+	Rate   int      `json:"rate"` // in msatoshi per character
+	Banned bool     `json:"banned,omitempty"`
+	Tags   []string `json:"tags,omitempty"` // self-declared interests
+}
+
+// who should receive an ad, besides the rate
+type Sats4AdsTargeting struct {
+	Locale     string   `json:"locale,omitempty"`
+	Tags       []string `json:"tags,omitempty"`        // receivers must have at least one of these
+	ActiveDays int      `json:"active_days,omitempty"` // receivers must have used the wallet recently
+}
+
+func sats4adsTargetingFromOpts(opts docopt.Opts) (targeting Sats4AdsTargeting, err error) {
+	targeting.Locale, _ = opts.String("--locale")
+	targeting.Locale = strings.ToLower(targeting.Locale)
+	if targeting.Locale != "" {
+		if _, ok := bundle.Translations[targeting.Locale]; !ok {
+			return targeting, fmt.Errorf("unknown locale '%s'.", targeting.Locale)
+		}
+	}
+
+	if tags, err := opts.String("--tags"); err == nil {
+		targeting.Tags = normalizeSats4AdsTags(strings.Split(tags, ","))
+	}
+
+	if active, err := opts.String("--active"); err == nil {
+		targeting.ActiveDays, err = strconv.Atoi(active)
+		if err != nil || targeting.ActiveDays < 0 {
+			return targeting, fmt.Errorf("invalid number of days '%s'.", active)
+		}
+	}
+
+	return targeting, nil
+}
+
+func normalizeSats4AdsTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimLeft(strings.TrimSpace(tag), "#"))
+		if tag == "" || stringIsIn(tag, normalized) {
+			continue
+		}
+		normalized = append(normalized, tag)
+		if len(normalized) == 10 {
+			break
+		}
+	}
+	return normalized
+}
+
+func (targeting Sats4AdsTargeting) IsEmpty() bool {
+	return targeting.Locale == "" && len(targeting.Tags) == 0 && targeting.ActiveDays == 0
+}
+
+// condition returns a SQL condition to be applied on the "account" table,
+// with params starting at $<first>.
+func (targeting Sats4AdsTargeting) condition(first int) (string, []interface{}) {
+	tags := targeting.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	jtags, _ := json.Marshal(tags)
+
+	return fmt.Sprintf(`
+  ($%[1]d = '' OR account.locale = $%[1]d)
+  AND ($%[2]d::jsonb = '[]'::jsonb OR
+    coalesce(account.appdata->'sats4ads'->'tags', '[]'::jsonb)
+      ?| ARRAY(SELECT jsonb_array_elements_text($%[2]d::jsonb)))
+  AND ($%[3]d::int = 0 OR
+    EXISTS (
+      SELECT 1 FROM lightning.transaction
+      WHERE from_id = account.id AND time > now() - make_interval(days => $%[3]d::int)
+    ) OR EXISTS (
+      SELECT 1 FROM lightning.transaction
+      WHERE to_id = account.id AND time > now() - make_interval(days => $%[3]d::int)
+        AND tag IS DISTINCT FROM 'sats4ads'
+    ))
+`, first, first+1, first+2), []interface{}{targeting.Locale, string(jtags), targeting.ActiveDays}
 }
 
 type Sats4AdsRateGroup struct {
@@ -63,15 +140,54 @@ func handleSats4Ads(ctx context.Context, u *User, opts docopt.Opts) {
 
 		send(ctx, u, t.SATS4ADSTOGGLE, t.T{"On": false})
 	case opts["rates"].(bool):
-		rates, err := getSats4AdsRates()
+		targeting, err := sats4adsTargetingFromOpts(opts)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+			return
+		}
+
+		rates, err := getSats4AdsRates(targeting)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+			return
+		}
+
+		go u.track("sats4ads rates", map[string]interface{}{
+			"targeted": !targeting.IsEmpty(),
+		})
+
+		text := translateTemplate(ctx, t.SATS4ADSPRICETABLE, t.T{"Rates": rates})
+		if !targeting.IsEmpty() {
+			text = translateTemplate(ctx, t.SATS4ADSTARGETING, t.T{
+				"Targeting": targeting,
+			}) + "\n" + text
+		}
+		send(ctx, u, text)
+	case opts["tags"].(bool):
+		var data Sats4AdsData
+		err := u.getAppData("sats4ads", &data)
 		if err != nil {
 			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
 			return
 		}
 
-		go u.track("sats4ads rates", nil)
+		if opts["clear"].(bool) {
+			data.Tags = nil
+		} else if interests := opts["<interest>"].([]string); len(interests) > 0 {
+			data.Tags = normalizeSats4AdsTags(interests)
+		} else {
+			send(ctx, u, t.SATS4ADSTAGS, t.T{"Tags": data.Tags})
+			return
+		}
+
+		go u.track("sats4ads tags", map[string]interface{}{"n": len(data.Tags)})
 
-		send(ctx, u, t.SATS4ADSPRICETABLE, t.T{"Rates": rates})
+		err = u.setAppData("sats4ads", data)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.SATS4ADSTAGS, t.T{"Tags": data.Tags})
 	case opts["broadcast"].(bool):
 		// check user banned
 		var data Sats4AdsData
@@ -80,7 +196,7 @@ func handleSats4Ads(ctx context.Context, u *User, opts docopt.Opts) {
 			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
 			return
 		}
-		if data.Banned {
+		if data.Banned || isBanned(u.Id, BANSATS4ADS) {
 			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": "user, banned"})
 			return
 		}
@@ -103,21 +219,68 @@ func handleSats4Ads(ctx context.Context, u *User, opts docopt.Opts) {
 		// optional args
 		maxrate, _ := opts.Int("--max-rate")
 		offset, _ := opts.Int("--skip")
+		targeting, err := sats4adsTargetingFromOpts(opts)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+			return
+		}
 
-		send(ctx, t.SATS4ADSSTART, ctx.Value("message"))
-
-		go func() {
-			nmessagesSent, totalCost, errMsg, err := broadcastSats4Ads(ctx,
-				satoshis, contentMessage, maxrate, offset)
+		startsAt := time.Now()
+		if start, err := opts.String("--start"); err == nil {
+			startsAt, err = parseSats4AdsStart(start)
 			if err != nil {
-				log.Warn().Err(err).Stringer("user", u).
-					Msg("sats4ads broadcast fail")
-				send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": errMsg})
+				send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
 				return
 			}
+		}
 
-			send(ctx, t.SATS4ADSBROADCAST, t.T{"NSent": nmessagesSent, "Sats": totalCost}, ctx.Value("message"))
-		}()
+		var triggerMessage int
+		if message, ok := ctx.Value("message").(*tgbotapi.Message); ok {
+			triggerMessage = message.MessageID
+		}
+
+		campaign, err := queueSats4AdsBroadcast(u, satoshis, contentMessage,
+			maxrate, offset, targeting, startsAt, triggerMessage)
+		if err != nil {
+			log.Warn().Err(err).Stringer("user", u).Msg("failed to queue sats4ads broadcast")
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": "Database error."})
+			return
+		}
+
+		if startsAt.After(time.Now()) {
+			send(ctx, t.SATS4ADSSCHEDULED, t.T{"Campaign": campaign}, ctx.Value("message"))
+		} else {
+			send(ctx, t.SATS4ADSSTART, ctx.Value("message"))
+		}
+	case opts["cancel"].(bool):
+		id, err := opts.Int("<campaign_id>")
+		if err != nil {
+			handleHelp(ctx, "sats4ads")
+			return
+		}
+
+		canceled, err := cancelSats4AdsCampaign(u, id)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+			return
+		}
+		if !canceled {
+			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": "campaign not found or already finished"})
+			return
+		}
+
+		go u.track("sats4ads cancel", map[string]interface{}{"campaign": id})
+
+		send(ctx, u, t.SATS4ADSCANCELED, t.T{"Id": id})
+	case opts["campaigns"].(bool):
+		handleSats4AdsCampaigns(ctx, u)
+	case opts["report"].(bool):
+		id, err := opts.Int("<campaign_id>")
+		if err != nil {
+			handleHelp(ctx, "sats4ads")
+			return
+		}
+		handleSats4AdsReport(ctx, u, id)
 	case opts["preview"].(bool):
 		go u.track("sats4ads preview", nil)
 
@@ -127,7 +290,7 @@ func handleSats4Ads(ctx context.Context, u *User, opts docopt.Opts) {
 			return
 		}
 
-		ad, _, _, _ := buildSats4AdsMessage(log, contentMessage, u, 0, nil)
+		ad, _, _, _ := buildSats4AdsMessage(log, contentMessage, u, 0, nil, nil)
 		if ad == nil {
 			send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": "invalid message used as ad content"})
 			return
@@ -144,7 +307,7 @@ func turnSats4AdsOn(user *User, rate int) error {
 		return err
 	}
 
-	if data.Banned {
+	if data.Banned || isBanned(user.Id, BANSATS4ADS) {
 		return errors.New("user banned")
 	}
 
@@ -173,156 +336,21 @@ WHERE id = $1
 	return
 }
 
-func getSats4AdsRates() (rates []Sats4AdsRateGroup, err error) {
+func getSats4AdsRates(targeting Sats4AdsTargeting) (rates []Sats4AdsRateGroup, err error) {
+	condition, params := targeting.condition(1)
 	err = pg.Select(&rates, `
 WITH enabled_listeners AS (
   SELECT (appdata->'sats4ads'->>'rate')::integer AS rate
   FROM account
   WHERE appdata->'sats4ads'->'on' = 'true'::jsonb
+    AND `+condition+`
 ), rategroups AS (
   SELECT generate_series ^ 3 AS uptorate FROM generate_series(1, 10)
 )
 
 SELECT uptorate, (SELECT count(*) FROM enabled_listeners WHERE rate <= uptorate) AS nusers
 FROM rategroups
-    `)
-	return
-}
-
-func broadcastSats4Ads(
-	ctx context.Context,
-	budgetSatoshis int,
-	contentMessage *tgbotapi.Message,
-	maxrate int,
-	offset int,
-) (messagesSent int, roundedCostSatoshis int, errMsg string, err error) {
-	user := ctx.Value("initiator").(*User)
-
-	costSatoshis := 0.0
-	if maxrate == 0 {
-		maxrate = 500
-	}
-
-	// decide on a unique hash for the source payment (so payments can be aggregated
-	// like Payer-3->Proxy, then Proxy-1->TargetA, Proxy-2->TargetB, Proxy-3->TargetC)
-	random, err := randomHex()
-	if err != nil {
-		return
-	}
-	sourcehash := hashString(random)
-
-	logger := log.With().Str("sourcehash", sourcehash).Int("budget", budgetSatoshis).Int("max", maxrate).Logger()
-
-	rows, err := pg.Queryx(`
-SELECT id, (appdata->'sats4ads'->>'rate')::int AS rate
-FROM account
-WHERE appdata->'sats4ads'->'on' = 'true'::jsonb
-  AND id != $1
-  AND (appdata->'sats4ads'->>'rate')::integer <= $2
-ORDER BY appdata->'sats4ads'->'rate' ASC, random()
-OFFSET $3
-    `, user.Id, maxrate, offset)
-	if err != nil {
-		return
-	}
-
-	// send messages and queue receivers to be paid
-	for rows.Next() {
-		var row struct {
-			Id   int `db:"id"`
-			Rate int `db:"rate"`
-		}
-
-		err = rows.StructScan(&row)
-		if err != nil {
-			return
-		}
-
-		// fetch the target user
-		var target *User
-		target, err = loadUser(row.Id)
-		if err != nil || target.TelegramChatId == 0 {
-			continue
-		}
-
-		// identifier for the received payment
-		// will be pending until the user clicks the "Viewed" button
-		targethash := hashString("%d:%s:%d",
-			contentMessage.MessageID, sourcehash, target.Id)
-		data := "s4a=v-" + targethash[:10]
-
-		// build ad message based on the message that was replied to
-		ad, nchars, thisCostMsat, thisCostSatoshis := buildSats4AdsMessage(
-			logger,
-			contentMessage, target, row.Rate,
-			tgbotapi.InlineKeyboardMarkup{
-				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
-					{
-						tgbotapi.InlineKeyboardButton{
-							Text: translate(
-								context.WithValue(ctx, "locale", target.Locale),
-								t.SATS4ADSVIEWED,
-							),
-							CallbackData: &data,
-						},
-					},
-				},
-			},
-		)
-
-		if ad == nil {
-			break
-		}
-
-		if int(costSatoshis+thisCostSatoshis) > budgetSatoshis {
-			// budget ended, stop queueing messages
-			logger.Info().Float64("spent", costSatoshis).
-				Float64("next", thisCostSatoshis).
-				Msg("budget ended")
-			break
-		}
-
-		var message tgbotapi.Message
-		message, err = bot.Send(ad)
-		if err != nil {
-			// message wasn't sent
-			// logger.Info().Err(err).Msg("message wasn't sent. skipping.")
-			err = nil
-			continue
-		}
-
-		// commit payment (pending for receiver)
-		errMsg, err = user.sendThroughProxy(
-			ctx,
-			sourcehash,
-			targethash,
-			contentMessage.MessageID,
-			message.MessageID,
-			target,
-			thisCostMsat,
-			fmt.Sprintf("ad dispatched to %d", messagesSent+1),
-			fmt.Sprintf("%d characters ad (%s) at %d msat/char", nchars, sourcehash, row.Rate),
-			true, // pending
-			"sats4ads",
-		)
-		if err != nil {
-			logger.Error().Err(err).Msg("error saving proxied payment. abort all.")
-			return
-		}
-
-		// we will store this for 7 days so we can use this information on a task
-		// if someone fail to see an ad for more than 3 days they will be excluded
-		rds.SetNX(redisKeyUnviewedAd(
-			target.Id),
-			time.Now().Format(SATS4ADSUNACTIVITYDATEFORMAT),
-			time.Hour*24*7,
-		)
-
-		messagesSent += 1
-		costSatoshis += thisCostSatoshis
-	}
-
-	roundedCostSatoshis = int(costSatoshis)
+    `, params...)
 	return
 }
 
@@ -332,9 +360,18 @@ func buildSats4AdsMessage(
 	target *User,
 	rate int,
 	keyboard interface{},
+	trackLinks func(string) string,
 ) (ad tgbotapi.Chattable, nchars int, thisCostMsat int, thisCostSatoshis float64) {
 	ctx := context.WithValue(context.Background(), "locale", target.Locale)
 
+	// links are tracked on the final text, but priced on the original
+	text := contentMessage.Text
+	caption := contentMessage.Caption
+	if trackLinks != nil {
+		text = trackLinks(text)
+		caption = trackLinks(caption)
+	}
+
 	thisCostMsat = 1000 // fixed 1sat fee for each message
 
 	baseChat := tgbotapi.BaseChat{
@@ -356,7 +393,7 @@ func buildSats4AdsMessage(
 
 		ad = tgbotapi.MessageConfig{
 			BaseChat:              baseChat,
-			Text:                  contentMessage.Text + footer,
+			Text:                  text + footer,
 			DisableWebPagePreview: false,
 		}
 	case contentMessage.Animation != nil:
@@ -368,7 +405,7 @@ func buildSats4AdsMessage(
 		})
 
 		ad = tgbotapi.AnimationConfig{
-			Caption: contentMessage.Caption + footer,
+			Caption: caption + footer,
 			BaseFile: tgbotapi.BaseFile{
 				BaseChat:    baseChat,
 				FileID:      contentMessage.Animation.FileID,
@@ -385,7 +422,7 @@ func buildSats4AdsMessage(
 		photos := *contentMessage.Photo
 
 		ad = tgbotapi.PhotoConfig{
-			Caption: contentMessage.Caption + footer,
+			Caption: caption + footer,
 			BaseFile: tgbotapi.BaseFile{
 				BaseChat:    baseChat,
 				FileID:      photos[0].FileID,
@@ -401,7 +438,7 @@ func buildSats4AdsMessage(
 		})
 
 		ad = tgbotapi.VideoConfig{
-			Caption: contentMessage.Caption + footer,
+			Caption: caption + footer,
 			BaseFile: tgbotapi.BaseFile{
 				BaseChat:    baseChat,
 				FileID:      contentMessage.Video.FileID,
@@ -417,7 +454,7 @@ func buildSats4AdsMessage(
 		})
 
 		ad = tgbotapi.DocumentConfig{
-			Caption: contentMessage.Caption + footer,
+			Caption: caption + footer,
 			BaseFile: tgbotapi.BaseFile{
 				BaseChat:    baseChat,
 				FileID:      contentMessage.Document.FileID,
@@ -433,7 +470,7 @@ func buildSats4AdsMessage(
 		})
 
 		ad = tgbotapi.AudioConfig{
-			Caption: contentMessage.Caption + footer,
+			Caption: caption + footer,
 			BaseFile: tgbotapi.BaseFile{
 				BaseChat:    baseChat,
 				FileID:      contentMessage.Audio.FileID,
@@ -449,9 +486,19 @@ func buildSats4AdsMessage(
 
 func confirmAdViewed(user *User, hashfirst10chars string) {
 	_, err := pg.Exec(`
-UPDATE lightning.transaction
-SET pending = false
-WHERE to_id = $1 AND payment_hash LIKE $2 || '%'
+WITH viewed AS (
+  UPDATE lightning.transaction
+  SET pending = false
+  WHERE to_id = $1 AND payment_hash LIKE $2 || '%' AND pending
+  RETURNING proxied_with, amount
+), groupedbyproxy AS (
+  SELECT proxied_with, count(*) AS views, sum(amount) AS amount FROM viewed
+  GROUP BY proxied_with
+)
+UPDATE sats4ads_campaign AS c
+SET views = c.views + v.views, viewed_cost = c.viewed_cost + v.amount
+FROM groupedbyproxy AS v
+WHERE c.source_hash = v.proxied_with
     `, user.Id, hashfirst10chars)
 	if err != nil {
 		log.Warn().Err(err).Str("hash", hashfirst10chars).Stringer("user", user).
@@ -474,19 +521,42 @@ func cleanupUnviewedAds() {
 	}
 	defer txn.Rollback()
 
+	// the advertisers get their money back, receivers lose the pending amounts
+	var affected []int
+	err = txn.Select(&affected, `
+WITH adsreceivedtxs AS (
+  SELECT to_id, proxied_with FROM lightning.transaction
+  WHERE tag = 'sats4ads' AND time < (now() - interval '3 days') AND pending
+)
+SELECT to_id FROM adsreceivedtxs
+UNION
+SELECT s.from_id FROM lightning.transaction AS s
+WHERE s.payment_hash IN (SELECT proxied_with FROM adsreceivedtxs)
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to list accounts affected by sats4ads cleanup")
+		return
+	}
+	audit := startAudit(ctx, txn, "sats4ads_cleanup", affected...)
+
 	var deletedReceiverIds []int
 	err = txn.Select(&deletedReceiverIds, `
 WITH adsreceivedtxs AS (
   SELECT to_id, amount, payment_hash, proxied_with FROM lightning.transaction
   WHERE tag = 'sats4ads' AND time < (now() - interval '3 days') AND pending
 ), groupedbyproxy AS (
-  SELECT proxied_with, sum(amount) AS amount FROM adsreceivedtxs
+  SELECT proxied_with, count(*) AS refunds, sum(amount) AS amount FROM adsreceivedtxs
   GROUP BY proxied_with
 ), sourceupdates AS (
   UPDATE lightning.transaction AS s
   SET amount = s.amount - t.amount
   FROM groupedbyproxy AS t
   WHERE t.proxied_with = s.payment_hash
+), campaignupdates AS (
+  UPDATE sats4ads_campaign AS c
+  SET refunds = c.refunds + t.refunds, refunded = c.refunded + t.amount
+  FROM groupedbyproxy AS t
+  WHERE t.proxied_with = c.source_hash
 ), deletes AS (
   DELETE FROM lightning.transaction
   WHERE payment_hash IN (SELECT payment_hash FROM adsreceivedtxs)
@@ -504,6 +574,12 @@ SELECT DISTINCT to_id FROM adsreceivedtxs
 		return
 	}
 
+	if err := audit.save(txn, "", map[string]interface{}{
+		"receivers": len(deletedReceiverIds),
+	}); err != nil {
+		return
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return
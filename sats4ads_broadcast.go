@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// sats4adsBroadcastRoutine sends queued ads at most s.Sats4AdsBroadcastRate
+// times per second. everything is kept on the database, so a broadcast that
+// was interrupted by a restart just continues from where it stopped.
+func sats4adsBroadcastRoutine() {
+	rate := s.Sats4AdsBroadcastRate
+	if rate <= 0 {
+		rate = 1
+	}
+	interval := time.Second / time.Duration(rate)
+
+	for {
+		startScheduledSats4AdsCampaigns()
+
+		dispatched, retryAfter := dispatchNextSats4Ad()
+		switch {
+		case retryAfter > 0:
+			time.Sleep(retryAfter)
+		case dispatched:
+			time.Sleep(interval)
+		default:
+			finishSats4AdsCampaigns()
+			time.Sleep(time.Second * 15)
+		}
+	}
+}
+
+// startScheduledSats4AdsCampaigns selects the receivers of every campaign
+// whose start time has come and puts them in the delivery queue.
+func startScheduledSats4AdsCampaigns() {
+	var campaigns []Sats4AdsCampaign
+	err := pg.Select(&campaigns, `
+SELECT * FROM sats4ads_campaign
+WHERE status = 'scheduled' AND starts_at <= now()
+ORDER BY starts_at
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch scheduled sats4ads campaigns")
+		return
+	}
+
+	for _, campaign := range campaigns {
+		if err := startSats4AdsCampaign(campaign); err != nil {
+			log.Warn().Err(err).Int("campaign", campaign.Id).
+				Msg("failed to start sats4ads campaign")
+			continue
+		}
+		log.Info().Int("campaign", campaign.Id).Msg("sats4ads campaign started")
+	}
+}
+
+func startSats4AdsCampaign(campaign Sats4AdsCampaign) error {
+	txn, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	condition, params := campaign.TargetingData().condition(5)
+	_, err = txn.Exec(`
+INSERT INTO sats4ads_delivery (campaign, receiver, rate)
+SELECT $1, id, rate FROM (
+  SELECT id, (appdata->'sats4ads'->>'rate')::int AS rate
+  FROM account
+  WHERE appdata->'sats4ads'->'on' = 'true'::jsonb
+    AND id != $2
+    AND (appdata->'sats4ads'->>'rate')::integer <= $3
+    AND `+condition+`
+  ORDER BY appdata->'sats4ads'->'rate' ASC, random()
+  OFFSET $4
+) AS receivers
+    `, append([]interface{}{
+		campaign.Id, campaign.Advertiser, campaign.MaxRate, campaign.Skip,
+	}, params...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = txn.Exec(`
+UPDATE sats4ads_campaign SET status = 'running'
+WHERE id = $1 AND status = 'scheduled'
+    `, campaign.Id)
+	if err != nil {
+		return err
+	}
+
+	return txn.Commit()
+}
+
+// dispatchNextSats4Ad sends the oldest queued ad. it returns false when there
+// is nothing to send, and a positive duration if telegram told us to slow down.
+func dispatchNextSats4Ad() (dispatched bool, retryAfter time.Duration) {
+	var delivery struct {
+		Id       int64 `db:"id"`
+		Campaign int   `db:"campaign"`
+		Receiver int   `db:"receiver"`
+		Rate     int   `db:"rate"`
+	}
+	err := pg.Get(&delivery, `
+SELECT d.id, campaign, receiver, d.rate
+FROM sats4ads_delivery AS d
+INNER JOIN sats4ads_campaign AS c ON c.id = d.campaign
+WHERE c.status = 'running' AND d.status = 'queued'
+ORDER BY d.id
+LIMIT 1
+    `)
+	if err == sql.ErrNoRows {
+		return false, 0
+	} else if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch next sats4ads delivery")
+		return false, 0
+	}
+
+	var campaign Sats4AdsCampaign
+	err = pg.Get(&campaign, `SELECT * FROM sats4ads_campaign WHERE id = $1`, delivery.Campaign)
+	if err != nil {
+		log.Warn().Err(err).Int("campaign", delivery.Campaign).
+			Msg("failed to load sats4ads campaign")
+		return false, 0
+	}
+
+	status, err := deliverSats4Ad(&campaign, delivery.Receiver, delivery.Rate)
+	var tgErr tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		// flood limit reached, leave this one queued and try again later
+		return true, time.Second * time.Duration(tgErr.RetryAfter)
+	}
+
+	_, err = pg.Exec(`
+UPDATE sats4ads_delivery SET status = $2 WHERE id = $1
+    `, delivery.Id, status)
+	if err != nil {
+		log.Warn().Err(err).Int("campaign", campaign.Id).
+			Msg("failed to update sats4ads delivery")
+	}
+
+	return true, 0
+}
+
+// deliverSats4Ad sends the ad to one receiver and pays them (pending until they
+// click "Viewed"). it returns the new status of the delivery.
+func deliverSats4Ad(campaign *Sats4AdsCampaign, receiverId int, rate int) (string, error) {
+	logger := log.With().Int("campaign", campaign.Id).Int("receiver", receiverId).Logger()
+
+	advertiser, err := loadUser(campaign.Advertiser)
+	if err != nil {
+		return "skipped", err
+	}
+	ctx := context.WithValue(
+		context.WithValue(context.Background(), "initiator", advertiser),
+		"origin", "background",
+	)
+
+	contentMessage, err := campaign.ContentMessage()
+	if err != nil {
+		finishSats4AdsCampaign(ctx, campaign, "invalid message used as ad content")
+		return "skipped", err
+	}
+
+	target, err := loadUser(receiverId)
+	if err != nil || target.TelegramChatId == 0 {
+		return "skipped", err
+	}
+	if isBanned(target.Id, BANSATS4ADS) {
+		return "skipped", nil
+	}
+
+	// identifier for the received payment
+	// will be pending until the user clicks the "Viewed" button
+	targethash := hashString("%d:%s:%d",
+		contentMessage.MessageID, campaign.SourceHash, target.Id)
+	data := "s4a=v-" + targethash[:10]
+
+	// this may have been sent already if we were interrupted before saving the status
+	var exists bool
+	pg.Get(&exists, `
+SELECT true FROM lightning.transaction WHERE payment_hash = $1
+    `, targethash)
+	if exists {
+		return "sent", nil
+	}
+
+	// build ad message based on the message that was replied to
+	ad, nchars, thisCostMsat, _ := buildSats4AdsMessage(
+		logger,
+		contentMessage, target, rate,
+		tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
+				{
+					tgbotapi.InlineKeyboardButton{
+						Text: translate(
+							context.WithValue(ctx, "locale", target.Locale),
+							t.SATS4ADSVIEWED,
+						),
+						CallbackData: &data,
+					},
+				},
+			},
+		},
+		campaign.trackLinks(targethash[:10]),
+	)
+	if ad == nil {
+		finishSats4AdsCampaign(ctx, campaign, "invalid message used as ad content")
+		return "skipped", nil
+	}
+
+	if campaign.Cost+int64(thisCostMsat) > int64(campaign.Budget)*1000 {
+		// budget ended. since receivers are sorted by rate everybody after
+		// this one would be too expensive too.
+		logger.Info().Int64("spent", campaign.Cost).Int("next", thisCostMsat).
+			Msg("budget ended")
+		finishSats4AdsCampaign(ctx, campaign, "")
+		return "skipped", nil
+	}
+
+	message, err := bot.Send(ad)
+	if err != nil {
+		// message wasn't sent
+		return "skipped", err
+	}
+
+	// commit payment (pending for receiver)
+	errMsg, err := advertiser.sendThroughProxy(
+		ctx,
+		campaign.SourceHash,
+		targethash,
+		contentMessage.MessageID,
+		message.MessageID,
+		target,
+		thisCostMsat,
+		fmt.Sprintf("ad dispatched to %d", campaign.Sent+1),
+		fmt.Sprintf("%d characters ad (%s) at %d msat/char", nchars, campaign.SourceHash, rate),
+		true, // pending
+		"sats4ads",
+	)
+	if err != nil {
+		logger.Error().Err(err).Msg("error saving proxied payment. abort all.")
+		finishSats4AdsCampaign(ctx, campaign, errMsg)
+		return "skipped", err
+	}
+
+	if err := campaign.registerDispatch(thisCostMsat); err != nil {
+		logger.Warn().Err(err).Msg("failed to register ad dispatch on campaign")
+	}
+	campaign.registerViewer(targethash[:10])
+
+	// we will store this for 7 days so we can use this information on a task
+	// if someone fail to see an ad for more than 3 days they will be excluded
+	rds.SetNX(redisKeyUnviewedAd(
+		target.Id),
+		time.Now().Format(SATS4ADSUNACTIVITYDATEFORMAT),
+		time.Hour*24*7,
+	)
+
+	return "sent", nil
+}
+
+// finishSats4AdsCampaigns marks as done the running campaigns that have
+// nothing more to send.
+func finishSats4AdsCampaigns() {
+	var campaigns []Sats4AdsCampaign
+	err := pg.Select(&campaigns, `
+SELECT * FROM sats4ads_campaign AS c
+WHERE status = 'running' AND NOT EXISTS (
+  SELECT 1 FROM sats4ads_delivery
+  WHERE campaign = c.id AND status = 'queued'
+)
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch finished sats4ads campaigns")
+		return
+	}
+
+	for _, campaign := range campaigns {
+		advertiser, err := loadUser(campaign.Advertiser)
+		if err != nil {
+			continue
+		}
+		ctx := context.WithValue(
+			context.WithValue(context.Background(), "initiator", advertiser),
+			"origin", "background",
+		)
+		finishSats4AdsCampaign(ctx, &campaign, "")
+	}
+}
+
+func finishSats4AdsCampaign(ctx context.Context, campaign *Sats4AdsCampaign, errMsg string) {
+	txn, err := pg.Beginx()
+	if err != nil {
+		log.Warn().Err(err).Int("campaign", campaign.Id).
+			Msg("failed to finish sats4ads campaign")
+		return
+	}
+	defer txn.Rollback()
+
+	var sent int
+	var cost int64
+	err = txn.QueryRow(`
+UPDATE sats4ads_campaign
+SET status = 'done', error = nullif($2, '')
+WHERE id = $1 AND status = 'running'
+RETURNING sent, cost
+    `, campaign.Id, errMsg).Scan(&sent, &cost)
+	if err == nil {
+		err = skipQueuedSats4AdsDeliveries(txn, campaign.Id)
+	}
+	if err == nil {
+		err = txn.Commit()
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn().Err(err).Int("campaign", campaign.Id).
+				Msg("failed to finish sats4ads campaign")
+		}
+		return
+	}
+
+	if errMsg != "" {
+		send(ctx, t.ERROR, t.T{"App": "sats4ads", "Err": errMsg}, campaign.TriggerMessage)
+	}
+	send(ctx, t.SATS4ADSBROADCAST, t.T{
+		"NSent":    sent,
+		"Sats":     int(cost / 1000),
+		"Campaign": campaign.Id,
+	}, campaign.TriggerMessage)
+}
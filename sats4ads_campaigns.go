@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// every sats4ads broadcast is recorded as a campaign so the advertiser can see
+// how it performed. views and refunds are accumulated as receivers click the
+// "Viewed" button or fail to do so (see confirmAdViewed and cleanupUnviewedAds).
+// the ads themselves are sent by sats4adsBroadcastRoutine.
+type Sats4AdsCampaign struct {
+	Id             int            `db:"id"`
+	Time           time.Time      `db:"time"`
+	Advertiser     int            `db:"advertiser"`
+	SourceHash     string         `db:"source_hash"`
+	Status         string         `db:"status"` // scheduled, running, done or canceled
+	StartsAt       time.Time      `db:"starts_at"`
+	Content        types.JSONText `db:"content"` // the message used as the ad
+	TriggerMessage int            `db:"trigger_message"`
+	MaxRate        int            `db:"max_rate"`
+	Skip           int            `db:"skip"`
+	Budget         int            `db:"budget"` // sat
+	Targeting      types.JSONText `db:"targeting"`
+	Links          types.JSONText `db:"links"`
+	Sent           int            `db:"sent"`
+	Cost           int64          `db:"cost"` // msat
+	Views          int            `db:"views"`
+	ViewedCost     int64          `db:"viewed_cost"` // msat
+	Refunds        int            `db:"refunds"`
+	Refunded       int64          `db:"refunded"` // msat
+	Clicks         int            `db:"clicks"`
+	Error          sql.NullString `db:"error"`
+}
+
+var linkRegex = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+func queueSats4AdsBroadcast(
+	advertiser *User,
+	budget int,
+	contentMessage *tgbotapi.Message,
+	maxrate int,
+	offset int,
+	targeting Sats4AdsTargeting,
+	startsAt time.Time,
+	triggerMessage int,
+) (*Sats4AdsCampaign, error) {
+	if maxrate == 0 {
+		maxrate = 500
+	}
+
+	// decide on a unique hash for the source payment (so payments can be aggregated
+	// like Payer-3->Proxy, then Proxy-1->TargetA, Proxy-2->TargetB, Proxy-3->TargetC)
+	random, err := randomHex()
+	if err != nil {
+		return nil, err
+	}
+	sourcehash := hashString(random)
+
+	adText := contentMessage.Text
+	if adText == "" {
+		adText = contentMessage.Caption
+	}
+	links := linkRegex.FindAllString(adText, -1)
+	if links == nil {
+		links = []string{}
+	}
+	jlinks, _ := json.Marshal(links)
+	jtargeting, _ := json.Marshal(targeting)
+	jcontent, err := json.Marshal(contentMessage)
+	if err != nil {
+		return nil, err
+	}
+
+	var campaign Sats4AdsCampaign
+	err = pg.Get(&campaign, `
+INSERT INTO sats4ads_campaign
+  (advertiser, source_hash, starts_at, content, trigger_message,
+   max_rate, skip, budget, targeting, links)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+RETURNING *
+    `, advertiser.Id, sourcehash, startsAt, types.JSONText(jcontent), triggerMessage,
+		maxrate, offset, budget, types.JSONText(jtargeting), types.JSONText(jlinks))
+	if err != nil {
+		return nil, err
+	}
+
+	return &campaign, nil
+}
+
+func parseSats4AdsStart(start string) (time.Time, error) {
+	startsAt, err := time.Parse("2006-01-02T15:04", start)
+	if err != nil {
+		delay, err := time.ParseDuration(start)
+		if err != nil {
+			return startsAt, fmt.Errorf("invalid start '%s', use a delay like 3h or a UTC time like 2021-05-30T18:00.", start)
+		}
+		startsAt = time.Now().Add(delay)
+	}
+
+	if startsAt.Before(time.Now().Add(-time.Minute)) {
+		return startsAt, errors.New("start time is in the past.")
+	}
+	if startsAt.After(time.Now().AddDate(0, 0, 30)) {
+		return startsAt, errors.New("can't schedule more than 30 days in advance.")
+	}
+
+	return startsAt, nil
+}
+
+func loadSats4AdsCampaign(advertiser *User, id int) (campaign Sats4AdsCampaign, err error) {
+	err = pg.Get(&campaign, `
+SELECT * FROM sats4ads_campaign WHERE id = $1 AND advertiser = $2
+    `, id, advertiser.Id)
+	return
+}
+
+func listSats4AdsCampaigns(advertiser *User) (campaigns []Sats4AdsCampaign, err error) {
+	err = pg.Select(&campaigns, `
+SELECT * FROM sats4ads_campaign WHERE advertiser = $1
+ORDER BY time DESC
+LIMIT 15
+    `, advertiser.Id)
+	return
+}
+
+func (campaign *Sats4AdsCampaign) registerDispatch(msats int) error {
+	_, err := pg.Exec(`
+UPDATE sats4ads_campaign
+SET sent = sent + 1, cost = cost + $2
+WHERE id = $1
+    `, campaign.Id, msats)
+	return err
+}
+
+func cancelSats4AdsCampaign(advertiser *User, id int) (canceled bool, err error) {
+	txn, err := pg.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer txn.Rollback()
+
+	res, err := txn.Exec(`
+UPDATE sats4ads_campaign
+SET status = 'canceled'
+WHERE id = $1 AND advertiser = $2 AND status IN ('scheduled', 'running')
+    `, id, advertiser.Id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return false, nil
+	}
+
+	if err := skipQueuedSats4AdsDeliveries(txn, id); err != nil {
+		return false, err
+	}
+
+	return true, txn.Commit()
+}
+
+// skipQueuedSats4AdsDeliveries is called when a campaign stops before going
+// through all its receivers.
+func skipQueuedSats4AdsDeliveries(txn *sqlx.Tx, campaignId int) error {
+	_, err := txn.Exec(`
+UPDATE sats4ads_delivery SET status = 'skipped'
+WHERE campaign = $1 AND status = 'queued'
+    `, campaignId)
+	return err
+}
+
+// trackLinks replaces each link in the ad text with a redirect through us so
+// clicks can be counted. viewer identifies the receiver so each one is only
+// counted once, and must be registered with registerViewer once the ad is
+// delivered or clicks with it won't count.
+func (campaign *Sats4AdsCampaign) trackLinks(viewer string) func(string) string {
+	return func(text string) string {
+		i := 0
+		return linkRegex.ReplaceAllStringFunc(text, func(link string) string {
+			tracked := fmt.Sprintf("%s/s4a/%d/%d/%s", s.ServiceURL, campaign.Id, i, viewer)
+			i++
+			return tracked
+		})
+	}
+}
+
+func redisKeySats4AdsViewers(campaignId int) string {
+	return fmt.Sprintf("sats4ads:viewers:%d", campaignId)
+}
+
+func (campaign *Sats4AdsCampaign) registerViewer(viewer string) {
+	key := redisKeySats4AdsViewers(campaign.Id)
+	rds.SAdd(key, viewer)
+	rds.Expire(key, time.Hour*24*30)
+}
+
+func (campaign Sats4AdsCampaign) SpentSats() float64 {
+	return float64(campaign.Cost-campaign.Refunded) / 1000
+}
+
+func (campaign Sats4AdsCampaign) CostPerView() float64 {
+	if campaign.Views == 0 {
+		return 0
+	}
+	return float64(campaign.ViewedCost) / 1000 / float64(campaign.Views)
+}
+
+func (campaign Sats4AdsCampaign) Pending() int {
+	return campaign.Sent - campaign.Views - campaign.Refunds
+}
+
+func (campaign Sats4AdsCampaign) TargetingData() (targeting Sats4AdsTargeting) {
+	campaign.Targeting.Unmarshal(&targeting)
+	return
+}
+
+func (campaign Sats4AdsCampaign) LinkList() (links []string) {
+	campaign.Links.Unmarshal(&links)
+	return
+}
+
+func (campaign Sats4AdsCampaign) ContentMessage() (message *tgbotapi.Message, err error) {
+	err = campaign.Content.Unmarshal(&message)
+	return
+}
+
+func handleSats4AdsCampaigns(ctx context.Context, u *User) {
+	campaigns, err := listSats4AdsCampaigns(u)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": err.Error()})
+		return
+	}
+
+	go u.track("sats4ads campaigns", nil)
+
+	send(ctx, u, t.SATS4ADSCAMPAIGNS, t.T{"Campaigns": campaigns})
+}
+
+func handleSats4AdsReport(ctx context.Context, u *User, id int) {
+	campaign, err := loadSats4AdsCampaign(u, id)
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"App": "sats4ads", "Err": "campaign not found"})
+		return
+	}
+
+	go u.track("sats4ads report", map[string]interface{}{"campaign": id})
+
+	send(ctx, u, t.SATS4ADSREPORT, t.T{"Campaign": campaign})
+}
+
+func serveSats4AdsClicks() {
+	router.Path("/s4a/{campaign:[0-9]+}/{link:[0-9]+}/{viewer}").HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			id, _ := strconv.Atoi(vars["campaign"])
+			index, _ := strconv.Atoi(vars["link"])
+
+			var jlinks types.JSONText
+			err := pg.Get(&jlinks, `
+SELECT links FROM sats4ads_campaign WHERE id = $1
+            `, id)
+			if err != nil {
+				http.Error(w, "campaign not found", 404)
+				return
+			}
+
+			var links []string
+			jlinks.Unmarshal(&links)
+			if index >= len(links) {
+				http.Error(w, "link not found", 404)
+				return
+			}
+
+			// only count clicks from people the ad was actually sent to, and
+			// only the first one from each
+			viewer := vars["viewer"]
+			key := fmt.Sprintf("sats4ads:clicks:%d", id)
+			if delivered, _ := rds.SIsMember(redisKeySats4AdsViewers(id), viewer).Result(); !delivered {
+				log.Debug().Int("campaign", id).Str("viewer", viewer).
+					Msg("click on sats4ads link from unknown viewer")
+			} else if added, err := rds.SAdd(key, viewer).Result(); err == nil && added == 1 {
+				rds.Expire(key, time.Hour*24*30)
+				if _, err := pg.Exec(`
+UPDATE sats4ads_campaign SET clicks = clicks + 1 WHERE id = $1
+                `, id); err != nil {
+					log.Warn().Err(err).Int("campaign", id).
+						Msg("failed to register sats4ads click")
+				}
+			}
+
+			http.Redirect(w, r, links[index], http.StatusFound)
+		},
+	)
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/go-cliche"
+	"github.com/fiatjaf/lntxbot/t"
+)
+
+// every few hours we compare what we owe to users with what the node has and
+// build a merkle-sum tree of the positive balances. only the root is public,
+// each user can get the paths from their leaves to the root with /proof and
+// check that their balance was counted in the total.
+//
+// each balance is split at random into SOLVENCYSPLITS leaves, so the sums a
+// path reveals are pieces of other balances and not the balances themselves.
+//
+// leaf hash: sha256("<nonce>:<balance>")
+// node hash: sha256("<left hash>:<left sum>:<right hash>:<right sum>")
+// when a level has an odd number of nodes the last one goes up unchanged.
+
+const (
+	SOLVENCYINTERVAL = 6 * time.Hour
+	SOLVENCYLEAFDAYS = 30 // leaves of older reports are deleted, the totals are kept
+	SOLVENCYSPLITS   = 4
+)
+
+type SolvencyReport struct {
+	Id          int       `db:"id" json:"id"`
+	CreatedAt   time.Time `db:"created_at" json:"time"`
+	Liabilities int64     `db:"liabilities" json:"liabilities_msat"`
+	Channels    int64     `db:"channels" json:"channels_msat"`
+	Onchain     int64     `db:"onchain" json:"onchain_msat"`
+	Accounts    int       `db:"accounts" json:"accounts"`
+	Root        string    `db:"root" json:"root"`
+}
+
+func (r SolvencyReport) Assets() int64 { return r.Channels + r.Onchain }
+
+func (r SolvencyReport) Ratio() float64 {
+	if r.Liabilities == 0 {
+		return 1
+	}
+	return float64(r.Assets()) / float64(r.Liabilities)
+}
+
+type SolvencyLeaf struct {
+	Report   int    `db:"report"`
+	Position int    `db:"position"`
+	Account  int    `db:"account"`
+	Nonce    string `db:"nonce"`
+	Balance  int64  `db:"balance"`
+}
+
+type MerkleSumNode struct {
+	Hash string `json:"hash"`
+	Sum  int64  `json:"sum"`
+}
+
+type MerkleSumStep struct {
+	Side string `json:"side"` // where the sibling is, "left" or "right"
+	MerkleSumNode
+}
+
+func merkleSumLeaf(nonce string, balance int64) MerkleSumNode {
+	return MerkleSumNode{hashString("%s:%d", nonce, balance), balance}
+}
+
+func merkleSumParent(left, right MerkleSumNode) MerkleSumNode {
+	return MerkleSumNode{
+		hashString("%s:%d:%s:%d", left.Hash, left.Sum, right.Hash, right.Sum),
+		left.Sum + right.Sum,
+	}
+}
+
+func merkleSumNextLevel(level []MerkleSumNode) []MerkleSumNode {
+	next := make([]MerkleSumNode, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 < len(level) {
+			next = append(next, merkleSumParent(level[i], level[i+1]))
+		} else {
+			next = append(next, level[i])
+		}
+	}
+	return next
+}
+
+func merkleSumRoot(level []MerkleSumNode) MerkleSumNode {
+	if len(level) == 0 {
+		return MerkleSumNode{hashString(""), 0}
+	}
+	for len(level) > 1 {
+		level = merkleSumNextLevel(level)
+	}
+	return level[0]
+}
+
+func merkleSumPath(level []MerkleSumNode, index int) (path []MerkleSumStep) {
+	for len(level) > 1 {
+		if index%2 == 1 {
+			path = append(path, MerkleSumStep{"left", level[index-1]})
+		} else if index+1 < len(level) {
+			path = append(path, MerkleSumStep{"right", level[index+1]})
+		}
+		level = merkleSumNextLevel(level)
+		index /= 2
+	}
+	return path
+}
+
+// splitBalance cuts the balance in parts at random points, some parts may be
+// zero.
+func splitBalance(balance int64, parts int) ([]int64, error) {
+	cuts := make([]int64, parts+1)
+	cuts[parts] = balance
+	for i := 1; i < parts; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(balance+1))
+		if err != nil {
+			return nil, err
+		}
+		cuts[i] = n.Int64()
+	}
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i] < cuts[j] })
+
+	split := make([]int64, parts)
+	for i := range split {
+		split[i] = cuts[i+1] - cuts[i]
+	}
+	return split, nil
+}
+
+// nodeAssets is what the node can spend: our side of the channels plus the
+// on-chain wallets, which cliche reports in satoshis.
+func nodeAssets() (channels int64, onchain int64, err error) {
+	if ln == nil {
+		return 0, 0, errors.New("not connected to the node")
+	}
+
+	info, err := ln.GetInfo()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	channels, onchain = sumNodeAssets(info)
+	return
+}
+
+func sumNodeAssets(info cliche.GetInfoResult) (channels int64, onchain int64) {
+	for _, channel := range info.Channels {
+		channels += int64(channel.Balance)
+	}
+	for _, wallet := range info.Wallets {
+		onchain += wallet.Balance * 1000
+	}
+	return
+}
+
+func makeSolvencyReport() (report SolvencyReport, err error) {
+	channels, onchain, err := nodeAssets()
+	if err != nil {
+		return report, err
+	}
+
+	txn, err := pg.Beginx()
+	if err != nil {
+		return report, err
+	}
+	defer txn.Rollback()
+
+	var balances []struct {
+		Account int   `db:"account_id"`
+		Balance int64 `db:"balance"`
+	}
+	err = txn.Select(&balances, `
+SELECT account_id, balance::bigint AS balance
+FROM lightning.balance
+WHERE account_id != $1 AND balance > 0
+    `, s.ProxyAccount)
+	if err != nil {
+		return report, err
+	}
+
+	// leaves are ordered by their hash, which is random because of the nonce,
+	// so positions in the tree say nothing about accounts
+	leaves := make([]SolvencyLeaf, 0, len(balances)*SOLVENCYSPLITS)
+	nodes := make([]MerkleSumNode, 0, len(balances)*SOLVENCYSPLITS)
+	for _, b := range balances {
+		parts, err := splitBalance(b.Balance, SOLVENCYSPLITS)
+		if err != nil {
+			return report, err
+		}
+		for _, part := range parts {
+			nonce, err := randomHex()
+			if err != nil {
+				return report, err
+			}
+			leaves = append(leaves, SolvencyLeaf{Account: b.Account, Nonce: nonce, Balance: part})
+			nodes = append(nodes, merkleSumLeaf(nonce, part))
+		}
+	}
+	sort.Sort(solvencyLeavesByHash{leaves, nodes})
+
+	root := merkleSumRoot(nodes)
+	err = txn.Get(&report, `
+INSERT INTO solvency_report (liabilities, channels, onchain, accounts, root)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING *
+    `, root.Sum, channels, onchain, len(balances), root.Hash)
+	if err != nil {
+		return report, err
+	}
+
+	stmt, err := txn.Prepare(`
+INSERT INTO solvency_leaf (report, position, account, nonce, balance)
+VALUES ($1, $2, $3, $4, $5)
+    `)
+	if err != nil {
+		return report, err
+	}
+	defer stmt.Close()
+	for i, leaf := range leaves {
+		if _, err := stmt.Exec(report.Id, i, leaf.Account, leaf.Nonce, leaf.Balance); err != nil {
+			return report, err
+		}
+	}
+
+	return report, txn.Commit()
+}
+
+type solvencyLeavesByHash struct {
+	leaves []SolvencyLeaf
+	nodes  []MerkleSumNode
+}
+
+func (l solvencyLeavesByHash) Len() int { return len(l.leaves) }
+func (l solvencyLeavesByHash) Less(i, j int) bool {
+	return l.nodes[i].Hash < l.nodes[j].Hash
+}
+func (l solvencyLeavesByHash) Swap(i, j int) {
+	l.leaves[i], l.leaves[j] = l.leaves[j], l.leaves[i]
+	l.nodes[i], l.nodes[j] = l.nodes[j], l.nodes[i]
+}
+
+func lastSolvencyReport() (report SolvencyReport, err error) {
+	err = pg.Get(&report, `
+SELECT * FROM solvency_report ORDER BY id DESC LIMIT 1
+    `)
+	return
+}
+
+func solvencyRoutine() {
+	ctx := context.WithValue(context.Background(), "origin", "background")
+
+	for {
+		previous, _ := lastSolvencyReport()
+
+		report, err := makeSolvencyReport()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to make solvency report")
+		} else {
+			log.Info().Int64("liabilities", report.Liabilities).
+				Int64("assets", report.Assets()).Float64("ratio", report.Ratio()).
+				Msg("solvency report")
+
+			// alert when we go under the threshold and every time it gets worse
+			if report.Ratio() < s.SolvencyAlertRatio &&
+				(previous.Id == 0 || report.Ratio() < previous.Ratio() ||
+					previous.Ratio() >= s.SolvencyAlertRatio) {
+				if admin, err := loadUser(s.AdminAccount); err == nil {
+					send(ctx, admin, t.SOLVENCYALERT, t.T{
+						"Report":    report,
+						"Threshold": s.SolvencyAlertRatio,
+					})
+				}
+			}
+		}
+
+		_, err = pg.Exec(`
+DELETE FROM solvency_leaf
+WHERE report IN (
+  SELECT id FROM solvency_report
+  WHERE created_at < now() - make_interval(days => $1)
+)
+        `, SOLVENCYLEAFDAYS)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to cleanup old solvency leaves")
+		}
+
+		time.Sleep(SOLVENCYINTERVAL)
+	}
+}
+
+type SolvencyProof struct {
+	Report  int                 `json:"report"`
+	Root    MerkleSumNode       `json:"root"`
+	Balance int64               `json:"balance"`
+	Leaves  []SolvencyProofLeaf `json:"leaves"`
+}
+
+type SolvencyProofLeaf struct {
+	Nonce   string          `json:"nonce"`
+	Balance int64           `json:"balance"`
+	Path    []MerkleSumStep `json:"path"`
+}
+
+func loadSolvencyProof(report SolvencyReport, account int) (proof SolvencyProof, err error) {
+	var leaves []SolvencyLeaf
+	err = pg.Select(&leaves, `
+SELECT * FROM solvency_leaf WHERE report = $1 ORDER BY position
+    `, report.Id)
+	if err != nil {
+		return
+	}
+
+	var indexes []int
+	nodes := make([]MerkleSumNode, len(leaves))
+	for i, leaf := range leaves {
+		nodes[i] = merkleSumLeaf(leaf.Nonce, leaf.Balance)
+		if leaf.Account == account {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return proof, sql.ErrNoRows
+	}
+
+	proof = SolvencyProof{
+		Report: report.Id,
+		Root:   MerkleSumNode{report.Root, report.Liabilities},
+	}
+	for _, index := range indexes {
+		proof.Balance += leaves[index].Balance
+		proof.Leaves = append(proof.Leaves, SolvencyProofLeaf{
+			Nonce:   leaves[index].Nonce,
+			Balance: leaves[index].Balance,
+			Path:    merkleSumPath(nodes, index),
+		})
+	}
+	return proof, nil
+}
+
+func handleProof(ctx context.Context) {
+	u := ctx.Value("initiator").(*User)
+
+	go u.track("proof", nil)
+
+	report, err := lastSolvencyReport()
+	if err == sql.ErrNoRows {
+		send(ctx, u, t.PROOF, t.T{"Report": nil})
+		return
+	} else if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	proof, err := loadSolvencyProof(report, u.Id)
+	if err != nil && err != sql.ErrNoRows {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	// the paths are too long for a message, they go as a file
+	var file interface{}
+	if err == nil {
+		j, _ := json.Marshal(proof)
+		file = tempAssetURL(".json", j)
+	}
+
+	send(ctx, u, t.PROOF, t.T{
+		"Report":   report,
+		"Included": err == nil,
+		"Balance":  proof.Balance,
+		"URL":      s.ServiceURL + "/solvency",
+	}, file)
+}
+
+// handleSolvency is only available to the admin, as "/solvency", and makes a
+// new report right away.
+func handleSolvency(ctx context.Context) {
+	u := ctx.Value("initiator").(*User)
+
+	report, err := makeSolvencyReport()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	send(ctx, u, t.SOLVENCY, t.T{
+		"Report":    report,
+		"Threshold": s.SolvencyAlertRatio,
+	})
+}
+
+func serveSolvency() {
+	router.Path("/solvency").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := lastSolvencyReport()
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "failed to load solvency report", 500)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			if report.Id == 0 {
+				http.Error(w, "no solvency report yet", 404)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(report)
+			return
+		}
+
+		if err = tmpl.ExecuteTemplate(w, "solvency", struct {
+			Report      SolvencyReport
+			Ratio       float64
+			Liabilities int64
+			Channels    int64
+			Onchain     int64
+		}{
+			report,
+			report.Ratio(),
+			report.Liabilities / 1000,
+			report.Channels / 1000,
+			report.Onchain / 1000,
+		}); err != nil {
+			log.Error().Err(err).Msg("failed to render template")
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// verifySolvencyPath does what the verifier on templates/solvency.html does.
+func verifySolvencyPath(nonce string, balance int64, path []MerkleSumStep) MerkleSumNode {
+	sha := func(text string) string {
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:])
+	}
+
+	hash := sha(fmt.Sprintf("%s:%d", nonce, balance))
+	sum := balance
+	for _, step := range path {
+		if step.Side == "left" {
+			hash = sha(fmt.Sprintf("%s:%d:%s:%d", step.Hash, step.Sum, hash, sum))
+		} else {
+			hash = sha(fmt.Sprintf("%s:%d:%s:%d", hash, sum, step.Hash, step.Sum))
+		}
+		sum += step.Sum
+	}
+	return MerkleSumNode{hash, sum}
+}
+
+func TestMerkleSumKnownRoot(t *testing.T) {
+	// computed with sha256sum
+	nodes := []MerkleSumNode{
+		merkleSumLeaf("n1", 1000),
+		merkleSumLeaf("n2", 2500),
+		merkleSumLeaf("n3", 0),
+	}
+	if nodes[0].Hash != "5bbe574b1e719b3f009c3218a9c6fb76b295e4a1f041ca39ed0310ee37799dfa" {
+		t.Errorf("wrong leaf hash %s", nodes[0].Hash)
+	}
+
+	root := merkleSumRoot(nodes)
+	expected := MerkleSumNode{"d5b02104c9834200f1e96a61bc32930a2979c0413e54052acf5b8f2f7987984e", 3500}
+	if root != expected {
+		t.Errorf("expected root %v, got %v", expected, root)
+	}
+
+	path := merkleSumPath(nodes, 2)
+	if len(path) != 1 || path[0].Side != "left" ||
+		path[0].Hash != "4158cf7ca7637ae04f8e6985cfd6d570f5a118b180266395b6a5d72af8e08e25" {
+		t.Errorf("wrong path for the odd leaf: %v", path)
+	}
+}
+
+func TestMerkleSumPaths(t *testing.T) {
+	for n := 1; n <= 33; n++ {
+		nodes := make([]MerkleSumNode, n)
+		balances := make([]int64, n)
+		for i := range nodes {
+			balances[i] = rand.Int63n(100000000)
+			nodes[i] = merkleSumLeaf(fmt.Sprintf("nonce-%d", i), balances[i])
+		}
+		root := merkleSumRoot(nodes)
+
+		for i := range nodes {
+			got := verifySolvencyPath(fmt.Sprintf("nonce-%d", i), balances[i],
+				merkleSumPath(nodes, i))
+			if got != root {
+				t.Fatalf("%d leaves, leaf %d: path leads to %v, root is %v", n, i, got, root)
+			}
+		}
+	}
+}
+
+func TestMerkleSumEmpty(t *testing.T) {
+	root := merkleSumRoot(nil)
+	if root.Sum != 0 || root.Hash != hashString("") {
+		t.Errorf("unexpected empty root %v", root)
+	}
+}
+
+func TestSplitBalance(t *testing.T) {
+	for _, balance := range []int64{0, 1, 7, 1000, 123456789} {
+		parts, err := splitBalance(balance, SOLVENCYSPLITS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(parts) != SOLVENCYSPLITS {
+			t.Fatalf("expected %d parts, got %d", SOLVENCYSPLITS, len(parts))
+		}
+
+		var total int64
+		for _, part := range parts {
+			if part < 0 {
+				t.Fatalf("negative part in %v", parts)
+			}
+			total += part
+		}
+		if total != balance {
+			t.Errorf("parts %v add up to %d, not %d", parts, total, balance)
+		}
+	}
+}
+
+func TestSolvencyProofFormat(t *testing.T) {
+	// the verifier reads these field names
+	j, _ := json.Marshal(SolvencyProof{
+		Report:  1,
+		Balance: 10,
+		Leaves: []SolvencyProofLeaf{{
+			Nonce:   "n",
+			Balance: 10,
+			Path:    []MerkleSumStep{{"left", MerkleSumNode{"h", 5}}},
+		}},
+	})
+
+	var proof struct {
+		Report  int   `json:"report"`
+		Balance int64 `json:"balance"`
+		Leaves  []struct {
+			Nonce   string `json:"nonce"`
+			Balance int64  `json:"balance"`
+			Path    []struct {
+				Side string `json:"side"`
+				Hash string `json:"hash"`
+				Sum  int64  `json:"sum"`
+			} `json:"path"`
+		} `json:"leaves"`
+	}
+	if err := json.Unmarshal(j, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if proof.Report != 1 || proof.Balance != 10 || len(proof.Leaves) != 1 ||
+		proof.Leaves[0].Nonce != "n" || proof.Leaves[0].Balance != 10 ||
+		len(proof.Leaves[0].Path) != 1 || proof.Leaves[0].Path[0].Side != "left" ||
+		proof.Leaves[0].Path[0].Hash != "h" || proof.Leaves[0].Path[0].Sum != 5 {
+		t.Errorf("unexpected proof json %s", j)
+	}
+}
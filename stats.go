@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	"github.com/fogleman/gg"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// group statistics are computed from the transactions that have the group in
+// their chat_id (see transactionChatId). proxy legs are ignored so proxied
+// payments aren't counted twice.
+
+type StatsEntry struct {
+	Account int    `db:"account"`
+	Tag     string `db:"tag"`
+	Msats   int64  `db:"msats"`
+	Count   int    `db:"count"`
+	User    string `db:"-"`
+}
+
+func (e StatsEntry) Sats() int64 { return e.Msats / 1000 }
+
+type StatsBucket struct {
+	Time  time.Time `db:"bucket"`
+	Msats int64     `db:"msats"`
+}
+
+func statsPeriod(opts docopt.Opts) (period string, since time.Time, granularity string) {
+	switch {
+	case opts["month"].(bool):
+		return "month", time.Now().AddDate(0, 0, -30), "day"
+	case opts["all"].(bool):
+		return "all", time.Time{}, "month"
+	default:
+		return "week", time.Now().AddDate(0, 0, -7), "day"
+	}
+}
+
+func handleStats(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	message := ctx.Value("message").(*tgbotapi.Message)
+
+	if message.Chat.Type == "private" {
+		send(ctx, u, t.MUSTBEGROUP)
+		return
+	}
+
+	g := ctx.Value("group").(GroupChat)
+	period, since, granularity := statsPeriod(opts)
+	logger := log.With().Int64("group", message.Chat.ID).Str("period", period).Logger()
+
+	var tippers, receivers, volume, players []StatsEntry
+	var buckets []StatsBucket
+
+	// tips and reactions, by sender and by receiver
+	err := pg.Select(&tippers, `
+SELECT from_id AS account, sum(amount)::bigint AS msats, count(*) AS count
+FROM lightning.transaction
+WHERE chat_id = $1 AND time > $2 AND (tag IS NULL OR tag = 'reaction')
+  AND from_id != $3 AND to_id != $3
+GROUP BY from_id
+ORDER BY msats DESC
+LIMIT 5
+    `, message.Chat.ID, since, s.ProxyAccount)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get top tippers")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	err = pg.Select(&receivers, `
+SELECT to_id AS account, sum(amount)::bigint AS msats, count(*) AS count
+FROM lightning.transaction
+WHERE chat_id = $1 AND time > $2 AND (tag IS NULL OR tag = 'reaction')
+  AND from_id != $3 AND to_id != $3
+GROUP BY to_id
+ORDER BY msats DESC
+LIMIT 5
+    `, message.Chat.ID, since, s.ProxyAccount)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get top receivers")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	// everything that was paid in the group, by app
+	err = pg.Select(&volume, `
+SELECT coalesce(tag, 'tip') AS tag, sum(amount)::bigint AS msats, count(*) AS count
+FROM lightning.transaction
+WHERE chat_id = $1 AND time > $2 AND from_id != $3 AND NOT pending
+GROUP BY coalesce(tag, 'tip')
+ORDER BY msats DESC
+    `, message.Chat.ID, since, s.ProxyAccount)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get volume by tag")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	// losers pay to the proxy, the winner gets one payment from it
+	err = pg.Select(&players, `
+SELECT account, 0 AS msats, count(*) AS count
+FROM (
+  SELECT from_id AS account
+  FROM lightning.transaction
+  WHERE chat_id = $1 AND time > $2 AND tag = 'coinflip' AND to_id = $3
+UNION ALL
+  SELECT to_id AS account
+  FROM lightning.transaction
+  WHERE chat_id = $1 AND time > $2 AND tag = 'coinflip' AND from_id = $3
+    AND description IS NULL -- skip taxes
+) AS entries
+GROUP BY account
+ORDER BY count DESC
+LIMIT 5
+    `, message.Chat.ID, since, s.ProxyAccount)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get coinflip players")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	err = pg.Select(&buckets, `
+SELECT date_trunc($4, time AT TIME ZONE 'UTC') AS bucket, sum(amount)::bigint AS msats
+FROM lightning.transaction
+WHERE chat_id = $1 AND time > $2 AND from_id != $3 AND NOT pending
+GROUP BY 1
+ORDER BY 1
+    `, message.Chat.ID, since, s.ProxyAccount, granularity)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to get volume buckets")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	for _, entries := range [][]StatsEntry{tippers, receivers, players} {
+		for i := range entries {
+			if user, err := loadUser(entries[i].Account); err == nil {
+				entries[i].User = user.AtName(ctx)
+			}
+		}
+	}
+
+	go u.track("stats", map[string]interface{}{
+		"group":  message.Chat.ID,
+		"period": period,
+	})
+
+	send(ctx, g, t.GROUPSTATS, t.T{
+		"Period":    period,
+		"Tippers":   tippers,
+		"Receivers": receivers,
+		"Volume":    volume,
+		"Players":   players,
+	})
+
+	if len(buckets) > 0 {
+		chart, err := renderStatsChart(fillStatsBuckets(buckets, since, granularity), granularity)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to render stats chart")
+			return
+		}
+		send(ctx, g, tempAssetURL(".png", chart))
+	}
+}
+
+// fillStatsBuckets adds the empty days or months so the chart shows them.
+func fillStatsBuckets(buckets []StatsBucket, since time.Time, granularity string) []StatsBucket {
+	next := func(t time.Time) time.Time {
+		if granularity == "month" {
+			return t.AddDate(0, 1, 0)
+		}
+		return t.AddDate(0, 0, 1)
+	}
+
+	// buckets are truncated in UTC, so the empty ones must be too
+	start := buckets[0].Time.UTC()
+	if !since.IsZero() {
+		since = since.UTC()
+		start = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.UTC)
+	}
+
+	byTime := make(map[int64]int64, len(buckets))
+	for _, bucket := range buckets {
+		byTime[bucket.Time.Unix()] = bucket.Msats
+	}
+
+	filled := make([]StatsBucket, 0, len(buckets))
+	for current := start; !current.After(time.Now()); current = next(current) {
+		filled = append(filled, StatsBucket{current, byTime[current.Unix()]})
+	}
+	return filled
+}
+
+func renderStatsChart(buckets []StatsBucket, granularity string) ([]byte, error) {
+	const (
+		width   = 640
+		height  = 320
+		padding = 40
+	)
+
+	var max int64
+	for _, bucket := range buckets {
+		if bucket.Msats > max {
+			max = bucket.Msats
+		}
+	}
+	if max == 0 {
+		max = 1
+	}
+
+	dc := gg.NewContext(width, height)
+	dc.SetHexColor("#ffffff")
+	dc.Clear()
+
+	// axis
+	dc.SetHexColor("#999999")
+	dc.SetLineWidth(1)
+	dc.DrawLine(padding, height-padding, width-padding/2, height-padding)
+	dc.Stroke()
+
+	// bars
+	slot := float64(width-padding-padding/2) / float64(len(buckets))
+	dc.SetHexColor("#f7931a")
+	for i, bucket := range buckets {
+		h := float64(height-padding*2) * float64(bucket.Msats) / float64(max)
+		dc.DrawRectangle(
+			padding+float64(i)*slot+slot*0.1,
+			float64(height-padding)-h,
+			slot*0.8,
+			h,
+		)
+	}
+	dc.Fill()
+
+	// labels
+	layout := "2 Jan"
+	if granularity == "month" {
+		layout = "Jan 2006"
+	}
+	dc.SetHexColor("#333333")
+	dc.DrawStringAnchored(fmt.Sprintf("%d sat", max/1000), padding, padding/2, 0, 0.5)
+	dc.DrawStringAnchored(buckets[0].Time.Format(layout),
+		padding, height-padding/2, 0, 0.5)
+	dc.DrawStringAnchored(buckets[len(buckets)-1].Time.Format(layout),
+		width-padding/2, height-padding/2, 1, 0.5)
+
+	var buf bytes.Buffer
+	if err := dc.EncodePNG(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
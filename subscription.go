@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	cmap "github.com/orcaman/concurrent-map"
+)
+
+// groups with a subscription price charge their members every period instead
+// of a one-time ticket. memberships are kept on the database and renewed by
+// subscriptionRoutine, members that don't pay until the end of the grace
+// period are kicked through the same machinery used for tickets.
+type Membership struct {
+	GroupId    int64     `db:"group_id"`
+	TelegramId int64     `db:"telegram_id"`
+	Username   string    `db:"username"`
+	PaidUntil  time.Time `db:"paid_until"`
+	Status     string    `db:"status"` // active, pending, lapsed or left
+}
+
+func (g GroupChat) setSubscription(price, period, grace int) (err error) {
+	defer forgetSubscriptionMembers(g.TelegramId)
+
+	_, err = pg.Exec(`
+UPDATE groupchat
+SET subscription_price = $2, subscription_period = $3, subscription_grace = $4
+WHERE telegram_id = $1
+    `, g.TelegramId, price, period, grace)
+	return
+}
+
+func (g GroupChat) getMembership(telegramId int64) (m Membership, err error) {
+	err = pg.Get(&m, `
+SELECT * FROM group_membership
+WHERE group_id = $1 AND telegram_id = $2
+    `, g.TelegramId, telegramId)
+	return
+}
+
+// isCurrentMember tells if the user has paid for the current period or is
+// still inside the grace period.
+func (g GroupChat) isCurrentMember(telegramId int64) bool {
+	m, err := g.getMembership(telegramId)
+	if err != nil {
+		return false
+	}
+	if m.Status != "active" && m.Status != "pending" {
+		return false
+	}
+	return m.PaidUntil.AddDate(0, 0, g.SubscriptionGrace).After(time.Now())
+}
+
+// resumeMembership is called when someone who left comes back before the end
+// of the period they had already paid for.
+func (g GroupChat) resumeMembership(telegramId int64) bool {
+	res, err := pg.Exec(`
+UPDATE group_membership SET status = 'active'
+WHERE group_id = $1 AND telegram_id = $2 AND status = 'left' AND paid_until > now()
+    `, g.TelegramId, telegramId)
+	if err != nil {
+		log.Warn().Err(err).Int64("group", g.TelegramId).Int64("member", telegramId).
+			Msg("failed to resume membership")
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// members that were already in the group when the subscription was turned on
+// never went through the ticket, and telegram doesn't let bots list the
+// members of a group, so they get a membership that is due right away when
+// they're first seen talking. subscription_members_seen avoids hitting the
+// database on every message.
+var subscription_members_seen = cmap.New()
+
+func seeSubscriptionMember(groupId int64, member *tgbotapi.User) {
+	key := fmt.Sprintf("%d:%d", groupId, member.ID)
+	if !subscription_members_seen.SetIfAbsent(key, true) {
+		return
+	}
+
+	_, err := pg.Exec(`
+INSERT INTO group_membership (group_id, telegram_id, username, paid_until)
+SELECT telegram_id, $2, $3, now() FROM groupchat
+WHERE telegram_id = $1 AND subscription_price > 0
+ON CONFLICT (group_id, telegram_id) DO NOTHING
+    `, groupId, member.ID, member.UserName)
+	if err != nil {
+		subscription_members_seen.Remove(key)
+		log.Warn().Err(err).Int64("group", groupId).Int("member", member.ID).
+			Msg("failed to add existing member to subscription")
+	}
+}
+
+func forgetSubscriptionMembers(groupId int64) {
+	prefix := fmt.Sprintf("%d:", groupId)
+	for _, key := range subscription_members_seen.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			subscription_members_seen.Remove(key)
+		}
+	}
+}
+
+func (g GroupChat) startMembership(telegramId int64, username string) (err error) {
+	_, err = pg.Exec(`
+INSERT INTO group_membership (group_id, telegram_id, username, paid_until)
+VALUES ($1, $2, $3, now() + make_interval(days => $4))
+ON CONFLICT (group_id, telegram_id) DO UPDATE SET
+  username = $3,
+  paid_until = now() + make_interval(days => $4),
+  status = 'active'
+    `, g.TelegramId, telegramId, username, g.SubscriptionPeriod)
+	return
+}
+
+func (g GroupChat) extendMembership(telegramId int64) (paidUntil time.Time, err error) {
+	err = pg.Get(&paidUntil, `
+UPDATE group_membership
+SET paid_until = greatest(paid_until, now() - make_interval(days => $4)) + make_interval(days => $3),
+    status = 'active'
+WHERE group_id = $1 AND telegram_id = $2
+RETURNING paid_until
+    `, g.TelegramId, telegramId, g.SubscriptionPeriod, g.SubscriptionGrace)
+	return
+}
+
+func setMembershipStatus(groupId int64, telegramId int64, status string) (err error) {
+	_, err = pg.Exec(`
+UPDATE group_membership SET status = $3
+WHERE group_id = $1 AND telegram_id = $2
+    `, groupId, telegramId, status)
+	return
+}
+
+func listMemberships(groupId int64) (members []Membership, err error) {
+	err = pg.Select(&members, `
+SELECT * FROM group_membership
+WHERE group_id = $1
+ORDER BY status = 'left', status = 'lapsed', paid_until DESC
+LIMIT 100
+    `, groupId)
+	return
+}
+
+func handleTelegramLeftMember(leaveMessage *tgbotapi.Message) {
+	member := leaveMessage.LeftChatMember
+	if member == nil {
+		return
+	}
+
+	// left before paying the ticket
+	cancelPendingJoin(leaveMessage.Chat.ID, member.ID)
+
+	// removed by an admin, not by themselves or by us for not paying
+	if leaveMessage.From != nil &&
+		leaveMessage.From.ID != member.ID && leaveMessage.From.ID != bot.Self.ID {
+		forfeitDeposit(context.Background(), leaveMessage.Chat.ID, int64(member.ID))
+	}
+
+	// stop charging people who leave by themselves
+	_, err := pg.Exec(`
+UPDATE group_membership SET status = 'left'
+WHERE group_id = $1 AND telegram_id = $2 AND status != 'lapsed'
+    `, leaveMessage.Chat.ID, member.ID)
+	if err != nil {
+		log.Warn().Err(err).Int64("group", leaveMessage.Chat.ID).Int("member", member.ID).
+			Msg("failed to mark membership as left")
+	}
+}
+
+func subscriptionRoutine() {
+	for {
+		chargeDueMemberships()
+		time.Sleep(time.Hour)
+	}
+}
+
+func chargeDueMemberships() {
+	var due []Membership
+	err := pg.Select(&due, `
+SELECT m.* FROM group_membership AS m
+INNER JOIN groupchat AS g ON g.telegram_id = m.group_id
+WHERE m.status = 'active' AND m.paid_until <= now() AND g.subscription_price > 0
+    `)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to fetch due memberships")
+		return
+	}
+
+	for _, m := range due {
+		if err := renewMembership(m); err != nil {
+			log.Warn().Err(err).Int64("group", m.GroupId).Int64("member", m.TelegramId).
+				Msg("failed to renew membership")
+		}
+	}
+}
+
+// renewMembership takes the money from the member balance if possible,
+// otherwise it sends them an invoice and waits until the end of the grace
+// period.
+func renewMembership(m Membership) error {
+	g, err := loadTelegramGroup(m.GroupId)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.WithValue(context.Background(), "origin", "background")
+	ctx = context.WithValue(ctx, "locale", g.Locale)
+
+	chatOwner, err := getChatOwner(g.TelegramId)
+	if err != nil {
+		return err
+	}
+
+	member, _ := loadTelegramUser(int(m.TelegramId))
+	if member != nil {
+		ctx = context.WithValue(ctx, "initiator", member)
+		ctx = context.WithValue(ctx, "locale", member.Locale)
+
+		if member.Id == chatOwner.Id {
+			_, err := g.extendMembership(m.TelegramId)
+			return err
+		}
+
+		// try the balance first
+		err := member.sendInternally(
+			ctx,
+			chatOwner,
+			false,
+			int64(g.SubscriptionPrice)*1000,
+			0,
+			fmt.Sprintf("Membership renewal for group %d.", g.TelegramId),
+			"",
+			"subscription",
+		)
+		if err == nil {
+			paidUntil, err := g.extendMembership(m.TelegramId)
+			if err != nil {
+				return err
+			}
+
+			send(ctx, member, t.SUBSCRIPTIONRENEWED, t.T{
+				"Sats":      g.SubscriptionPrice,
+				"PaidUntil": paidUntil,
+			})
+
+			go member.track("subscription renewed", map[string]interface{}{
+				"sats":  g.SubscriptionPrice,
+				"group": g.TelegramId,
+				"auto":  true,
+			})
+			return nil
+		}
+	}
+
+	// couldn't auto-debit, send an invoice
+	deadline := m.PaidUntil.AddDate(0, 0, g.SubscriptionGrace)
+	expiry := time.Until(deadline)
+	if expiry < time.Hour {
+		expiry = time.Hour
+		deadline = time.Now().Add(expiry)
+	}
+
+	username := m.Username
+	if member != nil {
+		username = member.AtName(ctx)
+	}
+
+	bolt11, hash, err := chatOwner.makeInvoice(ctx, &MakeInvoiceArgs{
+		IgnoreRateLimit: true,
+		Msatoshi:        int64(g.SubscriptionPrice) * 1000,
+		Description: fmt.Sprintf(
+			"membership renewal for %s in group %d.", username, g.TelegramId),
+		Tag:    "subscription",
+		Expiry: &expiry,
+	})
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("renewal:%d:%d", m.TelegramId, g.TelegramId)
+
+	// if we can't talk to the member privately we'll talk in the group
+	var target interface{} = g
+	var chatId int64 = g.TelegramId
+	if member != nil && member.TelegramChatId != 0 {
+		target = member
+		chatId = member.TelegramChatId
+	}
+
+	var keyboard *tgbotapi.InlineKeyboardMarkup
+	if member != nil {
+		keyboard = &tgbotapi.InlineKeyboardMarkup{
+			InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{
+				{
+					tgbotapi.NewInlineKeyboardButtonData(
+						translateTemplate(ctx, t.PAYAMOUNT,
+							t.T{"Sats": float64(g.SubscriptionPrice)}),
+						fmt.Sprintf("renew=%s", key),
+					),
+				},
+			},
+		}
+	}
+
+	notifyMessageId := send(ctx, target, t.SUBSCRIPTIONDUE, t.T{
+		"User":     username,
+		"Sats":     g.SubscriptionPrice,
+		"Deadline": deadline,
+	}, keyboard, FORCESPAMMY)
+	if notifyMessageId == nil {
+		return fmt.Errorf("failed to notify member about renewal")
+	}
+
+	var invoiceMessage *tgbotapi.Message
+	if invoiceMessageId := send(ctx, target, qrURL(bolt11),
+		"<code>"+bolt11+"</code>", FORCESPAMMY); invoiceMessageId != nil {
+		invoiceMessage = &tgbotapi.Message{
+			Chat:      &tgbotapi.Chat{ID: chatId},
+			MessageID: invoiceMessageId.(int),
+		}
+	}
+
+	var memberId int
+	if member != nil {
+		memberId = member.Id
+	}
+
+	kickdata := KickData{
+		Kind:           "renewal",
+		InvoiceMessage: invoiceMessage,
+		NotifyMessage: &tgbotapi.Message{
+			Chat:      &tgbotapi.Chat{ID: chatId},
+			MessageID: notifyMessageId.(int),
+		},
+		ChatMemberConfig: tgbotapi.ChatMemberConfig{
+			UserID: int(m.TelegramId),
+			ChatID: g.TelegramId,
+		},
+		ChatOwner:      chatOwner,
+		TargetId:       memberId,
+		TargetUsername: username,
+		Hash:           hash,
+		Sats:           g.SubscriptionPrice,
+		Deadline:       deadline,
+	}
+
+	err = savePendingCharge(key, &kickdata)
+	if err != nil {
+		log.Warn().Err(err).Str("renewal-key", key).Msg("error saving kickdata")
+	}
+	setMembershipStatus(g.TelegramId, m.TelegramId, "pending")
+	go waitToKick(ctx, key, kickdata)
+
+	go chatOwner.track("subscription invoice", map[string]interface{}{
+		"sats":  g.SubscriptionPrice,
+		"group": g.TelegramId,
+	})
+
+	return nil
+}
+
+func handleRenewalClickPay(ctx context.Context, key string) {
+	payer := ctx.Value("initiator").(*User)
+
+	log := log.With().Str("renewal-key", key).Logger()
+
+	kickdata, err := loadPendingCharge(key)
+	if err != nil {
+		log.Warn().Err(err).Msg("error getting renewal pending on callback")
+		return
+	}
+
+	if !resolveCharge(key, "paid") {
+		return
+	}
+
+	err = payer.sendInternally(
+		ctx,
+		kickdata.ChatOwner,
+		false,
+		int64(kickdata.Sats*1000),
+		0,
+		fmt.Sprintf("Membership renewal for group %d.", kickdata.ChatMemberConfig.ChatID),
+		"",
+		"subscription",
+	)
+	if err != nil {
+		reopenCharge(key, kickdata)
+		send(ctx, payer, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	dispatchGeneric(key, nil)
+	renewalPaid(ctx, key, kickdata)
+}
+
+func renewalPaid(ctx context.Context, key string, kickdata KickData) {
+	log.Debug().Str("renewal-key", key).Msg("renewal paid")
+
+	g, err := loadTelegramGroup(kickdata.ChatMemberConfig.ChatID)
+	if err != nil {
+		log.Error().Err(err).Int64("group", kickdata.ChatMemberConfig.ChatID).
+			Msg("error fetching group chat after renewal paid")
+		return
+	}
+
+	paidUntil, err := g.extendMembership(int64(kickdata.ChatMemberConfig.UserID))
+	if err != nil {
+		log.Error().Err(err).Str("renewal-key", key).
+			Msg("failed to extend membership after renewal paid")
+	}
+
+	if kickdata.InvoiceMessage != nil {
+		deleteMessage(kickdata.InvoiceMessage)
+	}
+
+	send(ctx, EDIT, kickdata.NotifyMessage, t.SUBSCRIPTIONRENEWED, t.T{
+		"Sats":      kickdata.Sats,
+		"PaidUntil": paidUntil,
+	}, &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+
+	go kickdata.ChatOwner.track("subscription renewed", map[string]interface{}{
+		"sats":  kickdata.Sats,
+		"group": g.TelegramId,
+		"auto":  false,
+	})
+}
+
+func renewalNotPaid(ctx context.Context, key string, kickdata KickData) {
+	log.Info().Str("renewal-key", key).Msg("membership lapsed, kicking user")
+
+	bot.KickChatMember(tgbotapi.KickChatMemberConfig{
+		ChatMemberConfig: kickdata.ChatMemberConfig,
+		UntilDate:        time.Now().AddDate(0, 0, 1).Unix(),
+	})
+
+	setMembershipStatus(kickdata.ChatMemberConfig.ChatID,
+		int64(kickdata.ChatMemberConfig.UserID), "lapsed")
+
+	if kickdata.InvoiceMessage != nil {
+		deleteMessage(kickdata.InvoiceMessage)
+	}
+
+	send(ctx, EDIT, kickdata.NotifyMessage, t.SUBSCRIPTIONLAPSED, t.T{
+		"User": kickdata.TargetUsername,
+	}, &tgbotapi.InlineKeyboardMarkup{
+		InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+	})
+}
+
+func handleMembers(ctx context.Context) {
+	u := ctx.Value("initiator").(*User)
+	message := ctx.Value("message").(*tgbotapi.Message)
+
+	if message.Chat.Type == "private" {
+		send(ctx, u, t.MUSTBEGROUP)
+		return
+	}
+	if !isAdmin(message.Chat, message.From) {
+		send(ctx, u, t.MUSTBEADMIN)
+		return
+	}
+
+	g, err := loadTelegramGroup(message.Chat.ID)
+	if err != nil && err != sql.ErrNoRows {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	members, err := listMemberships(message.Chat.ID)
+	if err != nil {
+		log.Warn().Err(err).Int64("group", message.Chat.ID).Msg("failed to list members")
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	go u.track("members", map[string]interface{}{"group": message.Chat.ID})
+
+	send(ctx, u, t.MEMBERSLIST, t.T{
+		"Group":   g,
+		"Members": members,
+	})
+}
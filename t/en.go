@@ -29,6 +29,9 @@ var EN = map[Key]string{
 	INLINEGIVEAWAYRESULT: "Give {{.Sats}} sat {{if .Receiver}}to @{{.Receiver}}{{else}}away{{end}}",
 	INLINEGIVEFLIPRESULT: "Give away {{.Sats}} sat to one out of {{.MaxPlayers}} participants",
 	INLINECOINFLIPRESULT: "Lottery with entry fee of {{.Sats}} sat for {{.MaxPlayers}} participants",
+	INLINEBALANCERESULT:  "Balance: {{printf \"%.15g\" .Sats}} sat",
+	INLINEBALANCEDESC:    "Only you can see this. Tap to share how to pay you.",
+	INLINEBALANCESHARE:   "Send me satoshis at <code>{{.Receive}}</code>",
 	INLINEHIDDENRESULT:   "{{.HiddenId}} ({{if gt .Message.Crowdfund 1}}crowd:{{.Message.Crowdfund}}{{else if gt .Message.Times 0}}priv:{{.Message.Times}}{{else if .Message.Public}}pub{{else}}priv{{end}}): {{.Message.Content}}",
 
 	LNURLUNSUPPORTED: "That kind of lnurl is not supported here.",
@@ -69,11 +72,24 @@ lnurl-auth success!
 
 	TICKETSET:         "New entrants will have to pay an invoice of {{.Sat}} sat (make sure you've set @lntxbot as administrator for this to work).",
 	TICKETUSERALLOWED: "Ticket paid. {{.User}} allowed.",
-	TICKETMESSAGE: `⚠️ {{.User}}, this group requires that you pay {{.Sats}} sat to be able to join.
+	TICKETMESSAGE: `⚠️ {{.User}}, this group requires that you {{if .Deposit}}lock a deposit of {{.Sats}} sat, which you'll get back later if you behave,{{else}}pay {{.Sats}} sat{{if .Subscription}} every {{.Period}} day{{s .Period}}{{end}}{{end}} to be able to join.
 
 You have 15 minutes to do it or you'll be kicked and banned for one day.
 `,
 
+	SUBSCRIPTIONMSG:     `{{with .Group}}{{if .SubscriptionPrice}}Membership in this group costs {{.SubscriptionPrice}} sat every {{.SubscriptionPeriod}} day{{s .SubscriptionPeriod}}. New entrants pay the first period to join, after that it's taken from their balance or they get an invoice and have {{.SubscriptionGrace}} day{{s .SubscriptionGrace}} to pay it before being kicked. Members who were already here are charged the same way the first time they send a message (make sure you've set @lntxbot as administrator for this to work).{{else}}This group doesn't charge a recurring membership.{{end}}{{end}}`,
+	SUBSCRIPTIONDUE:     `⚠️ {{.User}}, your membership must be renewed for {{.Sats}} sat. Pay until {{.Deadline | time}} or you'll be removed from the group.`,
+	SUBSCRIPTIONRENEWED: `Membership renewed for {{.Sats}} sat, paid until {{.PaidUntil | time}}.`,
+	SUBSCRIPTIONLAPSED:  `Membership of {{.User}} wasn't renewed, so they were removed from the group.`,
+	MEMBERSLIST: `<b>Members</b>{{with .Group}}{{if .SubscriptionPrice}} ({{.SubscriptionPrice}} sat every {{.SubscriptionPeriod}} day{{s .SubscriptionPeriod}}){{end}}{{end}}
+{{range .Members}}
+{{if eq .Status "active"}}✅{{else if eq .Status "pending"}}⏳{{else if eq .Status "lapsed"}}❌{{else}}🚪{{end}} {{if .Username}}{{.Username}}{{else}}<code>{{.TelegramId}}</code>{{end}}: {{.Status}}, paid until {{.PaidUntil | timeSmall}}{{else}}
+Nobody has paid a membership in this group yet.{{end}}
+    `,
+	DEPOSITMSG:       `{{with .Policy}}{{if .Sats}}New entrants must lock a deposit of {{.Sats}} sat to join. It's given back {{if .Days}}after {{.Days}} day{{s .Days}}{{end}}{{if and .Days .Messages}} or {{end}}{{if .Messages}}after {{.Messages}} message{{s .Messages}}{{end}}, but goes to the {{if eq .ForfeitTo "treasury"}}group treasury{{else}}group owner{{end}} if they're fined or banned by an admin (make sure you've set @lntxbot as administrator for this to work).{{else}}This group doesn't require deposits from new entrants.{{end}}{{end}}`,
+	DEPOSITREFUNDED:  `Your deposit of {{.Sats}} sat was given back.`,
+	DEPOSITFORFEITED: `{{.User}} lost their deposit of {{.Sats}} sat.`,
+
 	RENAMABLEMSG:      "Anyone can rename this group as long as they pay {{.Sat}} sat (make sure you've set @lntxbot as administrator for this to work).",
 	RENAMEPROMPT:      "Pay <b>{{.Sats}} sat</b> to rename this group to <i>{{.Name}}</i>?",
 	GROUPNOTRENAMABLE: "This group is not renamable!",
@@ -131,9 +147,41 @@ Service powered by https://sms4sats.com.`,
 	COINFLIPSENABLEDMSG:   "Coinflips are {{if .Enabled}}enabled{{else}}disabled{{end}} in this group.",
 	LANGUAGEMSG:           "This chat language is set to <code>{{.Language}}</code>.",
 	FREEJOIN:              "This group is now free to join.",
-	EXPENSIVEMSG:          "Every message in this group{{with .Pattern}} containing the pattern <code>{{.}}</code>{{end}} will cost {{.Price}} sat.",
+	EXPENSIVEMSG:          "Every message in this group{{with .Media}} with {{.}}{{end}}{{with .Pattern}} containing the pattern <code>{{.}}</code>{{end}} will cost {{.Price}} sat{{if .Treasury}}, paid to the group treasury{{end}}.{{with .Id}} (rule {{.}}){{end}}",
 	EXPENSIVENOTIFICATION: "The message {{.Link}} just {{if .Sender}}cost{{else}}earned{{end}} you {{.Price}} sat.",
 	FREETALK:              "Messages are free again",
+	EXPENSIVERULES: `<b>Expensive messages</b>
+{{range .Rules}}
+<code>{{.Id}}</code>: {{.Price}} sat for {{if .Media}}{{.Media}}{{else}}messages{{end}}{{with .Pattern}} matching <code>{{.}}</code>{{end}}, to the {{.Destination}}{{if or .ExemptAdmins .ExemptWhitelisted}}, except for {{if .ExemptAdmins}}admins{{end}}{{if and .ExemptAdmins .ExemptWhitelisted}} and {{end}}{{if .ExemptWhitelisted}}whitelisted users{{end}}{{end}}.{{else}}
+Messages are free in this group.{{end}}
+{{if .Exempt}}
+<b>Whitelist</b>: {{range $i, $e := .Exempt}}{{if $i}}, {{end}}{{if $e.Username}}{{$e.Username}}{{else}}<code>{{$e.TelegramId}}</code>{{end}}{{end}}{{end}}
+    `,
+	REACTIONSMSG: "Reactions are {{if .Enabled}}enabled. Reply to a message with {{.Emoji}} to send your /upvote amount to its author, or with something like <code>+21</code> to send a specific amount. See the best of the week with /leaderboard.{{else}}disabled.{{end}}",
+	UPVOTEMSG:    "Each of your reactions sends {{.Sats}} sat.",
+	LEADERBOARD: `<b>Reactions leaderboard this week</b>
+{{range $i, $e := .Entries}}
+{{add $i 1}}. {{$e.User}}: {{$e.Sats}} sat{{else}}
+Nobody got anything yet.{{end}}
+    `,
+	GROUPSTATS: `<b>Group stats</b> ({{if eq .Period "week"}}last 7 days{{else if eq .Period "month"}}last 30 days{{else}}all time{{end}})
+
+<b>Top tippers</b>
+{{range $i, $e := .Tippers}}{{add $i 1}}. {{$e.User}}: {{$e.Sats}} sat in {{$e.Count}} tip{{s $e.Count}}
+{{else}}Nobody has tipped yet.
+{{end}}
+<b>Top receivers</b>
+{{range $i, $e := .Receivers}}{{add $i 1}}. {{$e.User}}: {{$e.Sats}} sat from {{$e.Count}} tip{{s $e.Count}}
+{{else}}Nobody has received tips yet.
+{{end}}
+<b>Volume</b>
+{{range .Volume}}{{.Tag}}: {{.Sats}} sat in {{.Count}} payment{{s .Count}}
+{{else}}Nothing was paid here yet.
+{{end}}{{if .Players}}
+<b>Coinflip players</b>
+{{range $i, $e := .Players}}{{add $i 1}}. {{$e.User}}: {{$e.Count}} coinflip{{s $e.Count}}
+{{end}}{{end}}`,
+	EXPENSIVEEXEMPT: "{{.User}} is {{if .Exempt}}now{{else}}no longer{{end}} whitelisted from expensive messages.",
 
 	APPBALANCE: `#{{.App | lower}} Balance: <i>{{printf "%.15g" .Balance}} sat</i>`,
 
@@ -207,12 +255,50 @@ You have 15 minutes to pay or you will be kicked.
 	COINFLIPHELP: `Starts a fair lottery with the given number of participants. Everybody pay the same amount as the entry fee. The winner gets it all. Funds are only moved from participants accounts when the lottery is actualized.
 
 /coinflip_100_5: 5 participants needed, winner will get 500 satoshis (including its own 100, so it's 400 net satoshis).
+
+Coinflips are provably fair, check the result of any of them with /verify.
     `,
 	COINFLIPWINNERMSG:      "You're the winner of a coinflip for a prize of {{.TotalSats}} sat. The losers were: {{.Senders}}.",
 	COINFLIPGIVERMSG:       "You've lost {{.IndividualSats}} in a coinflip. The winner was {{.Receiver}}.",
 	COINFLIPAD:             "Pay {{.Sats}} and get a chance to win {{.Prize}}! {{.SpotsLeft}} out of {{.MaxPlayers}} spot{{s .SpotsLeft}} left!",
 	COINFLIPJOIN:           "Join lottery!",
 	CALLBACKCOINFLIPWINNER: "Coinflip winner: {{.Winner}}",
+	COINFLIPCOMMITMENT: `
+🔒 Coinflip <code>{{.Id}}</code>, seed commitment: <code>{{.Commitment}}</code>`,
+	COINFLIPREVEAL: `
+🔓 Seed: <code>{{.Seed}}</code>
+Check the result with /verify_{{.Id}}`,
+	COINFLIPVERIFY: `
+<b>Coinflip</b> <code>{{.Id}}</code> ({{.Sats}} sat)
+
+<b>Commitment</b>: <code>{{.Commitment}}</code>
+<b>Seed</b>: <code>{{.Seed}}</code>
+<b>Entries</b>:
+{{range $i, $e := .Entries}}{{$i}}. <code>{{$e}}</code>
+{{end}}
+<b>Winner</b>: {{.Winner}}
+
+{{if .CommitmentMatch}}✅ sha256(seed) matches the commitment.{{else}}❌ sha256(seed) doesn't match the commitment!{{end}}
+{{if .WinnerMatch}}✅ The winner matches the one that was paid.{{else}}❌ The winner doesn't match the one that was paid!{{end}}
+
+The winner is the entry at index <code>uint64(sha256(seed:entry0:entry1:...)[0:8]) mod number_of_entries</code>.
+    `,
+	COINFLIPRULESMSG: `
+<b>Coinflips</b> are {{if .Enabled}}enabled{{else}}disabled{{end}} in this group.
+
+<b>Entry</b>: {{if .Rules.MinSats}}at least {{.Rules.MinSats}} sat{{else}}no minimum{{end}}, {{if .Rules.MaxSats}}at most {{.Rules.MaxSats}} sat{{else}}no maximum{{end}}
+<b>Max participants</b>: {{.Rules.MaxPlayers}}
+<b>Tax</b>: {{if .Rules.Tax.Valid}}{{.Rules.Tax.Int64}}% of the prize, goes to the {{.Rules.TaxTo}}{{else}}none{{end}}
+<b>Daily coinflips per user</b>: {{if .Rules.Quota.Valid}}{{if .Rules.Quota.Int64}}{{.Rules.Quota.Int64}}{{else}}unlimited{{end}}{{else}}default{{end}}
+<b>Daily giveflips per user</b>: {{if .Rules.GiveflipQuota.Valid}}{{if .Rules.GiveflipQuota.Int64}}{{.Rules.GiveflipQuota.Int64}}{{else}}unlimited{{end}}{{else}}default{{end}}
+<b>Allowed hours</b>: {{if eq .Rules.HoursStart .Rules.HoursEnd}}any time{{else}}{{.Rules.HoursStart}}:00 to {{.Rules.HoursEnd}}:00 UTC{{end}}
+    `,
+	VERIFYHELP: `Verifies the result of a finished coinflip.
+
+When a coinflip is created the bot publishes the sha256 hash of a secret seed. Each participant that joins adds an entry. When the coinflip is finished the seed is revealed and the winner is the entry at index <code>uint64(sha256(seed:entry0:entry1:...)[0:8]) mod number_of_entries</code>.
+
+/verify_abc1234: shows the seed, the entries and the winner of coinflip <code>abc1234</code>.
+    `,
 
 	GIVEFLIPHELP: `Starts a giveaway, but instead of giving to the first person who clicks, the amount is raffled between first x clickers.
 
@@ -262,6 +348,144 @@ API Base URL: <code>{{.ServiceURL}}/</code>
 Keep these tokens secret. If they leak for some reason call /api_refresh to replace all.
     `,
 
+	WEBHOOKSHELP: `Calls your URLs whenever something happens to your balance.
+
+<code>/webhooks add https://example.com/hook</code> subscribes to all events, <code>/webhooks add https://example.com/hook received sent</code> only to some of them. Events are <code>received</code>, <code>sent</code>, <code>failed</code> and <code>internal</code> (transfers between bot users).
+<code>/webhooks del 3</code> removes a webhook.
+/webhooks_deliveries shows the last calls and whether they worked. Failed calls are retried for some hours.
+/webhooks_secret shows the key used to sign the calls, /webhooks_secret_reset replaces it.
+
+Each call is a POST with a JSON body. The <code>X-Lntxbot-Signature</code> header is <code>sha256=</code> followed by the hex HMAC-SHA256 of <code>X-Lntxbot-Timestamp</code>, a dot and the body, using your secret.
+    `,
+	WEBHOOKS: `<b>Webhooks</b>
+{{range .Subscriptions}}{{.Id}}. <code>{{.URL}}</code>: {{if .Events}}{{.Events}}{{else}}all events{{end}}
+{{else}}None yet, see /help_webhooks.
+{{end}}
+/webhooks_deliveries shows the last calls.
+    `,
+	WEBHOOKDELIVERIES: `<b>Webhook calls</b>
+{{range .Deliveries}}
+<code>{{timeSmall .CreatedAt}}</code> {{.Event}} to <code>{{.URL}}</code>
+  {{if eq .Status "delivered"}}✅ delivered{{else if eq .Status "failed"}}❌ gave up{{else}}⏳ retrying at {{timeSmall .NextAttempt}}{{end}} after {{.Attempts}} attempt{{s .Attempts}}{{if and (ne .Status "delivered") .LastError.Valid}}: <i>{{.LastError.String}}</i>{{end}}
+{{else}}
+Nothing was sent yet.
+{{end}}
+    `,
+	WEBHOOKSECRET: `Your webhook secret is <code>{{.Secret}}</code>.
+
+Use it to check the <code>X-Lntxbot-Signature</code> header, see /help_webhooks. /webhooks_secret_reset replaces it.
+    `,
+
+	ANALYTICS: `<b>Usage in the last {{.Days}} day{{s .Days}}</b>
+{{.Active}} active user{{s .Active}}.
+
+<b>Daily active users</b>
+{{range .Activity}}<code>{{.Day.Format "Mon 02 Jan"}}</code> {{.Active}} ({{.Events}} event{{s .Events}})
+{{else}}Nothing yet.
+{{end}}
+<b>Commands</b>
+{{range .Commands}}{{.Command}}: {{.Count}} time{{s .Count}} by {{.Users}} user{{s .Users}}
+{{else}}Nothing yet.
+{{end}}
+    `,
+
+	PROOFHELP: `Shows how to check that your balance is counted in the total the bot owes its users.
+
+Every few hours the bot adds up all balances in a tree where only the root, with the total, is published. Your balance is split in a few random pieces, /proof gives you the path from each of them to that root, which you can check on the solvency page without learning the balances of other users.
+    `,
+	PROOF: `{{if not .Report}}There's no solvency report yet, try again later.{{else if not .Included}}Your balance was zero on the last solvency report ({{timeSmall .Report.CreatedAt}}), so there's nothing to prove.{{else}}<b>Solvency report #{{.Report.Id}}</b> ({{timeSmall .Report.CreatedAt}})
+
+Your balance then: <i>{{msatToSat .Balance}} sat</i>
+Total owed to users: <i>{{msatToSat .Report.Liabilities}} sat</i>
+Root: <code>{{.Report.Root}}</code>
+
+Open the attached file on {{.URL}} to check it leads to the published root.{{end}}
+    `,
+	SOLVENCY: `<b>Solvency report #{{.Report.Id}}</b>
+Owed to users: <i>{{msatToSat .Report.Liabilities}} sat</i> in {{.Report.Accounts}} account{{s .Report.Accounts}}
+In channels: <i>{{msatToSat .Report.Channels}} sat</i>
+On-chain: <i>{{msatToSat .Report.Onchain}} sat</i>
+Coverage: <b>{{printf "%.3f" .Report.Ratio}}</b>{{if lt .Report.Ratio .Threshold}} ⚠️ under {{printf "%.3f" .Threshold}}{{end}}
+    `,
+	SOLVENCYALERT: `⚠️ <b>Node funds cover only {{printf "%.3f" .Report.Ratio}} of user balances</b> (alert threshold is {{printf "%.3f" .Threshold}}).
+
+Owed to users: <i>{{msatToSat .Report.Liabilities}} sat</i>
+In channels: <i>{{msatToSat .Report.Channels}} sat</i>
+On-chain: <i>{{msatToSat .Report.Onchain}} sat</i>
+    `,
+
+	ADMINHELP: `<b>Admin commands</b>
+<code>/admin lookup &lt;user&gt;</code> shows an account, by id, @username, <code>tg:&lt;telegram id&gt;</code> or payment hash.
+<code>/admin credit &lt;user&gt; &lt;sat&gt; &lt;note&gt;</code> and <code>/admin debit &lt;user&gt; &lt;sat&gt; &lt;note&gt;</code> adjust a balance, the note is saved with the transaction.
+<code>/admin ban &lt;user&gt; [--for=3d] [--scope=send] [&lt;reason&gt;]</code> bans someone, forever if there's no <code>--for</code>. The scope is <code>all</code> (the default), <code>send</code>, <code>apps</code> or <code>sats4ads</code>. <code>/admin unban &lt;user&gt;</code> lifts all bans and /admin_bans lists the current ones.
+<code>/admin settle &lt;hash&gt; &lt;preimage&gt;</code> marks a pending payment as paid, <code>/admin refund &lt;hash&gt;</code> gives the money back to the user. Both check the payment on the node first, refunds only go through when it has failed.
+<code>/admin broadcast &lt;text&gt;</code> sends a message to all users.
+/admin_node shows the node and the totals.
+<code>/admin audit [&lt;user&gt;] [--action=coinflip] [--limit=50]</code> shows the latest balance changes, <code>/admin audit export [&lt;user&gt;] [--days=90]</code> sends them as CSV.
+    `,
+	ADMINUSER: `<b>Account {{.User.Id}}</b>{{if .User.Username}} @{{.User.Username}}{{end}}
+Telegram: {{if .User.TelegramId}}<code>{{.User.TelegramId}}</code>{{else}}none{{end}}{{if not .User.TelegramChatId}}, no private chat{{end}}
+Balance: <i>{{printf "%.3f" .Info.Balance}} sat</i>
+Received: <i>{{printf "%.3f" .Info.TotalReceived}} sat</i>
+Sent: <i>{{printf "%.3f" .Info.TotalSent}} sat</i>
+Fees: <i>{{printf "%.3f" .Info.TotalFees}} sat</i>
+Pending payments: {{.Pending}}
+{{range .Bans}}⛔️ banned ({{.Scope}}) {{if .Until.Valid}}until {{time .Until.Time}}{{else}}forever{{end}}{{if .Reason}}: <i>{{.Reason}}</i>{{end}}
+{{end}}
+    `,
+	ADMINTRANSACTIONS: `{{range .Transactions}}<code>{{timeSmall .Time}}</code> {{if .Pending}}🕓{{end}} <i>{{msatToSat .Msatoshi}} sat</i>{{if .Fees}} (fee {{msatToSat .Fees}}){{end}}
+  from {{if .FromId.Valid}}{{.FromId.Int64}}{{if .FromUsername.Valid}} @{{.FromUsername.String}}{{end}}{{else}}outside{{end}} to {{if .ToId.Valid}}{{.ToId.Int64}}{{if .ToUsername.Valid}} @{{.ToUsername.String}}{{end}}{{else}}outside{{end}}{{if .Tag}} #{{.Tag}}{{end}}
+  {{if .Description}}<i>{{.Description}}</i>
+  {{end}}<code>{{.Hash}}</code>
+{{end}}
+    `,
+	ADMINADJUSTED: `{{if .Credit}}Added{{else}}Removed{{end}} <i>{{.Sats}} sat</i> {{if .Credit}}to{{else}}from{{end}} {{.User.Id}}{{if .User.Username}} @{{.User.Username}}{{end}}: <i>{{.Note}}</i>
+New balance: <i>{{printf "%.3f" .Balance}} sat</i>
+<code>{{.Hash}}</code>
+    `,
+	ADMINBANNED: `⛔️ {{.User.Id}}{{if .User.Username}} @{{.User.Username}}{{end}} is banned ({{.Ban.Scope}}) {{if .Ban.Until.Valid}}until {{time .Ban.Until.Time}}{{else}}forever{{end}}.`,
+	ADMINBANS: `<b>Bans</b>
+{{range .Bans}}{{.Account}}{{if .Username.Valid}} @{{.Username.String}}{{end}} ({{.Scope}}) {{if .Until.Valid}}until {{timeSmall .Until.Time}}{{else}}forever{{end}}{{if .Reason}}: <i>{{.Reason}}</i>{{end}}
+{{else}}Nobody is banned.
+{{end}}
+    `,
+	ADMINBROADCAST: "Broadcast finished: sent to {{.Sent}} user{{s .Sent}}, failed for {{.Failed}}.",
+	ADMINNODE: `<b>Node</b> <code>{{.Pubkey}}</code>
+Block height: {{.BlockHeight}}
+Channels: {{.Channels}}{{range $status, $n := .Statuses}}, {{$n}} {{$status}}{{end}}
+In channels: <i>{{.ChannelSats}} sat</i>
+On-chain: <i>{{.OnchainSats}} sat</i>
+
+Owed to users: <i>{{.Liabilities}} sat</i> in {{.Accounts}} account{{s .Accounts}}
+Pending payments: {{.Pending}} (<i>{{.PendingSats}} sat</i>)
+    `,
+	ADMINAUDIT: `{{range .Entries}}<code>{{timeSmall .Time}}</code> <b>{{.Action}}</b> {{.Account}}: <i>{{if ge .Delta 0}}+{{end}}{{msatToSat .Delta}} sat</i> ({{msatToSat .BalanceBefore}} → {{msatToSat .BalanceAfter}})
+  {{.Origin}}{{if .Actor.Valid}} by {{.Actor.Int64}}{{end}}{{if .PaymentHash.Valid}} <code>{{.PaymentHash.String}}</code>{{end}}
+{{else}}No entries.
+{{end}}
+    `,
+	ADMINAUDITEXPORT: `{{.N}} audit log entr{{if eq .N 1}}y{{else}}ies{{end}} from the last {{.Days}} day{{s .Days}}.`,
+	MERGECONFLICT: `Couldn't merge account {{.Remove.Id}}{{if .Remove.Username}} @{{.Remove.Username}}{{end}} into {{.Keep.Id}}{{if .Keep.Username}} @{{.Keep.Username}}{{end}}{{if .Keep.TelegramId}} (telegram <code>{{.Keep.TelegramId}}</code>){{end}}:
+{{range .Conflicts}}- {{.}}
+{{end}}
+Both accounts were left as they are.
+    `,
+
+	ACCOUNTHELP: `Exports or deletes everything the bot keeps about you.
+
+<code>/account export</code> sends you a file with your account, settings, transactions, balance checks and hidden messages.
+<code>/account delete</code> erases your account. Your balance must be zero, so withdraw everything first. The deletion only happens after a few days, and until then <code>/account cancel</code> stops it.
+    `,
+	ACCOUNTEXPORT: "Here's all the data we have about your account.",
+	ACCOUNTDELETECONFIRM: `If you confirm, your account will be deleted in {{.Days}} day{{s .Days}}. Your settings, balance checks, hidden messages, point-of-sale orders, webhooks, group memberships and the data of accounts merged into yours will be erased, and the people you've paid won't see your name on their transactions anymore. The audit log of your balance changes (amounts, times, payment hashes and what they were for) is kept for accounting. This can't be undone after that.
+
+Until then you can stop it with /account_cancel.`,
+	ACCOUNTDELETEBUTTON:    "Delete my account",
+	ACCOUNTDELETESCHEDULED: "🗑 Your account will be deleted on {{time .ExecuteAt}}. Send /account_cancel to keep it.",
+	ACCOUNTDELETECANCELED:  "{{if .Canceled}}Your account won't be deleted anymore.{{else}}There was no deletion scheduled for your account.{{end}}",
+	ACCOUNTDELETEBLOCKED:   "Your account can't be deleted: {{.Err}}",
+	ACCOUNTDELETED:         "🗑 Your account was deleted. If you send a message to the bot again a new one will be created.",
+
 	HIDEHELP: `Hides a message so it can be unlocked later with a payment.
 <code>/hide 500 'teaser showed on prompt'</code>, send this in reply to any message, with video, audio, images or text, and it will be hidden behind a 500 satoshis paywall.
 
@@ -269,6 +493,14 @@ Modifiers:
   <code>--crowdfund &lt;number&gt;</code> enables public crowdfunding of hidden messages.
   <code>--private</code> reveals the hidden message privately to the payer instead of in the group.
   <code>--revealers &lt;number&gt;</code> only allows the first <code>&lt;number&gt;</code> participants to see the hidden the message, then the prompt expires.
+  <code>--days &lt;number&gt;</code> keeps the message available for that many days (up to 365) instead of the default 3.
+  <code>--web</code> also sells the message on a public page anyone can pay with a Lightning wallet, each payment can be opened 3 times or as many as <code>--downloads &lt;number&gt;</code>.
+
+Photos, documents and voice notes can be hidden too, by replying to them. /hidden lists your hidden messages and how much each one has earned.
+    `,
+	HIDDENHELP: `Lists your hidden messages with how many times each one was revealed and how much it has earned.
+
+<code>/hidden cancel 5c0b2rh</code> withdraws the hidden message 5c0b2rh before it expires, so nobody else can reveal it.
     `,
 	REVEALHELP: `Reveals a message that was previously hidden. The author of the hidden message is never disclosed. Once a message is hidden it is available to be revealed globally, but only by those who know its hidden id.
 
@@ -280,20 +512,92 @@ A reveal prompt can also be created in a group or chat by clicking the "share" b
 	HIDDENDEFAULTPREVIEW: "A message is hidden here. {{.Sats}} sat needed to unlock.",
 	HIDDENWITHID: `Message hidden with id <code>{{.HiddenId}}</code>. {{if gt .Message.Crowdfund 1}}Will be revealed publicly once {{.Message.Crowdfund}} people pay {{.Message.Satoshis}}{{else if gt .Message.Times 0}}Will be revealed privately to the first {{.Message.Times}} payers{{else if .Message.Public}}Will be revealed publicly once one person pays {{.Message.Satoshis}}{{else}}Will be revealed privately to any payer{{end}}.
 
+Available until {{.Message.ExpiresAt | time}}, /hidden_cancel_{{.HiddenId}} withdraws it before that.
+{{if .WebURL}}
+Sold on the web at {{.WebURL}}, each payment can be opened {{.Message.Downloads}} time{{s .Message.Downloads}}.
+{{end}}
 {{if .WithInstructions}}Call /reveal_{{.HiddenId}} on a group to share it there.{{end}}
     `,
 	HIDDENSOURCEMSG:   "Hidden message <code>{{.Id}}</code> revealed by {{.Revealers}}. You got {{.Sats}} sat.",
 	HIDDENREVEALMSG:   "{{.Sats}} sat paid to reveal the message <code>{{.Id}}</code>.",
 	HIDDENMSGNOTFOUND: "Hidden message not found.",
 	HIDDENSHAREBTN:    "Share in another chat",
+	HIDDENWEBSOLD:     "Hidden message <code>{{.Id}}</code> sold on the web for {{.Sats}} sat.",
+	HIDDENCANCELED:    "Hidden message <code>{{.Id}}</code> withdrawn, it can't be revealed anymore.",
+	HIDDENLIST: `<b>Your hidden messages</b>
+{{range .Messages}}
+<code>{{.Id}}</code> {{.Satoshis}} sat{{if .MediaType}} ({{.MediaType}}){{end}}{{if .Web}} 🌐{{end}}: revealed {{.Reveals}} time{{s .Reveals}}, {{.Revenue | msatToSat}} sat earned. {{if .Withdrawn}}Withdrawn.{{else if .Expired}}Expired.{{else}}Until {{.ExpiresAt | timeSmall}}, /hidden_cancel_{{.Id}}{{end}}{{else}}
+You haven't hidden anything yet, see /help_hide.{{end}}
+    `,
+
+	POSHELP: `Point of sale for merchants. Keep a catalogue of items and charge customers by tapping them.
+
+<code>/pos add 3.5 usd coffee</code> adds an item priced in dollars, <code>/pos add 500 sat cookie</code> adds one priced in satoshis. Fiat prices are converted when the customer is charged.
+/pos_list shows the catalogue and <code>/pos del 2</code> removes the second item.
+/pos starts a new order: tap the items, then charge to get an invoice QR code for the customer. You'll be told when it's paid.
+/pos_sales shows today's sales, a summary is also sent at the end of each day.
+/pos_web gives you a page to use on a tablet at the counter, /pos_web_reset replaces its link.
+    `,
+	POSCATALOG: `<b>Catalogue</b>
+{{range $i, $item := .Items}}{{add $i 1}}. {{$item.Name}}: {{printf "%g" $item.Price}} {{$item.Currency}}
+{{else}}No items yet, add them with <code>/pos add 3.5 usd coffee</code>.
+{{end}}
+/pos starts a new order.
+    `,
+	POSORDER: `<b>{{if .Id}}Order #{{.Id}}{{else}}New order{{end}}</b>
+{{range .Lines}}{{.Quantity}}× {{.Name}} ({{printf "%g" .Price}} {{.Currency}})
+{{else}}Tap the items to add them.
+{{end}}{{if .Totals}}
+Total: {{range $i, $total := .Totals}}{{if $i}} + {{end}}{{printf "%g" $total.Amount}} {{$total.Currency}}{{end}}{{end}}
+    `,
+	POSCHARGEBTN: "🧾 Charge",
+	POSCLEARBTN:  "✖️ Clear",
+	POSPAID:      "✅ Order #{{.Id}} paid, {{.Sats}} sat received. /pos for the next customer.",
+	POSSALES: `<b>Sales on {{.Summary.Day}}</b>
+{{.Summary.Count}} order{{s .Summary.Count}}, {{.Summary.Sats}} sat in total.
+{{range .Summary.Items}}
+{{.Quantity}}× {{.Name}}{{end}}
+    `,
+	POSWEB: `Open {{.URL}} on the tablet at the counter.
+
+Anyone with this link can create invoices to you but can't see or move your money. /pos_web_reset replaces it.
+    `,
 
 	TOGGLEHELP: `Toggles bot features in groups on/off. In supergroups it can only be run by admins.
 
 /toggle_ticket_10 starts charging a fee for all new entrants. Useful as an antispam measure. The money goes to the group owner.
 /toggle_ticket stops charging new entrants a fee. 
+<code>/toggle subscription 1000 30 3</code> turns the ticket into a membership of 1000 sat every 30 days, with 3 days of grace for renewals. /toggle_subscription_0 turns it off, /toggle_subscription shows the current settings.
+<code>/toggle deposits 500 7 20</code> makes new entrants lock 500 sat that they get back after 7 days or 20 messages, whatever comes first. If they're fined or banned by an admin the deposit goes to the group owner, or to the /treasury with <code>--to=treasury</code>. /toggle_deposits_0 turns it off, /toggle_deposits shows the current settings.
+<code>/toggle expensive add 10 bitcoin</code> makes every message containing "bitcoin" cost 10 sat. Patterns are regular expressions and are optional. Add <code>--media=photo,video,link,forward</code> to charge only for these kinds of messages, <code>--to=treasury</code> to send the money to the /treasury instead of the group owner and <code>--exempt=none</code> to also charge admins and whitelisted users (the default is <code>--exempt=admins,whitelist</code>).
+/toggle_expensive lists the rules, <code>/toggle expensive del 3</code> removes one of them and /toggle_expensive_del_all removes all. <code>/toggle expensive exempt @someone</code> (or replying to a message) adds or removes someone from the whitelist.
+/toggle_reactions enables or disables tipping by replying to a message with 👍 or ⚡ (see /help_upvote), <code>/toggle reactions 🔥 🚀</code> changes these emoji.
 /toggle_language_ru changes the chat language to Russian, /toggle_language displays the chat language, these also work in private chats.
 /toggle_spammy toggles 'spammy' mode. 'spammy' mode is off by default. When turned on, tip notifications will be sent in the group instead of only privately.
+/toggle_coinflips enables or disables coinflips and giveflips in the group, /toggle_coinflips_rules shows the house rules for them.
+/toggle_coinflips_min_100, <code>/toggle coinflips max 10000</code> and <code>/toggle coinflips players 10</code> set bounds for the entry amount and the number of participants.
+<code>/toggle coinflips tax 5%</code> takes 5% of each coinflip prize and <code>/toggle coinflips taxto treasury</code> sends it to the /treasury of the group instead of to the group owner. <code>/toggle coinflips tax default</code> removes the tax. The bot fee of 10 sat per participant is always charged.
+<code>/toggle coinflips quota 3</code> and <code>/toggle coinflips giveflipquota 3</code> limit how many coinflips and giveflips each user can join per day (0 means unlimited).
+<code>/toggle coinflips hours 18-23</code> only allows coinflips and giveflips between these hours (UTC), <code>/toggle coinflips hours any</code> allows them at any time.
+    `,
+
+	TREASURYHELP: `Shows the balance of the group treasury, which collects taxes and fees when the group is configured to send them there. Group admins can transfer money out of it.
+
+<code>/treasury transfer 1000 @someone</code> sends 1000 sat from the treasury to @someone.
     `,
+	TREASURYMSG:   "🏦 The group treasury has {{printf \"%.15g\" .Sats}} sat.",
+	GROUPTREASURY: "the group treasury",
+
+	LEADERBOARDHELP: `Shows who earned the most with reactions in this group during the current week (see /help_upvote).`,
+	UPVOTEHELP: `Sets how much you send when you react to a message in a group by replying with one of the group's reaction emoji. The group must have reactions enabled with /toggle_reactions. You can also reply with something like <code>+21</code> to send a specific amount.
+
+/upvote_21 makes each of your reactions send 21 sat, /upvote shows the current amount.
+    `,
+	STATSHELP: `Shows who tipped and received the most in this group, how much was moved by each app and who played the most coinflips, with a chart of the daily volume.
+
+/stats shows the last 7 days, /stats_month the last 30 days and /stats_all everything since the bot started keeping track.
+    `,
+	MEMBERSHELP: `Lists the members of a group with a recurring membership (see /help_toggle), their status and until when they've paid. Only for admins.`,
 
 	SATS4ADSHELP: `
 Sats4ads is an ad marketplace on Telegram. Pay money to show ads to others, receive money for each ad you see.
@@ -309,11 +613,15 @@ To broadcast an ad you must send a message to the bot that will be your ad conte
 /sats4ads_off turns off your account so you won't get any more ads.
 /sats4ads_rates shows a breakdown of how many nodes are at each price level. Useful to plan your ad budget early.
 /sats4ads_rate shows your rate.
+/sats4ads_campaigns lists the ads you've broadcasted. Ads are sent gradually, use <code>--start=3h</code> or <code>--start=2021-05-30T18:00</code> (UTC) to schedule a broadcast for later and <code>/sats4ads cancel &lt;id&gt;</code> to stop it. <code>/sats4ads report &lt;id&gt;</code> shows how many people have viewed an ad, how many clicked on its links and how much each view cost.
 /sats4ads_preview in reply to a message shows a preview of how other users will see it. The satoshi amount shown in the preview message is not meaningful.
 /sats4ads_broadcast_1000 broadcasts an ad. The last number is the maximum number of satoshis that will be spend. Cheaper ad-listeners will be preferred over more expensive ones. Must be called in a reply to another message, the contents of which will be used as the ad text.
+<code>/sats4ads tags bitcoin music</code> declares your interests, so advertisers can target you. /sats4ads_tags_clear removes them.
+
+Broadcasts can be targeted with <code>--locale=es</code> (only users with that language), <code>--tags=bitcoin,music</code> (only users interested in any of these) and <code>--active=30</code> (only users that have used their wallet in the last 30 days). The same options can be used with /sats4ads_rates to see the size of the audience.
     `,
 	SATS4ADSTOGGLE:    `#sats4ads {{if .On}}Seeing ads and receiving {{printf "%.15g" .Sats}} sat per character.{{else}}You won't see any more ads.{{end}}`,
-	SATS4ADSBROADCAST: `#sats4ads {{if .NSent}}Message broadcasted {{.NSent}} time{{s .NSent}} for a total cost of {{.Sats}} sat ({{dollar .Sats}}).{{else}}Couldn't find a peer to notify with the given parameters. /sats4ads_rates{{end}}`,
+	SATS4ADSBROADCAST: `#sats4ads {{if .NSent}}Message broadcasted {{.NSent}} time{{s .NSent}} for a total cost of {{.Sats}} sat ({{dollar .Sats}}).{{if .Campaign}} Follow its performance at /sats4ads_report_{{.Campaign}}.{{end}}{{else}}Couldn't find a peer to notify with the given parameters. /sats4ads_rates{{end}}`,
 	SATS4ADSSTART:     `Message being broadcasted.`,
 	SATS4ADSPRICETABLE: `#sats4ads Quantity of users <b>up to</b> each pricing tier.
 {{range .Rates}}<code>{{.UpToRate}} msat</code>: <i>{{.NUsers}} user{{s .NUsers}}</i>
@@ -322,8 +630,35 @@ To broadcast an ad you must send a message to the bot that will be your ad conte
 {{end}}
 Each ad costs the above prices <i>per character</i> + <code>1 sat</code> for each user.
     `,
-	SATS4ADSADFOOTER: `[#sats4ads: {{printf "%.15g" .Sats}} sat]`,
-	SATS4ADSVIEWED:   `Claim`,
+	SATS4ADSADFOOTER:  `[#sats4ads: {{printf "%.15g" .Sats}} sat]`,
+	SATS4ADSVIEWED:    `Claim`,
+	SATS4ADSTARGETING: `#sats4ads Audience: {{with .Targeting}}{{if .Locale}}language <code>{{.Locale}}</code>; {{end}}{{if .Tags}}interested in {{range $i, $t := .Tags}}{{if $i}}, {{end}}<code>{{$t}}</code>{{end}}; {{end}}{{if .ActiveDays}}active in the last {{.ActiveDays}} day{{s .ActiveDays}}.{{end}}{{end}}`,
+	SATS4ADSTAGS:      `#sats4ads {{if .Tags}}Your interests: {{range $i, $t := .Tags}}{{if $i}}, {{end}}<code>{{$t}}</code>{{end}}. Advertisers targeting these will be able to reach you.{{else}}You haven't declared any interests. Use <code>/sats4ads tags bitcoin music</code> to get ads targeted to your interests.{{end}}`,
+	SATS4ADSSCHEDULED: `#sats4ads Campaign <code>{{.Campaign.Id}}</code> scheduled to start {{.Campaign.StartsAt | time}}. /sats4ads_cancel_{{.Campaign.Id}}`,
+	SATS4ADSCANCELED:  `#sats4ads Campaign <code>{{.Id}}</code> canceled. Ads already sent won't be refunded unless they're not viewed.`,
+	SATS4ADSCAMPAIGNS: `#sats4ads <b>Your campaigns</b>
+{{range .Campaigns}}
+<code>{{.Id}}</code> {{.StartsAt | timeSmall}} ({{.Status}}): {{.Views}}/{{.Sent}} viewed, {{printf "%.15g" .SpentSats}} sat spent. /sats4ads_report_{{.Id}}{{else}}
+You haven't broadcasted any ads yet.{{end}}
+    `,
+	SATS4ADSREPORT: `#sats4ads <b>Campaign</b> <code>{{.Campaign.Id}}</code>, {{if eq .Campaign.Status "scheduled"}}starts{{else}}started{{end}} {{.Campaign.StartsAt | time}}
+{{with .Campaign}}
+<b>Status</b>: {{.Status}}{{if .Error.Valid}} ({{.Error.String}}){{end}}
+<b>Budget</b>: {{.Budget}} sat
+{{with .TargetingData}}{{if .Locale}}<b>Language</b>: <code>{{.Locale}}</code>
+{{end}}{{if .Tags}}<b>Interests</b>: {{range $i, $t := .Tags}}{{if $i}}, {{end}}<code>{{$t}}</code>{{end}}
+{{end}}{{if .ActiveDays}}<b>Active in the last</b>: {{.ActiveDays}} day{{s .ActiveDays}}
+{{end}}{{end}}
+<b>Sent</b>: {{.Sent}}
+<b>Viewed</b>: {{.Views}}
+<b>Waiting view</b>: {{.Pending}}
+<b>Not viewed (refunded)</b>: {{.Refunds}}, {{printf "%.15g" (msatToSat .Refunded)}} sat
+{{if .LinkList}}<b>Clicks</b>: {{.Clicks}}
+{{end}}
+<b>Spent</b>: {{printf "%.15g" .SpentSats}} sat ({{dollar .SpentSats}})
+<b>Cost per view</b>: {{printf "%.3f" .CostPerView}} sat
+{{end}}
+    `,
 
 	HELPHELP: "Shows full help or help about specific command.",
 
@@ -384,6 +719,7 @@ Registered: {{.Registered}}
 	MISSINGRECEIVER:   "Missing receiver!",
 	GIVERCANTJOIN:     "Giver can't join!",
 	CANTJOINTWICE:     "Can't join twice!",
+	COINFLIPOPENED:    "The coinflip is open, press again to join.",
 	CANTREVEALOWN:     "Can't reveal your own hidden message!",
 	CANTCANCEL:        "You don't have the powers to cancel this.",
 	FAILEDINVOICE:     "Failed to generate invoice: {{.Err}}",
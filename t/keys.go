@@ -34,6 +34,9 @@ const (
 	INLINEGIVEAWAYRESULT Key = "InlineGiveawayResult"
 	INLINEGIVEFLIPRESULT Key = "InlineGiveflipResult"
 	INLINECOINFLIPRESULT Key = "InlineCoinflipResult"
+	INLINEBALANCERESULT  Key = "InlineBalanceResult"
+	INLINEBALANCEDESC    Key = "InlineBalanceDesc"
+	INLINEBALANCESHARE   Key = "InlineBalanceShare"
 	INLINEHIDDENRESULT   Key = "InlineHiddenResult"
 
 	LNURLUNSUPPORTED          Key = "LnurlUnsupported"
@@ -50,6 +53,15 @@ const (
 	TICKETMESSAGE     Key = "TicketMessage"
 	TICKETUSERALLOWED Key = "TicketUserAllowed"
 
+	SUBSCRIPTIONMSG     Key = "SubscriptionMsg"
+	SUBSCRIPTIONDUE     Key = "SubscriptionDue"
+	SUBSCRIPTIONRENEWED Key = "SubscriptionRenewed"
+	SUBSCRIPTIONLAPSED  Key = "SubscriptionLapsed"
+	MEMBERSLIST         Key = "MembersList"
+	DEPOSITMSG          Key = "DepositMsg"
+	DEPOSITREFUNDED     Key = "DepositRefunded"
+	DEPOSITFORFEITED    Key = "DepositForfeited"
+
 	RENAMABLEMSG      Key = "RenamableMsg"
 	RENAMEPROMPT      Key = "RenamePrompt"
 	GROUPNOTRENAMABLE Key = "GroupNotRenamable"
@@ -78,6 +90,13 @@ const (
 	EXPENSIVEMSG          Key = "ExpensiveMsg"
 	EXPENSIVENOTIFICATION Key = "ExpensiveNotification"
 	FREETALK              Key = "FreeTalk"
+	EXPENSIVERULES        Key = "ExpensiveRules"
+	EXPENSIVEEXEMPT       Key = "ExpensiveExempt"
+
+	REACTIONSMSG Key = "ReactionsMsg"
+	UPVOTEMSG    Key = "UpvoteMsg"
+	LEADERBOARD  Key = "Leaderboard"
+	GROUPSTATS   Key = "GroupStats"
 
 	APPBALANCE Key = "AppBalance"
 
@@ -113,6 +132,20 @@ const (
 	COINFLIPAD        Key = "CoinflipAd"
 	COINFLIPJOIN      Key = "CoinflipJoin"
 
+	COINFLIPCOMMITMENT Key = "CoinflipCommitment"
+	COINFLIPREVEAL     Key = "CoinflipReveal"
+	COINFLIPVERIFY     Key = "CoinflipVerify"
+	VERIFYHELP         Key = "verifyHelp"
+	COINFLIPRULESMSG   Key = "CoinflipRulesMsg"
+
+	TREASURYHELP    Key = "treasuryHelp"
+	MEMBERSHELP     Key = "membersHelp"
+	LEADERBOARDHELP Key = "leaderboardHelp"
+	UPVOTEHELP      Key = "upvoteHelp"
+	STATSHELP       Key = "statsHelp"
+	TREASURYMSG     Key = "TreasuryMsg"
+	GROUPTREASURY   Key = "GroupTreasury"
+
 	GIVEFLIPHELP      Key = "giveflipHelp"
 	GIVEFLIPMSG       Key = "GiveFlipMsg"
 	GIVEFLIPWINNERMSG Key = "GiveflipWinnerMsg"
@@ -131,8 +164,42 @@ const (
 	APIPASSWORDUPDATEERROR Key = "APIPasswordUpdateError"
 	APICREDENTIALS         Key = "APICredentials"
 
+	WEBHOOKSHELP      Key = "webhooksHelp"
+	WEBHOOKS          Key = "Webhooks"
+	WEBHOOKDELIVERIES Key = "WebhookDeliveries"
+	WEBHOOKSECRET     Key = "WebhookSecret"
+
+	ANALYTICS Key = "Analytics"
+
+	PROOFHELP     Key = "proofHelp"
+	PROOF         Key = "Proof"
+	SOLVENCY      Key = "Solvency"
+	SOLVENCYALERT Key = "SolvencyAlert"
+
+	ADMINHELP         Key = "AdminHelp"
+	ADMINUSER         Key = "AdminUser"
+	ADMINTRANSACTIONS Key = "AdminTransactions"
+	ADMINADJUSTED     Key = "AdminAdjusted"
+	ADMINBANNED       Key = "AdminBanned"
+	ADMINBANS         Key = "AdminBans"
+	ADMINBROADCAST    Key = "AdminBroadcast"
+	ADMINNODE         Key = "AdminNode"
+	ADMINAUDIT        Key = "AdminAudit"
+	ADMINAUDITEXPORT  Key = "AdminAuditExport"
+	MERGECONFLICT     Key = "MergeConflict"
+
+	ACCOUNTHELP            Key = "accountHelp"
+	ACCOUNTEXPORT          Key = "AccountExport"
+	ACCOUNTDELETECONFIRM   Key = "AccountDeleteConfirm"
+	ACCOUNTDELETEBUTTON    Key = "AccountDeleteButton"
+	ACCOUNTDELETESCHEDULED Key = "AccountDeleteScheduled"
+	ACCOUNTDELETECANCELED  Key = "AccountDeleteCanceled"
+	ACCOUNTDELETEBLOCKED   Key = "AccountDeleteBlocked"
+	ACCOUNTDELETED         Key = "AccountDeleted"
+
 	HIDEHELP             Key = "hideHelp"
 	REVEALHELP           Key = "revealHelp"
+	HIDDENHELP           Key = "hiddenHelp"
 	HIDDENREVEALBUTTON   Key = "HiddenRevealButton"
 	HIDDENDEFAULTPREVIEW Key = "HiddenDefaultPreview"
 	HIDDENWITHID         Key = "HiddenWithId"
@@ -140,6 +207,18 @@ const (
 	HIDDENREVEALMSG      Key = "HiddenRevealMsg"
 	HIDDENMSGNOTFOUND    Key = "HiddenMsgNotFound"
 	HIDDENSHAREBTN       Key = "HiddenShareBtn"
+	HIDDENCANCELED       Key = "HiddenCanceled"
+	HIDDENWEBSOLD        Key = "HiddenWebSold"
+	HIDDENLIST           Key = "HiddenList"
+
+	POSHELP      Key = "posHelp"
+	POSCATALOG   Key = "PosCatalog"
+	POSORDER     Key = "PosOrder"
+	POSCHARGEBTN Key = "PosChargeBtn"
+	POSCLEARBTN  Key = "PosClearBtn"
+	POSPAID      Key = "PosPaid"
+	POSSALES     Key = "PosSales"
+	POSWEB       Key = "PosWeb"
 
 	SATS4ADSHELP       Key = "sats4adsHelp"
 	SATS4ADSTOGGLE     Key = "Sats4adsToggle"
@@ -148,6 +227,12 @@ const (
 	SATS4ADSPRICETABLE Key = "Sats4adsPriceTable"
 	SATS4ADSADFOOTER   Key = "Sats4adsAdFooter"
 	SATS4ADSVIEWED     Key = "Viewed"
+	SATS4ADSTARGETING  Key = "Sats4adsTargeting"
+	SATS4ADSTAGS       Key = "Sats4adsTags"
+	SATS4ADSCAMPAIGNS  Key = "Sats4adsCampaigns"
+	SATS4ADSREPORT     Key = "Sats4adsReport"
+	SATS4ADSSCHEDULED  Key = "Sats4adsScheduled"
+	SATS4ADSCANCELED   Key = "Sats4adsCanceled"
 
 	TOGGLEHELP Key = "toggleHelp"
 
@@ -171,6 +256,7 @@ const (
 	MISSINGRECEIVER   Key = "MissingReceiver"
 	GIVERCANTJOIN     Key = "GiverCantJoin"
 	CANTJOINTWICE     Key = "CantJoinTwice"
+	COINFLIPOPENED    Key = "CoinflipOpened"
 	CANTREVEALOWN     Key = "CantRevealOwn"
 	CANTCANCEL        Key = "CantCancel"
 	FAILEDINVOICE     Key = "FailedInvoice"
@@ -17,7 +17,7 @@ func serveTempAssets() {
 	router.PathPrefix("/tempasset/").HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
 			name := r.URL.Path[11:]
-			mimeType := mime.TypeByExtension(filepath.Base(name))
+			mimeType := mime.TypeByExtension(filepath.Ext(name))
 			w.Header().Set("Content-Type", mimeType)
 
 			if val, ok := tempAssets.Get(name); ok {
@@ -3,17 +3,13 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/fiatjaf/lntxbot/t"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
-	cmap "github.com/orcaman/concurrent-map"
 )
 
-var pendingApproval = cmap.New()
-
 func handleTelegramNewMember(
 	ctx context.Context,
 	joinMessage *tgbotapi.Message,
@@ -31,13 +27,38 @@ func handleTelegramNewMember(
 		return
 	}
 
-	if g.Ticket == 0 {
+	// groups with subscriptions charge the first period as the ticket
+	price := g.Ticket
+	if g.SubscriptionPrice > 0 {
+		if g.isCurrentMember(int64(newmember.ID)) ||
+			g.resumeMembership(int64(newmember.ID)) {
+			// paid already, just rejoining
+			return
+		}
+		price = g.SubscriptionPrice
+	}
+
+	// groups with a deposit policy (and no subscription) make new members lock
+	// some money that they get back later instead of paying a ticket
+	kind := "ticket"
+	if g.SubscriptionPrice == 0 {
+		if policy, err := g.getDepositPolicy(); err == nil && policy.Sats > 0 {
+			if g.hasLockedDeposit(newmember.ID) {
+				// deposit still locked from a previous join
+				return
+			}
+			kind = "deposit"
+			price = policy.Sats
+		}
+	}
+
+	if price == 0 {
 		// no ticket policy
 		return
 	}
 
 	joinKey := fmt.Sprintf("%d:%d", newmember.ID, joinMessage.Chat.ID)
-	if _, isPending := pendingApproval.Get(joinKey); isPending {
+	if isPendingJoin(joinMessage.Chat.ID, newmember.ID) {
 		// user joined, left and joined again.
 		// do nothing as the old timer is still counting.
 		return
@@ -68,17 +89,32 @@ func handleTelegramNewMember(
 
 	target, _ := loadTelegramUser(newmember.ID)
 
+	// tickets are paid to the owner, but deposits are paid by the new member
+	// to their own account so they can be locked from there
+	invoiceReceiver := chatOwner
+	var targetId int
+	if kind == "deposit" {
+		target, _, err = ensureTelegramUser(&tgbotapi.Message{From: &newmember})
+		if err != nil {
+			log.Warn().Err(err).Str("username", username).
+				Msg("failed to ensure user for deposit. allowing user.")
+			return
+		}
+		invoiceReceiver = target
+		targetId = target.Id
+	}
+
 	if info, err := target.getInfo(); err == nil &&
-		info.BalanceMsat < int64(g.Ticket*1000) {
+		info.BalanceMsat < int64(price*1000) {
 
-		bolt11, hash, err = chatOwner.makeInvoice(ctx, &MakeInvoiceArgs{
+		bolt11, hash, err = invoiceReceiver.makeInvoice(ctx, &MakeInvoiceArgs{
 			IgnoreRateLimit: true,
-			Msatoshi:        int64(g.Ticket) * 1000,
+			Msatoshi:        int64(price) * 1000,
 			Description: fmt.Sprintf(
-				"ticket for %s to join %s (%d).",
-				username, joinMessage.Chat.Title, joinMessage.Chat.ID,
+				"%s for %s to join %s (%d).",
+				kind, username, joinMessage.Chat.Title, joinMessage.Chat.ID,
 			),
-			Tag:    "ticket",
+			Tag:    kind,
 			Extra:  InvoiceExtra{Message: joinMessage},
 			Expiry: &expiration,
 		})
@@ -91,7 +127,7 @@ func handleTelegramNewMember(
 		}
 
 		go chatOwner.track("ticket shown", map[string]interface{}{
-			"sats":    g.Ticket,
+			"sats":    price,
 			"group":   joinMessage.Chat.ID,
 			"invoice": true,
 		})
@@ -101,7 +137,7 @@ func handleTelegramNewMember(
 				{
 					tgbotapi.NewInlineKeyboardButtonData(
 						fmt.Sprintf(translateTemplate(ctx,
-							t.PAYAMOUNT, t.T{"Sats": float64(g.Ticket)})),
+							t.PAYAMOUNT, t.T{"Sats": float64(price)})),
 						fmt.Sprintf("ticket=%s", joinKey),
 					),
 				},
@@ -109,15 +145,18 @@ func handleTelegramNewMember(
 		}
 
 		go chatOwner.track("ticket shown", map[string]interface{}{
-			"sats":    g.Ticket,
+			"sats":    price,
 			"group":   joinMessage.Chat.ID,
 			"balance": true,
 		})
 	}
 
 	notifyMessageId := send(ctx, g, t.TICKETMESSAGE, t.T{
-		"User": username,
-		"Sats": g.Ticket,
+		"User":         username,
+		"Sats":         price,
+		"Subscription": g.SubscriptionPrice > 0,
+		"Period":       g.SubscriptionPeriod,
+		"Deposit":      kind == "deposit",
 	}, keyboard)
 
 	var invoiceMessage *tgbotapi.Message
@@ -137,7 +176,7 @@ func handleTelegramNewMember(
 	}
 
 	kickdata := KickData{
-		"ticket",
+		kind,
 		invoiceMessage,
 		&tgbotapi.Message{
 			Chat:      &tgbotapi.Chat{ID: joinMessage.Chat.ID},
@@ -149,19 +188,17 @@ func handleTelegramNewMember(
 			ChatID: joinMessage.Chat.ID,
 		},
 		chatOwner,
-		0,
+		targetId,
 		username,
 		hash,
-		g.Ticket,
+		price,
+		time.Time{},
 	}
 
-	kickdatajson, _ := json.Marshal(kickdata)
-	err = rds.HSet("ticket-pending", joinKey, string(kickdatajson)).Err()
+	err = savePendingCharge(joinKey, &kickdata)
 	if err != nil {
-		log.Warn().Err(err).Str("kickdata", string(kickdatajson)).
-			Msg("error saving kickdata")
+		log.Warn().Err(err).Str("join-key", joinKey).Msg("error saving kickdata")
 	}
-	pendingApproval.Set(joinKey, kickdata)
 	go waitToKick(ctx, joinKey, kickdata)
 }
 
@@ -170,15 +207,26 @@ func handleTicketClickPay(ctx context.Context, joinKey string) {
 
 	log := log.With().Str("ticket-key", joinKey).Logger()
 
-	kickdatastr, err := rds.HGet("ticket-pending", joinKey).Result()
+	kickdata, err := loadPendingCharge(joinKey)
 	if err != nil {
 		log.Warn().Err(err).Msg("error getting ticket pending on callback")
 		return
 	}
 
-	var kickdata KickData
-	if err := json.Unmarshal([]byte(kickdatastr), &kickdata); err != nil {
-		log.Warn().Err(err).Msg("failed to unmarshal kickdata from redis")
+	if !resolveCharge(joinKey, "paid") {
+		return
+	}
+
+	// deposits are locked from whoever pays them and given back to them later
+	if kickdata.Kind == "deposit" {
+		if err := lockDeposit(ctx, payer, kickdata); err != nil {
+			reopenCharge(joinKey, kickdata)
+			send(ctx, payer, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		dispatchGeneric(joinKey, nil)
+		ticketPaid(ctx, joinKey, kickdata)
 		return
 	}
 
@@ -201,6 +249,7 @@ func handleTicketClickPay(ctx context.Context, joinKey string) {
 		"ticket",
 	)
 	if err != nil {
+		reopenCharge(joinKey, kickdata)
 		send(ctx, payer, t.ERROR, t.T{"Err": err.Error()})
 		return
 	}
@@ -220,8 +269,14 @@ func ticketPaid(ctx context.Context, joinKey string, kickdata KickData) {
 	}
 
 	log.Debug().Str("join-key", joinKey).Msg("ticket paid")
-	pendingApproval.Remove(joinKey)
-	rds.HDel("ticket-pending", joinKey)
+
+	// on groups with subscriptions the ticket pays for the first period
+	if g.SubscriptionPrice > 0 {
+		err := g.startMembership(int64(kickdata.ChatMemberConfig.UserID), kickdata.TargetUsername)
+		if err != nil {
+			log.Error().Err(err).Str("join-key", joinKey).Msg("failed to start membership")
+		}
+	}
 
 	// delete the invoice message
 	if kickdata.InvoiceMessage != nil {
@@ -249,9 +304,6 @@ func ticketNotPaid(ctx context.Context, joinKey string, kickdata KickData) {
 		UntilDate:        time.Now().AddDate(0, 0, 1).Unix(),
 	})
 
-	pendingApproval.Remove(joinKey)
-	rds.HDel("ticket-pending", joinKey)
-
 	// delete messages
 	if kickdata.JoinMessage != nil {
 		deleteMessage(kickdata.JoinMessage)
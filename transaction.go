@@ -114,12 +114,16 @@ func (t Transaction) Icon() string {
 		return "🎲"
 	case "fundraise":
 		return "🎷"
-	case "reveal":
+	case "reveal", "webreveal":
 		return "🔎"
 	case "sats4ads":
 		return "📢"
 	case "expensive":
 		return "💸"
+	case "reaction":
+		return "👍"
+	case "treasury":
+		return "🏦"
 	default:
 		switch {
 		case t.TelegramPeer.Valid:
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// every group can have a treasury, which is just an account without a telegram
+// user attached that collects taxes and fees. it is created when first needed
+// and only admins of the group can send money out of it.
+func (g GroupChat) getTreasury() (*User, error) {
+	var treasuryId sql.NullInt64
+	err := pg.Get(&treasuryId, `
+SELECT treasury FROM groupchat WHERE telegram_id = $1
+    `, g.TelegramId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !treasuryId.Valid {
+		// lock the group row so two concurrent calls can't both create an account
+		txn, err := pg.Beginx()
+		if err != nil {
+			return nil, err
+		}
+		defer txn.Rollback()
+
+		err = txn.Get(&treasuryId, `
+SELECT treasury FROM groupchat WHERE telegram_id = $1 FOR UPDATE
+        `, g.TelegramId)
+		if err != nil {
+			return nil, err
+		}
+
+		if !treasuryId.Valid {
+			err = txn.Get(&treasuryId, `
+WITH treasury AS (
+  INSERT INTO account DEFAULT VALUES
+  RETURNING id
+)
+UPDATE groupchat
+SET treasury = (SELECT id FROM treasury)
+WHERE telegram_id = $1
+RETURNING treasury
+            `, g.TelegramId)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := txn.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	return loadUser(int(treasuryId.Int64))
+}
+
+// getGroupDestination returns the account that should receive money collected
+// by the group, "owner" or "treasury".
+func (g GroupChat) getGroupDestination(destination string) (*User, error) {
+	if destination == "treasury" {
+		return g.getTreasury()
+	}
+	return getChatOwner(g.TelegramId)
+}
+
+func handleTreasury(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+	message := ctx.Value("message").(*tgbotapi.Message)
+
+	if message.Chat.Type == "private" {
+		send(ctx, u, t.MUSTBEGROUP)
+		return
+	}
+
+	g, err := ensureTelegramGroup(message.Chat.ID, u.Locale)
+	if err != nil {
+		log.Warn().Err(err).Int64("group", message.Chat.ID).Msg("failed to ensure group")
+		return
+	}
+
+	treasury, err := g.getTreasury()
+	if err != nil {
+		log.Warn().Err(err).Stringer("group", &g).Msg("failed to load treasury")
+		send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+
+	if opts["transfer"].(bool) {
+		if !isAdmin(message.Chat, message.From) {
+			send(ctx, u, t.MUSTBEADMIN)
+			return
+		}
+
+		msats, err := parseSatoshis(opts)
+		if err != nil {
+			send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		receiver, err := examineTelegramUsername(opts["<receiver>"].(string))
+		if err != nil {
+			send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		err = treasury.sendInternally(ctx, receiver, false, msats, 0,
+			fmt.Sprintf("Group treasury transfer by %s.", u.AtName(ctx)), "", "treasury")
+		if err != nil {
+			send(ctx, g, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+
+		send(ctx, receiver, t.USERSENTYOUSATS, t.T{
+			"User":    translate(ctx, t.GROUPTREASURY),
+			"Sats":    msats / 1000,
+			"RawSats": "",
+			"BotOp":   "/treasury",
+		})
+
+		go u.track("treasury send", map[string]interface{}{
+			"group": g.TelegramId,
+			"sats":  msats / 1000,
+		})
+	}
+
+	send(ctx, g, t.TREASURYMSG, t.T{
+		"Sats": float64(getBalance(pg, treasury.Id)) / 1000,
+	})
+}
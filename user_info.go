@@ -106,8 +106,10 @@ GROUP BY tag
 }
 
 func (u User) checkBalanceFor(ctx context.Context, msats int64, purpose string) bool {
-	if _, ok := s.Banned[u.Id]; ok {
+	// these are all payments for apps or group fees
+	if err := checkSpendingBan(u.Id, purpose); err != nil {
 		log.Debug().Stringer("user", &u).Msg("got balance check on banned user")
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()}, WITHALERT)
 		return false
 	}
 
@@ -166,6 +168,21 @@ SELECT * FROM (
 	return
 }
 
+// recentContacts returns the telegram usernames of the people this user has
+// exchanged money with, the most recent first.
+func (u User) recentContacts(limit, offset int) (usernames []string, err error) {
+	err = pg.Select(&usernames, `
+SELECT telegram_peer FROM lightning.account_txn
+WHERE account_id = $1 AND NOT anonymous
+  AND telegram_peer IS NOT NULL AND telegram_peer !~ '^[0-9]+$'
+GROUP BY telegram_peer
+ORDER BY max(time) DESC
+LIMIT $2
+OFFSET $3
+    `, u.Id, limit, offset)
+	return
+}
+
 func handleBalance(ctx context.Context, opts docopt.Opts) {
 	u := ctx.Value("initiator").(*User)
 
@@ -6,12 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
-	"strconv"
 	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/jmoiron/sqlx"
-	"github.com/msingleton/amplitude-go"
 )
 
 type User struct {
@@ -143,34 +141,27 @@ RETURNING `+USERFIELDS,
 		}
 	case 2:
 		// user has 2 accounts, one with the username, other with the telegram_id
-		var txn *sqlx.Tx
-		txn, err = pg.BeginTxx(context.Background(), &sql.TxOptions{})
-		if err != nil {
-			return &u, tcase, err
-		}
-		defer txn.Rollback()
-
-		idToDelete := userRows[1].Id
-		idToRemain := userRows[0].Id
+		ctx := context.WithValue(context.Background(), "origin", "telegram")
 
-		_, err = txn.Exec(
-			"UPDATE lightning.transaction SET to_id = $1 WHERE to_id = $2",
-			idToRemain, idToDelete)
-		if err != nil {
-			return &u, tcase, err
+		keep, remove := &userRows[0], &userRows[1]
+		if remove.TelegramId == telegramId {
+			keep, remove = remove, keep
 		}
 
-		_, err = txn.Exec(
-			"UPDATE lightning.transaction SET from_id = $1 WHERE from_id = $2",
-			idToRemain, idToDelete)
+		var txn *sqlx.Tx
+		txn, err = pg.BeginTxx(ctx, &sql.TxOptions{})
 		if err != nil {
 			return &u, tcase, err
 		}
+		defer txn.Rollback()
 
-		_, err = txn.Exec(
-			"DELETE FROM account WHERE id = $1",
-			idToDelete)
-		if err != nil {
+		var conflicts []string
+		_, conflicts, err = mergeAccounts(ctx, txn, keep, remove)
+		if err == ErrMergeConflict {
+			// keep using the account with the telegram id as it is
+			go notifyMergeConflict(keep, remove, conflicts)
+			return keep, tcase, nil
+		} else if err != nil {
 			return &u, tcase, err
 		}
 
@@ -179,7 +170,7 @@ UPDATE account
 SET telegram_id = $2, telegram_username = $3
 WHERE id = $1
 RETURNING `+USERFIELDS,
-			idToRemain, telegramId, vusername)
+			keep.Id, telegramId, vusername)
 		if err != nil {
 			return &u, tcase, err
 		}
@@ -188,6 +179,9 @@ RETURNING `+USERFIELDS,
 		if err != nil {
 			return &u, tcase, err
 		}
+
+		// bans may have been moved
+		bansChanged()
 	default:
 		err = errors.New("odd error with more than 2 rows for the same user.")
 	}
@@ -285,11 +279,7 @@ WHERE account = $1 AND service = $2
 }
 
 func (u User) track(event string, eventProperties map[string]interface{}) {
-	amp.Event(amplitude.Event{
-		UserId:          strconv.Itoa(u.Id),
-		EventType:       event,
-		EventProperties: eventProperties,
-	})
+	analytics.Track(u.Id, event, eventProperties)
 }
 
 func (u User) AtName(ctx context.Context) string {
@@ -122,6 +122,7 @@ func (u User) makeInvoice(
 	if err != nil {
 		return "", "", fmt.Errorf("failed to create invoice: %w", err)
 	}
+	metricInvoicesCreated.Inc(metricTag(args.Tag))
 
 	var messageId interface{}
 	if message := ctx.Value("message"); message != nil {
@@ -158,6 +159,10 @@ func (u User) payInvoice(
 	bolt11 string,
 	manuallySpecifiedMsatoshi int64,
 ) (hash string, err error) {
+	if err := checkSpendingBan(u.Id, ""); err != nil {
+		return "", err
+	}
+
 	if ok := getRateLimitBucket(u.Id).WaitMaxDuration(1, time.Second*5); !ok {
 		return "", errors.New("Making too many payments, please wait about 5 minutes.")
 	}
@@ -236,6 +241,8 @@ func (u User) actuallySendExternalPayment(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "external_payment", u.Id)
+
 	// if not tg this will just be ignored
 	// TODO
 	var tgMessageId int
@@ -267,6 +274,14 @@ VALUES ($1, $2, $3, $4, $5, true, $6, $7)
 		return errors.New("Insufficient balance.")
 	}
 
+	if err := audit.save(txn, hash, map[string]interface{}{
+		"msatoshi":    msatoshi,
+		"fee_reserve": int64(fee_reserve),
+		"payee":       inv.Payee,
+	}); err != nil {
+		return err
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		log.Debug().Err(err).Msg("database error committing transaction")
@@ -274,6 +289,7 @@ VALUES ($1, $2, $3, $4, $5, true, $6, $7)
 	}
 
 	// perform payment
+	startPaymentTimer(hash)
 	go func() {
 		_, err := ln.PayInvoice(cliche.PayInvoiceParams{
 			Invoice:  bolt11,
@@ -302,6 +318,8 @@ func (u User) addInternalPendingInvoice(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "internal_pending_payment", u.Id, targetId)
+
 	// if not tg this will just be ignored
 	var tgMessageId int
 	if message := ctx.Value("message"); message != nil {
@@ -325,6 +343,13 @@ VALUES ($1, $2, $3, $4, $5, true, $6)
 		return ErrInsufficientBalance
 	}
 
+	if err := audit.save(txn, hash, map[string]interface{}{
+		"msatoshi": msats,
+		"pending":  true,
+	}); err != nil {
+		return err
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		log.Debug().Err(err).Msg("database error committing transaction")
@@ -348,6 +373,13 @@ func (u User) sendInternally(
 		return errors.New("Can't pay yourself.")
 	}
 
+	if err := checkSpendingBan(u.Id, tag); err != nil {
+		return err
+	}
+	if isBanned(target.Id, BANALL) {
+		return ErrReceiverBanned
+	}
+
 	if msats == 0 {
 		// if nothing was provided, end here
 		return ErrInvalidAmount
@@ -365,6 +397,8 @@ func (u User) sendInternally(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "internal_payment", u.Id, target.Id)
+
 	// if not tg this will just be ignored
 	var tgMessageId int
 	if message := ctx.Value("message"); message != nil {
@@ -373,7 +407,7 @@ func (u User) sendInternally(
 		}
 	}
 
-	_, err = txn.Exec(`
+	err = txn.Get(&hash, `
 INSERT INTO lightning.transaction (
   from_id,
   to_id,
@@ -383,7 +417,8 @@ INSERT INTO lightning.transaction (
   description,
   tag,
   payment_hash,
-  trigger_message
+  trigger_message,
+  chat_id
 )
 VALUES (
   $1,
@@ -397,9 +432,12 @@ VALUES (
     THEN $8::text
     ELSE md5(random()::text) || md5(random()::text)
   END,
-  $9
+  $9,
+  $10
 )
-    `, u.Id, target.Id, anonymous, msats, fees, descn, tagn, hashn, tgMessageId)
+RETURNING payment_hash
+    `, u.Id, target.Id, anonymous, msats, fees, descn, tagn, hashn, tgMessageId,
+		transactionChatId(ctx))
 	if err != nil {
 		return ErrDatabase
 	}
@@ -409,14 +447,53 @@ VALUES (
 		return ErrInsufficientBalance
 	}
 
+	transfer := PaymentEvent{
+		Event:       "internal",
+		PaymentHash: hash,
+		Msatoshi:    msats,
+		Description: desc,
+		Tag:         tag,
+	}
+	out, in := transfer.forAccount(u.Id), transfer.forAccount(target.Id)
+	out.Direction, out.Counterparty, out.FeeMsatoshi = "out", target.Id, fees
+	in.Direction = "in"
+	if !anonymous {
+		in.Counterparty = u.Id
+	}
+	if err := saveAccountEvents(txn, out, in); err != nil {
+		return ErrDatabase
+	}
+
+	if err := audit.save(txn, hash, map[string]interface{}{
+		"msatoshi":  msats,
+		"fees":      fees,
+		"tag":       tag,
+		"anonymous": anonymous,
+	}); err != nil {
+		return err
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return ErrDatabase
 	}
 
+	go publishPaymentEvent(out)
+	go publishPaymentEvent(in)
+
 	return nil
 }
 
+// transactionChatId returns the group where a payment was made, if any, so
+// group statistics can be computed later.
+func transactionChatId(ctx context.Context) sql.NullInt64 {
+	if message, ok := ctx.Value("message").(*tgbotapi.Message); ok &&
+		message != nil && message.Chat != nil && message.Chat.Type != "private" {
+		return sql.NullInt64{Int64: message.Chat.ID, Valid: true}
+	}
+	return sql.NullInt64{}
+}
+
 func (u User) sendThroughProxy(
 	ctx context.Context,
 	// these must be unique across payments that must be combined, otherwise different
@@ -438,6 +515,13 @@ func (u User) sendThroughProxy(
 		targetdescn = sql.NullString{String: targetdesc, Valid: targetdesc != ""}
 	)
 
+	if err := checkSpendingBan(u.Id, tag); err != nil {
+		return err.Error(), err
+	}
+	if isBanned(target.Id, BANALL) {
+		return ErrReceiverBanned.Error(), ErrReceiverBanned
+	}
+
 	// start transaction
 	txn, err := pg.BeginTxx(ctx, &sql.TxOptions{})
 	if err != nil {
@@ -445,18 +529,21 @@ func (u User) sendThroughProxy(
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "proxied_payment", u.Id, target.Id)
+
 	// send transaction source->proxy, then proxy->target
 	// both are updated if exist
 	_, err = txn.Exec(`
 INSERT INTO lightning.transaction AS t
-  (payment_hash, from_id, to_id, amount, description, tag, trigger_message)
-VALUES ($1, $2, $3, $4, $5, $6, $7)
+  (payment_hash, from_id, to_id, amount, description, tag, trigger_message, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 ON CONFLICT (payment_hash) DO UPDATE SET
   amount = t.amount + $4,
   description = $5,
   tag = $6,
   trigger_message = $7
-    `, sourcehash, u.Id, s.ProxyAccount, msats, sourcedescn, tagn, sourceMessageId)
+    `, sourcehash, u.Id, s.ProxyAccount, msats, sourcedescn, tagn, sourceMessageId,
+		transactionChatId(ctx))
 	if err != nil {
 		return "Database error.", err
 	}
@@ -464,10 +551,10 @@ ON CONFLICT (payment_hash) DO UPDATE SET
 	_, err = txn.Exec(`
 INSERT INTO lightning.transaction AS t
   (proxied_with, payment_hash, from_id, to_id, amount,
-   description, tag, trigger_message, pending)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+   description, tag, trigger_message, pending, chat_id)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
     `, sourcehash, targethash, s.ProxyAccount, target.Id, msats,
-		targetdescn, tagn, targetMessageId, pending)
+		targetdescn, tagn, targetMessageId, pending, transactionChatId(ctx))
 	if err != nil {
 		return "Database error.", err
 	}
@@ -486,11 +573,30 @@ VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		return "Database error.", err
 	}
 
+	out := appPaymentEvent("out", target.Id, int64(msats), sourcehash, tag, sourcedesc).
+		forAccount(u.Id)
+	in := appPaymentEvent("in", u.Id, int64(msats), targethash, tag, targetdesc).
+		forAccount(target.Id)
+	if err := saveAccountEvents(txn, out, in); err != nil {
+		return "Database error.", err
+	}
+
+	if err := audit.save(txn, targethash, map[string]interface{}{
+		"msatoshi":    msats,
+		"tag":         tag,
+		"source_hash": sourcehash,
+	}); err != nil {
+		return "Database error.", err
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return "Unable to pay due to internal database error.", err
 	}
 
+	go publishPaymentEvent(out)
+	go publishPaymentEvent(in)
+
 	return "", nil
 }
 
@@ -500,6 +606,10 @@ func (u User) payToInternalService(ctx context.Context, msats int64, desc string
 		return ErrInvalidAmount
 	}
 
+	if err := checkSpendingBan(u.Id, tag); err != nil {
+		return err
+	}
+
 	var (
 		descn = sql.NullString{String: desc, Valid: desc != ""}
 		tagn  = sql.NullString{String: tag, Valid: tag != ""}
@@ -511,6 +621,8 @@ func (u User) payToInternalService(ctx context.Context, msats int64, desc string
 	}
 	defer txn.Rollback()
 
+	audit := startAudit(ctx, txn, "service_payment", u.Id)
+
 	// if not tg this will just be ignored
 	var tgMessageId int
 	if message := ctx.Value("message"); message != nil {
@@ -519,7 +631,8 @@ func (u User) payToInternalService(ctx context.Context, msats int64, desc string
 		}
 	}
 
-	_, err = txn.Exec(`
+	var hash string
+	err = txn.Get(&hash, `
 INSERT INTO lightning.transaction (
   from_id,
   amount,
@@ -534,6 +647,7 @@ VALUES (
   $4,
   $5
 )
+RETURNING payment_hash
     `, u.Id, msats, descn, tagn, tgMessageId)
 	if err != nil {
 		return ErrDatabase
@@ -544,11 +658,25 @@ VALUES (
 		return ErrInsufficientBalance
 	}
 
+	event := appPaymentEvent("out", 0, msats, hash, tag, desc).forAccount(u.Id)
+	if err := saveAccountEvents(txn, event); err != nil {
+		return ErrDatabase
+	}
+
+	if err := audit.save(txn, hash, map[string]interface{}{
+		"msatoshi": msats,
+		"tag":      tag,
+	}); err != nil {
+		return err
+	}
+
 	err = txn.Commit()
 	if err != nil {
 		return ErrDatabase
 	}
 
+	go publishPaymentEvent(event)
+
 	return nil
 }
 
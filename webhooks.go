@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docopt/docopt-go"
+	"github.com/fiatjaf/lntxbot/t"
+)
+
+// webhooks notify external services about payments. accounts can subscribe
+// URLs to some events. every notification is saved to the outbox before being
+// sent, so the ones that fail can be retried later. requests are signed with
+// a secret only the account owner knows. no URL can point to a private or
+// local address.
+
+const (
+	MAXWEBHOOKATTEMPTS      = 10
+	MAXWEBHOOKSUBSCRIPTIONS = 5
+	WEBHOOKRETRYBASE        = 30 * time.Second
+)
+
+var WEBHOOKEVENTS = []string{"received", "sent", "failed", "internal"}
+
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		// the address is checked again here, after being resolved, so a
+		// hostname can't point somewhere else after it was accepted
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !isPublicIP(net.ParseIP(host)) {
+					return fmt.Errorf("webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConns:        20,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+var nonPublicNets = func() (nets []*net.IPNet) {
+	for _, cidr := range []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16",
+		"198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+	} {
+		_, ipnet, _ := net.ParseCIDR(cidr)
+		nets = append(nets, ipnet)
+	}
+	return
+}()
+
+// isPublicIP rejects loopback, private, link-local (which includes the cloud
+// metadata addresses), multicast and reserved addresses.
+func isPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipnet := range nonPublicNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkWebhookHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		if !isPublicIP(ip) {
+			return errors.New("address is not public")
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return errors.New("host has no addresses")
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errors.New("host resolves to an address that is not public")
+		}
+	}
+	return nil
+}
+
+type WebhookSettings struct {
+	Secret string `json:"secret"`
+}
+
+type WebhookSubscription struct {
+	Id        int       `db:"id"`
+	Account   int       `db:"account"`
+	URL       string    `db:"url"`
+	Events    string    `db:"events"` // comma-separated, empty means all
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type WebhookDelivery struct {
+	Id           int64          `db:"id"`
+	Account      int            `db:"account"`
+	URL          string         `db:"url"`
+	Event        string         `db:"event"`
+	Payload      string         `db:"payload"`
+	Status       string         `db:"status"` // pending, delivered or failed
+	Attempts     int            `db:"attempts"`
+	NextAttempt  time.Time      `db:"next_attempt"`
+	LastResponse sql.NullInt64  `db:"last_response"`
+	LastError    sql.NullString `db:"last_error"`
+	CreatedAt    time.Time      `db:"created_at"`
+	DeliveredAt  sql.NullTime   `db:"delivered_at"`
+}
+
+// webhookSecret returns the key used to sign this account's webhooks,
+// creating it on the first call.
+func (u User) webhookSecret() (string, error) {
+	var settings WebhookSettings
+	if err := u.getAppData("webhooks", &settings); err != nil {
+		return "", err
+	}
+	if settings.Secret != "" {
+		return settings.Secret, nil
+	}
+	return u.resetWebhookSecret()
+}
+
+func (u User) resetWebhookSecret() (string, error) {
+	secret, err := randomHex()
+	if err != nil {
+		return "", err
+	}
+	if err := u.setAppData("webhooks", WebhookSettings{Secret: secret}); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// signWebhook is what receivers must check: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" using the account secret.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseWebhookURL only accepts absolute http(s) URLs on public addresses.
+func parseWebhookURL(raw string) (string, bool) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || parsed.Host == "" ||
+		(parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return "", false
+	}
+	if err := checkWebhookHost(parsed.Hostname()); err != nil {
+		log.Debug().Err(err).Str("url", raw).Msg("refused webhook url")
+		return "", false
+	}
+	return parsed.String(), true
+}
+
+// parseWebhookEvents validates and normalizes a list of event names, an empty
+// list means all events.
+func parseWebhookEvents(events []string) (string, bool) {
+	var valid []string
+	for _, event := range events {
+		for _, name := range strings.Split(strings.ToLower(event), ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+
+			found := false
+			for _, allowed := range WEBHOOKEVENTS {
+				if name == allowed {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", false
+			}
+			valid = append(valid, name)
+		}
+	}
+	return strings.Join(valid, ","), true
+}
+
+func (u User) listWebhookSubscriptions() (subs []WebhookSubscription, err error) {
+	err = pg.Select(&subs, `
+SELECT * FROM webhook_subscription
+WHERE account = $1
+ORDER BY id
+    `, u.Id)
+	return
+}
+
+func (u User) addWebhookSubscription(webhookURL string, events string) (err error) {
+	subs, err := u.listWebhookSubscriptions()
+	if err != nil {
+		return
+	}
+	if len(subs) >= MAXWEBHOOKSUBSCRIPTIONS {
+		return fmt.Errorf("can't have more than %d webhooks.", MAXWEBHOOKSUBSCRIPTIONS)
+	}
+
+	_, err = pg.Exec(`
+INSERT INTO webhook_subscription (account, url, events)
+VALUES ($1, $2, $3)
+ON CONFLICT (account, url) DO UPDATE SET events = $3
+    `, u.Id, webhookURL, events)
+	return
+}
+
+func (u User) removeWebhookSubscription(id int) (removed bool, err error) {
+	res, err := pg.Exec(`
+DELETE FROM webhook_subscription WHERE account = $1 AND id = $2
+    `, u.Id, id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (u User) listWebhookDeliveries(limit int) (deliveries []WebhookDelivery, err error) {
+	err = pg.Select(&deliveries, `
+SELECT * FROM webhook_delivery
+WHERE account = $1
+ORDER BY id DESC
+LIMIT $2
+    `, u.Id, limit)
+	return
+}
+
+// enqueueWebhooks saves a delivery for each subscription of the account that
+// wants this event, then tries to send them right away.
+func enqueueWebhooks(account int, payload PaymentEvent) {
+	body, _ := json.Marshal(payload)
+
+	logger := log.With().Int("account", account).Str("event", payload.Event).
+		Str("hash", payload.PaymentHash).Logger()
+
+	var ids []int64
+	err := pg.Select(&ids, `
+INSERT INTO webhook_delivery (account, url, event, payload)
+SELECT account, url, $2, $3
+FROM webhook_subscription
+WHERE account = $1
+  AND (events = '' OR ',' || events || ',' LIKE '%,' || $2 || ',%')
+RETURNING id
+    `, account, payload.Event, string(body))
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to enqueue webhooks")
+		return
+	}
+
+	for _, id := range ids {
+		go deliverWebhook(id)
+	}
+}
+
+// webhookDeliveryRoutine retries the deliveries that are due. it also picks
+// up the ones that were interrupted by a restart.
+func webhookDeliveryRoutine() {
+	for {
+		for deliverWebhook(0) {
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// deliverWebhook sends one delivery, the given one or the next due if id is 0,
+// and returns false if there was nothing to send.
+func deliverWebhook(id int64) bool {
+	// the delivery is leased for a while so nobody else sends it in parallel
+	var delivery WebhookDelivery
+	err := pg.Get(&delivery, `
+UPDATE webhook_delivery
+SET attempts = attempts + 1, next_attempt = now() + interval '5 minutes'
+WHERE id = (
+  SELECT id FROM webhook_delivery
+  WHERE status = 'pending' AND next_attempt <= now() AND ($1 = 0 OR id = $1)
+  ORDER BY next_attempt
+  LIMIT 1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING *
+    `, id)
+	if err == sql.ErrNoRows {
+		return false
+	} else if err != nil {
+		log.Warn().Err(err).Int64("id", id).Msg("failed to fetch webhook delivery")
+		return false
+	}
+
+	logger := log.With().Int64("delivery", delivery.Id).Int("account", delivery.Account).
+		Str("url", delivery.URL).Int("attempt", delivery.Attempts).Logger()
+
+	code, err := postWebhook(delivery)
+	if err == nil {
+		_, err = pg.Exec(`
+UPDATE webhook_delivery
+SET status = 'delivered', delivered_at = now(), last_response = $2, last_error = NULL
+WHERE id = $1
+        `, delivery.Id, code)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed to mark webhook as delivered")
+		}
+		return true
+	}
+
+	logger.Debug().Err(err).Int("code", code).Msg("webhook delivery failed")
+
+	// exponential backoff: 30s, 1m, 2m, 4m... until it gives up
+	status := "pending"
+	if delivery.Attempts >= MAXWEBHOOKATTEMPTS {
+		status = "failed"
+	}
+	delay := WEBHOOKRETRYBASE * time.Duration(1<<uint(delivery.Attempts-1))
+	_, err = pg.Exec(`
+UPDATE webhook_delivery
+SET status = $2, next_attempt = $3, last_response = $4, last_error = $5
+WHERE id = $1
+    `, delivery.Id, status, time.Now().Add(delay),
+		sql.NullInt64{Int64: int64(code), Valid: code != 0}, err.Error())
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to schedule webhook retry")
+	}
+	return true
+}
+
+func postWebhook(delivery WebhookDelivery) (code int, err error) {
+	body := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "lntxbot-webhooks")
+	req.Header.Set("X-Lntxbot-Event", delivery.Event)
+	req.Header.Set("X-Lntxbot-Delivery", strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set("X-Lntxbot-Timestamp", strconv.FormatInt(timestamp, 10))
+
+	user, err := loadUser(delivery.Account)
+	if err != nil {
+		return 0, err
+	}
+	secret, err := user.webhookSecret()
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Lntxbot-Signature", "sha256="+signWebhook(secret, timestamp, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New(resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func handleWebhooks(ctx context.Context, opts docopt.Opts) {
+	u := ctx.Value("initiator").(*User)
+
+	switch {
+	case opts["add"].(bool):
+		webhookURL, ok := parseWebhookURL(opts["<url>"].(string))
+		if !ok {
+			send(ctx, u, t.ERROR, t.T{"Err": "invalid URL, it must start with https:// or http://."})
+			return
+		}
+		events, ok := parseWebhookEvents(opts["<events>"].([]string))
+		if !ok {
+			send(ctx, u, t.ERROR, t.T{
+				"Err": "unknown event, use " + strings.Join(WEBHOOKEVENTS, ", ") + ".",
+			})
+			return
+		}
+
+		if err := u.addWebhookSubscription(webhookURL, events); err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		go u.track("webhook add", map[string]interface{}{"events": events})
+	case opts["del"].(bool):
+		id, err := strconv.Atoi(opts["<webhook_id>"].(string))
+		if err != nil {
+			handleHelp(ctx, "webhooks")
+			return
+		}
+
+		removed, err := u.removeWebhookSubscription(id)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		if !removed {
+			send(ctx, u, t.ERROR, t.T{"Err": fmt.Sprintf("webhook %d not found.", id)})
+			return
+		}
+		go u.track("webhook del", nil)
+	case opts["deliveries"].(bool):
+		deliveries, err := u.listWebhookDeliveries(15)
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.WEBHOOKDELIVERIES, t.T{"Deliveries": deliveries})
+		return
+	case opts["secret"].(bool):
+		var secret string
+		var err error
+		if opts["reset"].(bool) {
+			secret, err = u.resetWebhookSecret()
+		} else {
+			secret, err = u.webhookSecret()
+		}
+		if err != nil {
+			send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+			return
+		}
+		send(ctx, u, t.WEBHOOKSECRET, t.T{"Secret": secret})
+		return
+	}
+
+	subs, err := u.listWebhookSubscriptions()
+	if err != nil {
+		send(ctx, u, t.ERROR, t.T{"Err": err.Error()})
+		return
+	}
+	send(ctx, u, t.WEBHOOKS, t.T{"Subscriptions": subs})
+}
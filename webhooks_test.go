@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSignWebhook(t *testing.T) {
+	// echo -n '1700000000.{"event":"received"}' | openssl dgst -sha256 -hmac secret
+	got := signWebhook("secret", 1700000000, []byte(`{"event":"received"}`))
+	expected := "8386c5db1ea44a322bf7726728846e719823d9abd4120faa7d41672a1c386ba7"
+	if got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	if signWebhook("other", 1700000000, []byte(`{"event":"received"}`)) == got {
+		t.Error("signature doesn't depend on the secret")
+	}
+	if signWebhook("secret", 1700000001, []byte(`{"event":"received"}`)) == got {
+		t.Error("signature doesn't depend on the timestamp")
+	}
+}
+
+func TestParseWebhookEvents(t *testing.T) {
+	for _, c := range []struct {
+		events   []string
+		expected string
+		ok       bool
+	}{
+		{nil, "", true},
+		{[]string{"received"}, "received", true},
+		{[]string{"Received, sent"}, "received,sent", true},
+		{[]string{"failed", "internal,"}, "failed,internal", true},
+		{[]string{"received", "app"}, "", false},
+		{[]string{"whatever"}, "", false},
+	} {
+		got, ok := parseWebhookEvents(c.events)
+		if ok != c.ok || got != c.expected {
+			t.Errorf("%v: expected %q %v, got %q %v", c.events, c.expected, c.ok, got, ok)
+		}
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"1.1.1.1":          true,
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"::":               false,
+		"fd00::1":          false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+		"::ffff:10.0.0.1":  false,
+	} {
+		if got := isPublicIP(net.ParseIP(addr)); got != public {
+			t.Errorf("%s: expected public=%v", addr, public)
+		}
+	}
+
+	if isPublicIP(nil) {
+		t.Error("nil ip is public")
+	}
+}
+
+func TestParseWebhookURLLiteralAddresses(t *testing.T) {
+	for _, raw := range []string{
+		"http://127.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"https://[::1]:8080/",
+		"ftp://1.1.1.1/",
+		"/relative",
+	} {
+		if _, ok := parseWebhookURL(raw); ok {
+			t.Errorf("%s was accepted", raw)
+		}
+	}
+
+	if _, ok := parseWebhookURL("https://1.1.1.1/hook"); !ok {
+		t.Error("public address was refused")
+	}
+}